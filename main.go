@@ -2,32 +2,66 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"container/list"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/utils/diff"
 	"github.com/google/generative-ai-go/genai"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/width"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"gopkg.in/yaml.v3"
 )
 
 // グローバル変数
 var (
-	repo      *git.Repository
-	workDir   string
-	genClient *genai.Client
-	model     *genai.GenerativeModel
+	config     *Config
+	tokenVault *TokenVault
+	repo       *git.Repository
+	workDir    string
+	genClient  *genai.Client
+	aiUsage    *aiUsageTracker
+	aiCache    *aiResultCache
 )
 
 // レスポンス型
@@ -45,8 +79,10 @@ type InitRequest struct {
 
 // 保存リクエスト
 type SaveRequest struct {
-	Message string `json:"message"`
-	UseAI   bool   `json:"useAI"`
+	Message  string `json:"message"`
+	UseAI    bool   `json:"useAI"`
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
 }
 
 // 草案作成リクエスト
@@ -56,9 +92,14 @@ type DraftRequest struct {
 
 // AI分析リクエスト
 type AnalyzeRequest struct {
-	Text   string `json:"text" binding:"required"`
-	Type   string `json:"type"` // "summary", "review", "commit"
-	Prompt string `json:"prompt"`
+	Text      string          `json:"text" binding:"required"`
+	Type      string          `json:"type"` // "summary", "review", "commit"
+	Prompt    string          `json:"prompt"`
+	Provider  string          `json:"provider"`  // "gemini", "openai", "fake"（省略時は設定のデフォルト）
+	Model     string          `json:"model"`     // 省略時はプロバイダーのデフォルト
+	Template  string          `json:"template"`  // 使用するプロンプトテンプレート名（省略時は type と同名）
+	Variables PromptVariables `json:"variables"` // ジャンル・想定読者・文体の注意など
+	NoCache   bool            `json:"noCache"`   // true の場合はキャッシュを使わずに生成し直す
 }
 
 // GitHub OAuth関連
@@ -114,89 +155,104 @@ type TenkaiSettings struct {
 	Theme          string                 `json:"theme"`        // "light" or "dark"
 	Repositories   []string               `json:"repositories"` // リポジトリのフルネーム
 	ActiveRepo     string                 `json:"active_repo"`
+	AIProvider     string                 `json:"ai_provider,omitempty"` // ユーザーごとのAIプロバイダー
+	AIModel        string                 `json:"ai_model,omitempty"`    // ユーザーごとのモデル
 	CustomSettings map[string]interface{} `json:"custom_settings"`
 	LastUpdated    string                 `json:"last_updated"`
 }
 
 // 設定取得/保存リクエスト
 type SettingsRequest struct {
-	AccessToken string         `json:"access_token" binding:"required"`
+	AccessToken string         `json:"access_token"` // 省略時はセッションから解決
 	Settings    TenkaiSettings `json:"settings,omitempty"`
 }
 
 // Gitラッパー用リクエスト構造体
 type SouanTeishutsuRequest struct {
-	AccessToken string `json:"access_token" binding:"required"`
+	AccessToken string `json:"access_token"` // 省略時はセッションから解決
 	Repository  string `json:"repository" binding:"required"`
 	Message     string `json:"message" binding:"required"`
 	Branch      string `json:"branch"`
-	Files       []struct {
-		Path    string `json:"path"`
-		Content string `json:"content"`
-		Mode    string `json:"mode"` // "100644" for regular files
-	} `json:"files"`
+	Files       []SouanFile `json:"files"`
+}
+
+// 草案提出で送るファイル
+type SouanFile struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+	Mode    string `json:"mode"` // "100644" for regular files
 }
 
 type SouanRequest struct {
-	AccessToken string `json:"access_token" binding:"required"`
+	AccessToken string `json:"access_token"` // 省略時はセッションから解決
 	Repository  string `json:"repository" binding:"required"`
 	Name        string `json:"name" binding:"required"`
 	BaseBranch  string `json:"base_branch"` // デフォルト: main
 }
 
 type ShuseiIraiRequest struct {
-	AccessToken string `json:"access_token" binding:"required"`
+	AccessToken string `json:"access_token"` // 省略時はセッションから解決
 	Repository  string `json:"repository" binding:"required"`
 	Branch      string `json:"branch" binding:"required"`
-	Title       string `json:"title" binding:"required"`
+	Title       string `json:"title"` // generate_description 指定時は省略可
 	Description string `json:"description"`
 	BaseBranch  string `json:"base_branch"` // デフォルト: main
+
+	GenerateDescription bool   `json:"generate_description"` // 未入力のタイトル・説明文を差分からAIで下書きする
+	Provider            string `json:"provider"`
+	Model               string `json:"model"`
 }
 
 type KouseiIraiRequest struct {
-	AccessToken string   `json:"access_token" binding:"required"`
+	AccessToken string   `json:"access_token"` // 省略時はセッションから解決
 	Repository  string   `json:"repository" binding:"required"`
 	Branch      string   `json:"branch" binding:"required"`
-	Title       string   `json:"title" binding:"required"`
+	Title       string   `json:"title"` // generate_description 指定時は省略可
 	Description string   `json:"description"`
 	Reviewers   []string `json:"reviewers"` // GitHubユーザー名のリスト
 	BaseBranch  string   `json:"base_branch"` // デフォルト: main
+
+	GenerateDescription bool   `json:"generate_description"` // 未入力のタイトル・説明文を差分からAIで下書きする
+	Provider            string `json:"provider"`
+	Model               string `json:"model"`
 }
 
 func main() {
-	// 環境変数からGemini APIキーを取得して初期化
-	geminiAPIKey := os.Getenv("GEMINI_API_KEY")
-	if geminiAPIKey != "" {
-		ctx := context.Background()
-		var err error
-		genClient, err = genai.NewClient(ctx, option.WithAPIKey(geminiAPIKey))
-		if err != nil {
-			log.Printf("Gemini API初期化エラー: %v", err)
-		} else {
-			model = genClient.GenerativeModel("gemini-pro")
-			model.SetTemperature(0.7)
-			log.Println("Gemini APIを環境変数から初期化しました")
-		}
-	} else {
-		log.Println("GEMINI_API_KEY環境変数が設定されていません")
+	// 設定を読み込み（環境変数 + 任意の設定ファイル）
+	var err error
+	config, err = loadConfig(os.Getenv("TENKAI_CONFIG"))
+	if err != nil {
+		log.Fatalf("設定の読み込みに失敗しました / failed to load config:\n%v", err)
+	}
+
+	// トークン保管庫を初期化
+	tokenVault, err = newTokenVault(config.Vault)
+	if err != nil {
+		log.Fatalf("トークン保管庫の初期化に失敗しました: %v", err)
+	}
+
+	// AI利用量の記録を初期化
+	aiUsage, err = newAIUsageTracker(config.Quota)
+	if err != nil {
+		log.Fatalf("AI利用量の読み込みに失敗しました: %v", err)
 	}
 
+	aiCache = newAIResultCache(config.AI.Cache)
+
+	// Gemini APIを初期化
+	initGemini(config.Gemini)
+
 	// Ginの初期化
 	r := gin.Default()
 
-	// CORS設定
-	r.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-		
-		c.Next()
-	})
+	// 信用するプロキシ（未指定なら X-Forwarded-For を無視し、接続元のアドレスを使う）
+	// 未ログインのAI利用量は接続元のIPごとに数えるので、ヘッダーの詐称で上限を逃れられないようにする
+	if err := r.SetTrustedProxies(config.TrustedProxies); err != nil {
+		log.Fatalf("TRUSTED_PROXIES の設定に失敗しました: %v", err)
+	}
+
+	// CORS設定（FRONTEND_URL と追加オリジンの許可リスト）
+	r.Use(corsMiddleware(config.FrontendURL, config.CORS))
 
 	// ルート定義
 	r.GET("/", func(c *gin.Context) {
@@ -213,7 +269,58 @@ func main() {
 	r.POST("/api/draft/switch", handleDraftSwitch)
 	r.GET("/api/status", handleStatus)
 	r.POST("/api/ai/analyze", handleAIAnalyze)
+	r.POST("/api/ai/analyze/stream", handleAIAnalyzeStream)
+	r.POST("/api/ai/analyze/long", handleAIAnalyzeLong)
+	r.GET("/api/ai/usage", handleAIUsage)
+	r.GET("/api/prompts", handleListPrompts)
+	r.GET("/api/prompts/:name", handleGetPrompt)
+	r.PUT("/api/prompts/:name", handleSavePrompt)
+	r.DELETE("/api/prompts/:name", handleDeletePrompt)
+	r.POST("/api/prompts/preview", handlePreviewPrompt)
+	r.POST("/api/ai/proofread", handleAIProofread)
+	r.POST("/api/ai/proofread/apply", handleAIProofreadApply)
+	r.POST("/api/assistant/plan", handleAssistantPlan)
+	r.POST("/api/assistant/execute", handleAssistantExecute)
+	r.POST("/api/layout/paginate", handlePaginate)
+	r.POST("/api/aozora/parse", handleAozoraParse)
+	r.GET("/api/export/epub", handleExportEPUB)
+	r.GET("/api/export/docx", handleExportDOCX)
+	r.POST("/api/import/docx", handleImportDOCX)
+	r.GET("/api/export/profiles", handleListExportProfiles)
+	r.PUT("/api/export/profiles/:name", handleSaveExportProfile)
+	r.DELETE("/api/export/profiles/:name", handleDeleteExportProfile)
+	r.GET("/api/export/text", handleExportText)
+	r.GET("/api/export/text/check", handleCheckExportText)
+	r.GET("/api/export/web", handleExportWebSerial)
+	r.GET("/api/export/web/zip", handleExportWebSerialZip)
+	r.POST("/api/import/web", handleImportWebSerial)
+	r.POST("/api/proofread/lint", handleProofreadLint)
+	r.GET("/api/proofread/rules", handleListProofreadRules)
+	r.PUT("/api/proofread/rules/:id", handleSaveProofreadRule)
+	r.GET("/api/glossary", handleListGlossary)
+	r.POST("/api/glossary", handleCreateGlossaryEntry)
+	r.PUT("/api/glossary/:term", handleUpdateGlossaryEntry)
+	r.DELETE("/api/glossary/:term", handleDeleteGlossaryEntry)
+	r.POST("/api/glossary/check", handleCheckGlossary)
+	r.POST("/api/glossary/normalize", handleNormalizeGlossary)
+	r.GET("/api/world", handleListWorld)
+	r.POST("/api/world", handleCreateWorldEntity)
+	r.GET("/api/world/graph", handleWorldGraph)
+	r.GET("/api/world/appearances", handleWorldAppearanceSummary)
+	r.GET("/api/world/:id", handleGetWorldEntity)
+	r.PUT("/api/world/:id", handleUpdateWorldEntity)
+	r.DELETE("/api/world/:id", handleDeleteWorldEntity)
+	r.GET("/api/world/:id/appearances", handleWorldAppearances)
+	r.GET("/api/book", handleGetBook)
+	r.PUT("/api/book", handleUpdateBook)
+	r.PATCH("/api/book/chapters/:id", handleUpdateBookChapter)
+	r.POST("/api/book/reorder", handleReorderBook)
+	r.POST("/api/book/split", handleSplitBookChapter)
+	r.POST("/api/book/merge", handleMergeBookChapters)
+	r.GET("/api/auth/github/login", handleGitHubLogin)
 	r.GET("/api/auth/github/callback", handleGitHubCallback)
+	r.POST("/api/auth/session", handleExchangeLoginCode)
+	r.POST("/api/auth/logout", handleLogout)
 	// GitHub設定管理API
 	r.GET("/api/settings", handleGetSettings)
 	r.POST("/api/settings", handleSaveSettings)
@@ -225,16 +332,455 @@ func main() {
 	r.POST("/api/git/souan-switch", handleSouanSwitch)          // 草案切替（branch switch）
 	r.POST("/api/git/shusei-irai", handleShuseiIrai)            // 修正依頼（push & PR）
 	r.POST("/api/git/kousei-irai", handleKouseiIrai)            // 校正依頼（push & PR with review）
+	r.POST("/api/git/irai-draft", handleIraiDraft)              // 修正依頼・校正依頼の説明文をAIで下書き
 	r.GET("/api/git/repository-info", handleRepositoryInfo)      // リポジトリ情報取得
 
 	// サーバー起動
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3001"
+	log.Printf("tenkai_server が起動しました: http://localhost:%s", config.Port)
+	log.Fatal(r.Run(":" + config.Port))
+}
+
+// Gemini APIの初期化
+func initGemini(cfg GeminiConfig) {
+	if cfg.APIKey == "" {
+		log.Println("GEMINI_API_KEY環境変数が設定されていません")
+		return
+	}
+
+	ctx := context.Background()
+	var err error
+	genClient, err = genai.NewClient(ctx, option.WithAPIKey(cfg.APIKey))
+	if err != nil {
+		log.Printf("Gemini API初期化エラー: %v", err)
+		return
+	}
+	log.Printf("Gemini APIを初期化しました (model: %s)", cfg.Model)
+}
+
+// CORSミドルウェア
+func corsMiddleware(frontendURL string, cfg CORSConfig) gin.HandlerFunc {
+	allowed := make(map[string]bool)
+	allowed[normalizeOrigin(frontendURL)] = true
+	for _, o := range cfg.AllowedOrigins {
+		allowed[normalizeOrigin(o)] = true
+	}
+
+	return func(c *gin.Context) {
+		// オリジンによって応答が変わるため、キャッシュにはOriginを考慮させる
+		c.Writer.Header().Add("Vary", "Origin")
+
+		origin := c.GetHeader("Origin")
+		originOK := origin != "" && allowed[normalizeOrigin(origin)]
+		if originOK {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+			c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if c.Request.Method == "OPTIONS" {
+			if !originOK {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Method")
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Headers")
+			c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Tenkai-Session")
+			c.Writer.Header().Set("Access-Control-Max-Age", strconv.Itoa(preflightMaxAge(cfg, c.Request.URL.Path)))
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// ヘルパー関数: オリジンの表記ゆれを正規化（大文字小文字・末尾スラッシュ）
+func normalizeOrigin(origin string) string {
+	return strings.ToLower(strings.TrimRight(origin, "/"))
+}
+
+// ヘルパー関数: パスに対応するプリフライトのキャッシュ秒数（最長一致）
+func preflightMaxAge(cfg CORSConfig, path string) int {
+	maxAge := cfg.MaxAge
+	matched := ""
+	for prefix, age := range cfg.RouteMaxAge {
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(matched) {
+			matched = prefix
+			maxAge = age
+		}
+	}
+	return maxAge
+}
+
+// サーバー設定
+type Config struct {
+	Port           string       `yaml:"port" toml:"port"`
+	ServerURL      string       `yaml:"server_url" toml:"server_url"`           // このサーバーの公開URL
+	FrontendURL    string       `yaml:"frontend_url" toml:"frontend_url"`       // フロントエンドのURL
+	TrustedProxies []string     `yaml:"trusted_proxies" toml:"trusted_proxies"` // X-Forwarded-For を信用するプロキシ（IP / CIDR。空の場合はどれも信用しない）
+	GitHub         GitHubConfig `yaml:"github" toml:"github"`
+	Gemini         GeminiConfig `yaml:"gemini" toml:"gemini"`
+	CORS           CORSConfig   `yaml:"cors" toml:"cors"`
+	Vault          VaultConfig  `yaml:"vault" toml:"vault"`
+	AI             AIConfig     `yaml:"ai" toml:"ai"`
+	Quota          QuotaConfig  `yaml:"quota" toml:"quota"`
+}
+
+// AI利用量の上限（0は無制限）
+type QuotaConfig struct {
+	DailyRequests     int                   `yaml:"daily_requests" toml:"daily_requests"`
+	DailyTokens       int                   `yaml:"daily_tokens" toml:"daily_tokens"`
+	MonthlyRequests   int                   `yaml:"monthly_requests" toml:"monthly_requests"`
+	MonthlyTokens     int                   `yaml:"monthly_tokens" toml:"monthly_tokens"`
+	RequestsPerMinute int                   `yaml:"requests_per_minute" toml:"requests_per_minute"`
+	UsagePath         string                `yaml:"usage_path" toml:"usage_path"` // 利用量の保存先（空の場合はメモリのみ）
+	Prices            map[string]ModelPrice `yaml:"prices" toml:"prices"`         // モデル名 → 料金
+}
+
+// モデルの料金（100万トークンあたりのUSD）
+type ModelPrice struct {
+	Input  float64 `yaml:"input" toml:"input"`
+	Output float64 `yaml:"output" toml:"output"`
+}
+
+// AIプロバイダー設定
+type AIConfig struct {
+	Provider      string        `yaml:"provider" toml:"provider"`             // デフォルトのプロバイダー: "gemini", "openai", "fake"
+	AllowedModels []string      `yaml:"allowed_models" toml:"allowed_models"` // リクエストやユーザー設定で選べる "プロバイダー:モデル"（"openai:*" でそのプロバイダーの全モデル）
+	EnableFake    bool          `yaml:"enable_fake" toml:"enable_fake"`       // 開発・テスト用の fake プロバイダーを使えるようにする
+	OpenAI        OpenAIConfig  `yaml:"openai" toml:"openai"`
+	Cache         AICacheConfig `yaml:"cache" toml:"cache"`
+}
+
+// AI結果のキャッシュ設定
+type AICacheConfig struct {
+	TTL        int `yaml:"ttl" toml:"ttl"`                 // 有効期間（秒）
+	MaxEntries int `yaml:"max_entries" toml:"max_entries"` // 保持する件数の上限（0でキャッシュしない）
+}
+
+// OpenAI互換API設定（Ollama / llama.cpp のサーバーもこちらで指定）
+type OpenAIConfig struct {
+	BaseURL     string  `yaml:"base_url" toml:"base_url"` // 例: https://api.openai.com/v1, http://localhost:11434/v1
+	APIKey      string  `yaml:"api_key" toml:"api_key"`
+	Model       string  `yaml:"model" toml:"model"`
+	Temperature float32 `yaml:"temperature" toml:"temperature"`
+}
+
+// トークン保管庫の設定
+type VaultConfig struct {
+	Store string   `yaml:"store" toml:"store"` // "memory" または "file"
+	Path  string   `yaml:"path" toml:"path"`   // store = "file" のときの保存先
+	Keys  []string `yaml:"keys" toml:"keys"`   // "鍵ID:base64(32バイト)"。先頭が現在の鍵、残りは復号専用の旧鍵
+}
+
+// CORS設定
+type CORSConfig struct {
+	AllowedOrigins []string       `yaml:"allowed_origins" toml:"allowed_origins"` // FRONTEND_URL 以外に許可するオリジン
+	MaxAge         int            `yaml:"max_age" toml:"max_age"`                 // プリフライト結果のキャッシュ秒数
+	RouteMaxAge    map[string]int `yaml:"route_max_age" toml:"route_max_age"`     // パスの接頭辞ごとのキャッシュ秒数
+}
+
+// GitHub OAuth App設定
+type GitHubConfig struct {
+	ClientID     string `yaml:"client_id" toml:"client_id"`
+	ClientSecret string `yaml:"client_secret" toml:"client_secret"`
+	RedirectURI  string `yaml:"redirect_uri" toml:"redirect_uri"` // 省略時は ServerURL から組み立てる
+}
+
+// Gemini API設定
+type GeminiConfig struct {
+	APIKey      string  `yaml:"api_key" toml:"api_key"`
+	Model       string  `yaml:"model" toml:"model"`
+	Temperature float32 `yaml:"temperature" toml:"temperature"`
+}
+
+// 設定のデフォルト値
+func defaultConfig() *Config {
+	return &Config{
+		Port:        "3001",
+		FrontendURL: "http://localhost:3000", // 本番では FRONTEND_URL / frontend_url で指定する
+		Gemini: GeminiConfig{
+			Model:       "gemini-pro",
+			Temperature: 0.7,
+		},
+		CORS: CORSConfig{
+			MaxAge: 600,
+		},
+		Vault: VaultConfig{
+			Store: "memory",
+			Path:  "tenkai-sessions.json",
+		},
+		AI: AIConfig{
+			Provider: "gemini",
+			OpenAI: OpenAIConfig{
+				Temperature: 0.7,
+			},
+			Cache: AICacheConfig{
+				TTL:        24 * 60 * 60,
+				MaxEntries: 500,
+			},
+		},
+	}
+}
+
+// 設定の読み込み：デフォルト → 設定ファイル → 環境変数 の順に上書きする
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		if err := loadConfigFile(path, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []string
+	envString := func(key string, dst *string) {
+		if v, ok := os.LookupEnv(key); ok && v != "" {
+			*dst = v
+		}
+	}
+	envString("PORT", &cfg.Port)
+	envString("SERVER_URL", &cfg.ServerURL)
+	envString("FRONTEND_URL", &cfg.FrontendURL)
+	envString("GITHUB_CLIENT_ID", &cfg.GitHub.ClientID)
+	envString("GITHUB_CLIENT_SECRET", &cfg.GitHub.ClientSecret)
+	envString("GITHUB_REDIRECT_URI", &cfg.GitHub.RedirectURI)
+	envString("GEMINI_API_KEY", &cfg.Gemini.APIKey)
+	envString("GEMINI_MODEL", &cfg.Gemini.Model)
+	envString("AI_PROVIDER", &cfg.AI.Provider)
+	envString("OPENAI_BASE_URL", &cfg.AI.OpenAI.BaseURL)
+	envString("OPENAI_API_KEY", &cfg.AI.OpenAI.APIKey)
+	envString("OPENAI_MODEL", &cfg.AI.OpenAI.Model)
+	envString("TOKEN_STORE", &cfg.Vault.Store)
+	envString("TOKEN_STORE_PATH", &cfg.Vault.Path)
+	if v := os.Getenv("TOKEN_ENCRYPTION_KEYS"); v != "" {
+		cfg.Vault.Keys = strings.Split(v, ",")
+	}
+	if v := os.Getenv("AI_ALLOWED_MODELS"); v != "" {
+		cfg.AI.AllowedModels = nil
+		for _, m := range strings.Split(v, ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				cfg.AI.AllowedModels = append(cfg.AI.AllowedModels, m)
+			}
+		}
+	}
+	if v := os.Getenv("AI_ENABLE_FAKE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("AI_ENABLE_FAKE は true か false を指定してください / AI_ENABLE_FAKE must be a boolean: %q", v))
+		} else {
+			cfg.AI.EnableFake = b
+		}
+	}
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		cfg.TrustedProxies = nil
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				cfg.TrustedProxies = append(cfg.TrustedProxies, p)
+			}
+		}
+	}
+	if v := os.Getenv("CORS_ALLOWED_ORIGINS"); v != "" {
+		cfg.CORS.AllowedOrigins = nil
+		for _, o := range strings.Split(v, ",") {
+			if o = strings.TrimSpace(o); o != "" {
+				cfg.CORS.AllowedOrigins = append(cfg.CORS.AllowedOrigins, o)
+			}
+		}
+	}
+	envInt := func(key string, dst *int) {
+		if v := os.Getenv(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s が数値ではありません / %s is not a number: %q", key, key, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	envInt("AI_DAILY_REQUEST_LIMIT", &cfg.Quota.DailyRequests)
+	envInt("AI_DAILY_TOKEN_LIMIT", &cfg.Quota.DailyTokens)
+	envInt("AI_MONTHLY_REQUEST_LIMIT", &cfg.Quota.MonthlyRequests)
+	envInt("AI_MONTHLY_TOKEN_LIMIT", &cfg.Quota.MonthlyTokens)
+	envInt("AI_RATE_LIMIT_PER_MINUTE", &cfg.Quota.RequestsPerMinute)
+	envString("AI_USAGE_PATH", &cfg.Quota.UsagePath)
+	envInt("AI_CACHE_TTL", &cfg.AI.Cache.TTL)
+	envInt("AI_CACHE_MAX_ENTRIES", &cfg.AI.Cache.MaxEntries)
+	if v := os.Getenv("CORS_MAX_AGE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("CORS_MAX_AGE が数値ではありません / CORS_MAX_AGE is not a number: %q", v))
+		} else {
+			cfg.CORS.MaxAge = n
+		}
+	}
+	if v := os.Getenv("GEMINI_TEMPERATURE"); v != "" {
+		t, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("GEMINI_TEMPERATURE が数値ではありません / GEMINI_TEMPERATURE is not a number: %q", v))
+		} else {
+			cfg.Gemini.Temperature = float32(t)
+		}
+	}
+
+	if cfg.ServerURL == "" {
+		// 本番では SERVER_URL / server_url で指定する
+		cfg.ServerURL = "http://localhost:" + cfg.Port
+	}
+	cfg.ServerURL = strings.TrimRight(cfg.ServerURL, "/")
+	cfg.FrontendURL = strings.TrimRight(cfg.FrontendURL, "/")
+	if cfg.GitHub.RedirectURI == "" {
+		cfg.GitHub.RedirectURI = cfg.ServerURL + "/api/auth/github/callback"
+	}
+
+	errs = append(errs, cfg.validate()...)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return cfg, nil
+}
+
+// ヘルパー関数：localhost などのループバックのホスト名か
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// 設定ファイルの読み込み（拡張子で YAML / TOML を判定）
+func loadConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("設定ファイルを読み込めません / cannot read config file %s: %w", path, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	case ".toml":
+		err = toml.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("未対応の設定ファイル形式です / unsupported config file format: %s (.yaml, .yml, .toml)", path)
+	}
+	if err != nil {
+		return fmt.Errorf("設定ファイルの解析に失敗しました / failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// 設定値の検証。問題があればエラーメッセージの一覧を返す
+func (cfg *Config) validate() []string {
+	var errs []string
+
+	if n, err := strconv.Atoi(cfg.Port); err != nil || n <= 0 || n > 65535 {
+		errs = append(errs, fmt.Sprintf("PORT が不正です / PORT is invalid: %q", cfg.Port))
+	}
+
+	checkURL := func(name, value string) {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("%s が正しいURLではありません / %s is not a valid http(s) URL: %q", name, name, value))
+		}
+	}
+	checkURL("SERVER_URL", cfg.ServerURL)
+	checkURL("FRONTEND_URL", cfg.FrontendURL)
+	checkURL("GITHUB_REDIRECT_URI", cfg.GitHub.RedirectURI)
+	if gin.Mode() == gin.ReleaseMode {
+		// 本番でローカル向けのデフォルト値のまま起動しない
+		for _, v := range [][2]string{{"SERVER_URL", cfg.ServerURL}, {"FRONTEND_URL", cfg.FrontendURL}} {
+			if u, err := url.Parse(v[1]); err == nil && isLoopbackHost(u.Hostname()) {
+				errs = append(errs, fmt.Sprintf("GIN_MODE=release では %s を指定してください / %s is required when GIN_MODE=release: %q", v[0], v[0], v[1]))
+			}
+		}
+	}
+	for _, p := range cfg.TrustedProxies {
+		if net.ParseIP(p) == nil {
+			if _, _, err := net.ParseCIDR(p); err != nil {
+				errs = append(errs, fmt.Sprintf("TRUSTED_PROXIES は IP アドレスか CIDR で指定してください / TRUSTED_PROXIES entries must be IP addresses or CIDRs: %q", p))
+			}
+		}
+	}
+	for _, o := range cfg.CORS.AllowedOrigins {
+		checkURL("CORS_ALLOWED_ORIGINS", o)
+	}
+	if cfg.CORS.MaxAge < 0 {
+		errs = append(errs, fmt.Sprintf("CORS_MAX_AGE は0以上で指定してください / CORS_MAX_AGE must not be negative: %d", cfg.CORS.MaxAge))
+	}
+	for prefix, age := range cfg.CORS.RouteMaxAge {
+		if !strings.HasPrefix(prefix, "/") || age < 0 {
+			errs = append(errs, fmt.Sprintf("cors.route_max_age の指定が不正です / invalid cors.route_max_age entry: %q = %d", prefix, age))
+		}
+	}
+
+	if (cfg.GitHub.ClientID == "") != (cfg.GitHub.ClientSecret == "") {
+		errs = append(errs, "GITHUB_CLIENT_ID と GITHUB_CLIENT_SECRET は両方設定してください / GITHUB_CLIENT_ID and GITHUB_CLIENT_SECRET must be set together")
+	}
+
+	switch cfg.Vault.Store {
+	case "memory":
+	case "file":
+		if cfg.Vault.Path == "" {
+			errs = append(errs, "TOKEN_STORE_PATH が空です / TOKEN_STORE_PATH must not be empty")
+		}
+		if len(cfg.Vault.Keys) == 0 {
+			errs = append(errs, "TOKEN_STORE=file には TOKEN_ENCRYPTION_KEYS が必要です / TOKEN_ENCRYPTION_KEYS is required when TOKEN_STORE=file")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("TOKEN_STORE は memory か file を指定してください / TOKEN_STORE must be memory or file: %q", cfg.Vault.Store))
+	}
+	if _, _, err := parseVaultKeys(cfg.Vault.Keys); err != nil {
+		errs = append(errs, fmt.Sprintf("TOKEN_ENCRYPTION_KEYS が不正です / TOKEN_ENCRYPTION_KEYS is invalid: %v", err))
+	}
+
+	switch cfg.AI.Provider {
+	case "gemini":
+	case "fake":
+		if !cfg.AI.EnableFake {
+			errs = append(errs, "AI_PROVIDER=fake には AI_ENABLE_FAKE=true が必要です / AI_ENABLE_FAKE=true is required when AI_PROVIDER=fake")
+		}
+	case "openai":
+		if cfg.AI.OpenAI.Model == "" {
+			errs = append(errs, "AI_PROVIDER=openai には OPENAI_MODEL が必要です / OPENAI_MODEL is required when AI_PROVIDER=openai")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("AI_PROVIDER は gemini, openai, fake のいずれかを指定してください / AI_PROVIDER must be gemini, openai or fake: %q", cfg.AI.Provider))
+	}
+	for _, m := range cfg.AI.AllowedModels {
+		provider, model, ok := strings.Cut(m, ":")
+		if !ok || model == "" || (provider != "gemini" && provider != "openai" && provider != "fake") {
+			errs = append(errs, fmt.Sprintf("AI_ALLOWED_MODELS は \"プロバイダー:モデル\" の形で指定してください / AI_ALLOWED_MODELS entries must be \"provider:model\": %q", m))
+		}
+	}
+	if cfg.AI.OpenAI.BaseURL != "" {
+		checkURL("OPENAI_BASE_URL", cfg.AI.OpenAI.BaseURL)
+	} else if cfg.AI.Provider == "openai" {
+		errs = append(errs, "AI_PROVIDER=openai には OPENAI_BASE_URL が必要です / OPENAI_BASE_URL is required when AI_PROVIDER=openai")
+	}
+
+	for name, n := range map[string]int{
+		"AI_DAILY_REQUEST_LIMIT":   cfg.Quota.DailyRequests,
+		"AI_DAILY_TOKEN_LIMIT":     cfg.Quota.DailyTokens,
+		"AI_MONTHLY_REQUEST_LIMIT": cfg.Quota.MonthlyRequests,
+		"AI_MONTHLY_TOKEN_LIMIT":   cfg.Quota.MonthlyTokens,
+		"AI_RATE_LIMIT_PER_MINUTE": cfg.Quota.RequestsPerMinute,
+		"AI_CACHE_TTL":             cfg.AI.Cache.TTL,
+		"AI_CACHE_MAX_ENTRIES":     cfg.AI.Cache.MaxEntries,
+	} {
+		if n < 0 {
+			errs = append(errs, fmt.Sprintf("%s は0以上で指定してください / %s must not be negative: %d", name, name, n))
+		}
 	}
 
-	log.Printf("tenkai_server が起動しました: http://localhost:%s", port)
-	log.Fatal(r.Run(":" + port))
+	if cfg.Gemini.Model == "" {
+		errs = append(errs, "GEMINI_MODEL が空です / GEMINI_MODEL must not be empty")
+	}
+	if cfg.Gemini.Temperature < 0 || cfg.Gemini.Temperature > 2 {
+		errs = append(errs, fmt.Sprintf("GEMINI_TEMPERATURE は0〜2の範囲で指定してください / GEMINI_TEMPERATURE must be between 0 and 2: %v", cfg.Gemini.Temperature))
+	}
+
+	return errs
 }
 
 // 初期化
@@ -273,7 +819,7 @@ func handleInit(c *gin.Context) {
 		Message: "原稿管理を開始しました",
 		Data: map[string]string{
 			"workDir": workDir,
-			"aiEnabled": fmt.Sprintf("%v", genClient != nil),
+			"aiEnabled": fmt.Sprintf("%v", aiAvailable()),
 		},
 	})
 }
@@ -327,14 +873,17 @@ func handleSave(c *gin.Context) {
 	}
 
 	// AIによるコミットメッセージ生成
-	if req.UseAI && genClient != nil {
-		status, _ := w.Status()
-		changes := formatChanges(status)
-		if changes != "" {
-			aiMessage := generateAICommitMessage(changes)
-			if aiMessage != "" {
-				commitMessage = aiMessage
+	if req.UseAI {
+		if provider, err := resolveLLMForRequest(c, req.Provider, req.Model); err == nil {
+			status, _ := w.Status()
+			if changes := summarizeChanges(status); changes != "" {
+				aiMessage := generateAICommitMessage(c.Request.Context(), provider, changes)
+				if aiMessage != "" {
+					commitMessage = aiMessage
+				}
 			}
+		} else {
+			log.Printf("AIプロバイダーの解決に失敗: %v", err)
 		}
 	}
 
@@ -450,25 +999,8 @@ func handleDraftCreate(c *gin.Context) {
 		return
 	}
 
-	// ワークツリーを取得
-	w, err := repo.Worktree()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Success: false,
-			Message: "作業ツリーの取得に失敗しました",
-			Error:   err.Error(),
-		})
-		return
-	}
-
 	// 新しいブランチを作成してチェックアウト
-	branchName := plumbing.NewBranchReferenceName(req.Name)
-	err = w.Checkout(&git.CheckoutOptions{
-		Create: true,
-		Branch: branchName,
-	})
-
-	if err != nil {
+	if err := checkoutDraft(req.Name, true); err != nil {
 		c.JSON(http.StatusInternalServerError, Response{
 			Success: false,
 			Message: "草案の作成に失敗しました",
@@ -563,24 +1095,8 @@ func handleDraftSwitch(c *gin.Context) {
 		return
 	}
 
-	// ワークツリーを取得
-	w, err := repo.Worktree()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Success: false,
-			Message: "作業ツリーの取得に失敗しました",
-			Error:   err.Error(),
-		})
-		return
-	}
-
 	// ブランチにチェックアウト
-	branchName := plumbing.NewBranchReferenceName(req.Name)
-	err = w.Checkout(&git.CheckoutOptions{
-		Branch: branchName,
-	})
-
-	if err != nil {
+	if err := checkoutDraft(req.Name, false); err != nil {
 		c.JSON(http.StatusInternalServerError, Response{
 			Success: false,
 			Message: "草案の切り替えに失敗しました",
@@ -598,6 +1114,18 @@ func handleDraftSwitch(c *gin.Context) {
 	})
 }
 
+// ヘルパー関数：草案（ブランチ）に切り替える（create で新しく作成してから切り替える）
+func checkoutDraft(name string, create bool) error {
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	return w.Checkout(&git.CheckoutOptions{
+		Create: create,
+		Branch: plumbing.NewBranchReferenceName(name),
+	})
+}
+
 // 状態確認
 func handleStatus(c *gin.Context) {
 	if repo == nil {
@@ -670,124 +1198,495 @@ func handleAIAnalyze(c *gin.Context) {
 		return
 	}
 
-	if genClient == nil {
-		c.JSON(http.StatusBadRequest, Response{
-			Success: false,
-			Message: "AI機能が初期化されていません",
-		})
+	provider, err := resolveLLMForRequest(c, req.Provider, req.Model)
+	if err != nil {
+		respondAIError(c, http.StatusBadRequest, "AI機能が初期化されていません", err)
 		return
 	}
 
-	prompt := ""
-	switch req.Type {
-	case "summary":
-		prompt = "以下の文章を簡潔に要約してください：\n\n" + req.Text
-	case "review":
-		prompt = "以下の文章を校正し、改善点を指摘してください：\n\n" + req.Text
-	case "commit":
-		prompt = "以下の変更内容から適切な日本語のコミットメッセージを生成してください：\n\n" + req.Text
-	default:
-		prompt = req.Prompt
-		if prompt == "" {
-			prompt = req.Text
-		}
-	}
-
-	ctx := context.Background()
-	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+	prompt, pt, err := renderAnalyzePrompt(c, req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
+		c.JSON(http.StatusBadRequest, Response{
 			Success: false,
-			Message: "AI分析に失敗しました",
+			Message: "プロンプトの作成に失敗しました",
 			Error:   err.Error(),
 		})
 		return
 	}
 
-	var result string
-	for _, cand := range resp.Candidates {
-		if cand.Content != nil {
-			for _, part := range cand.Content.Parts {
-				result += fmt.Sprintf("%v", part)
-			}
-		}
+	templateName, version := promptTemplateIdentity(pt, "analyze")
+	result, cached, err := generateCached(c.Request.Context(), provider, templateName, version, LLMRequest{Prompt: prompt}, req.NoCache)
+	if err != nil {
+		respondAIError(c, http.StatusInternalServerError, "AI分析に失敗しました", err)
+		return
 	}
 
 	c.JSON(http.StatusOK, Response{
 		Success: true,
-		Data: map[string]string{
-			"result": result,
-			"type":   req.Type,
+		Data: map[string]interface{}{
+			"result":   result,
+			"type":     req.Type,
+			"provider": provider.Name(),
+			"model":    provider.Model(),
+			"cached":   cached,
 		},
 	})
 }
 
-// ヘルパー関数：変更内容のフォーマット
-func formatChanges(status git.Status) string {
-	var changes []string
-	for file, s := range status {
-		if s.Staging != git.Unmodified {
-			changes = append(changes, fmt.Sprintf("%s: %s", file, s.Staging))
-		} else if s.Worktree != git.Unmodified {
-			changes = append(changes, fmt.Sprintf("%s: %s", file, s.Worktree))
-		}
+// AI分析（Server-Sent Eventsで逐次返す）
+func handleAIAnalyzeStream(c *gin.Context) {
+	var req AnalyzeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
 	}
-	return strings.Join(changes, "\n")
-}
 
-// ヘルパー関数：AIによるコミットメッセージ生成
-func generateAICommitMessage(changes string) string {
-	if genClient == nil {
-		return ""
+	provider, err := resolveLLMForRequest(c, req.Provider, req.Model)
+	if err != nil {
+		respondAIError(c, http.StatusBadRequest, "AI機能が初期化されていません", err)
+		return
 	}
 
-	ctx := context.Background()
-	prompt := fmt.Sprintf("以下の変更内容から、簡潔で分かりやすい日本語のコミットメッセージを1行で生成してください。技術的な詳細は避け、何をしたかを明確に：\n\n%s", changes)
-	
-	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+	prompt, pt, err := renderAnalyzePrompt(c, req)
 	if err != nil {
-		log.Printf("AI生成エラー: %v", err)
-		return ""
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "プロンプトの作成に失敗しました",
+			Error:   err.Error(),
+		})
+		return
 	}
 
-	for _, cand := range resp.Candidates {
-		if cand.Content != nil {
-			for _, part := range cand.Content.Parts {
-				return strings.TrimSpace(fmt.Sprintf("%v", part))
+	templateName, version := promptTemplateIdentity(pt, "analyze")
+	cacheKey := aiCacheKey{
+		Provider: provider.Name(),
+		Model:    provider.Model(),
+		Template: templateName,
+		Version:  version,
+		Input:    "\x00" + prompt,
+	}
+	cachedText, cached := "", false
+	if !req.NoCache {
+		cachedText, cached = aiCache.Get(cacheKey)
+	}
+	if !cached {
+		// ストリームを始めると状態コードを返せないので、上限はここで判定する
+		if err := checkAIQuota(provider); err != nil {
+			respondAIError(c, http.StatusInternalServerError, "AI分析に失敗しました", err)
+			return
+		}
+	}
+
+	// クライアントが切断すると c.Request.Context() がキャンセルされ、上流のリクエストも中断される
+	ctx := c.Request.Context()
+
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Writer.Header().Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	c.SSEvent("meta", gin.H{
+		"type":     req.Type,
+		"provider": provider.Name(),
+		"model":    provider.Model(),
+		"cached":   cached,
+	})
+	c.Writer.Flush()
+
+	if cached {
+		// キャッシュ済みの結果は一度に送る
+		c.SSEvent("delta", gin.H{"text": cachedText})
+		c.SSEvent("done", gin.H{"type": req.Type, "cached": true})
+		c.Writer.Flush()
+		return
+	}
+
+	var output strings.Builder
+	err = provider.Stream(ctx, LLMRequest{Prompt: prompt}, func(text string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		output.WriteString(text)
+		c.SSEvent("delta", gin.H{"text": text})
+		c.Writer.Flush()
+		return nil
+	})
+
+	if ctx.Err() != nil {
+		// クライアントによる中断。応答先がないので何も送らない
+		log.Printf("AIストリーミングが中断されました: %v", ctx.Err())
+		return
+	}
+	if err != nil {
+		message := "AI分析に失敗しました"
+		var qe *quotaError
+		if errors.As(err, &qe) {
+			message = qe.Error()
+		}
+		c.SSEvent("error", gin.H{
+			"message": message,
+			"error":   err.Error(),
+		})
+		c.Writer.Flush()
+		return
+	}
+
+	aiCache.Put(cacheKey, output.String())
+
+	c.SSEvent("done", gin.H{"type": req.Type, "cached": false})
+	c.Writer.Flush()
+}
+
+// 差分要約の上限（文字数）
+const (
+	diffSummaryTotalLimit = 6000 // 全体
+	diffSummaryFileLimit  = 1500 // 1ファイルあたり
+	diffSummaryHunkLimit  = 200  // 1箇所あたり
+)
+
+// ヘルパー関数：変更ファイルごとの本文の差分を、AIに渡せる大きさに要約する
+func summarizeChanges(status git.Status) string {
+	files := make([]string, 0, len(status))
+	for file, s := range status {
+		if s.Staging != git.Unmodified || s.Worktree != git.Unmodified {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+
+	headTree := headCommitTree()
+
+	var sb strings.Builder
+	total, omitted := 0, 0 // total は sb の文字数
+	for _, file := range files {
+		section := summarizeFileDiff(headTree, file)
+		n := utf8.RuneCountInString(section)
+		if sb.Len() > 0 && total+n > diffSummaryTotalLimit {
+			omitted++
+			continue
+		}
+		sb.WriteString(section)
+		sb.WriteString("\n")
+		total += n + 1
+	}
+	if omitted > 0 {
+		sb.WriteString(fmt.Sprintf("（ほか%dファイルの変更は省略）\n", omitted))
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// ヘルパー関数：HEADのツリーを取得（最初のコミット前はnil）
+func headCommitTree() *object.Tree {
+	head, err := repo.Head()
+	if err != nil {
+		return nil
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil
+	}
+	return tree
+}
+
+// ヘルパー関数：1ファイル分の差分要約
+func summarizeFileDiff(headTree *object.Tree, path string) string {
+	oldText, oldExists := "", false
+	if headTree != nil {
+		if f, err := headTree.File(path); err == nil {
+			if content, err := f.Contents(); err == nil {
+				oldText, oldExists = content, true
 			}
 		}
 	}
-	
-	return ""
+
+	newBytes, err := os.ReadFile(filepath.Join(workDir, path))
+	newExists := err == nil
+	newText := string(newBytes)
+
+	switch {
+	case !newExists && !oldExists:
+		return fmt.Sprintf("## %s（変更）", path)
+	case !newExists:
+		return fmt.Sprintf("## %s（削除）", path)
+	case strings.ContainsRune(oldText, 0) || strings.ContainsRune(newText, 0):
+		return fmt.Sprintf("## %s（バイナリファイルの変更）", path)
+	}
+
+	// 原稿はルビや注記の記法を除いた本文どうしで比べる（記法の書き換えだけの変更を本文の変更として扱わない）
+	if manuscriptExtensions[strings.ToLower(filepath.Ext(path))] {
+		oldText, _ = parseAozora(oldText).PlainText()
+		newText, _ = parseAozora(newText).PlainText()
+	}
+	if !oldExists {
+		return fmt.Sprintf("## %s（新規）\n+ %s", path, truncateRunes(strings.TrimSpace(newText), diffSummaryFileLimit))
+	}
+	if oldText == newText {
+		return fmt.Sprintf("## %s（ルビ・注記のみの変更）", path)
+	}
+
+	// 追加・削除された箇所を集める
+	var hunks []string
+	for _, d := range diff.Do(oldText, newText) {
+		text := strings.TrimSpace(d.Text)
+		if text == "" {
+			continue
+		}
+		text = truncateRunes(text, diffSummaryHunkLimit)
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			hunks = append(hunks, "+ "+strings.ReplaceAll(text, "\n", "\n+ "))
+		case diffmatchpatch.DiffDelete:
+			hunks = append(hunks, "- "+strings.ReplaceAll(text, "\n", "\n- "))
+		}
+	}
+	if len(hunks) == 0 {
+		return fmt.Sprintf("## %s（空白のみの変更）", path)
+	}
+
+	// 大きな変更は全体から均等に抜き出す
+	selected := hunks
+	budget := diffSummaryFileLimit / diffSummaryHunkLimit
+	if len(hunks) > budget {
+		selected = make([]string, 0, budget)
+		for i := 0; i < budget; i++ {
+			selected = append(selected, hunks[i*len(hunks)/budget])
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("## %s（%d箇所の変更）\n", path, len(hunks)))
+	sb.WriteString(strings.Join(selected, "\n"))
+	if len(selected) < len(hunks) {
+		sb.WriteString(fmt.Sprintf("\n（ほか%d箇所は省略）", len(hunks)-len(selected)))
+	}
+	return sb.String()
+}
+
+// ヘルパー関数：文字数で切り詰める
+func truncateRunes(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit]) + "…"
+}
+
+// ヘルパー関数：AIによるコミットメッセージ生成（1行目が件名、空行の後に任意の本文）
+func generateAICommitMessage(ctx context.Context, provider LLMProvider, changes string) string {
+	prompt := fmt.Sprintf(`以下は原稿の変更内容です（"+" は追加、"-" は削除された文章）。
+この変更を表す日本語のコミットメッセージを作成してください。
+
+- 1行目は40文字以内の件名。何を書き直したかを具体的に（例：「第三章の冒頭を改稿し、主人公の動機を明確化」）
+- 補足が必要な場合のみ、空行を挟んで2〜3行の本文を書く
+- ファイル名や技術的な用語は避け、メッセージ以外は出力しない
+
+%s`, changes)
+
+	resp, err := provider.Generate(ctx, LLMRequest{Prompt: prompt})
+	if err != nil {
+		log.Printf("AI生成エラー: %v", err)
+		return ""
+	}
+
+	return formatCommitMessage(resp.Text)
+}
+
+// ヘルパー関数：AIの出力を「件名 + 空行 + 本文」の形に整える
+func formatCommitMessage(text string) string {
+	text = strings.TrimSpace(text)
+	text = strings.TrimPrefix(text, "```")
+	text = strings.TrimSuffix(text, "```")
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		lines = append(lines, strings.TrimRight(line, " \t\r"))
+	}
+	if len(lines) == 0 || lines[0] == "" {
+		return ""
+	}
+
+	subject := strings.Trim(lines[0], "「」\"' ")
+	body := strings.TrimSpace(strings.Join(lines[1:], "\n"))
+	if body == "" {
+		return subject
+	}
+	return subject + "\n\n" + body
+}
+
+// ヘルパー関数：デフォルトのAIプロバイダーが利用可能か
+func aiAvailable() bool {
+	_, err := resolveLLM("", "")
+	return err == nil
+}
+
+// OAuth stateの有効期限
+const oauthStateTTL = 10 * time.Minute
+
+// ログインを始めたブラウザに state を結びつけるCookie名
+const oauthStateCookieName = "tenkai_oauth_state"
+
+// ログイン開始時に発行したstateとPKCE検証子
+type oauthState struct {
+	Verifier  string
+	ExpiresAt time.Time
+}
+
+var (
+	oauthStatesMu sync.Mutex
+	oauthStates   = make(map[string]oauthState)
+)
+
+// GitHub OAuthログイン開始
+func handleGitHubLogin(c *gin.Context) {
+	clientID := config.GitHub.ClientID
+	if clientID == "" {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "OAuth設定が不足しています",
+		})
+		return
+	}
+
+	state, err := randomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "stateの生成に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	verifier, err := randomToken(48)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "PKCE検証子の生成に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	storeOAuthState(state, verifier)
+	setOAuthStateCookie(c, state, int(oauthStateTTL.Seconds()))
+
+	params := url.Values{}
+	params.Set("client_id", clientID)
+	params.Set("redirect_uri", config.GitHub.RedirectURI)
+	params.Set("scope", "repo")
+	params.Set("state", state)
+	params.Set("code_challenge", pkceChallenge(verifier))
+	params.Set("code_challenge_method", "S256")
+
+	c.Redirect(http.StatusFound, "https://github.com/login/oauth/authorize?"+params.Encode())
+}
+
+// ヘルパー関数: URLセーフなランダム文字列を生成
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ヘルパー関数: PKCEのコードチャレンジ（S256）を計算
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// ヘルパー関数: state のCookieを設定（maxAge < 0 で削除）
+func setOAuthStateCookie(c *gin.Context, state string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oauthStateCookieName, state, maxAge, "/", "", true, true)
+}
+
+// ヘルパー関数: stateを保存（期限切れのものは掃除する）
+func storeOAuthState(state, verifier string) {
+	oauthStatesMu.Lock()
+	defer oauthStatesMu.Unlock()
+
+	now := time.Now()
+	for s, v := range oauthStates {
+		if now.After(v.ExpiresAt) {
+			delete(oauthStates, s)
+		}
+	}
+
+	oauthStates[state] = oauthState{
+		Verifier:  verifier,
+		ExpiresAt: now.Add(oauthStateTTL),
+	}
+}
+
+// ヘルパー関数: stateを取り出して検証（一度しか使えない）
+func consumeOAuthState(state string) (string, bool) {
+	if state == "" {
+		return "", false
+	}
+
+	oauthStatesMu.Lock()
+	defer oauthStatesMu.Unlock()
+
+	v, ok := oauthStates[state]
+	if !ok {
+		return "", false
+	}
+	delete(oauthStates, state)
+
+	if time.Now().After(v.ExpiresAt) {
+		return "", false
+	}
+	return v.Verifier, true
 }
 
 // GitHub OAuth認証処理
 func handleGitHubCallback(c *gin.Context) {
 	// GETパラメータから取得
 	code := c.Query("code")
-	// state := c.Query("state") // 現在は使用していないがCSRF対策で将来使用予定
+	state := c.Query("state")
 	errorParam := c.Query("error")
-	
-	// フロントエンドURLを環境変数から取得
-	frontendURL := os.Getenv("FRONTEND_URL")
-	if frontendURL == "" {
-		frontendURL = "https://tenkai-production.up.railway.app"
+
+	frontendURL := config.FrontendURL
+
+	// stateを検証（CSRF対策）。ログインを始めたブラウザのCookieと一致しない・期限切れは拒否する
+	var verifier string
+	stateOK := false
+	if cookieState, err := c.Cookie(oauthStateCookieName); err == nil && cookieState != "" &&
+		subtle.ConstantTimeCompare([]byte(cookieState), []byte(state)) == 1 {
+		verifier, stateOK = consumeOAuthState(state)
 	}
-	
+	setOAuthStateCookie(c, "", -1)
+
 	// エラーチェック
 	if errorParam != "" {
-		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/auth?error=%s", frontendURL, errorParam))
+		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/auth?error=%s", frontendURL, url.QueryEscape(errorParam)))
 		return
 	}
-	
+
+	if !stateOK {
+		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/auth?error=invalid_state", frontendURL))
+		return
+	}
+
 	if code == "" {
 		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/auth?error=missing_code", frontendURL))
 		return
 	}
 
 	// GitHub OAuth App設定
-	clientID := os.Getenv("GITHUB_CLIENT_ID")
-	clientSecret := os.Getenv("GITHUB_CLIENT_SECRET")
+	clientID := config.GitHub.ClientID
+	clientSecret := config.GitHub.ClientSecret
 	
 	if clientID == "" || clientSecret == "" {
 		c.JSON(http.StatusInternalServerError, Response{
@@ -803,7 +1702,8 @@ func handleGitHubCallback(c *gin.Context) {
 	data.Set("client_id", clientID)
 	data.Set("client_secret", clientSecret)
 	data.Set("code", code)
-	data.Set("redirect_uri", "https://tenkaiserver-production.up.railway.app/api/auth/github/callback")
+	data.Set("redirect_uri", config.GitHub.RedirectURI)
+	data.Set("code_verifier", verifier)
 
 	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(data.Encode()))
 	if err != nil {
@@ -887,75 +1787,79 @@ func handleGitHubCallback(c *gin.Context) {
 		return
 	}
 
-	// 認証成功後、フロントエンドにリダイレクト（一時的な実装）
-	redirectURL := fmt.Sprintf("%s/app?auth_success=true&token=%s&user=%s", 
-		frontendURL,
-		url.QueryEscape(accessToken), 
-		url.QueryEscape(user.Login))
-	
-	c.Redirect(http.StatusTemporaryRedirect, redirectURL)
-}
-
-// GitHub設定管理: 設定取得
-func handleGetSettings(c *gin.Context) {
-	accessToken := c.GetHeader("Authorization")
-	if accessToken == "" {
-		c.JSON(http.StatusUnauthorized, Response{
+	// サーバー側セッションを作成
+	session, err := createSession(&user, accessToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
 			Success: false,
-			Message: "認証が必要です",
+			Message: "セッションの作成に失敗しました",
+			Error:   err.Error(),
 		})
 		return
 	}
-	
-	// "Bearer " プレフィックスを削除
-	if strings.HasPrefix(accessToken, "Bearer ") {
-		accessToken = strings.TrimPrefix(accessToken, "Bearer ")
-	}
+	setSessionCookie(c, session.ID, int(sessionTTL.Seconds()))
 
-	// ユーザー情報を取得
-	user, err := getGitHubUser(accessToken)
+	// フロントエンドとAPIが別サイトの場合、APIのCookieはフロントエンドからの呼び出しに付かない。
+	// セッションIDの代わりに一度きり・短命のログインコードを渡し、POST /api/auth/session で交換させる
+	loginCode, err := randomToken(32)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, Response{
+		c.JSON(http.StatusInternalServerError, Response{
 			Success: false,
-			Message: "GitHubユーザー情報の取得に失敗しました",
+			Message: "ログインコードの生成に失敗しました",
 			Error:   err.Error(),
 		})
 		return
 	}
+	storeLoginCode(loginCode, session.ID)
 
-	// .tenkai-settings リポジトリから設定を取得
-	settings, err := getTenkaiSettings(accessToken, user.Login)
-	if err != nil {
-		// 設定が存在しない場合はデフォルト設定を返す
-		defaultSettings := TenkaiSettings{
-			Version:        "1.0",
-			CharsPerLine:   17,
-			LinesPerPage:   42,
-			WritingMode:    "vertical",
-			Theme:          "light",
-			Repositories:   []string{},
-			ActiveRepo:     "",
-			CustomSettings: make(map[string]interface{}),
-			LastUpdated:    time.Now().Format(time.RFC3339),
-		}
-		
-		c.JSON(http.StatusOK, Response{
-			Success: true,
-			Message: "デフォルト設定を返しました",
-			Data:    defaultSettings,
-		})
-		return
-	}
+	// 認証成功後、フロントエンドにリダイレクト（一時的な実装）
+	// アクセストークンはサーバー側にのみ保持し、セッションIDはURLに載せない（履歴やRefererに残る）
+	redirectURL := fmt.Sprintf("%s/app?auth_success=true&user=%s&login_code=%s",
+		frontendURL,
+		url.QueryEscape(user.Login),
+		url.QueryEscape(loginCode))
+	
+	c.Redirect(http.StatusTemporaryRedirect, redirectURL)
+}
 
-	c.JSON(http.StatusOK, Response{
-		Success: true,
-		Data:    settings,
-	})
+// セッションの有効期限
+const sessionTTL = 30 * 24 * time.Hour
+
+// セッションCookie名
+const sessionCookieName = "tenkai_session"
+
+// ログインセッション（AccessTokenは復号済みの値で、保管時は暗号化される）
+type authSession struct {
+	ID          string
+	UserID      int
+	Login       string
+	AccessToken string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
 }
 
-// GitHub設定管理: 設定保存
-func handleSaveSettings(c *gin.Context) {
-	var req SettingsRequest
+// ログインコードの有効期限（リダイレクト直後に交換する前提）
+const loginCodeTTL = time.Minute
+
+// ログインコードとセッションIDの対応
+type loginCode struct {
+	SessionID string
+	ExpiresAt time.Time
+}
+
+var (
+	loginCodesMu sync.Mutex
+	loginCodes   = make(map[string]loginCode)
+)
+
+// ログインコード交換リクエスト
+type LoginCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// ログインコードをセッションIDに交換（Cookieを使えない別サイトのフロントエンド向け）
+func handleExchangeLoginCode(c *gin.Context) {
+	var req LoginCodeRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, Response{
 			Success: false,
@@ -965,850 +1869,11537 @@ func handleSaveSettings(c *gin.Context) {
 		return
 	}
 
-	// ユーザー情報を取得
-	user, err := getGitHubUser(req.AccessToken)
-	if err != nil {
+	sessionID, ok := consumeLoginCode(req.Code)
+	session := getSession(sessionID)
+	if !ok || session == nil {
 		c.JSON(http.StatusUnauthorized, Response{
 			Success: false,
-			Message: "GitHubユーザー情報の取得に失敗しました",
-			Error:   err.Error(),
-		})
-		return
-	}
-
-	// 設定に最終更新日時を設定
-	req.Settings.LastUpdated = time.Now().Format(time.RFC3339)
-
-	// .tenkai-settings リポジトリに設定を保存
-	err = saveTenkaiSettings(req.AccessToken, user.Login, req.Settings)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Success: false,
-			Message: "設定の保存に失敗しました",
-			Error:   err.Error(),
+			Message: "ログインコードが無効か期限切れです",
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, Response{
 		Success: true,
-		Message: "設定を保存しました",
-		Data:    req.Settings,
+		Message: "ログインしました",
+		Data: map[string]interface{}{
+			"sessionId": session.ID,
+			"login":     session.Login,
+			"expiresAt": session.ExpiresAt,
+		},
 	})
 }
 
-// GitHub設定管理: リポジトリ一覧取得
-func handleGetRepositories(c *gin.Context) {
-	accessToken := c.GetHeader("Authorization")
-	if accessToken == "" {
-		c.JSON(http.StatusUnauthorized, Response{
-			Success: false,
-			Message: "認証が必要です",
-		})
-		return
-	}
-	
-	// "Bearer " プレフィックスを削除
-	if strings.HasPrefix(accessToken, "Bearer ") {
-		accessToken = strings.TrimPrefix(accessToken, "Bearer ")
-	}
+// ヘルパー関数: ログインコードを保存（期限切れのものは掃除する）
+func storeLoginCode(code, sessionID string) {
+	loginCodesMu.Lock()
+	defer loginCodesMu.Unlock()
 
-	// GitHubからリポジトリ一覧を取得
-	repos, err := getGitHubRepositories(accessToken)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Success: false,
-			Message: "リポジトリ一覧の取得に失敗しました",
-			Error:   err.Error(),
-		})
-		return
+	now := time.Now()
+	for k, v := range loginCodes {
+		if now.After(v.ExpiresAt) {
+			delete(loginCodes, k)
+		}
 	}
 
-	c.JSON(http.StatusOK, Response{
-		Success: true,
-		Data:    repos,
-	})
+	loginCodes[code] = loginCode{
+		SessionID: sessionID,
+		ExpiresAt: now.Add(loginCodeTTL),
+	}
 }
 
-// ヘルパー関数: GitHubユーザー情報取得
-func getGitHubUser(accessToken string) (*GitHubUser, error) {
-	userURL := "https://api.github.com/user"
-	req, err := http.NewRequest("GET", userURL, nil)
-	if err != nil {
-		return nil, err
+// ヘルパー関数: ログインコードを取り出して検証（一度しか使えない）
+func consumeLoginCode(code string) (string, bool) {
+	if code == "" {
+		return "", false
 	}
-	
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("User-Agent", "tenkai-app")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+	loginCodesMu.Lock()
+	defer loginCodesMu.Unlock()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GitHub API error: %d", resp.StatusCode)
+	v, ok := loginCodes[code]
+	if !ok {
+		return "", false
 	}
+	delete(loginCodes, code)
 
-	var user GitHubUser
-	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		return nil, err
+	if time.Now().After(v.ExpiresAt) {
+		return "", false
 	}
+	return v.SessionID, true
+}
 
-	return &user, nil
+// ログアウトリクエスト
+type LogoutRequest struct {
+	Everywhere bool `json:"everywhere"` // trueの場合、同じユーザーの全セッションを無効化
 }
 
-// ヘルパー関数: Tenkai設定取得
-func getTenkaiSettings(accessToken, username string) (*TenkaiSettings, error) {
-	// .tenkai-settings リポジトリから settings.json を取得
-	fileURL := fmt.Sprintf("https://api.github.com/repos/%s/.tenkai-settings/contents/settings.json", username)
-	req, err := http.NewRequest("GET", fileURL, nil)
-	if err != nil {
-		return nil, err
+// ログアウト（セッション破棄とトークン失効）
+func handleLogout(c *gin.Context) {
+	var req LogoutRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Message: "リクエストが不正です",
+				Error:   err.Error(),
+			})
+			return
+		}
 	}
-	
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("User-Agent", "tenkai-app")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	if c.Query("everywhere") == "true" {
+		req.Everywhere = true
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("settings not found")
+	// 対象のトークンを集める
+	var targets []*authSession
+	if session := getSession(sessionIDFromRequest(c)); session != nil {
+		if req.Everywhere {
+			targets = removeUserSessions(session.UserID)
+		} else {
+			removeSession(session.ID)
+			targets = []*authSession{session}
+		}
+	} else if token := bearerToken(c); token != "" {
+		// セッションを使わないクライアント向け：Authorizationのトークンを直接失効させる
+		targets = []*authSession{{AccessToken: token}}
+		if req.Everywhere {
+			if user, err := getGitHubUser(token); err == nil {
+				targets = append(targets, removeUserSessions(user.ID)...)
+			}
+		}
+	} else {
+		c.JSON(http.StatusUnauthorized, Response{
+			Success: false,
+			Message: "認証が必要です",
+		})
+		return
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GitHub API error: %d", resp.StatusCode)
-	}
+	setSessionCookie(c, "", -1)
 
-	var file GitHubFile
-	if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
-		return nil, err
+	// GitHub側のトークンを失効させる
+	revoked := make(map[string]bool)
+	var failures []string
+	for _, t := range targets {
+		if t.AccessToken == "" || revoked[t.AccessToken] {
+			continue
+		}
+		var err error
+		if req.Everywhere {
+			err = revokeGitHubGrant(t.AccessToken)
+		} else {
+			err = revokeGitHubToken(t.AccessToken)
+		}
+		if err != nil {
+			log.Printf("トークンの失効に失敗: %v", err)
+			failures = append(failures, err.Error())
+			continue
+		}
+		revoked[t.AccessToken] = true
 	}
 
-	// Base64デコード
-	content, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(file.Content, "\n", ""))
-	if err != nil {
-		return nil, err
+	if len(failures) > 0 {
+		c.JSON(http.StatusBadGateway, Response{
+			Success: false,
+			Message: "ログアウトしましたが、GitHubトークンの失効に失敗しました",
+			Error:   strings.Join(failures, "; "),
+		})
+		return
 	}
 
-	var settings TenkaiSettings
-	if err := json.Unmarshal(content, &settings); err != nil {
-		return nil, err
+	message := "ログアウトしました"
+	if req.Everywhere {
+		message = "すべての端末からログアウトしました"
 	}
-
-	return &settings, nil
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: message,
+		Data: map[string]interface{}{
+			"revokedTokens": len(revoked),
+			"everywhere":    req.Everywhere,
+		},
+	})
 }
 
-// ヘルパー関数: Tenkai設定保存
-func saveTenkaiSettings(accessToken, username string, settings TenkaiSettings) error {
-	// 設定をJSONに変換
-	settingsJSON, err := json.MarshalIndent(settings, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	// Base64エンコード
-	contentEncoded := base64.StdEncoding.EncodeToString(settingsJSON)
-
-	// 既存ファイルのSHAを取得（更新の場合）
-	existingSHA := ""
-	existingSettings, err := getTenkaiSettings(accessToken, username)
-	if err == nil && existingSettings != nil {
-		// 既存ファイルがある場合、SHAを取得
-		sha, _ := getFileSHA(accessToken, username, "settings.json")
-		existingSHA = sha
-	}
-
-	// .tenkai-settings リポジトリが存在しない場合は作成
-	err = ensureTenkaiSettingsRepo(accessToken, username)
+// ヘルパー関数: セッションを作成（トークンは暗号化して保管庫へ）
+func createSession(user *GitHubUser, accessToken string) (*authSession, error) {
+	id, err := randomToken(32)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// ファイルを更新/作成
-	fileURL := fmt.Sprintf("https://api.github.com/repos/%s/.tenkai-settings/contents/settings.json", username)
-	
-	updateData := map[string]interface{}{
-		"message": "tenkai設定を更新",
-		"content": contentEncoded,
-	}
-	
-	if existingSHA != "" {
-		updateData["sha"] = existingSHA
+	now := time.Now()
+	session := &authSession{
+		ID:          id,
+		UserID:      user.ID,
+		Login:       user.Login,
+		AccessToken: accessToken,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(sessionTTL),
 	}
 
-	updateJSON, err := json.Marshal(updateData)
-	if err != nil {
-		return err
+	if err := tokenVault.Put(session); err != nil {
+		return nil, err
 	}
+	return session, nil
+}
 
-	req, err := http.NewRequest("PUT", fileURL, strings.NewReader(string(updateJSON)))
-	if err != nil {
-		return err
+// ヘルパー関数: セッションを取得（存在しない・期限切れはnil）
+func getSession(id string) *authSession {
+	if id == "" {
+		return nil
 	}
-	
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("User-Agent", "tenkai-app")
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	session, err := tokenVault.Get(id)
 	if err != nil {
-		return err
+		log.Printf("セッションの読み込みに失敗: %v", err)
+		return nil
 	}
-	defer resp.Body.Close()
+	return session
+}
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("GitHub API error: %d, %s", resp.StatusCode, string(body))
+// ヘルパー関数: セッションを削除
+func removeSession(id string) {
+	if err := tokenVault.Delete(id); err != nil {
+		log.Printf("セッションの削除に失敗: %v", err)
 	}
-
-	return nil
 }
 
-// ヘルパー関数: GitHubリポジトリ一覧取得
-func getGitHubRepositories(accessToken string) ([]GitHubRepository, error) {
-	reposURL := "https://api.github.com/user/repos?sort=updated&per_page=100"
-	req, err := http.NewRequest("GET", reposURL, nil)
+// ヘルパー関数: ユーザーの全セッションを削除して返す
+func removeUserSessions(userID int) []*authSession {
+	removed, err := tokenVault.DeleteUser(userID)
 	if err != nil {
-		return nil, err
+		log.Printf("セッションの削除に失敗: %v", err)
 	}
-	
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("User-Agent", "tenkai-app")
+	return removed
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+// ヘルパー関数: リクエストからGitHubアクセストークンを解決
+// セッションID（Cookie / X-Tenkai-Session）を優先し、なければ従来の直接指定（本文 / Authorization）を使う
+func resolveAccessToken(c *gin.Context, legacyToken string) string {
+	if session := getSession(sessionIDFromRequest(c)); session != nil {
+		return session.AccessToken
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GitHub API error: %d", resp.StatusCode)
+	if legacyToken != "" {
+		return legacyToken
 	}
+	return bearerToken(c)
+}
 
-	var repos []GitHubRepository
-	if err := json.NewDecoder(resp.Body).Decode(&repos); err != nil {
-		return nil, err
+// ヘルパー関数: リクエストからセッションIDを取得（Cookie → X-Tenkai-Session）
+func sessionIDFromRequest(c *gin.Context) string {
+	if id, err := c.Cookie(sessionCookieName); err == nil && id != "" {
+		return id
 	}
+	return c.GetHeader("X-Tenkai-Session")
+}
 
-	return repos, nil
+// ヘルパー関数: Authorizationヘッダーからトークンを取得
+func bearerToken(c *gin.Context) string {
+	return strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
 }
 
-// ヘルパー関数: .tenkai-settings リポジトリの確保
-func ensureTenkaiSettingsRepo(accessToken, username string) error {
-	// リポジトリが存在するかチェック
-	repoURL := fmt.Sprintf("https://api.github.com/repos/%s/.tenkai-settings", username)
-	req, err := http.NewRequest("GET", repoURL, nil)
-	if err != nil {
-		return err
-	}
-	
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("User-Agent", "tenkai-app")
+// ヘルパー関数: セッションCookieを設定（maxAge < 0 で削除）
+func setSessionCookie(c *gin.Context, id string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookieName, id, maxAge, "/", "", true, true)
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	resp.Body.Close()
+// ヘルパー関数: GitHubのアクセストークンを失効
+func revokeGitHubToken(accessToken string) error {
+	return callGitHubApplicationsAPI("token", accessToken)
+}
 
-	if resp.StatusCode == http.StatusOK {
-		// リポジトリが既に存在する
-		return nil
-	}
+// ヘルパー関数: GitHubの認可そのものを取り消し（そのユーザーの全トークンが無効になる）
+func revokeGitHubGrant(accessToken string) error {
+	return callGitHubApplicationsAPI("grant", accessToken)
+}
 
-	// リポジトリを作成
-	createData := map[string]interface{}{
-		"name":        ".tenkai-settings",
-		"description": "tenkai editor settings",
-		"private":     true,
-		"auto_init":   true,
+// ヘルパー関数: GitHub Applications APIへのDELETE呼び出し
+func callGitHubApplicationsAPI(kind, accessToken string) error {
+	clientID := config.GitHub.ClientID
+	clientSecret := config.GitHub.ClientSecret
+	if clientID == "" || clientSecret == "" {
+		return fmt.Errorf("OAuth設定が不足しています")
 	}
 
-	createJSON, err := json.Marshal(createData)
+	body, err := json.Marshal(map[string]string{"access_token": accessToken})
 	if err != nil {
 		return err
 	}
 
-	createURL := "https://api.github.com/user/repos"
-	req, err = http.NewRequest("POST", createURL, strings.NewReader(string(createJSON)))
+	apiURL := fmt.Sprintf("https://api.github.com/applications/%s/%s", clientID, kind)
+	req, err := http.NewRequest("DELETE", apiURL, strings.NewReader(string(body)))
 	if err != nil {
 		return err
 	}
-	
-	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	req.SetBasicAuth(clientID, clientSecret)
+	req.Header.Set("Accept", "application/vnd.github+json")
 	req.Header.Set("User-Agent", "tenkai-app")
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err = client.Do(req)
+	client := &http.Client{}
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to create repository: %d, %s", resp.StatusCode, string(body))
+	// 404は既に失効済み
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("GitHub API error: %d, %s", resp.StatusCode, string(respBody))
 	}
 
 	return nil
 }
 
-// ヘルパー関数: ファイルのSHA取得
-func getFileSHA(accessToken, username, filename string) (string, error) {
-	fileURL := fmt.Sprintf("https://api.github.com/repos/%s/.tenkai-settings/contents/%s", username, filename)
-	req, err := http.NewRequest("GET", fileURL, nil)
-	if err != nil {
-		return "", err
+// GitHub設定管理: 設定取得
+func handleGetSettings(c *gin.Context) {
+	accessToken := resolveAccessToken(c, "")
+	if accessToken == "" {
+		c.JSON(http.StatusUnauthorized, Response{
+			Success: false,
+			Message: "認証が必要です",
+		})
+		return
 	}
-	
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("User-Agent", "tenkai-app")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	// ユーザー情報を取得
+	user, err := getGitHubUser(accessToken)
 	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("file not found")
-	}
-
-	var file GitHubFile
-	if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
-		return "", err
-	}
-
-	return file.SHA, nil
-}
-
-// 草案提出（コミット）
-func handleSouanTeishutsu(c *gin.Context) {
-	var req SouanTeishutsuRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, Response{
+		c.JSON(http.StatusUnauthorized, Response{
 			Success: false,
-			Message: "リクエストが不正です",
+			Message: "GitHubユーザー情報の取得に失敗しました",
 			Error:   err.Error(),
 		})
 		return
 	}
 
-	// ブランチの設定（デフォルト: main）
-	branch := req.Branch
-	if branch == "" {
-		branch = "main"
-	}
-
-	// 各ファイルをコミット
-	for _, file := range req.Files {
-		// ファイルの内容をBase64エンコード
-		contentEncoded := base64.StdEncoding.EncodeToString([]byte(file.Content))
-		
-		// 既存ファイルのSHAを取得
-		existingSHA := ""
-		fileURL := fmt.Sprintf("https://api.github.com/repos/%s/contents/%s", req.Repository, file.Path)
-		getReq, _ := http.NewRequest("GET", fileURL+"?ref="+branch, nil)
-		getReq.Header.Set("Authorization", "Bearer "+req.AccessToken)
-		getReq.Header.Set("User-Agent", "tenkai-app")
-		
-		client := &http.Client{}
-		getResp, err := client.Do(getReq)
-		if err == nil && getResp.StatusCode == http.StatusOK {
-			defer getResp.Body.Close()
-			var existingFile GitHubFile
-			if json.NewDecoder(getResp.Body).Decode(&existingFile) == nil {
-				existingSHA = existingFile.SHA
-			}
-		}
-		
-		// ファイルを更新/作成
-		updateData := map[string]interface{}{
-			"message": req.Message,
-			"content": contentEncoded,
-			"branch":  branch,
-		}
-		
-		if existingSHA != "" {
-			updateData["sha"] = existingSHA
-		}
-		
-		updateJSON, _ := json.Marshal(updateData)
-		
-		putReq, _ := http.NewRequest("PUT", fileURL, strings.NewReader(string(updateJSON)))
-		putReq.Header.Set("Authorization", "Bearer "+req.AccessToken)
-		putReq.Header.Set("User-Agent", "tenkai-app")
-		putReq.Header.Set("Content-Type", "application/json")
-		
-		putResp, err := client.Do(putReq)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, Response{
-				Success: false,
-				Message: "ファイルのコミットに失敗しました",
-				Error:   err.Error(),
-			})
-			return
+	// .tenkai-settings リポジトリから設定を取得
+	settings, err := getTenkaiSettings(accessToken, user.Login)
+	if err != nil {
+		// 設定が存在しない場合はデフォルト設定を返す
+		defaultSettings := TenkaiSettings{
+			Version:        "1.0",
+			CharsPerLine:   defaultCharsPerLine,
+			LinesPerPage:   defaultLinesPerPage,
+			WritingMode:    "vertical",
+			Theme:          "light",
+			Repositories:   []string{},
+			ActiveRepo:     "",
+			CustomSettings: make(map[string]interface{}),
+			LastUpdated:    time.Now().Format(time.RFC3339),
 		}
-		defer putResp.Body.Close()
 		
-		if putResp.StatusCode != http.StatusOK && putResp.StatusCode != http.StatusCreated {
-			body, _ := io.ReadAll(putResp.Body)
-			c.JSON(http.StatusInternalServerError, Response{
-				Success: false,
-				Message: "ファイルのコミットに失敗しました",
-				Error:   string(body),
-			})
-			return
-		}
+		c.JSON(http.StatusOK, Response{
+			Success: true,
+			Message: "デフォルト設定を返しました",
+			Data:    defaultSettings,
+		})
+		return
 	}
 
 	c.JSON(http.StatusOK, Response{
 		Success: true,
-		Message: "草案を提出しました",
-		Data: map[string]interface{}{
-			"repository": req.Repository,
-			"branch":     branch,
-			"message":    req.Message,
-		},
+		Data:    settings,
 	})
 }
 
-// 草案一覧取得
-func handleSouanList(c *gin.Context) {
-	accessToken := c.GetHeader("Authorization")
-	repository := c.Query("repository")
-	
-	if accessToken == "" || repository == "" {
+// GitHub設定管理: 設定保存
+func handleSaveSettings(c *gin.Context) {
+	var req SettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, Response{
 			Success: false,
-			Message: "認証トークンとリポジトリ名が必要です",
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
 		})
 		return
 	}
-	
-	// "Bearer " プレフィックスを削除
-	if strings.HasPrefix(accessToken, "Bearer ") {
-		accessToken = strings.TrimPrefix(accessToken, "Bearer ")
-	}
 
-	// ブランチ一覧を取得
-	branchesURL := fmt.Sprintf("https://api.github.com/repos/%s/branches", repository)
-	req, _ := http.NewRequest("GET", branchesURL, nil)
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("User-Agent", "tenkai-app")
-	
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
+	accessToken := resolveAccessToken(c, req.AccessToken)
+	if accessToken == "" {
+		c.JSON(http.StatusUnauthorized, Response{
 			Success: false,
-			Message: "草案一覧の取得に失敗しました",
-			Error:   err.Error(),
+			Message: "認証が必要です",
 		})
 		return
 	}
-	defer resp.Body.Close()
-	
-	if resp.StatusCode != http.StatusOK {
-		c.JSON(http.StatusInternalServerError, Response{
+
+	// ユーザー情報を取得
+	user, err := getGitHubUser(accessToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, Response{
 			Success: false,
-			Message: "草案一覧の取得に失敗しました",
-			Error:   fmt.Sprintf("GitHub API error: %d", resp.StatusCode),
+			Message: "GitHubユーザー情報の取得に失敗しました",
+			Error:   err.Error(),
 		})
 		return
 	}
-	
-	var branches []map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&branches); err != nil {
+
+	// 設定に最終更新日時を設定
+	req.Settings.LastUpdated = time.Now().Format(time.RFC3339)
+
+	// .tenkai-settings リポジトリに設定を保存
+	err = saveTenkaiSettings(accessToken, user.Login, req.Settings)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{
 			Success: false,
-			Message: "レスポンスのパースに失敗しました",
+			Message: "設定の保存に失敗しました",
 			Error:   err.Error(),
 		})
 		return
 	}
-	
-	// 日本語化した草案情報を作成
-	souanList := make([]map[string]interface{}, len(branches))
-	for i, branch := range branches {
-		souanList[i] = map[string]interface{}{
-			"name":      branch["name"],
-			"protected": branch["protected"],
-			"commit":    branch["commit"],
-		}
-	}
-	
+
 	c.JSON(http.StatusOK, Response{
 		Success: true,
-		Data:    souanList,
+		Message: "設定を保存しました",
+		Data:    req.Settings,
 	})
 }
 
-// 草案作成
-func handleSouanCreate(c *gin.Context) {
-	var req SouanRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, Response{
+// GitHub設定管理: リポジトリ一覧取得
+func handleGetRepositories(c *gin.Context) {
+	accessToken := resolveAccessToken(c, "")
+	if accessToken == "" {
+		c.JSON(http.StatusUnauthorized, Response{
 			Success: false,
-			Message: "リクエストが不正です",
-			Error:   err.Error(),
+			Message: "認証が必要です",
 		})
 		return
 	}
 
-	// ベースブランチの設定（デフォルト: main）
-	baseBranch := req.BaseBranch
-	if baseBranch == "" {
-		baseBranch = "main"
-	}
-
-	// ベースブランチの最新コミットを取得
-	baseRefURL := fmt.Sprintf("https://api.github.com/repos/%s/git/refs/heads/%s", req.Repository, baseBranch)
-	getReq, _ := http.NewRequest("GET", baseRefURL, nil)
-	getReq.Header.Set("Authorization", "Bearer "+req.AccessToken)
-	getReq.Header.Set("User-Agent", "tenkai-app")
-	
-	client := &http.Client{}
-	getResp, err := client.Do(getReq)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Success: false,
-			Message: "ベースブランチの取得に失敗しました",
-			Error:   err.Error(),
-		})
-		return
-	}
-	defer getResp.Body.Close()
-	
-	var baseRef map[string]interface{}
-	if err := json.NewDecoder(getResp.Body).Decode(&baseRef); err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Success: false,
-			Message: "ベースブランチ情報のパースに失敗しました",
-			Error:   err.Error(),
-		})
-		return
-	}
-	
-	// 新しいブランチの参照を作成
-	createRefURL := fmt.Sprintf("https://api.github.com/repos/%s/git/refs", req.Repository)
-	createData := map[string]interface{}{
-		"ref": fmt.Sprintf("refs/heads/%s", req.Name),
-		"sha": baseRef["object"].(map[string]interface{})["sha"],
-	}
-	
-	createJSON, _ := json.Marshal(createData)
-	
-	postReq, _ := http.NewRequest("POST", createRefURL, strings.NewReader(string(createJSON)))
-	postReq.Header.Set("Authorization", "Bearer "+req.AccessToken)
-	postReq.Header.Set("User-Agent", "tenkai-app")
-	postReq.Header.Set("Content-Type", "application/json")
-	
-	postResp, err := client.Do(postReq)
+	// GitHubからリポジトリ一覧を取得
+	repos, err := getGitHubRepositories(accessToken)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{
 			Success: false,
-			Message: "草案の作成に失敗しました",
+			Message: "リポジトリ一覧の取得に失敗しました",
 			Error:   err.Error(),
 		})
 		return
 	}
-	defer postResp.Body.Close()
-	
-	if postResp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(postResp.Body)
-		c.JSON(http.StatusInternalServerError, Response{
-			Success: false,
-			Message: "草案の作成に失敗しました",
-			Error:   string(body),
-		})
-		return
-	}
-	
+
 	c.JSON(http.StatusOK, Response{
 		Success: true,
-		Message: fmt.Sprintf("草案「%s」を作成しました", req.Name),
-		Data: map[string]interface{}{
-			"repository": req.Repository,
-			"name":       req.Name,
-			"baseBranch": baseBranch,
-		},
+		Data:    repos,
 	})
 }
 
-// 草案切替
-func handleSouanSwitch(c *gin.Context) {
-	// このAPIはクライアント側で現在の作業ブランチを管理するため、
-	// サーバー側では特に処理は不要
-	var req SouanRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, Response{
-			Success: false,
-			Message: "リクエストが不正です",
-			Error:   err.Error(),
-		})
-		return
+// ヘルパー関数: GitHubユーザー情報取得
+func getGitHubUser(accessToken string) (*GitHubUser, error) {
+	userURL := "https://api.github.com/user"
+	req, err := http.NewRequest("GET", userURL, nil)
+	if err != nil {
+		return nil, err
 	}
 	
-	c.JSON(http.StatusOK, Response{
-		Success: true,
-		Message: fmt.Sprintf("草案「%s」に切り替えました", req.Name),
-		Data: map[string]interface{}{
-			"repository": req.Repository,
-			"name":       req.Name,
-		},
-	})
-}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", "tenkai-app")
 
-// 修正依頼（プルリクエスト作成）
-func handleShuseiIrai(c *gin.Context) {
-	var req ShuseiIraiRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, Response{
-			Success: false,
-			Message: "リクエストが不正です",
-			Error:   err.Error(),
-		})
-		return
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	// ベースブランチの設定（デフォルト: main）
-	baseBranch := req.BaseBranch
-	if baseBranch == "" {
-		baseBranch = "main"
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GitHub API error: %d", resp.StatusCode)
 	}
 
-	// プルリクエストを作成
-	prURL := fmt.Sprintf("https://api.github.com/repos/%s/pulls", req.Repository)
-	prData := map[string]interface{}{
-		"title": req.Title,
-		"body":  req.Description,
-		"head":  req.Branch,
-		"base":  baseBranch,
+	var user GitHubUser
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// ヘルパー関数: Tenkai設定取得
+func getTenkaiSettings(accessToken, username string) (*TenkaiSettings, error) {
+	// .tenkai-settings リポジトリから settings.json を取得
+	content, _, err := getSettingsRepoFile(accessToken, username, "settings.json")
+	if errors.Is(err, errSettingsFileNotFound) {
+		return nil, fmt.Errorf("settings not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var settings TenkaiSettings
+	if err := json.Unmarshal(content, &settings); err != nil {
+		return nil, err
+	}
+
+	return &settings, nil
+}
+
+// ヘルパー関数: Tenkai設定保存
+func saveTenkaiSettings(accessToken, username string, settings TenkaiSettings) error {
+	// 設定をJSONに変換
+	settingsJSON, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// .tenkai-settings リポジトリが存在しない場合は作成
+	err = ensureTenkaiSettingsRepo(accessToken, username)
+	if err != nil {
+		return err
+	}
+
+	// 既存ファイルのSHAを取得（更新の場合。なければ新規作成）
+	existingSHA, _ := getFileSHA(accessToken, username, "settings.json")
+
+	// ファイルを更新/作成
+	if err := putSettingsRepoFile(accessToken, username, "settings.json", settingsJSON, existingSHA, "tenkai設定を更新"); err != nil {
+		return err
+	}
+
+	forgetUserSettings(accessToken)
+	return nil
+}
+
+// ヘルパー関数: GitHubリポジトリ一覧取得
+func getGitHubRepositories(accessToken string) ([]GitHubRepository, error) {
+	reposURL := "https://api.github.com/user/repos?sort=updated&per_page=100"
+	req, err := http.NewRequest("GET", reposURL, nil)
+	if err != nil {
+		return nil, err
 	}
 	
-	prJSON, _ := json.Marshal(prData)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", "tenkai-app")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GitHub API error: %d", resp.StatusCode)
+	}
+
+	var repos []GitHubRepository
+	if err := json.NewDecoder(resp.Body).Decode(&repos); err != nil {
+		return nil, err
+	}
+
+	return repos, nil
+}
+
+// ヘルパー関数: .tenkai-settings リポジトリの確保
+func ensureTenkaiSettingsRepo(accessToken, username string) error {
+	// リポジトリが存在するかチェック
+	repoURL := fmt.Sprintf("https://api.github.com/repos/%s/.tenkai-settings", username)
+	req, err := http.NewRequest("GET", repoURL, nil)
+	if err != nil {
+		return err
+	}
 	
-	prReq, _ := http.NewRequest("POST", prURL, strings.NewReader(string(prJSON)))
-	prReq.Header.Set("Authorization", "Bearer "+req.AccessToken)
-	prReq.Header.Set("User-Agent", "tenkai-app")
-	prReq.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", "tenkai-app")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		// リポジトリが既に存在する
+		return nil
+	}
+
+	// リポジトリを作成
+	createData := map[string]interface{}{
+		"name":        ".tenkai-settings",
+		"description": "tenkai editor settings",
+		"private":     true,
+		"auto_init":   true,
+	}
+
+	createJSON, err := json.Marshal(createData)
+	if err != nil {
+		return err
+	}
+
+	createURL := "https://api.github.com/user/repos"
+	req, err = http.NewRequest("POST", createURL, strings.NewReader(string(createJSON)))
+	if err != nil {
+		return err
+	}
 	
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", "tenkai-app")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err = client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to create repository: %d, %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// ヘルパー関数: ファイルのSHA取得
+func getFileSHA(accessToken, username, filename string) (string, error) {
+	_, sha, err := getSettingsRepoFile(accessToken, username, filename)
+	if err != nil {
+		return "", fmt.Errorf("file not found")
+	}
+	return sha, nil
+}
+
+// .tenkai-settings のファイルが存在しない
+var errSettingsFileNotFound = errors.New("settings file not found")
+
+// ヘルパー関数: .tenkai-settings リポジトリのファイルを取得（内容とSHA）
+func getSettingsRepoFile(accessToken, username, filename string) ([]byte, string, error) {
+	fileURL := fmt.Sprintf("https://api.github.com/repos/%s/.tenkai-settings/contents/%s", username, filename)
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", "tenkai-app")
+
 	client := &http.Client{}
-	prResp, err := client.Do(prReq)
+	resp, err := client.Do(req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", errSettingsFileNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("GitHub API error: %d", resp.StatusCode)
+	}
+
+	var file GitHubFile
+	if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
+		return nil, "", err
+	}
+
+	content, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(file.Content, "\n", ""))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return content, file.SHA, nil
+}
+
+// ヘルパー関数: .tenkai-settings リポジトリのファイルを作成/更新（sha が空なら新規作成）
+func putSettingsRepoFile(accessToken, username, filename string, content []byte, sha, message string) error {
+	fileURL := fmt.Sprintf("https://api.github.com/repos/%s/.tenkai-settings/contents/%s", username, filename)
+
+	updateData := map[string]interface{}{
+		"message": message,
+		"content": base64.StdEncoding.EncodeToString(content),
+	}
+	if sha != "" {
+		updateData["sha"] = sha
+	}
+
+	updateJSON, err := json.Marshal(updateData)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", fileURL, strings.NewReader(string(updateJSON)))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", "tenkai-app")
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("GitHub API error: %d, %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// 草案提出（コミット）
+func handleSouanTeishutsu(c *gin.Context) {
+	var req SouanTeishutsuRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
 			Success: false,
-			Message: "修正依頼の作成に失敗しました",
+			Message: "リクエストが不正です",
 			Error:   err.Error(),
 		})
 		return
 	}
-	defer prResp.Body.Close()
-	
-	if prResp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(prResp.Body)
-		c.JSON(http.StatusInternalServerError, Response{
+
+	accessToken := resolveAccessToken(c, req.AccessToken)
+	if accessToken == "" {
+		c.JSON(http.StatusUnauthorized, Response{
 			Success: false,
-			Message: "修正依頼の作成に失敗しました",
-			Error:   string(body),
+			Message: "認証が必要です",
 		})
 		return
 	}
-	
-	var prResult map[string]interface{}
-	if err := json.NewDecoder(prResp.Body).Decode(&prResult); err != nil {
+
+	// ブランチの設定（デフォルト: main）
+	branch := req.Branch
+	if branch == "" {
+		branch = "main"
+	}
+
+	// 各ファイルをコミット
+	committed, err := putGitHubFiles(accessToken, req.Repository, branch, req.Message, req.Files)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{
 			Success: false,
-			Message: "レスポンスのパースに失敗しました",
+			Message: "ファイルのコミットに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "草案を提出しました",
+		Data: map[string]interface{}{
+			"repository":     req.Repository,
+			"branch":         branch,
+			"message":        req.Message,
+			"committedFiles": committed,
+		},
+	})
+}
+
+// ヘルパー関数：ファイルをGitHubのブランチにコミットする（内容が同じファイルは送らない）。送った件数を返す
+func putGitHubFiles(accessToken, repository, branch, message string, files []SouanFile) (int, error) {
+	client := &http.Client{}
+	put := 0
+	for _, file := range files {
+		// 既存ファイルのSHAを取得
+		existingSHA := ""
+		fileURL := fmt.Sprintf("https://api.github.com/repos/%s/contents/%s", repository, escapeURLPath(file.Path))
+		getReq, err := http.NewRequest("GET", fileURL+"?ref="+url.QueryEscape(branch), nil)
+		if err != nil {
+			return put, err
+		}
+		getReq.Header.Set("Authorization", "Bearer "+accessToken)
+		getReq.Header.Set("User-Agent", "tenkai-app")
+
+		if getResp, err := client.Do(getReq); err == nil {
+			if getResp.StatusCode == http.StatusOK {
+				var existingFile GitHubFile
+				if json.NewDecoder(getResp.Body).Decode(&existingFile) == nil {
+					existingSHA = existingFile.SHA
+				}
+			}
+			getResp.Body.Close()
+		}
+
+		// GitHubのSHAはgitのblobのハッシュなので、一致すれば内容は同じ
+		if existingSHA != "" && existingSHA == plumbing.ComputeHash(plumbing.BlobObject, []byte(file.Content)).String() {
+			continue
+		}
+
+		// ファイルを更新/作成
+		updateData := map[string]interface{}{
+			"message": message,
+			"content": base64.StdEncoding.EncodeToString([]byte(file.Content)),
+			"branch":  branch,
+		}
+		if existingSHA != "" {
+			updateData["sha"] = existingSHA
+		}
+		updateJSON, _ := json.Marshal(updateData)
+
+		putReq, err := http.NewRequest("PUT", fileURL, strings.NewReader(string(updateJSON)))
+		if err != nil {
+			return put, err
+		}
+		putReq.Header.Set("Authorization", "Bearer "+accessToken)
+		putReq.Header.Set("User-Agent", "tenkai-app")
+		putReq.Header.Set("Content-Type", "application/json")
+
+		putResp, err := client.Do(putReq)
+		if err != nil {
+			return put, err
+		}
+		body, _ := io.ReadAll(putResp.Body)
+		putResp.Body.Close()
+		if putResp.StatusCode != http.StatusOK && putResp.StatusCode != http.StatusCreated {
+			return put, fmt.Errorf("%s: %s", file.Path, string(body))
+		}
+		put++
+	}
+	return put, nil
+}
+
+// ヘルパー関数：パスの各部分をURLエスケープする（区切りの / は残す）
+func escapeURLPath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// ヘルパー関数：GitHubにブランチがなければ base から作成する。作成した場合は true を返す
+func ensureGitHubBranch(accessToken, repository, branch, base string) (bool, error) {
+	refURL := fmt.Sprintf("https://api.github.com/repos/%s/git/ref/heads/%s", repository, escapeURLPath(branch))
+	req, err := http.NewRequest("GET", refURL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", "tenkai-app")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return false, nil
+	case http.StatusNotFound:
+		return true, createGitHubBranch(accessToken, repository, branch, base)
+	default:
+		return false, fmt.Errorf("GitHub API error: %d", resp.StatusCode)
+	}
+}
+
+// ヘルパー関数：GitHubに base の最新コミットから新しいブランチを作成する
+func createGitHubBranch(accessToken, repository, name, base string) error {
+	// ベースブランチの最新コミットを取得
+	baseRefURL := fmt.Sprintf("https://api.github.com/repos/%s/git/refs/heads/%s", repository, escapeURLPath(base))
+	getReq, err := http.NewRequest("GET", baseRefURL, nil)
+	if err != nil {
+		return err
+	}
+	getReq.Header.Set("Authorization", "Bearer "+accessToken)
+	getReq.Header.Set("User-Agent", "tenkai-app")
+
+	client := &http.Client{}
+	getResp, err := client.Do(getReq)
+	if err != nil {
+		return fmt.Errorf("ベースブランチの取得に失敗しました: %v", err)
+	}
+	defer getResp.Body.Close()
+
+	if getResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ベースブランチ「%s」が見つかりません（GitHub API error: %d）", base, getResp.StatusCode)
+	}
+	var baseRef struct {
+		Object struct {
+			SHA string `json:"sha"`
+		} `json:"object"`
+	}
+	if err := json.NewDecoder(getResp.Body).Decode(&baseRef); err != nil {
+		return fmt.Errorf("ベースブランチ情報のパースに失敗しました: %v", err)
+	}
+
+	// 新しいブランチの参照を作成
+	createRefURL := fmt.Sprintf("https://api.github.com/repos/%s/git/refs", repository)
+	createJSON, _ := json.Marshal(map[string]interface{}{
+		"ref": fmt.Sprintf("refs/heads/%s", name),
+		"sha": baseRef.Object.SHA,
+	})
+
+	postReq, err := http.NewRequest("POST", createRefURL, strings.NewReader(string(createJSON)))
+	if err != nil {
+		return err
+	}
+	postReq.Header.Set("Authorization", "Bearer "+accessToken)
+	postReq.Header.Set("User-Agent", "tenkai-app")
+	postReq.Header.Set("Content-Type", "application/json")
+
+	postResp, err := client.Do(postReq)
+	if err != nil {
+		return err
+	}
+	defer postResp.Body.Close()
+
+	if postResp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(postResp.Body)
+		return errors.New(string(body))
+	}
+	return nil
+}
+
+// 草案一覧取得
+func handleSouanList(c *gin.Context) {
+	accessToken := resolveAccessToken(c, "")
+	repository := c.Query("repository")
+	
+	if accessToken == "" || repository == "" {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "認証トークンとリポジトリ名が必要です",
+		})
+		return
+	}
+
+	// ブランチ一覧を取得
+	branchesURL := fmt.Sprintf("https://api.github.com/repos/%s/branches", repository)
+	req, _ := http.NewRequest("GET", branchesURL, nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", "tenkai-app")
+	
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "草案一覧の取得に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode != http.StatusOK {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "草案一覧の取得に失敗しました",
+			Error:   fmt.Sprintf("GitHub API error: %d", resp.StatusCode),
+		})
+		return
+	}
+	
+	var branches []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&branches); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "レスポンスのパースに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+	
+	// 日本語化した草案情報を作成
+	souanList := make([]map[string]interface{}, len(branches))
+	for i, branch := range branches {
+		souanList[i] = map[string]interface{}{
+			"name":      branch["name"],
+			"protected": branch["protected"],
+			"commit":    branch["commit"],
+		}
+	}
+	
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    souanList,
+	})
+}
+
+// 草案作成
+func handleSouanCreate(c *gin.Context) {
+	var req SouanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	accessToken := resolveAccessToken(c, req.AccessToken)
+	if accessToken == "" {
+		c.JSON(http.StatusUnauthorized, Response{
+			Success: false,
+			Message: "認証が必要です",
+		})
+		return
+	}
+
+	// ベースブランチの設定（デフォルト: main）
+	baseBranch := req.BaseBranch
+	if baseBranch == "" {
+		baseBranch = "main"
+	}
+
+	// ベースブランチの最新コミットから新しいブランチを作成
+	if err := createGitHubBranch(accessToken, req.Repository, req.Name, baseBranch); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "草案の作成に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("草案「%s」を作成しました", req.Name),
+		Data: map[string]interface{}{
+			"repository": req.Repository,
+			"name":       req.Name,
+			"baseBranch": baseBranch,
+		},
+	})
+}
+
+// 草案切替
+func handleSouanSwitch(c *gin.Context) {
+	// このAPIはクライアント側で現在の作業ブランチを管理するため、
+	// サーバー側では特に処理は不要
+	var req SouanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+	
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("草案「%s」に切り替えました", req.Name),
+		Data: map[string]interface{}{
+			"repository": req.Repository,
+			"name":       req.Name,
+		},
+	})
+}
+
+// 修正依頼（プルリクエスト作成）
+func handleShuseiIrai(c *gin.Context) {
+	var req ShuseiIraiRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	accessToken := resolveAccessToken(c, req.AccessToken)
+	if accessToken == "" {
+		c.JSON(http.StatusUnauthorized, Response{
+			Success: false,
+			Message: "認証が必要です",
+		})
+		return
+	}
+
+	// ベースブランチの設定（デフォルト: main）
+	baseBranch := req.BaseBranch
+	if baseBranch == "" {
+		baseBranch = "main"
+	}
+
+	// 未入力のタイトル・説明文をAIで下書き
+	if req.GenerateDescription && (req.Title == "" || req.Description == "") {
+		title, description, err := draftIraiDescription(c, accessToken, req.Repository, baseBranch, req.Branch, "shusei", req.Provider, req.Model)
+		if err != nil {
+			respondAIError(c, http.StatusInternalServerError, "説明文の下書きに失敗しました", err)
+			return
+		}
+		if req.Title == "" {
+			req.Title = title
+		}
+		if req.Description == "" {
+			req.Description = description
+		}
+	}
+	if req.Title == "" {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "タイトルを入力してください（generate_description を指定するとAIで下書きします）",
+		})
+		return
+	}
+
+	// プルリクエストを作成
+	prResult, err := createPullRequest(accessToken, req.Repository, req.Branch, baseBranch, req.Title, req.Description, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "修正依頼の作成に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "修正依頼を作成しました",
+		Data: map[string]interface{}{
+			"repository": req.Repository,
+			"pullRequestNumber": prResult["number"],
+			"pullRequestURL": prResult["html_url"],
+		},
+	})
+}
+
+// 校正依頼（レビュワー付きプルリクエスト作成）
+func handleKouseiIrai(c *gin.Context) {
+	var req KouseiIraiRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	accessToken := resolveAccessToken(c, req.AccessToken)
+	if accessToken == "" {
+		c.JSON(http.StatusUnauthorized, Response{
+			Success: false,
+			Message: "認証が必要です",
+		})
+		return
+	}
+
+	// ベースブランチの設定（デフォルト: main）
+	baseBranch := req.BaseBranch
+	if baseBranch == "" {
+		baseBranch = "main"
+	}
+
+	// 未入力のタイトル・説明文をAIで下書き
+	if req.GenerateDescription && (req.Title == "" || req.Description == "") {
+		title, description, err := draftIraiDescription(c, accessToken, req.Repository, baseBranch, req.Branch, "kousei", req.Provider, req.Model)
+		if err != nil {
+			respondAIError(c, http.StatusInternalServerError, "説明文の下書きに失敗しました", err)
+			return
+		}
+		if req.Title == "" {
+			req.Title = title
+		}
+		if req.Description == "" {
+			req.Description = description
+		}
+	}
+	if req.Title == "" {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "タイトルを入力してください（generate_description を指定するとAIで下書きします）",
+		})
+		return
+	}
+
+	// プルリクエストを作成し、レビュワーを追加
+	prResult, err := createPullRequest(accessToken, req.Repository, req.Branch, baseBranch, req.Title, req.Description+"\n\n📝 校正をお願いします", req.Reviewers)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "校正依頼の作成に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "校正依頼を作成しました",
+		Data: map[string]interface{}{
+			"repository": req.Repository,
+			"pullRequestNumber": prResult["number"],
+			"pullRequestURL": prResult["html_url"],
+			"reviewers": req.Reviewers,
+		},
+	})
+}
+
+// ヘルパー関数：プルリクエストを作成し、指定があればレビュワーを追加する
+func createPullRequest(accessToken, repository, head, base, title, body string, reviewers []string) (map[string]interface{}, error) {
+	prURL := fmt.Sprintf("https://api.github.com/repos/%s/pulls", repository)
+	prData := map[string]interface{}{
+		"title": title,
+		"body":  body,
+		"head":  head,
+		"base":  base,
+	}
+
+	prJSON, _ := json.Marshal(prData)
+
+	prReq, _ := http.NewRequest("POST", prURL, strings.NewReader(string(prJSON)))
+	prReq.Header.Set("Authorization", "Bearer "+accessToken)
+	prReq.Header.Set("User-Agent", "tenkai-app")
+	prReq.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	prResp, err := client.Do(prReq)
+	if err != nil {
+		return nil, err
+	}
+	defer prResp.Body.Close()
+
+	if prResp.StatusCode != http.StatusCreated {
+		respBody, _ := io.ReadAll(prResp.Body)
+		return nil, errors.New(string(respBody))
+	}
+
+	var prResult map[string]interface{}
+	if err := json.NewDecoder(prResp.Body).Decode(&prResult); err != nil {
+		return nil, fmt.Errorf("レスポンスのパースに失敗しました: %v", err)
+	}
+
+	// レビュワーを追加
+	if len(reviewers) > 0 {
+		reviewURL := fmt.Sprintf("https://api.github.com/repos/%s/pulls/%v/requested_reviewers",
+			repository, prResult["number"])
+		reviewJSON, _ := json.Marshal(map[string]interface{}{
+			"reviewers": reviewers,
+		})
+
+		reviewReq, _ := http.NewRequest("POST", reviewURL, strings.NewReader(string(reviewJSON)))
+		reviewReq.Header.Set("Authorization", "Bearer "+accessToken)
+		reviewReq.Header.Set("User-Agent", "tenkai-app")
+		reviewReq.Header.Set("Content-Type", "application/json")
+
+		reviewResp, err := client.Do(reviewReq)
+		if err != nil {
+			// レビュワー追加に失敗してもPRは作成されているので、警告のみ
+			log.Printf("レビュワーの追加に失敗: %v", err)
+		} else {
+			reviewResp.Body.Close()
+		}
+	}
+	return prResult, nil
+}
+
+// リポジトリ情報取得
+func handleRepositoryInfo(c *gin.Context) {
+	accessToken := resolveAccessToken(c, "")
+	repository := c.Query("repository")
+	
+	if accessToken == "" || repository == "" {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "認証トークンとリポジトリ名が必要です",
+		})
+		return
+	}
+
+	// リポジトリ情報を取得
+	repoURL := fmt.Sprintf("https://api.github.com/repos/%s", repository)
+	req, _ := http.NewRequest("GET", repoURL, nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", "tenkai-app")
+	
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "リポジトリ情報の取得に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode != http.StatusOK {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "リポジトリ情報の取得に失敗しました",
+			Error:   fmt.Sprintf("GitHub API error: %d", resp.StatusCode),
+		})
+		return
+	}
+	
+	var repoInfo map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&repoInfo); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "レスポンスのパースに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+	
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    repoInfo,
+	})
+}
+
+// ===== トークン保管庫 =====
+
+// 保管庫に保存されるセッション（トークンは暗号化済み）
+type storedSession struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	Login      string    `json:"login"`
+	KeyID      string    `json:"key_id"`
+	Ciphertext string    `json:"ciphertext"` // base64(nonce + AES-GCM暗号文)
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// セッションの永続化先
+type TokenStore interface {
+	Save(s *storedSession) error
+	Load(id string) (*storedSession, error) // 存在しない場合は nil, nil
+	Delete(id string) error
+	List() ([]*storedSession, error)
+}
+
+// メモリ上の保存先（再起動で消える）
+type memoryTokenStore struct {
+	mu       sync.Mutex
+	sessions map[string]*storedSession
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{sessions: make(map[string]*storedSession)}
+}
+
+func (m *memoryTokenStore) Save(s *storedSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	purgeExpiredSessions(m.sessions, time.Now())
+	copied := *s
+	m.sessions[s.ID] = &copied
+	return nil
+}
+
+func (m *memoryTokenStore) Load(id string) (*storedSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	copied := *s
+	return &copied, nil
+}
+
+func (m *memoryTokenStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memoryTokenStore) List() ([]*storedSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*storedSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		copied := *s
+		list = append(list, &copied)
+	}
+	return list, nil
+}
+
+// JSONファイルへの保存先（最初に読み込んだ内容をメモリに持ち、書き込みのたびにファイル全体を置き換える）
+type fileTokenStore struct {
+	mu       sync.Mutex
+	path     string
+	sessions map[string]*storedSession // nil の間はまだ読み込んでいない
+}
+
+func newFileTokenStore(path string) *fileTokenStore {
+	return &fileTokenStore{path: path}
+}
+
+func (f *fileTokenStore) read() (map[string]*storedSession, error) {
+	if f.sessions != nil {
+		return f.sessions, nil
+	}
+	sessions := make(map[string]*storedSession)
+	data, err := os.ReadFile(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &sessions); err != nil {
+			return nil, err
+		}
+	}
+	f.sessions = sessions
+	return sessions, nil
+}
+
+func (f *fileTokenStore) write(sessions map[string]*storedSession) error {
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return err
+	}
+	f.sessions = sessions
+	return nil
+}
+
+func (f *fileTokenStore) Save(s *storedSession) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, err := f.read()
+	if err != nil {
+		return err
+	}
+	// 書き込みに失敗してもメモリ上の内容が変わらないように、写しを変更して保存する
+	sessions := make(map[string]*storedSession, len(current)+1)
+	for id, stored := range current {
+		sessions[id] = stored
+	}
+	purgeExpiredSessions(sessions, time.Now())
+	copied := *s
+	sessions[s.ID] = &copied
+	return f.write(sessions)
+}
+
+func (f *fileTokenStore) Load(id string) (*storedSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sessions, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	s, ok := sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	copied := *s
+	return &copied, nil
+}
+
+func (f *fileTokenStore) Delete(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, err := f.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := current[id]; !ok {
+		return nil
+	}
+	sessions := make(map[string]*storedSession, len(current))
+	for sid, stored := range current {
+		if sid != id {
+			sessions[sid] = stored
+		}
+	}
+	return f.write(sessions)
+}
+
+func (f *fileTokenStore) List() ([]*storedSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sessions, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*storedSession, 0, len(sessions))
+	for _, s := range sessions {
+		copied := *s
+		list = append(list, &copied)
+	}
+	return list, nil
+}
+
+// ヘルパー関数: 期限切れのセッションを取り除く（保存のたびに呼び、保管庫が増え続けないようにする）
+func purgeExpiredSessions(sessions map[string]*storedSession, now time.Time) {
+	for id, s := range sessions {
+		if now.After(s.ExpiresAt) {
+			delete(sessions, id)
+		}
+	}
+}
+
+// アクセストークンを暗号化して保管する。ハンドラーにはセッションIDだけを見せる
+type TokenVault struct {
+	store     TokenStore
+	keys      map[string]cipher.AEAD
+	primaryID string
+}
+
+// トークン保管庫の作成。旧鍵で暗号化されたセッションは現在の鍵で暗号化し直す
+func newTokenVault(cfg VaultConfig) (*TokenVault, error) {
+	keys, primaryID, err := parseVaultKeys(cfg.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	if primaryID == "" {
+		// 鍵の指定がない場合は起動ごとの一時鍵を使う（メモリ保存のみ）
+		log.Println("TOKEN_ENCRYPTION_KEYS が設定されていないため、一時的な暗号鍵を使用します")
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		primaryID = "ephemeral"
+		keys[primaryID] = aead
+	}
+
+	var store TokenStore
+	switch cfg.Store {
+	case "file":
+		store = newFileTokenStore(cfg.Path)
+	default:
+		store = newMemoryTokenStore()
+	}
+
+	v := &TokenVault{store: store, keys: keys, primaryID: primaryID}
+
+	rotated, err := v.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	if rotated > 0 {
+		log.Printf("%d件のセッションを新しい鍵で暗号化し直しました", rotated)
+	}
+	return v, nil
+}
+
+// ヘルパー関数: "鍵ID:base64" 形式の鍵リストを解析（先頭が現在の鍵）
+func parseVaultKeys(specs []string) (map[string]cipher.AEAD, string, error) {
+	keys := make(map[string]cipher.AEAD)
+	primaryID := ""
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(spec, ":")
+		if !ok || id == "" {
+			return nil, "", fmt.Errorf("鍵は \"鍵ID:base64\" 形式で指定してください / key must be \"id:base64\"")
+		}
+		if _, dup := keys[id]; dup {
+			return nil, "", fmt.Errorf("鍵IDが重複しています / duplicate key id: %s", id)
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, "", fmt.Errorf("鍵 %s のbase64が不正です / key %s is not valid base64", id, id)
+		}
+		if len(raw) != 32 {
+			return nil, "", fmt.Errorf("鍵 %s は32バイトである必要があります / key %s must be 32 bytes", id, id)
+		}
+		aead, err := newAEAD(raw)
+		if err != nil {
+			return nil, "", err
+		}
+		keys[id] = aead
+		if primaryID == "" {
+			primaryID = id
+		}
+	}
+	return keys, primaryID, nil
+}
+
+// ヘルパー関数: AES-256-GCMの作成
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// トークンの暗号化（セッションIDを追加認証データとして束縛する）
+func (v *TokenVault) encrypt(sessionID, token string) (string, error) {
+	aead := v.keys[v.primaryID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(token), []byte(sessionID))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// トークンの復号
+func (v *TokenVault) decrypt(s *storedSession) (string, error) {
+	aead, ok := v.keys[s.KeyID]
+	if !ok {
+		return "", fmt.Errorf("unknown key id: %s", s.KeyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(s.Ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(s.ID))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// セッションを保存
+func (v *TokenVault) Put(session *authSession) error {
+	ciphertext, err := v.encrypt(session.ID, session.AccessToken)
+	if err != nil {
+		return err
+	}
+	return v.store.Save(&storedSession{
+		ID:         session.ID,
+		UserID:     session.UserID,
+		Login:      session.Login,
+		KeyID:      v.primaryID,
+		Ciphertext: ciphertext,
+		CreatedAt:  session.CreatedAt,
+		ExpiresAt:  session.ExpiresAt,
+	})
+}
+
+// セッションを取得して復号（存在しない・期限切れは nil）
+func (v *TokenVault) Get(id string) (*authSession, error) {
+	stored, err := v.store.Load(id)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		return nil, v.store.Delete(id)
+	}
+	return v.open(stored)
+}
+
+// セッションを削除
+func (v *TokenVault) Delete(id string) error {
+	return v.store.Delete(id)
+}
+
+// ユーザーの全セッションを削除し、削除したセッションを返す
+func (v *TokenVault) DeleteUser(userID int) ([]*authSession, error) {
+	list, err := v.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []*authSession
+	for _, stored := range list {
+		if stored.UserID != userID {
+			continue
+		}
+		if err := v.store.Delete(stored.ID); err != nil {
+			return removed, err
+		}
+		session, err := v.open(stored)
+		if err != nil {
+			// 復号できなくても削除は行う
+			log.Printf("セッション %s の復号に失敗: %v", stored.ID, err)
+			continue
+		}
+		removed = append(removed, session)
+	}
+	return removed, nil
+}
+
+// 旧鍵で暗号化されたセッションを現在の鍵で暗号化し直し、期限切れを掃除する
+func (v *TokenVault) Rotate() (int, error) {
+	list, err := v.store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	now := time.Now()
+	for _, stored := range list {
+		if now.After(stored.ExpiresAt) {
+			if err := v.store.Delete(stored.ID); err != nil {
+				return rotated, err
+			}
+			continue
+		}
+		if stored.KeyID == v.primaryID {
+			continue
+		}
+		session, err := v.open(stored)
+		if err != nil {
+			log.Printf("セッション %s を復号できないため破棄します: %v", stored.ID, err)
+			if err := v.store.Delete(stored.ID); err != nil {
+				return rotated, err
+			}
+			continue
+		}
+		if err := v.Put(session); err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+// ヘルパー関数: 保存形式から復号済みセッションへ
+func (v *TokenVault) open(stored *storedSession) (*authSession, error) {
+	token, err := v.decrypt(stored)
+	if err != nil {
+		return nil, err
+	}
+	return &authSession{
+		ID:          stored.ID,
+		UserID:      stored.UserID,
+		Login:       stored.Login,
+		AccessToken: token,
+		CreatedAt:   stored.CreatedAt,
+		ExpiresAt:   stored.ExpiresAt,
+	}, nil
+}
+
+// ===== AIプロバイダー =====
+
+// AI生成リクエスト
+type LLMRequest struct {
+	System      string   // システムプロンプト（任意）
+	Prompt      string   // ユーザープロンプト
+	Temperature *float32 // nilの場合はプロバイダーの既定値
+	MaxTokens   int      // 0の場合は制限なし
+}
+
+// AI生成結果
+type LLMResponse struct {
+	Text         string
+	InputTokens  int // プロバイダーが返した場合のみ（0は不明）
+	OutputTokens int
+}
+
+// すべてのAI機能が利用するプロバイダーのインターフェース
+type LLMProvider interface {
+	Name() string
+	Model() string
+	Generate(ctx context.Context, req LLMRequest) (*LLMResponse, error)
+	// 生成されたテキストを断片ごとに onChunk へ渡す。ctx のキャンセルで上流のリクエストも中断する
+	Stream(ctx context.Context, req LLMRequest, onChunk func(text string) error) error
+	// テキストのトークン数。正確に数えられないプロバイダーは概算を返す
+	CountTokens(ctx context.Context, text string) (int, error)
+}
+
+// 利用するAIプロバイダーの解決（リクエストやユーザー設定での指定 → 設定のデフォルト）
+func resolveLLM(providerName, modelName string) (LLMProvider, error) {
+	if providerName == "" {
+		providerName = config.AI.Provider
+	}
+
+	switch providerName {
+	case "gemini":
+		if genClient == nil {
+			return nil, fmt.Errorf("AI機能が初期化されていません")
+		}
+		if modelName == "" {
+			modelName = config.Gemini.Model
+		}
+		return &geminiProvider{client: genClient, model: modelName, temperature: config.Gemini.Temperature}, nil
+	case "openai":
+		cfg := config.AI.OpenAI
+		if cfg.BaseURL == "" {
+			return nil, fmt.Errorf("OpenAI互換APIのURLが設定されていません")
+		}
+		if modelName == "" {
+			modelName = cfg.Model
+		}
+		return &openAIProvider{baseURL: cfg.BaseURL, apiKey: cfg.APIKey, model: modelName, temperature: cfg.Temperature}, nil
+	case "fake":
+		if !config.AI.EnableFake {
+			return nil, fmt.Errorf("fake プロバイダーは開発・テスト用です（AI_ENABLE_FAKE=true で有効になります）")
+		}
+		if modelName == "" {
+			modelName = "fake"
+		}
+		return &fakeProvider{model: modelName}, nil
+	default:
+		return nil, fmt.Errorf("未対応のAIプロバイダーです: %s", providerName)
+	}
+}
+
+// Gemini API
+type geminiProvider struct {
+	client      *genai.Client
+	model       string
+	temperature float32
+}
+
+func (g *geminiProvider) Name() string  { return "gemini" }
+func (g *geminiProvider) Model() string { return g.model }
+
+// ヘルパー関数: リクエストに応じたGenerativeModelを作成
+func (g *geminiProvider) generativeModel(req LLMRequest) *genai.GenerativeModel {
+	m := g.client.GenerativeModel(g.model)
+	m.SetTemperature(g.temperature)
+	if req.Temperature != nil {
+		m.SetTemperature(*req.Temperature)
+	}
+	if req.MaxTokens > 0 {
+		m.SetMaxOutputTokens(int32(req.MaxTokens))
+	}
+	if req.System != "" {
+		m.SystemInstruction = &genai.Content{Parts: []genai.Part{genai.Text(req.System)}}
+	}
+	return m
+}
+
+func (g *geminiProvider) Generate(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	resp, err := g.generativeModel(req).GenerateContent(ctx, genai.Text(req.Prompt))
+	if err != nil {
+		return nil, err
+	}
+	return &LLMResponse{Text: geminiText(resp)}, nil
+}
+
+func (g *geminiProvider) Stream(ctx context.Context, req LLMRequest, onChunk func(text string) error) error {
+	iter := g.generativeModel(req).GenerateContentStream(ctx, genai.Text(req.Prompt))
+	for {
+		resp, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if text := geminiText(resp); text != "" {
+			if err := onChunk(text); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (g *geminiProvider) CountTokens(ctx context.Context, text string) (int, error) {
+	resp, err := g.client.GenerativeModel(g.model).CountTokens(ctx, genai.Text(text))
+	if err != nil {
+		return 0, err
+	}
+	return int(resp.TotalTokens), nil
+}
+
+// ヘルパー関数: Geminiのレスポンスからテキストを取り出す
+func geminiText(resp *genai.GenerateContentResponse) string {
+	var result string
+	for _, cand := range resp.Candidates {
+		if cand.Content != nil {
+			for _, part := range cand.Content.Parts {
+				if text, ok := part.(genai.Text); ok {
+					result += string(text)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// OpenAI互換API（OpenAI本体のほか、Ollama や llama.cpp のサーバーにも対応）
+type openAIProvider struct {
+	baseURL     string
+	apiKey      string
+	model       string
+	temperature float32
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIChatRequest struct {
+	Model       string          `json:"model"`
+	Messages    []openAIMessage `json:"messages"`
+	Temperature float32         `json:"temperature"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Stream      bool            `json:"stream,omitempty"`
+}
+
+type openAIChatResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+func (o *openAIProvider) Name() string  { return "openai" }
+func (o *openAIProvider) Model() string { return o.model }
+
+// ヘルパー関数: チャットリクエストの組み立て
+func (o *openAIProvider) chatRequest(req LLMRequest) openAIChatRequest {
+	var messages []openAIMessage
+	if req.System != "" {
+		messages = append(messages, openAIMessage{Role: "system", Content: req.System})
+	}
+	messages = append(messages, openAIMessage{Role: "user", Content: req.Prompt})
+
+	temperature := o.temperature
+	if req.Temperature != nil {
+		temperature = *req.Temperature
+	}
+	return openAIChatRequest{
+		Model:       o.model,
+		Messages:    messages,
+		Temperature: temperature,
+		MaxTokens:   req.MaxTokens,
+	}
+}
+
+// ヘルパー関数: /chat/completions へのPOST
+func (o *openAIProvider) post(ctx context.Context, body interface{}) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(o.baseURL, "/")+"/chat/completions", strings.NewReader(string(payload)))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if o.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+o.apiKey)
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("OpenAI API error: %d, %s", resp.StatusCode, string(respBody))
+	}
+	return resp, nil
+}
+
+func (o *openAIProvider) Generate(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	resp, err := o.post(ctx, o.chatRequest(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result openAIChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Choices) == 0 {
+		return nil, fmt.Errorf("OpenAI API returned no choices")
+	}
+	return &LLMResponse{
+		Text:         result.Choices[0].Message.Content,
+		InputTokens:  result.Usage.PromptTokens,
+		OutputTokens: result.Usage.CompletionTokens,
+	}, nil
+}
+
+// ストリーミング時の差分
+type openAIStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+}
+
+func (o *openAIProvider) Stream(ctx context.Context, req LLMRequest, onChunk func(text string) error) error {
+	body := o.chatRequest(req)
+	body.Stream = true
+	resp, err := o.post(ctx, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			return nil
+		}
+		var chunk openAIStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return err
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			if err := onChunk(choice.Delta.Content); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+func (o *openAIProvider) CountTokens(ctx context.Context, text string) (int, error) {
+	return estimateTokens(text), nil
+}
+
+// テスト用の決定的なプロバイダー（外部APIを呼ばない）
+type fakeProvider struct {
+	model string
+}
+
+func (f *fakeProvider) Name() string  { return "fake" }
+func (f *fakeProvider) Model() string { return f.model }
+
+func (f *fakeProvider) Generate(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(req.System + "\x00" + req.Prompt))
+	return &LLMResponse{
+		Text: fmt.Sprintf("[fake:%s] %x (%d文字)", f.model, sum[:4], len([]rune(req.Prompt))),
+	}, nil
+}
+
+func (f *fakeProvider) CountTokens(ctx context.Context, text string) (int, error) {
+	return estimateTokens(text), nil
+}
+
+func (f *fakeProvider) Stream(ctx context.Context, req LLMRequest, onChunk func(text string) error) error {
+	resp, err := f.Generate(ctx, req)
+	if err != nil {
+		return err
+	}
+	// 8文字ずつに分けて返す
+	runes := []rune(resp.Text)
+	for i := 0; i < len(runes); i += 8 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := i + 8
+		if end > len(runes) {
+			end = len(runes)
+		}
+		if err := onChunk(string(runes[i:end])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ===== AI校正（構造化） =====
+
+// 校正リクエスト
+type ProofreadRequest struct {
+	Text     string `json:"text" binding:"required"`
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	NoCache  bool   `json:"noCache"` // true の場合はキャッシュを使わずに校正し直す
+}
+
+// 校正の指摘1件（Start/End は文字単位のオフセットで、End は含まない）
+type ProofreadIssue struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"` // "typo", "grammar", "style", "notation", "consistency"
+	Start      int    `json:"start"`
+	End        int    `json:"end"`
+	Original   string `json:"original"`
+	Suggestion string `json:"suggestion"`
+	Reason     string `json:"reason"`
+	Source     string `json:"source"`           // "ai" または "rule"
+	RuleID     string `json:"ruleId,omitempty"` // Source = "rule" の場合のルールID
+}
+
+// 校正結果の反映リクエスト
+type ProofreadApplyRequest struct {
+	Path    string           `json:"path" binding:"required"` // 作業ディレクトリからの相対パス
+	Issues  []ProofreadIssue `json:"issues" binding:"required"`
+	Message string           `json:"message"`
+}
+
+// 指摘の種類
+var proofreadIssueTypes = map[string]bool{
+	"typo":        true,
+	"grammar":     true,
+	"style":       true,
+	"notation":    true,
+	"consistency": true,
+}
+
+// AIの出力が壊れていた場合に修復を依頼する回数
+const proofreadRepairAttempts = 1
+
+// AI校正（指摘を文字位置付きのJSONで返す）
+func handleAIProofread(c *gin.Context) {
+	var req ProofreadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	provider, err := resolveLLMForRequest(c, req.Provider, req.Model)
+	if err != nil {
+		respondAIError(c, http.StatusBadRequest, "AI機能が初期化されていません", err)
+		return
+	}
+
+	// 校正結果は検証済みの指摘をJSONでキャッシュする
+	cacheKey := aiCacheKey{
+		Provider: provider.Name(),
+		Model:    provider.Model(),
+		Template: "proofread",
+		Version:  proofreadPromptVersion,
+		Input:    req.Text,
+	}
+	var issues []ProofreadIssue
+	cached := false
+	if !req.NoCache {
+		if data, ok := aiCache.Get(cacheKey); ok && json.Unmarshal([]byte(data), &issues) == nil {
+			cached = true
+		}
+	}
+	if !cached {
+		// 青空文庫形式の注記はAIに渡さず、本文だけを校正して元の位置に戻す
+		plain, offsets := parseAozora(req.Text).PlainText()
+		issues, err = proofreadWithAI(c.Request.Context(), provider, plain)
+		if err != nil {
+			respondAIError(c, http.StatusInternalServerError, "AI校正に失敗しました", err)
+			return
+		}
+		issues = mapProofreadIssues(req.Text, issues, offsets)
+		if data, err := json.Marshal(issues); err == nil {
+			aiCache.Put(cacheKey, string(data))
+		}
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("%d件の指摘があります", len(issues)),
+		Data: map[string]interface{}{
+			"issues":   issues,
+			"provider": provider.Name(),
+			"model":    provider.Model(),
+			"cached":   cached,
+		},
+	})
+}
+
+// 校正プロンプトの版（プロンプトや検証方法を変えたら上げて、古いキャッシュを使わないようにする）
+const proofreadPromptVersion = 1
+
+// ヘルパー関数：注記を除いた本文での指摘を元の文字列での位置に戻す（注記にかかる指摘は、記法を壊さないよう除く）
+func mapProofreadIssues(source string, issues []ProofreadIssue, offsets []int) []ProofreadIssue {
+	runes := []rune(source)
+	mapped := make([]ProofreadIssue, 0, len(issues))
+	for _, issue := range issues {
+		start := offsets[issue.Start]
+		end := offsets[issue.End]
+		if issue.End > issue.Start {
+			end = offsets[issue.End-1] + 1
+		}
+		original := string(runes[start:end])
+		if strings.ContainsAny(original, "｜《》［］") {
+			continue
+		}
+		issue.Start, issue.End, issue.Original = start, end, original
+		issue.ID = fmt.Sprintf("%s-%d-%d", issue.Source, start, end)
+		mapped = append(mapped, issue)
+	}
+	return mapped
+}
+
+// ヘルパー関数：AIに校正させ、検証済みの指摘を返す
+func proofreadWithAI(ctx context.Context, provider LLMProvider, text string) ([]ProofreadIssue, error) {
+	prompt := fmt.Sprintf(`あなたは日本語の文芸作品の校正者です。次の文章を校正し、指摘をJSONだけで出力してください。
+
+出力形式:
+{"issues":[{"type":"typo|grammar|style|notation|consistency","start":0,"end":0,"original":"","suggestion":"","reason":""}]}
+
+- start / end は文章の先頭からの文字数（0始まり、endは含まない）
+- original は文章中の該当部分をそのまま抜き出す
+- suggestion は置き換える文字列、reason は日本語で簡潔に
+- 指摘がない場合は {"issues":[]}
+
+文章:
+%s`, text)
+
+	resp, err := provider.Generate(ctx, LLMRequest{Prompt: prompt})
+	if err != nil {
+		return nil, err
+	}
+
+	output := resp.Text
+	issues, parseErr := parseProofreadIssues(output)
+	for attempt := 0; parseErr != nil && attempt < proofreadRepairAttempts; attempt++ {
+		// 形式が壊れている場合はエラー内容を添えて修復を依頼する
+		repairPrompt := fmt.Sprintf(`次のJSONは形式が正しくありません（%v）。
+{"issues":[{"type":"...","start":0,"end":0,"original":"...","suggestion":"...","reason":"..."}]} の形式に直し、JSONだけを出力してください。
+
+%s`, parseErr, output)
+		resp, err := provider.Generate(ctx, LLMRequest{Prompt: repairPrompt})
+		if err != nil {
+			return nil, err
+		}
+		output = resp.Text
+		issues, parseErr = parseProofreadIssues(output)
+	}
+	if parseErr != nil {
+		return nil, fmt.Errorf("AIの出力を解釈できませんでした: %v", parseErr)
+	}
+
+	return alignProofreadIssues(text, issues, "ai"), nil
+}
+
+// ヘルパー関数：AIの出力からJSONを取り出してスキーマを検証する
+func parseProofreadIssues(output string) ([]ProofreadIssue, error) {
+	raw := extractJSON(output)
+	if raw == "" {
+		return nil, fmt.Errorf("JSONが見つかりません")
+	}
+
+	var payload struct {
+		Issues []ProofreadIssue `json:"issues"`
+	}
+	if strings.HasPrefix(raw, "[") {
+		if err := json.Unmarshal([]byte(raw), &payload.Issues); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal([]byte(raw), &payload); err != nil {
+		return nil, err
+	}
+
+	for i, issue := range payload.Issues {
+		if issue.Original == "" {
+			return nil, fmt.Errorf("issues[%d].original が空です", i)
+		}
+		if issue.Reason == "" {
+			return nil, fmt.Errorf("issues[%d].reason が空です", i)
+		}
+		if !proofreadIssueTypes[issue.Type] {
+			// 未知の種類は文体の指摘として扱う
+			payload.Issues[i].Type = "style"
+		}
+	}
+	return payload.Issues, nil
+}
+
+// ヘルパー関数：文章からJSON部分（コードブロック内、または最初の { / [ から最後の } / ] まで）を取り出す
+func extractJSON(output string) string {
+	output = strings.TrimSpace(output)
+	if i := strings.Index(output, "```"); i >= 0 {
+		rest := output[i+3:]
+		if nl := strings.Index(rest, "\n"); nl >= 0 {
+			rest = rest[nl+1:]
+		}
+		if j := strings.Index(rest, "```"); j >= 0 {
+			output = strings.TrimSpace(rest[:j])
+		}
+	}
+
+	start := strings.IndexAny(output, "{[")
+	if start < 0 {
+		return ""
+	}
+	closer := "}"
+	if output[start] == '[' {
+		closer = "]"
+	}
+	end := strings.LastIndex(output, closer)
+	if end < start {
+		return ""
+	}
+	return output[start : end+1]
+}
+
+// ヘルパー関数：指摘の位置を本文に合わせて補正する
+// 指定位置に original がなければ、指定位置に最も近い出現箇所へ移す。見つからない指摘は捨てる
+func alignProofreadIssues(text string, issues []ProofreadIssue, source string) []ProofreadIssue {
+	runes := []rune(text)
+	aligned := make([]ProofreadIssue, 0, len(issues))
+	for _, issue := range issues {
+		original := []rune(issue.Original)
+		start := -1
+		if issue.Start >= 0 && issue.Start+len(original) <= len(runes) && string(runes[issue.Start:issue.Start+len(original)]) == issue.Original {
+			start = issue.Start
+		} else {
+			start = nearestOccurrence(runes, original, issue.Start)
+		}
+		if start < 0 || issue.Suggestion == issue.Original {
+			continue
+		}
+
+		issue.Start = start
+		issue.End = start + len(original)
+		issue.Source = source
+		issue.ID = fmt.Sprintf("%s-%d-%d", source, issue.Start, issue.End)
+		aligned = append(aligned, issue)
+	}
+
+	sort.SliceStable(aligned, func(i, j int) bool { return aligned[i].Start < aligned[j].Start })
+	return aligned
+}
+
+// ヘルパー関数：hint に最も近い needle の出現位置（文字単位）。なければ -1
+func nearestOccurrence(haystack, needle []rune, hint int) int {
+	if len(needle) == 0 || len(needle) > len(haystack) {
+		return -1
+	}
+	best, bestDist := -1, 0
+	for i := 0; i+len(needle) <= len(haystack); i++ {
+		if string(haystack[i:i+len(needle)]) != string(needle) {
+			continue
+		}
+		dist := i - hint
+		if dist < 0 {
+			dist = -dist
+		}
+		if best < 0 || dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	return best
+}
+
+// 校正結果の反映（選択した指摘を作業ファイルに適用して1回の保存にする）
+func handleAIProofreadApply(c *gin.Context) {
+	var req ProofreadApplyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if repo == nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "先に初期化してください",
+		})
+		return
+	}
+
+	fullPath, err := workspacePath(req.Path)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "ファイルのパスが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	content, err := os.ReadFile(fullPath)
+	if err != nil {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Message: "ファイルが見つかりません",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	updated, err := applyProofreadIssues(string(content), req.Issues)
+	if err != nil {
+		c.JSON(http.StatusConflict, Response{
+			Success: false,
+			Message: "指摘を反映できませんでした。ファイルが変更されている可能性があります",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if err := os.WriteFile(fullPath, []byte(updated), 0644); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "ファイルの書き込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	message := req.Message
+	if message == "" {
+		message = fmt.Sprintf("校正を反映: %s（%d件）", req.Path, len(req.Issues))
+	}
+
+	commit, err := commitWorkspace(message, req.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "保存に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("%d件の校正を反映して保存しました", len(req.Issues)),
+		Data: map[string]interface{}{
+			"commit":  commit.String()[:7],
+			"message": message,
+			"applied": len(req.Issues),
+		},
+	})
+}
+
+// ヘルパー関数：指摘を本文に適用する（重なる指摘や位置のずれはエラー）
+func applyProofreadIssues(text string, issues []ProofreadIssue) (string, error) {
+	sorted := make([]ProofreadIssue, len(issues))
+	copy(sorted, issues)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	runes := []rune(text)
+	for i, issue := range sorted {
+		if issue.Start < 0 || issue.End < issue.Start || issue.End > len(runes) {
+			return "", fmt.Errorf("指摘の位置が範囲外です: %d-%d", issue.Start, issue.End)
+		}
+		if string(runes[issue.Start:issue.End]) != issue.Original {
+			return "", fmt.Errorf("%d-%d の文字列が「%s」と一致しません", issue.Start, issue.End, issue.Original)
+		}
+		if i > 0 && issue.Start < sorted[i-1].End {
+			return "", fmt.Errorf("指摘の範囲が重なっています: %d-%d", issue.Start, issue.End)
+		}
+	}
+
+	// 後ろから置き換えて位置のずれを防ぐ
+	for i := len(sorted) - 1; i >= 0; i-- {
+		issue := sorted[i]
+		replaced := make([]rune, 0, len(runes)-(issue.End-issue.Start)+len([]rune(issue.Suggestion)))
+		replaced = append(replaced, runes[:issue.Start]...)
+		replaced = append(replaced, []rune(issue.Suggestion)...)
+		replaced = append(replaced, runes[issue.End:]...)
+		runes = replaced
+	}
+	return string(runes), nil
+}
+
+// ヘルパー関数：作業ディレクトリ内の相対パスを絶対パスに変換（作業ディレクトリの外は拒否）
+func workspacePath(rel string) (string, error) {
+	if rel == "" || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("作業ディレクトリからの相対パスを指定してください: %q", rel)
+	}
+	cleaned := filepath.Clean(filepath.FromSlash(rel))
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("作業ディレクトリの外は指定できません: %q", rel)
+	}
+	if cleaned == ".git" || strings.HasPrefix(cleaned, ".git"+string(filepath.Separator)) {
+		return "", fmt.Errorf(".git は指定できません: %q", rel)
+	}
+	full := filepath.Join(workDir, cleaned)
+	if err := checkInsideWorkspace(full); err != nil {
+		return "", fmt.Errorf("%v: %q", err, rel)
+	}
+	return full, nil
+}
+
+// ヘルパー関数：シンボリックリンクをたどった先が作業ディレクトリの中か（まだないファイルは、ある親ディレクトリで調べる）
+func checkInsideWorkspace(full string) error {
+	root, err := filepath.EvalSymlinks(workDir)
+	if err != nil {
+		return err
+	}
+	existing := full
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+				return fmt.Errorf("シンボリックリンクで作業ディレクトリの外は指定できません")
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if _, lerr := os.Lstat(existing); lerr == nil {
+			// リンク先がないシンボリックリンク（書き込むと外にファイルができる）
+			return fmt.Errorf("リンク先のないシンボリックリンクは指定できません")
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return err
+		}
+		existing = parent
+	}
+}
+
+// ヘルパー関数：指定したファイルをステージングしてコミットする
+func commitWorkspace(message string, paths ...string) (plumbing.Hash, error) {
+	w, err := repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	for _, p := range paths {
+		if _, err := w.Add(filepath.ToSlash(filepath.Clean(p))); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	return w.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "tenkai",
+			Email: "tenkai@example.com",
+			When:  time.Now(),
+		},
+	})
+}
+
+// ===== 長編原稿のAI分析 =====
+
+// 長編分析リクエスト
+type LongAnalyzeRequest struct {
+	Type        string `json:"type"`   // "summary" または "review"
+	Source      string `json:"source"` // "text", "file", "draft", "workspace"
+	Text        string `json:"text"`   // source = "text"
+	Path        string `json:"path"`   // source = "file"（作業ディレクトリからの相対パス）
+	Draft       string `json:"draft"`  // source = "draft"（草案名）
+	ChunkTokens int    `json:"chunkTokens"`
+	Provider    string `json:"provider"`
+	Model       string `json:"model"`
+	NoCache     bool   `json:"noCache"` // true の場合はキャッシュを使わずに分析し直す
+}
+
+// 分析対象の原稿ファイル
+type manuscriptFile struct {
+	Path    string
+	Content string
+}
+
+// 分割された原稿の断片
+type manuscriptChunk struct {
+	Index  int    `json:"index"`
+	File   string `json:"file"`
+	Start  int    `json:"start"` // ファイル内の開始位置（文字単位）
+	End    int    `json:"end"`
+	Tokens int    `json:"tokens"`
+	Text   string `json:"-"`
+	Result string `json:"result"`
+	Cached bool   `json:"cached"` // 前回の結果を再利用した（本文が変わっていない）
+}
+
+// 分割の既定値と同時実行数
+const (
+	defaultChunkTokens = 6000
+	minChunkTokens     = 500
+	mapConcurrency     = 3
+)
+
+// 原稿として扱う拡張子
+var manuscriptExtensions = map[string]bool{
+	".txt": true,
+	".md":  true,
+}
+
+// 長編原稿のAI分析（分割して要約・講評し、最後に統合する）
+func handleAIAnalyzeLong(c *gin.Context) {
+	var req LongAnalyzeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if req.Type == "" {
+		req.Type = "summary"
+	}
+	if req.Type != "summary" && req.Type != "review" {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "type は summary か review を指定してください",
+		})
+		return
+	}
+	if req.ChunkTokens <= 0 {
+		req.ChunkTokens = defaultChunkTokens
+	}
+	if req.ChunkTokens < minChunkTokens {
+		req.ChunkTokens = minChunkTokens
+	}
+
+	provider, err := resolveLLMForRequest(c, req.Provider, req.Model)
+	if err != nil {
+		respondAIError(c, http.StatusBadRequest, "AI機能が初期化されていません", err)
+		return
+	}
+
+	files, err := loadAnalysisSource(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "分析対象の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	var chunks []*manuscriptChunk
+	totalTokens := 0
+	for _, f := range files {
+		// 注記を取り除いた本文を分析し、断片の位置は元のファイルでの位置に戻す
+		plain, offsets := parseAozora(f.Content).PlainText()
+		for _, ch := range chunkManuscript(plain, req.ChunkTokens) {
+			ch.Index = len(chunks)
+			ch.File = f.Path
+			ch.Start, ch.End = offsets[ch.Start], offsets[ch.End]
+			chunks = append(chunks, ch)
+			totalTokens += ch.Tokens
+		}
+	}
+	if len(chunks) == 0 {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "分析する本文がありません",
+		})
+		return
+	}
+
+	// map: 断片ごとに分析
+	if err := mapChunks(ctx, provider, req.Type, chunks, req.NoCache); err != nil {
+		respondAIError(c, http.StatusInternalServerError, "AI分析に失敗しました", err)
+		return
+	}
+
+	// reduce: 断片の結果を統合
+	merged, reduceCached, err := reduceChunkResults(ctx, provider, req.Type, chunks, req.ChunkTokens, req.NoCache)
+	if err != nil {
+		respondAIError(c, http.StatusInternalServerError, "分析結果の統合に失敗しました", err)
+		return
+	}
+
+	fileNames := make([]string, len(files))
+	var whole strings.Builder
+	for i, f := range files {
+		fileNames[i] = f.Path
+		whole.WriteString(f.Content)
+	}
+
+	// 全体のトークン数はプロバイダーで数える（失敗した場合は分割時の概算を使う）
+	if counted, err := provider.CountTokens(ctx, whole.String()); err == nil {
+		totalTokens = counted
+	} else {
+		log.Printf("トークン数の取得に失敗: %v", err)
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("%dファイル・%d分割で分析しました", len(files), len(chunks)),
+		Data: map[string]interface{}{
+			"type":        req.Type,
+			"source":      req.Source,
+			"files":       fileNames,
+			"chunks":      chunks,
+			"result":      merged,
+			"totalTokens": totalTokens,
+			"cached":      reduceCached,
+			"provider":    provider.Name(),
+			"model":       provider.Model(),
+		},
+	})
+}
+
+// ヘルパー関数：分析対象の原稿を読み込む
+func loadAnalysisSource(req LongAnalyzeRequest) ([]manuscriptFile, error) {
+	switch req.Source {
+	case "", "text":
+		if req.Text == "" {
+			return nil, fmt.Errorf("text が空です")
+		}
+		return []manuscriptFile{{Path: "", Content: req.Text}}, nil
+	}
+
+	if repo == nil {
+		return nil, fmt.Errorf("先に初期化してください")
+	}
+
+	switch req.Source {
+	case "file":
+		fullPath, err := workspacePath(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		content, err := os.ReadFile(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		return []manuscriptFile{{Path: req.Path, Content: string(content)}}, nil
+	case "draft":
+		if req.Draft == "" {
+			return nil, fmt.Errorf("draft が空です")
+		}
+		return readManuscriptAtRevision(plumbing.NewBranchReferenceName(req.Draft).String())
+	case "workspace":
+		return readWorkspaceManuscript()
+	default:
+		return nil, fmt.Errorf("未対応の source です: %s", req.Source)
+	}
+}
+
+// ヘルパー関数：作業ディレクトリの原稿ファイルを構成（.tenkai/book.yaml）の順、なければパス順に読み込む
+func readWorkspaceManuscript() ([]manuscriptFile, error) {
+	var files []manuscriptFile
+	err := filepath.WalkDir(workDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if strings.HasPrefix(d.Name(), ".") && path != workDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !manuscriptExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(workDir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, manuscriptFile{Path: filepath.ToSlash(rel), Content: string(content)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	book, err := getRepoBook()
+	if err != nil {
+		return nil, err
+	}
+	return orderByBook(files, book), nil
+}
+
+// ヘルパー関数：指定したリビジョン（草案名・コミットなど）の原稿ファイルを構成の順、なければパス順に読み込む
+func readManuscriptAtRevision(revision string) ([]manuscriptFile, error) {
+	hash, err := repo.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return nil, fmt.Errorf("リビジョン %s が見つかりません: %v", revision, err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	var files []manuscriptFile
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if !manuscriptExtensions[strings.ToLower(path.Ext(f.Name))] || isHiddenPath(f.Name) {
+			return nil
+		}
+		content, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		files = append(files, manuscriptFile{Path: f.Name, Content: content})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	book, err := bookManifestInTree(tree)
+	if err != nil {
+		return nil, err
+	}
+	return orderByBook(files, book), nil
+}
+
+// ヘルパー関数：隠しディレクトリ（.tenkai など）配下か
+func isHiddenPath(p string) bool {
+	for _, part := range strings.Split(p, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// ヘルパー関数：原稿ファイルとして書き込めるパスか（作業ディレクトリの中、隠しフォルダの外、原稿の拡張子）
+func checkManuscriptPath(p string) error {
+	if _, err := workspacePath(p); err != nil {
+		return err
+	}
+	if p != path.Clean(p) || isHiddenPath(p) || !manuscriptExtensions[strings.ToLower(path.Ext(p))] {
+		return fmt.Errorf("%s は原稿ファイルのパスではありません", p)
+	}
+	return nil
+}
+
+// ヘルパー関数：トークン数の概算（日本語は1文字1トークン、英数字は4文字1トークン程度）
+func estimateTokens(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < 0x80 {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return other + (ascii+3)/4
+}
+
+// ヘルパー関数：段落単位で原稿を分割する（長すぎる段落は文の区切りでさらに分割）
+func chunkManuscript(text string, maxTokens int) []*manuscriptChunk {
+	var chunks []*manuscriptChunk
+	var current strings.Builder
+	currentTokens := 0
+	currentStart := 0
+	offset := 0
+
+	flush := func() {
+		if strings.TrimSpace(current.String()) != "" {
+			content := current.String()
+			chunks = append(chunks, &manuscriptChunk{
+				Start:  currentStart,
+				End:    currentStart + len([]rune(content)),
+				Tokens: currentTokens,
+				Text:   content,
+			})
+		}
+		current.Reset()
+		currentTokens = 0
+		currentStart = offset
+	}
+
+	for _, para := range splitKeepingDelimiter(text, "\n") {
+		pieces := []string{para}
+		if estimateTokens(para) > maxTokens {
+			pieces = splitKeepingDelimiter(para, "。")
+		}
+		for _, piece := range pieces {
+			for _, part := range splitByTokens(piece, maxTokens) {
+				tokens := estimateTokens(part)
+				if currentTokens > 0 && currentTokens+tokens > maxTokens {
+					flush()
+				}
+				current.WriteString(part)
+				currentTokens += tokens
+				offset += len([]rune(part))
+			}
+		}
+	}
+	flush()
+	return chunks
+}
+
+// ヘルパー関数：区切り文字を残したまま分割する
+func splitKeepingDelimiter(text, sep string) []string {
+	var parts []string
+	for text != "" {
+		i := strings.Index(text, sep)
+		if i < 0 {
+			parts = append(parts, text)
+			break
+		}
+		parts = append(parts, text[:i+len(sep)])
+		text = text[i+len(sep):]
+	}
+	return parts
+}
+
+// ヘルパー関数：区切りのない長い文字列をトークン数で強制的に分割する
+func splitByTokens(text string, maxTokens int) []string {
+	if estimateTokens(text) <= maxTokens {
+		return []string{text}
+	}
+	runes := []rune(text)
+	var parts []string
+	for len(runes) > 0 {
+		n := maxTokens
+		if n > len(runes) {
+			n = len(runes)
+		}
+		parts = append(parts, string(runes[:n]))
+		runes = runes[n:]
+	}
+	return parts
+}
+
+// ヘルパー関数：断片ごとの分析（map）
+func mapChunks(ctx context.Context, provider LLMProvider, analysisType string, chunks []*manuscriptChunk, bypassCache bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sem := make(chan struct{}, mapConcurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	for _, ch := range chunks {
+		ch := ch
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			prompt := chunkPrompt(analysisType, ch, len(chunks))
+			result, cached, err := generateCached(ctx, provider, "long-"+analysisType, 0, LLMRequest{Prompt: prompt}, bypassCache)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("断片%d（%s）: %w", ch.Index+1, ch.File, err)
+					cancel()
+				}
+				return
+			}
+			ch.Result = strings.TrimSpace(result)
+			ch.Cached = cached
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// ヘルパー関数：断片用のプロンプト
+func chunkPrompt(analysisType string, ch *manuscriptChunk, total int) string {
+	position := fmt.Sprintf("（全%d分割のうち%d番目", total, ch.Index+1)
+	if ch.File != "" {
+		position += "、" + ch.File
+	}
+	position += "）"
+
+	if analysisType == "review" {
+		return fmt.Sprintf("以下は長編原稿の一部です%s。この部分を校正し、改善点を具体的に指摘してください：\n\n%s", position, ch.Text)
+	}
+	return fmt.Sprintf("以下は長編原稿の一部です%s。登場人物・出来事・場面の変化が分かるように簡潔に要約してください：\n\n%s", position, ch.Text)
+}
+
+// ヘルパー関数：断片の結果を統合する（reduce）。入力が大きすぎる場合は段階的に統合する
+func reduceChunkResults(ctx context.Context, provider LLMProvider, analysisType string, chunks []*manuscriptChunk, maxTokens int, bypassCache bool) (string, bool, error) {
+	results := make([]string, len(chunks))
+	allCached := true
+	for i, ch := range chunks {
+		results[i] = ch.Result
+		allCached = allCached && ch.Cached
+	}
+	if len(results) == 1 {
+		return results[0], allCached, nil
+	}
+
+	for len(results) > 1 {
+		var groups [][]string
+		var group []string
+		groupTokens := 0
+		for _, r := range results {
+			tokens := estimateTokens(r)
+			if len(group) > 0 && groupTokens+tokens > maxTokens {
+				groups = append(groups, group)
+				group, groupTokens = nil, 0
+			}
+			group = append(group, r)
+			groupTokens += tokens
+		}
+		groups = append(groups, group)
+
+		// 1件ずつしか入らない場合は進まないので、2件ずつまとめる
+		if len(groups) == len(results) {
+			groups = nil
+			for i := 0; i < len(results); i += 2 {
+				end := i + 2
+				if end > len(results) {
+					end = len(results)
+				}
+				groups = append(groups, results[i:end])
+			}
+		}
+
+		merged := make([]string, 0, len(groups))
+		for _, g := range groups {
+			if len(g) == 1 {
+				merged = append(merged, g[0])
+				continue
+			}
+			result, cached, err := generateCached(ctx, provider, "long-reduce-"+analysisType, 0, LLMRequest{Prompt: reducePrompt(analysisType, g)}, bypassCache)
+			if err != nil {
+				return "", false, err
+			}
+			allCached = allCached && cached
+			merged = append(merged, strings.TrimSpace(result))
+		}
+		results = merged
+	}
+	return results[0], allCached, nil
+}
+
+// ヘルパー関数：統合用のプロンプト
+func reducePrompt(analysisType string, parts []string) string {
+	var sb strings.Builder
+	for i, p := range parts {
+		sb.WriteString(fmt.Sprintf("【%d】\n%s\n\n", i+1, p))
+	}
+	if analysisType == "review" {
+		return "以下は長編原稿を分割して校正した結果です。重複をまとめ、作品全体として優先度の高い改善点から整理してください：\n\n" + sb.String()
+	}
+	return "以下は長編原稿を分割して要約したものです（物語の順番どおり）。全体のあらすじとして一つにまとめてください：\n\n" + sb.String()
+}
+
+// ===== プロンプトテンプレート =====
+
+// テンプレートに渡す変数
+type PromptVariables struct {
+	Text         string `json:"text"`
+	Genre        string `json:"genre"`
+	TargetReader string `json:"targetReader"`
+	StyleNotes   string `json:"styleNotes"`
+}
+
+// 名前付きプロンプトテンプレート（Go の text/template 形式。{{.Text}} {{.Genre}} {{.TargetReader}} {{.StyleNotes}} が使える）
+type PromptTemplate struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Template    string `json:"template"`
+	Version     int    `json:"version"`
+	UpdatedAt   string `json:"updatedAt"`
+	Source      string `json:"source"` // "builtin", "user", "repository"
+}
+
+// テンプレートファイルの形式（.tenkai-settings/prompts.json と 原稿リポジトリの .tenkai/prompts.json）
+type PromptTemplateFile struct {
+	Version   string                     `json:"version"`
+	Templates map[string]*PromptTemplate `json:"templates"`
+}
+
+// テンプレート保存リクエスト
+type PromptTemplateRequest struct {
+	Description string `json:"description"`
+	Template    string `json:"template" binding:"required"`
+}
+
+// プレビューリクエスト（name か template のどちらかを指定）
+type PromptPreviewRequest struct {
+	Name      string          `json:"name"`
+	Template  string          `json:"template"`
+	Variables PromptVariables `json:"variables"`
+}
+
+// テンプレートの保存先
+const (
+	userPromptsFile = "prompts.json"
+	repoPromptsFile = ".tenkai/prompts.json"
+)
+
+// テンプレート名に使える文字
+var promptNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// 組み込みテンプレート
+func builtinPromptTemplates() map[string]*PromptTemplate {
+	contextLines := `{{with .Genre}}
+ジャンル：{{.}}{{end}}{{with .TargetReader}}
+想定読者：{{.}}{{end}}{{with .StyleNotes}}
+文体の注意：{{.}}{{end}}`
+
+	templates := map[string]*PromptTemplate{
+		"summary": {
+			Description: "要約",
+			Template:    "以下の文章を簡潔に要約してください：" + contextLines + "\n\n{{.Text}}",
+		},
+		"review": {
+			Description: "校正・改善点の指摘",
+			Template:    "以下の文章を校正し、改善点を指摘してください：" + contextLines + "\n\n{{.Text}}",
+		},
+		"commit": {
+			Description: "コミットメッセージ生成",
+			Template:    "以下の変更内容から適切な日本語のコミットメッセージを生成してください：\n\n{{.Text}}",
+		},
+	}
+	for name, t := range templates {
+		t.Name = name
+		t.Version = 1
+		t.Source = "builtin"
+	}
+	return templates
+}
+
+// ヘルパー関数：テンプレートを解析する（未知の変数はエラー）
+func parsePromptTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// 変数名の誤りを保存前に検出する
+	if err := t.Execute(io.Discard, PromptVariables{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ヘルパー関数：テンプレートに変数を埋め込む
+func renderPromptTemplate(pt *PromptTemplate, vars PromptVariables) (string, error) {
+	t, err := parsePromptTemplate(pt.Name, pt.Template)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, vars); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// ヘルパー関数：組み込み → ユーザー（.tenkai-settings）→ 原稿リポジトリ の順に重ねたテンプレート一覧
+// accessToken が空の場合はユーザーのテンプレートを読まない
+func loadPromptTemplates(accessToken string) (map[string]*PromptTemplate, error) {
+	templates := builtinPromptTemplates()
+
+	if accessToken != "" {
+		userTemplates, err := cachedUserPromptTemplates(accessToken)
+		if err != nil {
+			return nil, err
+		}
+		for name, t := range userTemplates {
+			templates[name] = t
+		}
+	}
+
+	repoFile, err := getRepoPromptTemplates()
+	if err != nil {
+		return nil, err
+	}
+	for name, t := range repoFile.Templates {
+		t.Name = name
+		t.Source = "repository"
+		templates[name] = t
+	}
+
+	return templates, nil
+}
+
+// ユーザーのテンプレートのキャッシュ（分析のたびにGitHubへ問い合わせないようにする）
+const promptTemplateCacheTTL = 5 * time.Minute
+
+type promptTemplateCacheEntry struct {
+	templates map[string]*PromptTemplate
+	expiresAt time.Time
+}
+
+var (
+	promptTemplateCacheMu sync.Mutex
+	promptTemplateCache   = make(map[string]promptTemplateCacheEntry)
+)
+
+// ヘルパー関数：ユーザーのテンプレートをキャッシュから取得（なければ .tenkai-settings から読み込む）
+func cachedUserPromptTemplates(accessToken string) (map[string]*PromptTemplate, error) {
+	key := accessTokenKey(accessToken)
+	promptTemplateCacheMu.Lock()
+	entry, ok := promptTemplateCache[key]
+	promptTemplateCacheMu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.templates, nil
+	}
+
+	user, err := getGitHubUser(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	userFile, _, err := getUserPromptTemplates(accessToken, user.Login)
+	if err != nil {
+		return nil, err
+	}
+	for name, t := range userFile.Templates {
+		t.Name = name
+		t.Source = "user"
+	}
+
+	promptTemplateCacheMu.Lock()
+	promptTemplateCache[key] = promptTemplateCacheEntry{templates: userFile.Templates, expiresAt: time.Now().Add(promptTemplateCacheTTL)}
+	promptTemplateCacheMu.Unlock()
+	return userFile.Templates, nil
+}
+
+// ヘルパー関数：ユーザーのテンプレートのキャッシュを捨てる
+func forgetUserPromptTemplates(accessToken string) {
+	promptTemplateCacheMu.Lock()
+	delete(promptTemplateCache, accessTokenKey(accessToken))
+	promptTemplateCacheMu.Unlock()
+}
+
+// ヘルパー関数：ユーザーのテンプレートを .tenkai-settings から取得（存在しない場合は空）
+func getUserPromptTemplates(accessToken, username string) (*PromptTemplateFile, string, error) {
+	file := &PromptTemplateFile{Version: "1.0", Templates: make(map[string]*PromptTemplate)}
+
+	content, sha, err := getSettingsRepoFile(accessToken, username, userPromptsFile)
+	if errors.Is(err, errSettingsFileNotFound) {
+		return file, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := json.Unmarshal(content, file); err != nil {
+		return nil, "", fmt.Errorf("%s の形式が不正です: %v", userPromptsFile, err)
+	}
+	if file.Templates == nil {
+		file.Templates = make(map[string]*PromptTemplate)
+	}
+	return file, sha, nil
+}
+
+// ヘルパー関数：原稿リポジトリ（作業ディレクトリ）のテンプレートを取得（存在しない場合は空）
+func getRepoPromptTemplates() (*PromptTemplateFile, error) {
+	file := &PromptTemplateFile{Version: "1.0", Templates: make(map[string]*PromptTemplate)}
+	if repo == nil {
+		return file, nil
+	}
+
+	content, err := os.ReadFile(filepath.Join(workDir, filepath.FromSlash(repoPromptsFile)))
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, file); err != nil {
+		return nil, fmt.Errorf("%s の形式が不正です: %v", repoPromptsFile, err)
+	}
+	if file.Templates == nil {
+		file.Templates = make(map[string]*PromptTemplate)
+	}
+	return file, nil
+}
+
+// ヘルパー関数：分析用のプロンプトを組み立てる（種別と同じ名前のテンプレートを使う）
+func renderAnalyzePrompt(c *gin.Context, req AnalyzeRequest) (string, *PromptTemplate, error) {
+	name := req.Template
+	if name == "" {
+		name = req.Type
+	}
+
+	vars := req.Variables
+	vars.Text = req.Text
+
+	templates, err := loadPromptTemplates(resolveAccessToken(c, ""))
+	if err != nil {
+		// GitHubの障害や古いトークンでテンプレートを読めなくても、組み込みのテンプレートで分析を続ける
+		log.Printf("プロンプトテンプレートの読み込みに失敗したため組み込みのテンプレートを使います: %v", err)
+		templates = builtinPromptTemplates()
+	}
+
+	pt, ok := templates[name]
+	if !ok {
+		if req.Template != "" {
+			return "", nil, fmt.Errorf("テンプレート「%s」が見つかりません", req.Template)
+		}
+		// 種別に対応するテンプレートがなければ自由入力として扱う
+		if req.Prompt != "" {
+			return req.Prompt, nil, nil
+		}
+		return req.Text, nil, nil
+	}
+
+	prompt, err := renderPromptTemplate(pt, vars)
+	if err != nil {
+		return "", nil, fmt.Errorf("テンプレート「%s」の展開に失敗しました: %v", name, err)
+	}
+	return prompt, pt, nil
+}
+
+// テンプレート一覧
+func handleListPrompts(c *gin.Context) {
+	templates, err := loadPromptTemplates(resolveAccessToken(c, ""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "テンプレートの取得に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	list := make([]*PromptTemplate, 0, len(templates))
+	for _, t := range templates {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    list,
+	})
+}
+
+// テンプレート取得
+func handleGetPrompt(c *gin.Context) {
+	templates, err := loadPromptTemplates(resolveAccessToken(c, ""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "テンプレートの取得に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	t, ok := templates[c.Param("name")]
+	if !ok {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Message: fmt.Sprintf("テンプレート「%s」が見つかりません", c.Param("name")),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    t,
+	})
+}
+
+// テンプレート保存（ユーザーの .tenkai-settings に作成・更新）
+func handleSavePrompt(c *gin.Context) {
+	name := c.Param("name")
+	if !promptNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "テンプレート名は英数字・ハイフン・アンダースコアで64文字以内にしてください",
+		})
+		return
+	}
+
+	var req PromptTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if _, err := parsePromptTemplate(name, req.Template); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "テンプレートの書式が不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	accessToken := resolveAccessToken(c, "")
+	if accessToken == "" {
+		c.JSON(http.StatusUnauthorized, Response{
+			Success: false,
+			Message: "認証が必要です",
+		})
+		return
+	}
+
+	user, err := getGitHubUser(accessToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, Response{
+			Success: false,
+			Message: "GitHubユーザー情報の取得に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	file, sha, err := getUserPromptTemplates(accessToken, user.Login)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "テンプレートの取得に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	version := 1
+	if existing, ok := file.Templates[name]; ok {
+		version = existing.Version + 1
+	}
+	saved := &PromptTemplate{
+		Name:        name,
+		Description: req.Description,
+		Template:    req.Template,
+		Version:     version,
+		UpdatedAt:   time.Now().Format(time.RFC3339),
+		Source:      "user",
+	}
+	file.Templates[name] = saved
+
+	if err := putUserPromptTemplates(accessToken, user.Login, file, sha, fmt.Sprintf("プロンプト「%s」を保存", name)); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "テンプレートの保存に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("テンプレート「%s」を保存しました", name),
+		Data:    saved,
+	})
+}
+
+// テンプレート削除（ユーザーの .tenkai-settings から削除）
+func handleDeletePrompt(c *gin.Context) {
+	name := c.Param("name")
+
+	accessToken := resolveAccessToken(c, "")
+	if accessToken == "" {
+		c.JSON(http.StatusUnauthorized, Response{
+			Success: false,
+			Message: "認証が必要です",
+		})
+		return
+	}
+
+	user, err := getGitHubUser(accessToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, Response{
+			Success: false,
+			Message: "GitHubユーザー情報の取得に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	file, sha, err := getUserPromptTemplates(accessToken, user.Login)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "テンプレートの取得に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if _, ok := file.Templates[name]; !ok {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Message: fmt.Sprintf("テンプレート「%s」が見つかりません", name),
+		})
+		return
+	}
+	delete(file.Templates, name)
+
+	if err := putUserPromptTemplates(accessToken, user.Login, file, sha, fmt.Sprintf("プロンプト「%s」を削除", name)); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "テンプレートの削除に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("テンプレート「%s」を削除しました", name),
+	})
+}
+
+// テンプレートのプレビュー（展開結果を返すだけでAIは呼ばない）
+func handlePreviewPrompt(c *gin.Context) {
+	var req PromptPreviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	var pt *PromptTemplate
+	switch {
+	case req.Template != "":
+		pt = &PromptTemplate{Name: "preview", Template: req.Template}
+	case req.Name != "":
+		templates, err := loadPromptTemplates(resolveAccessToken(c, ""))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Message: "テンプレートの取得に失敗しました",
+				Error:   err.Error(),
+			})
+			return
+		}
+		var ok bool
+		if pt, ok = templates[req.Name]; !ok {
+			c.JSON(http.StatusNotFound, Response{
+				Success: false,
+				Message: fmt.Sprintf("テンプレート「%s」が見つかりません", req.Name),
+			})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "name か template を指定してください",
+		})
+		return
+	}
+
+	rendered, err := renderPromptTemplate(pt, req.Variables)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "テンプレートの展開に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"name":     pt.Name,
+			"source":   pt.Source,
+			"version":  pt.Version,
+			"rendered": rendered,
+		},
+	})
+}
+
+// ヘルパー関数：ユーザーのテンプレートを .tenkai-settings に保存
+func putUserPromptTemplates(accessToken, username string, file *PromptTemplateFile, sha, message string) error {
+	content, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureTenkaiSettingsRepo(accessToken, username); err != nil {
+		return err
+	}
+	if err := putSettingsRepoFile(accessToken, username, userPromptsFile, content, sha, message); err != nil {
+		return err
+	}
+	forgetUserPromptTemplates(accessToken)
+	return nil
+}
+
+// ===== AI利用量の上限と記録 =====
+
+// 1回のAI呼び出しの記録
+type aiUsageRecord struct {
+	Time         time.Time `json:"time"`
+	Provider     string    `json:"provider"`
+	Model        string    `json:"model"`
+	InputTokens  int       `json:"inputTokens"`
+	OutputTokens int       `json:"outputTokens"`
+	Cost         float64   `json:"cost"` // USD
+}
+
+// 期間ごとの集計
+type aiUsageCounter struct {
+	Requests     int     `json:"requests"`
+	InputTokens  int     `json:"inputTokens"`
+	OutputTokens int     `json:"outputTokens"`
+	Cost         float64 `json:"cost"`
+}
+
+// ユーザーごとの利用状況
+type aiUsageAccount struct {
+	Daily   map[string]*aiUsageCounter `json:"daily"`   // "2006-01-02" → 集計
+	Monthly map[string]*aiUsageCounter `json:"monthly"` // "2006-01" → 集計
+	Recent  []aiUsageRecord            `json:"recent"`  // 直近の呼び出し
+}
+
+// 保持する直近の呼び出し件数と日別集計の日数
+const (
+	aiUsageRecentLimit = 50
+	aiUsageKeepDays    = 62
+)
+
+// 利用状況をファイルに書き出す間隔（呼び出しのたびには書かない）
+const aiUsageFlushInterval = 10 * time.Second
+
+// AI利用量の記録と上限の判定
+type aiUsageTracker struct {
+	mu       sync.Mutex
+	path     string // 空の場合は保存しない
+	cfg      QuotaConfig
+	accounts map[string]*aiUsageAccount
+	minute   map[string][]time.Time // レート制限用の直近1分間の呼び出し時刻（予約した時点で加える）
+	pending  map[string]int         // 予約済みでまだ記録していない呼び出しの数
+	dirty    bool                   // 保存していない変更がある
+}
+
+// 呼び出し1回分の予約（Check で取り、Record か Release で返す）
+type aiUsageReservation struct {
+	user string
+	at   time.Time
+	done bool
+}
+
+// 利用上限を超えた
+type quotaError struct {
+	message string
+}
+
+func (e *quotaError) Error() string { return e.message }
+
+// AI利用量の記録先を作成（保存先があれば読み込む）
+func newAIUsageTracker(cfg QuotaConfig) (*aiUsageTracker, error) {
+	t := &aiUsageTracker{
+		path:     cfg.UsagePath,
+		cfg:      cfg,
+		accounts: make(map[string]*aiUsageAccount),
+		minute:   make(map[string][]time.Time),
+		pending:  make(map[string]int),
+	}
+	if t.path == "" {
+		return t, nil
+	}
+	go t.flushLoop()
+
+	data, err := os.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &t.accounts); err != nil {
+			return nil, fmt.Errorf("%s の形式が不正です: %v", t.path, err)
+		}
+	}
+	return t, nil
+}
+
+// ヘルパー関数：ユーザーの利用状況（なければ作成）
+func (t *aiUsageTracker) account(user string) *aiUsageAccount {
+	a, ok := t.accounts[user]
+	if !ok {
+		a = &aiUsageAccount{
+			Daily:   make(map[string]*aiUsageCounter),
+			Monthly: make(map[string]*aiUsageCounter),
+		}
+		t.accounts[user] = a
+	}
+	return a
+}
+
+// 呼び出し前の上限チェックと予約（上限に達していれば quotaError）
+// 判定と予約を同じロックの中で行うので、同時に来た呼び出しがまとめて上限をすり抜けることはない
+func (t *aiUsageTracker) Check(user string) (*aiUsageReservation, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if err := t.exceeded(user, now); err != nil {
+		return nil, err
+	}
+	t.minute[user] = append(t.minute[user], now)
+	t.pending[user]++
+	return &aiUsageReservation{user: user, at: now}, nil
+}
+
+// 呼び出し前の上限チェック（予約はしない）
+func (t *aiUsageTracker) Available(user string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.exceeded(user, time.Now())
+}
+
+// 失敗した呼び出しの予約を取り消す（レート制限の枠も返す）
+func (t *aiUsageTracker) Release(r *aiUsageReservation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r.done {
+		return
+	}
+	r.done = true
+	t.pending[r.user]--
+	times := t.minute[r.user]
+	for i, at := range times {
+		if at.Equal(r.at) {
+			t.minute[r.user] = append(times[:i], times[i+1:]...)
+			break
+		}
+	}
+}
+
+// ヘルパー関数：上限に達しているか（予約中の呼び出しも回数に数える。ロックを取ってから呼ぶ）
+func (t *aiUsageTracker) exceeded(user string, now time.Time) error {
+	if limit := t.cfg.RequestsPerMinute; limit > 0 {
+		recent := t.minute[user][:0]
+		for _, at := range t.minute[user] {
+			if now.Sub(at) < time.Minute {
+				recent = append(recent, at)
+			}
+		}
+		t.minute[user] = recent
+		if len(recent) >= limit {
+			return &quotaError{fmt.Sprintf("AIの呼び出しが集中しています（1分あたり%d回まで）。少し時間をおいてから再度お試しください", limit)}
+		}
+	}
+
+	a := t.account(user)
+	day := a.Daily[now.Format("2006-01-02")]
+	month := a.Monthly[now.Format("2006-01")]
+	if day == nil {
+		day = &aiUsageCounter{}
+	}
+	if month == nil {
+		month = &aiUsageCounter{}
+	}
+	pending := t.pending[user]
+
+	switch {
+	case t.cfg.DailyRequests > 0 && day.Requests+pending >= t.cfg.DailyRequests:
+		return &quotaError{fmt.Sprintf("本日のAI利用回数の上限（%d回）に達しました。明日以降に再度お試しください", t.cfg.DailyRequests)}
+	case t.cfg.DailyTokens > 0 && day.InputTokens+day.OutputTokens >= t.cfg.DailyTokens:
+		return &quotaError{fmt.Sprintf("本日のAI利用トークン数の上限（%d）に達しました。明日以降に再度お試しください", t.cfg.DailyTokens)}
+	case t.cfg.MonthlyRequests > 0 && month.Requests+pending >= t.cfg.MonthlyRequests:
+		return &quotaError{fmt.Sprintf("今月のAI利用回数の上限（%d回）に達しました。来月以降に再度お試しください", t.cfg.MonthlyRequests)}
+	case t.cfg.MonthlyTokens > 0 && month.InputTokens+month.OutputTokens >= t.cfg.MonthlyTokens:
+		return &quotaError{fmt.Sprintf("今月のAI利用トークン数の上限（%d）に達しました。来月以降に再度お試しください", t.cfg.MonthlyTokens)}
+	}
+	return nil
+}
+
+// 呼び出し結果の記録（予約を使い切る）
+func (t *aiUsageTracker) Record(r *aiUsageReservation, rec aiUsageRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !r.done {
+		r.done = true
+		t.pending[r.user]--
+	}
+	if price, ok := t.cfg.Prices[rec.Model]; ok {
+		rec.Cost = (float64(rec.InputTokens)*price.Input + float64(rec.OutputTokens)*price.Output) / 1e6
+	}
+
+	a := t.account(r.user)
+	add := func(counters map[string]*aiUsageCounter, key string) {
+		c, ok := counters[key]
+		if !ok {
+			c = &aiUsageCounter{}
+			counters[key] = c
+		}
+		c.Requests++
+		c.InputTokens += rec.InputTokens
+		c.OutputTokens += rec.OutputTokens
+		c.Cost += rec.Cost
+	}
+	add(a.Daily, rec.Time.Format("2006-01-02"))
+	add(a.Monthly, rec.Time.Format("2006-01"))
+
+	a.Recent = append(a.Recent, rec)
+	if len(a.Recent) > aiUsageRecentLimit {
+		a.Recent = a.Recent[len(a.Recent)-aiUsageRecentLimit:]
+	}
+
+	pruneAIUsage(a, rec.Time)
+	t.dirty = true
+}
+
+// ヘルパー関数：古い日別集計と先月以前の月別集計を捨てる
+func pruneAIUsage(a *aiUsageAccount, now time.Time) {
+	cutoff := now.AddDate(0, 0, -aiUsageKeepDays).Format("2006-01-02")
+	for key := range a.Daily {
+		if key < cutoff {
+			delete(a.Daily, key)
+		}
+	}
+	thisMonth := now.Format("2006-01")
+	for key := range a.Monthly {
+		if key < thisMonth {
+			delete(a.Monthly, key)
+		}
+	}
+}
+
+// ヘルパー関数：一定間隔で変更を保存する
+func (t *aiUsageTracker) flushLoop() {
+	ticker := time.NewTicker(aiUsageFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := t.Flush(); err != nil {
+			log.Printf("AI利用量の保存に失敗: %v", err)
+		}
+	}
+}
+
+// 保存していない変更があればファイルに書き出す（使われなくなったユーザーの古い集計もここで捨てる）
+func (t *aiUsageTracker) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.dirty || t.path == "" {
+		return nil
+	}
+
+	now := time.Now()
+	for user, a := range t.accounts {
+		pruneAIUsage(a, now)
+		if len(a.Daily) == 0 && len(a.Monthly) == 0 && t.pending[user] == 0 {
+			delete(t.accounts, user)
+		}
+	}
+	if err := t.save(); err != nil {
+		return err
+	}
+	t.dirty = false
+	return nil
+}
+
+// ヘルパー関数：利用状況をファイルに保存（ロックを取ってから呼ぶ）
+func (t *aiUsageTracker) save() error {
+	data, err := json.MarshalIndent(t.accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// ユーザーの利用状況のスナップショット
+func (t *aiUsageTracker) Snapshot(user string) (aiUsageCounter, aiUsageCounter, []aiUsageRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var day, month aiUsageCounter
+	a, ok := t.accounts[user]
+	if !ok {
+		return day, month, []aiUsageRecord{}
+	}
+	if d := a.Daily[now.Format("2006-01-02")]; d != nil {
+		day = *d
+	}
+	if m := a.Monthly[now.Format("2006-01")]; m != nil {
+		month = *m
+	}
+	recent := make([]aiUsageRecord, len(a.Recent))
+	copy(recent, a.Recent)
+	return day, month, recent
+}
+
+// 利用量を記録するプロバイダーのラッパー
+type meteredProvider struct {
+	LLMProvider
+	user    string
+	tracker *aiUsageTracker
+}
+
+func (m *meteredProvider) Generate(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	reservation, err := m.tracker.Check(m.user)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.LLMProvider.Generate(ctx, req)
+	if err != nil {
+		m.tracker.Release(reservation)
+		return nil, err
+	}
+	m.record(reservation, req, resp.InputTokens, resp.OutputTokens, resp.Text)
+	return resp, nil
+}
+
+func (m *meteredProvider) Stream(ctx context.Context, req LLMRequest, onChunk func(text string) error) error {
+	reservation, err := m.tracker.Check(m.user)
+	if err != nil {
+		return err
+	}
+	var output strings.Builder
+	err = m.LLMProvider.Stream(ctx, req, func(text string) error {
+		output.WriteString(text)
+		return onChunk(text)
+	})
+	if err != nil && output.Len() == 0 {
+		// 何も生成されなかった呼び出しは数えない
+		m.tracker.Release(reservation)
+		return err
+	}
+	// 中断された場合も、それまでに生成された分は記録する
+	m.record(reservation, req, 0, 0, output.String())
+	return err
+}
+
+// ヘルパー関数：トークン数を記録（プロバイダーが返さない場合は概算）
+func (m *meteredProvider) record(reservation *aiUsageReservation, req LLMRequest, inputTokens, outputTokens int, output string) {
+	if inputTokens == 0 {
+		inputTokens = estimateTokens(req.System + req.Prompt)
+	}
+	if outputTokens == 0 {
+		outputTokens = estimateTokens(output)
+	}
+	m.tracker.Record(reservation, aiUsageRecord{
+		Time:         time.Now(),
+		Provider:     m.Name(),
+		Model:        m.Model(),
+		InputTokens:  inputTokens,
+		OutputTokens: outputTokens,
+	})
+}
+
+// ヘルパー関数：リクエストのユーザー向けにAIプロバイダーを解決し、利用量の記録と上限判定を付ける
+// リクエストで指定がなければユーザー設定（ai_provider / ai_model）を使い、どちらも許可リストにあるものに限る
+// 上限はここでは判定しない（上限に達していてもキャッシュ済みの結果は返せるように、実際に呼び出すときに判定する）
+func resolveLLMForRequest(c *gin.Context, providerName, modelName string) (LLMProvider, error) {
+	if providerName == "" && modelName == "" {
+		if settings := userTenkaiSettings(c); settings != nil && (settings.AIProvider != "" || settings.AIModel != "") {
+			// 許可されていない・使えないユーザー設定はデフォルトに戻す
+			if provider, err := resolveLLM(settings.AIProvider, settings.AIModel); err == nil && llmAllowed(provider) {
+				providerName, modelName = settings.AIProvider, settings.AIModel
+			}
+		}
+	}
+
+	provider, err := resolveLLM(providerName, modelName)
+	if err != nil {
+		return nil, err
+	}
+	if !llmAllowed(provider) {
+		return nil, fmt.Errorf("このサーバーでは %s:%s は使えません（AI_ALLOWED_MODELS）", provider.Name(), provider.Model())
+	}
+
+	return &meteredProvider{LLMProvider: provider, user: aiUserID(c), tracker: aiUsage}, nil
+}
+
+// ヘルパー関数：呼び出す前に上限に達していないか調べる（キャッシュになく、準備に手間のかかる呼び出しで先に断るため）
+func checkAIQuota(provider LLMProvider) error {
+	metered, ok := provider.(*meteredProvider)
+	if !ok {
+		return nil
+	}
+	return metered.tracker.Available(metered.user)
+}
+
+// ヘルパー関数：プロバイダーとモデルの組が使えるか（デフォルトのプロバイダーの既定モデル、許可リスト、有効な fake）
+func llmAllowed(provider LLMProvider) bool {
+	name, model := provider.Name(), provider.Model()
+	if name == "fake" {
+		return config.AI.EnableFake
+	}
+	if name == config.AI.Provider {
+		if (name == "gemini" && model == config.Gemini.Model) || (name == "openai" && model == config.AI.OpenAI.Model) {
+			return true
+		}
+	}
+	for _, m := range config.AI.AllowedModels {
+		p, allowed, _ := strings.Cut(m, ":")
+		if p == name && (allowed == "*" || allowed == model) {
+			return true
+		}
+	}
+	return false
+}
+
+// ヘルパー関数：AI利用量を集計するユーザーの識別子（GitHubユーザー、未ログインはIPアドレス）
+func aiUserID(c *gin.Context) string {
+	if session := getSession(sessionIDFromRequest(c)); session != nil {
+		return "github:" + session.Login
+	}
+	if token := bearerToken(c); token != "" {
+		if login := cachedGitHubLogin(token); login != "" {
+			return "github:" + login
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// AI利用量の集計先のキャッシュ（AI呼び出しのたびにトークンからGitHubユーザーを問い合わせないようにする）
+const aiUserCacheTTL = 5 * time.Minute
+
+type aiUserCacheEntry struct {
+	login     string
+	expiresAt time.Time
+}
+
+var (
+	aiUserCacheMu sync.Mutex
+	aiUserCache   = make(map[string]aiUserCacheEntry)
+)
+
+// ヘルパー関数：トークンのGitHubユーザー名（取得できない場合は空文字。失敗もキャッシュする）
+func cachedGitHubLogin(accessToken string) string {
+	key := accessTokenKey(accessToken)
+	aiUserCacheMu.Lock()
+	entry, ok := aiUserCache[key]
+	aiUserCacheMu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.login
+	}
+
+	login := ""
+	if user, err := getGitHubUser(accessToken); err == nil {
+		login = user.Login
+	}
+
+	aiUserCacheMu.Lock()
+	defer aiUserCacheMu.Unlock()
+	now := time.Now()
+	for k, v := range aiUserCache {
+		if now.After(v.expiresAt) {
+			delete(aiUserCache, k)
+		}
+	}
+	aiUserCache[key] = aiUserCacheEntry{login: login, expiresAt: now.Add(aiUserCacheTTL)}
+	return login
+}
+
+// ヘルパー関数：AI呼び出しのエラー応答（利用上限の場合は429で上限の案内を返す）
+func respondAIError(c *gin.Context, status int, message string, err error) {
+	var qe *quotaError
+	if errors.As(err, &qe) {
+		c.JSON(http.StatusTooManyRequests, Response{
+			Success: false,
+			Message: qe.Error(),
+			Error:   "quota_exceeded",
+		})
+		return
+	}
+	c.JSON(status, Response{
+		Success: false,
+		Message: message,
+		Error:   err.Error(),
+	})
+}
+
+// AI利用状況
+func handleAIUsage(c *gin.Context) {
+	user := aiUserID(c)
+	day, month, recent := aiUsage.Snapshot(user)
+
+	limits := aiUsage.cfg
+	remaining := func(limit, used int) interface{} {
+		if limit <= 0 {
+			return nil // 無制限
+		}
+		if used >= limit {
+			return 0
+		}
+		return limit - used
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"user":   user,
+			"today":  day,
+			"month":  month,
+			"recent": recent,
+			"limits": map[string]int{
+				"dailyRequests":     limits.DailyRequests,
+				"dailyTokens":       limits.DailyTokens,
+				"monthlyRequests":   limits.MonthlyRequests,
+				"monthlyTokens":     limits.MonthlyTokens,
+				"requestsPerMinute": limits.RequestsPerMinute,
+			},
+			"remaining": map[string]interface{}{
+				"dailyRequests":   remaining(limits.DailyRequests, day.Requests),
+				"dailyTokens":     remaining(limits.DailyTokens, day.InputTokens+day.OutputTokens),
+				"monthlyRequests": remaining(limits.MonthlyRequests, month.Requests),
+				"monthlyTokens":   remaining(limits.MonthlyTokens, month.InputTokens+month.OutputTokens),
+			},
+		},
+	})
+}
+
+// ===== AI結果のキャッシュ =====
+
+// キャッシュのキー（同じプロバイダー・モデル・テンプレート版・入力なら同じ結果を返す）
+type aiCacheKey struct {
+	Provider string
+	Model    string
+	Template string // テンプレート名（テンプレートを使わない場合は用途名）
+	Version  int
+	Input    string // 入力（展開後のプロンプトなど）。キーにはハッシュだけを使う
+}
+
+// ヘルパー関数：キーの文字列表現
+func (k aiCacheKey) String() string {
+	sum := sha256.Sum256([]byte(k.Input))
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%d\x00%x", k.Provider, k.Model, k.Template, k.Version, sum)
+}
+
+type aiCacheEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+// AI結果のキャッシュ（件数の上限を超えたら古いものから捨てる）
+type aiResultCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	order      *list.List // 先頭が最近使ったもの
+	items      map[string]*list.Element
+}
+
+// AI結果のキャッシュを作成
+func newAIResultCache(cfg AICacheConfig) *aiResultCache {
+	return &aiResultCache{
+		ttl:        time.Duration(cfg.TTL) * time.Second,
+		maxEntries: cfg.MaxEntries,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// キャッシュから取得（期限切れは捨てる）
+func (rc *aiResultCache) Get(key aiCacheKey) (string, bool) {
+	if rc.maxEntries <= 0 {
+		return "", false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	k := key.String()
+	el, ok := rc.items[k]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*aiCacheEntry)
+	if time.Now().After(entry.expires) {
+		rc.order.Remove(el)
+		delete(rc.items, k)
+		return "", false
+	}
+	rc.order.MoveToFront(el)
+	return entry.value, true
+}
+
+// キャッシュに保存
+func (rc *aiResultCache) Put(key aiCacheKey, value string) {
+	if rc.maxEntries <= 0 {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	k := key.String()
+	expires := time.Now().Add(rc.ttl)
+	if el, ok := rc.items[k]; ok {
+		entry := el.Value.(*aiCacheEntry)
+		entry.value, entry.expires = value, expires
+		rc.order.MoveToFront(el)
+		return
+	}
+	rc.items[k] = rc.order.PushFront(&aiCacheEntry{key: k, value: value, expires: expires})
+	for rc.order.Len() > rc.maxEntries {
+		oldest := rc.order.Back()
+		rc.order.Remove(oldest)
+		delete(rc.items, oldest.Value.(*aiCacheEntry).key)
+	}
+}
+
+// ヘルパー関数：キャッシュがあればそれを返し、なければ生成して保存する（bypass で常に生成し直す）
+func generateCached(ctx context.Context, provider LLMProvider, template string, version int, req LLMRequest, bypass bool) (string, bool, error) {
+	key := aiCacheKey{
+		Provider: provider.Name(),
+		Model:    provider.Model(),
+		Template: template,
+		Version:  version,
+		Input:    req.System + "\x00" + req.Prompt,
+	}
+	if !bypass {
+		if text, ok := aiCache.Get(key); ok {
+			return text, true, nil
+		}
+	}
+
+	resp, err := provider.Generate(ctx, req)
+	if err != nil {
+		return "", false, err
+	}
+	aiCache.Put(key, resp.Text)
+	return resp.Text, false, nil
+}
+
+// ヘルパー関数：キャッシュキーに使うテンプレート名と版（テンプレートを使わない場合は用途名と0）
+func promptTemplateIdentity(pt *PromptTemplate, fallback string) (string, int) {
+	if pt == nil {
+		return fallback, 0
+	}
+	return pt.Source + ":" + pt.Name, pt.Version
+}
+
+// ===== 修正依頼・校正依頼の説明文の下書き =====
+
+// 説明文の下書きリクエスト
+type IraiDraftRequest struct {
+	AccessToken string `json:"access_token"` // 省略時はセッションから解決
+	Repository  string `json:"repository" binding:"required"`
+	Branch      string `json:"branch" binding:"required"`
+	BaseBranch  string `json:"base_branch"` // デフォルト: main
+	Kind        string `json:"kind"`        // "shusei"（修正依頼）または "kousei"（校正依頼）
+	Provider    string `json:"provider"`
+	Model       string `json:"model"`
+}
+
+// GitHubのブランチ比較結果（必要な項目のみ）
+type githubComparison struct {
+	TotalCommits int `json:"total_commits"`
+	Commits      []struct {
+		Commit struct {
+			Message string `json:"message"`
+		} `json:"commit"`
+	} `json:"commits"`
+	Files []struct {
+		Filename  string `json:"filename"`
+		Status    string `json:"status"`
+		Additions int    `json:"additions"`
+		Deletions int    `json:"deletions"`
+		Patch     string `json:"patch"`
+	} `json:"files"`
+}
+
+// 修正依頼・校正依頼のタイトルと説明文をAIで下書き（作成前に編集できるよう、PRは作らない）
+func handleIraiDraft(c *gin.Context) {
+	var req IraiDraftRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	accessToken := resolveAccessToken(c, req.AccessToken)
+	if accessToken == "" {
+		c.JSON(http.StatusUnauthorized, Response{
+			Success: false,
+			Message: "認証が必要です",
+		})
+		return
+	}
+
+	baseBranch := req.BaseBranch
+	if baseBranch == "" {
+		baseBranch = "main"
+	}
+
+	title, description, err := draftIraiDescription(c, accessToken, req.Repository, baseBranch, req.Branch, req.Kind, req.Provider, req.Model)
+	if err != nil {
+		respondAIError(c, http.StatusInternalServerError, "説明文の下書きに失敗しました", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"title":       title,
+			"description": description,
+			"branch":      req.Branch,
+			"base_branch": baseBranch,
+		},
+	})
+}
+
+// ヘルパー関数：ブランチ間の差分からタイトルと説明文を生成する
+func draftIraiDescription(c *gin.Context, accessToken, repository, base, head, kind, providerName, modelName string) (string, string, error) {
+	provider, err := resolveLLMForRequest(c, providerName, modelName)
+	if err != nil {
+		return "", "", err
+	}
+	if err := checkAIQuota(provider); err != nil {
+		return "", "", err
+	}
+
+	comparison, err := fetchBranchComparison(accessToken, repository, base, head)
+	if err != nil {
+		return "", "", err
+	}
+	if comparison.TotalCommits == 0 && len(comparison.Files) == 0 {
+		return "", "", fmt.Errorf("草案「%s」には「%s」からの変更がありません", head, base)
+	}
+
+	focus := "作者が意図した変更が反映されているか、読み返してほしい箇所"
+	if kind == "kousei" {
+		focus = "校正者・編集者が重点的に確認すべき点（表記、事実関係、前後のつながりなど）"
+	}
+
+	prompt := fmt.Sprintf(`以下は小説原稿の草案「%s」と「%s」の差分です（"+" は追加、"-" は削除された文章）。
+この変更をレビューしてもらうための、日本語のタイトルと説明文を作成してください。
+
+- 1行目は40文字以内のタイトル
+- 空行を挟んで、次の見出しで説明文を書く
+  ## 変更の概要
+  ## 章ごとの変更（ファイルごとに箇条書き）
+  ## 確認してほしい点（%s）
+- タイトルと説明文以外は出力しない
+
+%s`, head, base, focus, summarizeComparison(comparison))
+
+	resp, err := provider.Generate(c.Request.Context(), LLMRequest{Prompt: prompt})
+	if err != nil {
+		return "", "", err
+	}
+
+	message := formatCommitMessage(resp.Text)
+	if message == "" {
+		return "", "", fmt.Errorf("AIの出力が空でした")
+	}
+	title, description, _ := strings.Cut(message, "\n\n")
+	return title, description, nil
+}
+
+// ヘルパー関数：GitHubでブランチを比較する
+func fetchBranchComparison(accessToken, repository, base, head string) (*githubComparison, error) {
+	owner, name, _ := strings.Cut(repository, "/")
+	compareURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/compare/%s...%s",
+		url.PathEscape(owner), url.PathEscape(name), url.PathEscape(base), url.PathEscape(head))
+	req, _ := http.NewRequest("GET", compareURL, nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", "tenkai-app")
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("ブランチの比較に失敗しました（%d）: %s", resp.StatusCode, string(body))
+	}
+
+	var comparison githubComparison
+	if err := json.NewDecoder(resp.Body).Decode(&comparison); err != nil {
+		return nil, err
+	}
+	return &comparison, nil
+}
+
+// AIに渡すコミットの件数の上限
+const comparisonCommitLimit = 30
+
+// ヘルパー関数：コミットと差分をAIに渡せる大きさにまとめる
+func summarizeComparison(comparison *githubComparison) string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("【コミット（%d件）】\n", comparison.TotalCommits))
+	for i, commit := range comparison.Commits {
+		if i == comparisonCommitLimit {
+			sb.WriteString(fmt.Sprintf("（ほか%d件は省略）\n", comparison.TotalCommits-comparisonCommitLimit))
+			break
+		}
+		subject, _, _ := strings.Cut(commit.Commit.Message, "\n")
+		sb.WriteString("- " + subject + "\n")
+	}
+
+	sb.WriteString("\n【変更されたファイル】\n")
+	total, omitted := utf8.RuneCountInString(sb.String()), 0 // total は sb の文字数
+	for _, f := range comparison.Files {
+		entry := fmt.Sprintf("=== %s（%s、+%d -%d）\n", f.Filename, f.Status, f.Additions, f.Deletions)
+		if f.Patch != "" {
+			patch := f.Patch
+			if manuscriptExtensions[strings.ToLower(path.Ext(f.Filename))] {
+				patch = plainPatch(patch)
+			}
+			entry += truncateRunes(patch, diffSummaryFileLimit) + "\n"
+		}
+		n := utf8.RuneCountInString(entry)
+		if total+n > diffSummaryTotalLimit {
+			omitted++
+			continue
+		}
+		sb.WriteString(entry)
+		total += n
+	}
+	if omitted > 0 {
+		sb.WriteString(fmt.Sprintf("（ほか%dファイルは省略）\n", omitted))
+	}
+	return sb.String()
+}
+
+// ヘルパー関数：unified diff の各行からルビや注記の記法を除く（記法の書き換えだけの行は省く）
+func plainPatch(patch string) string {
+	lines := strings.Split(patch, "\n")
+	var kept []string
+	for _, line := range lines {
+		if line == "" || strings.HasPrefix(line, "@@") {
+			kept = append(kept, line)
+			continue
+		}
+		plain, _ := parseAozora(line[1:]).PlainText()
+		kept = append(kept, line[:1]+plain)
+	}
+
+	// 本文が同じ削除行と追加行の組を取り除く
+	var result []string
+	for i := 0; i < len(kept); i++ {
+		line := kept[i]
+		if strings.HasPrefix(line, "-") {
+			j := i + 1
+			for j < len(kept) && strings.HasPrefix(kept[j], "-") {
+				j++
+			}
+			removed, added := kept[i:j], []string{}
+			k := j
+			for k < len(kept) && strings.HasPrefix(kept[k], "+") {
+				added = append(added, kept[k])
+				k++
+			}
+			if len(removed) == len(added) {
+				same := true
+				for n := range removed {
+					if removed[n][1:] != added[n][1:] {
+						same = false
+						break
+					}
+				}
+				if same {
+					i = k - 1
+					continue
+				}
+			}
+			result = append(result, kept[i:k]...)
+			i = k - 1
+			continue
+		}
+		result = append(result, line)
+	}
+	return strings.Join(result, "\n")
+}
+
+// ===== 関数呼び出し（function calling） =====
+
+// モデルに渡す関数の定義
+type LLMTool struct {
+	Name        string
+	Description string
+	Parameters  []LLMToolParam
+}
+
+// 関数の引数（Type は "string", "integer", "array"（文字列の配列））
+type LLMToolParam struct {
+	Name        string
+	Type        string
+	Description string
+	Required    bool
+}
+
+// モデルからの関数呼び出し
+type LLMToolCall struct {
+	ID   string
+	Name string
+	Args map[string]interface{}
+}
+
+// 関数の実行結果
+type LLMToolResult struct {
+	CallID  string
+	Name    string
+	Content map[string]interface{}
+}
+
+// 関数呼び出しを含む会話の1件（Role: "user", "assistant", "tool"）
+type LLMMessage struct {
+	Role    string
+	Text    string
+	Calls   []LLMToolCall   // Role = "assistant"
+	Results []LLMToolResult // Role = "tool"
+}
+
+// 関数呼び出しに対する応答（Calls が空ならテキストだけの返答）
+type LLMToolResponse struct {
+	Text         string
+	Calls        []LLMToolCall
+	InputTokens  int
+	OutputTokens int
+}
+
+// 関数呼び出しに対応したプロバイダー
+type LLMToolCaller interface {
+	GenerateWithTools(ctx context.Context, system string, messages []LLMMessage, tools []LLMTool) (*LLMToolResponse, error)
+}
+
+func (g *geminiProvider) GenerateWithTools(ctx context.Context, system string, messages []LLMMessage, tools []LLMTool) (*LLMToolResponse, error) {
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("会話が空です")
+	}
+
+	m := g.generativeModel(LLMRequest{System: system})
+	decls := make([]*genai.FunctionDeclaration, len(tools))
+	for i, t := range tools {
+		schema := &genai.Schema{Type: genai.TypeObject, Properties: make(map[string]*genai.Schema)}
+		for _, p := range t.Parameters {
+			prop := &genai.Schema{Type: genai.TypeString, Description: p.Description}
+			switch p.Type {
+			case "integer":
+				prop.Type = genai.TypeInteger
+			case "array":
+				prop.Type = genai.TypeArray
+				prop.Items = &genai.Schema{Type: genai.TypeString}
+			}
+			schema.Properties[p.Name] = prop
+			if p.Required {
+				schema.Required = append(schema.Required, p.Name)
+			}
+		}
+		decls[i] = &genai.FunctionDeclaration{Name: t.Name, Description: t.Description, Parameters: schema}
+	}
+	m.Tools = []*genai.Tool{{FunctionDeclarations: decls}}
+
+	contents := make([]*genai.Content, len(messages))
+	for i, msg := range messages {
+		content := &genai.Content{Role: "user"}
+		if msg.Text != "" {
+			content.Parts = append(content.Parts, genai.Text(msg.Text))
+		}
+		if msg.Role == "assistant" {
+			content.Role = "model"
+			for _, call := range msg.Calls {
+				content.Parts = append(content.Parts, genai.FunctionCall{Name: call.Name, Args: call.Args})
+			}
+		}
+		for _, r := range msg.Results {
+			content.Parts = append(content.Parts, genai.FunctionResponse{Name: r.Name, Response: r.Content})
+		}
+		contents[i] = content
+	}
+
+	cs := m.StartChat()
+	cs.History = contents[:len(contents)-1]
+	resp, err := cs.SendMessage(ctx, contents[len(contents)-1].Parts...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &LLMToolResponse{Text: geminiText(resp)}
+	for _, cand := range resp.Candidates {
+		if cand.Content == nil {
+			continue
+		}
+		for _, part := range cand.Content.Parts {
+			if call, ok := part.(genai.FunctionCall); ok {
+				result.Calls = append(result.Calls, LLMToolCall{
+					ID:   fmt.Sprintf("call_%d", len(result.Calls)),
+					Name: call.Name,
+					Args: call.Args,
+				})
+			}
+		}
+	}
+	return result, nil
+}
+
+// OpenAI互換APIの関数呼び出し用メッセージ
+type openAIToolMessage struct {
+	Role       string           `json:"role"`
+	Content    string           `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"` // JSON文字列
+	} `json:"function"`
+}
+
+type openAIToolChoiceResponse struct {
+	Choices []struct {
+		Message openAIToolMessage `json:"message"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+func (o *openAIProvider) GenerateWithTools(ctx context.Context, system string, messages []LLMMessage, tools []LLMTool) (*LLMToolResponse, error) {
+	var chat []openAIToolMessage
+	if system != "" {
+		chat = append(chat, openAIToolMessage{Role: "system", Content: system})
+	}
+	for _, msg := range messages {
+		switch msg.Role {
+		case "assistant":
+			m := openAIToolMessage{Role: "assistant", Content: msg.Text}
+			for _, call := range msg.Calls {
+				args, _ := json.Marshal(call.Args)
+				tc := openAIToolCall{ID: call.ID, Type: "function"}
+				tc.Function.Name = call.Name
+				tc.Function.Arguments = string(args)
+				m.ToolCalls = append(m.ToolCalls, tc)
+			}
+			chat = append(chat, m)
+		case "tool":
+			for _, r := range msg.Results {
+				content, _ := json.Marshal(r.Content)
+				chat = append(chat, openAIToolMessage{Role: "tool", Content: string(content), ToolCallID: r.CallID})
+			}
+		default:
+			chat = append(chat, openAIToolMessage{Role: "user", Content: msg.Text})
+		}
+	}
+
+	var defs []map[string]interface{}
+	for _, t := range tools {
+		properties := make(map[string]interface{})
+		required := []string{}
+		for _, p := range t.Parameters {
+			prop := map[string]interface{}{"type": p.Type, "description": p.Description}
+			if p.Type == "array" {
+				prop["items"] = map[string]string{"type": "string"}
+			}
+			properties[p.Name] = prop
+			if p.Required {
+				required = append(required, p.Name)
+			}
+		}
+		defs = append(defs, map[string]interface{}{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        t.Name,
+				"description": t.Description,
+				"parameters": map[string]interface{}{
+					"type":       "object",
+					"properties": properties,
+					"required":   required,
+				},
+			},
+		})
+	}
+
+	resp, err := o.post(ctx, map[string]interface{}{
+		"model":       o.model,
+		"messages":    chat,
+		"temperature": o.temperature,
+		"tools":       defs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result openAIToolChoiceResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Choices) == 0 {
+		return nil, fmt.Errorf("OpenAI API returned no choices")
+	}
+
+	message := result.Choices[0].Message
+	out := &LLMToolResponse{
+		Text:         message.Content,
+		InputTokens:  result.Usage.PromptTokens,
+		OutputTokens: result.Usage.CompletionTokens,
+	}
+	for _, tc := range message.ToolCalls {
+		args := make(map[string]interface{})
+		if tc.Function.Arguments != "" {
+			if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil {
+				return nil, fmt.Errorf("関数「%s」の引数を解釈できませんでした: %v", tc.Function.Name, err)
+			}
+		}
+		out.Calls = append(out.Calls, LLMToolCall{ID: tc.ID, Name: tc.Function.Name, Args: args})
+	}
+	return out, nil
+}
+
+// fake では、発言中の `関数名({"引数":"値"})` をそのまま関数呼び出しとして返す（オフラインでの動作確認用）
+var fakeToolCallPattern = regexp.MustCompile(`([a-z_]+)\((\{[^()]*\})?\)`)
+
+func (f *fakeProvider) GenerateWithTools(ctx context.Context, system string, messages []LLMMessage, tools []LLMTool) (*LLMToolResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	last := messages[len(messages)-1]
+	if last.Role != "user" {
+		return &LLMToolResponse{Text: fmt.Sprintf("[fake:%s] %d件の関数を呼び出しました", f.model, len(last.Results))}, nil
+	}
+
+	known := make(map[string]bool, len(tools))
+	for _, t := range tools {
+		known[t.Name] = true
+	}
+
+	resp := &LLMToolResponse{}
+	for _, m := range fakeToolCallPattern.FindAllStringSubmatch(last.Text, -1) {
+		if !known[m[1]] {
+			continue
+		}
+		args := make(map[string]interface{})
+		if m[2] != "" {
+			if err := json.Unmarshal([]byte(m[2]), &args); err != nil {
+				return nil, err
+			}
+		}
+		resp.Calls = append(resp.Calls, LLMToolCall{ID: fmt.Sprintf("call_%d", len(resp.Calls)), Name: m[1], Args: args})
+	}
+	if len(resp.Calls) == 0 {
+		resp.Text = fmt.Sprintf("[fake:%s] 該当する操作がありません", f.model)
+	}
+	return resp, nil
+}
+
+func (m *meteredProvider) GenerateWithTools(ctx context.Context, system string, messages []LLMMessage, tools []LLMTool) (*LLMToolResponse, error) {
+	caller, ok := m.LLMProvider.(LLMToolCaller)
+	if !ok {
+		return nil, fmt.Errorf("%s は関数呼び出しに対応していません", m.Name())
+	}
+	reservation, err := m.tracker.Check(m.user)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := caller.GenerateWithTools(ctx, system, messages, tools)
+	if err != nil {
+		m.tracker.Release(reservation)
+		return nil, err
+	}
+
+	inputTokens, outputTokens := resp.InputTokens, resp.OutputTokens
+	if inputTokens == 0 {
+		data, _ := json.Marshal(messages)
+		inputTokens = estimateTokens(system + string(data))
+	}
+	if outputTokens == 0 {
+		data, _ := json.Marshal(resp.Calls)
+		outputTokens = estimateTokens(resp.Text + string(data))
+	}
+	m.tracker.Record(reservation, aiUsageRecord{
+		Time:         time.Now(),
+		Provider:     m.Name(),
+		Model:        m.Model(),
+		InputTokens:  inputTokens,
+		OutputTokens: outputTokens,
+	})
+	return resp, nil
+}
+
+// ===== Gitアシスタント（自然文での操作） =====
+
+// アシスタントへの依頼
+type AssistantPlanRequest struct {
+	AccessToken string `json:"access_token"` // 省略時はセッションから解決（校正依頼に使用）
+	Message     string `json:"message" binding:"required"`
+	Repository  string `json:"repository"` // 校正依頼を出すGitHubリポジトリ（owner/name）
+	Provider    string `json:"provider"`
+	Model       string `json:"model"`
+}
+
+// 計画の実行リクエスト
+type AssistantExecuteRequest struct {
+	AccessToken string `json:"access_token"`
+	PlanID      string `json:"planId" binding:"required"`
+}
+
+// 計画した操作1件
+type assistantAction struct {
+	Tool    string                 `json:"tool"`
+	Args    map[string]interface{} `json:"args"`
+	Summary string                 `json:"summary"` // 確認用の説明
+}
+
+// 確認待ちの計画
+type assistantPlan struct {
+	ID         string            `json:"id"`
+	User       string            `json:"-"`
+	Repository string            `json:"repository"`
+	Message    string            `json:"message"`
+	Actions    []assistantAction `json:"actions"`
+	ExpiresAt  time.Time         `json:"expiresAt"`
+}
+
+// 計画の有効期限と、1回の依頼でのモデルとのやり取りの上限
+const (
+	assistantPlanTTL   = 10 * time.Minute
+	assistantMaxRounds = 5
+)
+
+var (
+	assistantPlansMu sync.Mutex
+	assistantPlans   = make(map[string]*assistantPlan)
+)
+
+// アシスタントが使える操作
+var assistantTools = []LLMTool{
+	{
+		Name:        "history",
+		Description: "保存履歴（コミット）を新しい順に取得する。日時から版を特定するときに使う。読み取りのみ",
+		Parameters: []LLMToolParam{
+			{Name: "limit", Type: "integer", Description: "取得する件数（既定20）"},
+			{Name: "path", Type: "string", Description: "このファイルまたはフォルダを変更した履歴だけに絞る"},
+		},
+	},
+	{
+		Name:        "restore",
+		Description: "指定した版（コミット）の内容に戻して保存する。path を指定するとそのファイル・フォルダだけを戻す",
+		Parameters: []LLMToolParam{
+			{Name: "commit", Type: "string", Description: "戻す版のコミットID（history で取得したもの）", Required: true},
+			{Name: "path", Type: "string", Description: "戻すファイルまたはフォルダ（省略時は全体）"},
+		},
+	},
+	{
+		Name:        "draft_create",
+		Description: "新しい草案（ブランチ）を作成して切り替える",
+		Parameters: []LLMToolParam{
+			{Name: "name", Type: "string", Description: "草案名", Required: true},
+		},
+	},
+	{
+		Name:        "draft_switch",
+		Description: "既存の草案（ブランチ）に切り替える",
+		Parameters: []LLMToolParam{
+			{Name: "name", Type: "string", Description: "草案名", Required: true},
+		},
+	},
+	{
+		Name:        "souan_teishutsu",
+		Description: "草案提出：原稿ファイルの変更を保存（コミット）し、現在の草案をGitHubに送る。校正依頼の前に使う",
+		Parameters: []LLMToolParam{
+			{Name: "message", Type: "string", Description: "保存メッセージ（日本語）"},
+			{Name: "base_branch", Type: "string", Description: "GitHubに草案がない場合の作成元（省略時は main）"},
+		},
+	},
+	{
+		Name:        "kousei_irai",
+		Description: "校正依頼：草案をGitHubでレビュー付きのプルリクエストとして提出する",
+		Parameters: []LLMToolParam{
+			{Name: "branch", Type: "string", Description: "提出する草案名（省略時は現在の草案）"},
+			{Name: "base_branch", Type: "string", Description: "取り込み先（省略時は main）"},
+			{Name: "title", Type: "string", Description: "タイトル（省略時は差分から自動生成）"},
+			{Name: "reviewers", Type: "array", Description: "校正をお願いするGitHubユーザー名"},
+		},
+	},
+}
+
+// 自然文の依頼から操作の計画を作る（読み取り以外の操作はまだ実行しない）
+func handleAssistantPlan(c *gin.Context) {
+	var req AssistantPlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if repo == nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "先に初期化してください",
+		})
+		return
+	}
+
+	provider, err := resolveLLMForRequest(c, req.Provider, req.Model)
+	if err != nil {
+		respondAIError(c, http.StatusBadRequest, "AI機能が初期化されていません", err)
+		return
+	}
+	caller, ok := provider.(LLMToolCaller)
+	if !ok {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "このAIプロバイダーは関数呼び出しに対応していません",
+		})
+		return
+	}
+	if err := checkAIQuota(provider); err != nil {
+		respondAIError(c, http.StatusInternalServerError, "依頼の解釈に失敗しました", err)
+		return
+	}
+
+	plan := &assistantPlan{
+		User:       aiUserID(c),
+		Repository: req.Repository,
+		Message:    req.Message,
+		Actions:    []assistantAction{},
+	}
+
+	messages := []LLMMessage{{Role: "user", Text: req.Message}}
+	reply := ""
+	for round := 0; round < assistantMaxRounds; round++ {
+		resp, err := caller.GenerateWithTools(c.Request.Context(), assistantSystemPrompt(req.Repository), messages, assistantTools)
+		if err != nil {
+			respondAIError(c, http.StatusInternalServerError, "依頼の解釈に失敗しました", err)
+			return
+		}
+		reply = resp.Text
+		if len(resp.Calls) == 0 {
+			break
+		}
+
+		messages = append(messages, LLMMessage{Role: "assistant", Text: resp.Text, Calls: resp.Calls})
+		results := make([]LLMToolResult, len(resp.Calls))
+		for i, call := range resp.Calls {
+			results[i] = LLMToolResult{CallID: call.ID, Name: call.Name, Content: planAssistantCall(plan, call)}
+		}
+		messages = append(messages, LLMMessage{Role: "tool", Results: results})
+	}
+
+	if len(plan.Actions) == 0 {
+		c.JSON(http.StatusOK, Response{
+			Success: true,
+			Message: "実行する操作はありません",
+			Data: map[string]interface{}{
+				"reply":   reply,
+				"actions": plan.Actions,
+			},
+		})
+		return
+	}
+
+	id, err := randomToken(16)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "計画の作成に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+	plan.ID = id
+	plan.ExpiresAt = time.Now().Add(assistantPlanTTL)
+	storeAssistantPlan(plan)
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "次の操作を実行します。よろしければ確認してください",
+		Data: map[string]interface{}{
+			"planId":    plan.ID,
+			"reply":     reply,
+			"actions":   plan.Actions,
+			"expiresAt": plan.ExpiresAt,
+		},
+	})
+}
+
+// 確認済みの計画を実行
+func handleAssistantExecute(c *gin.Context) {
+	var req AssistantExecuteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// 計画は一度しか使えないので、実行できない状態では取り出さない
+	if repo == nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "先に初期化してください",
+		})
+		return
+	}
+
+	plan := consumeAssistantPlan(req.PlanID, aiUserID(c))
+	if plan == nil {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Message: "計画が見つからないか、有効期限が切れています。もう一度依頼してください",
+		})
+		return
+	}
+
+	accessToken := resolveAccessToken(c, req.AccessToken)
+	results := make([]map[string]interface{}, 0, len(plan.Actions))
+	for _, action := range plan.Actions {
+		data, err := executeAssistantAction(c, plan, action, accessToken)
+		if err != nil {
+			// 途中で失敗した場合は以降の操作を実行しない
+			results = append(results, map[string]interface{}{
+				"tool":    action.Tool,
+				"summary": action.Summary,
+				"success": false,
+				"error":   err.Error(),
+			})
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Message: fmt.Sprintf("「%s」の実行に失敗しました", action.Summary),
+				Error:   err.Error(),
+				Data:    results,
+			})
+			return
+		}
+		results = append(results, map[string]interface{}{
+			"tool":    action.Tool,
+			"summary": action.Summary,
+			"success": true,
+			"result":  data,
+		})
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("%d件の操作を実行しました", len(results)),
+		Data:    results,
+	})
+}
+
+// ヘルパー関数：アシスタントのシステムプロンプト（現在の状態を添える）
+func assistantSystemPrompt(repository string) string {
+	var sb strings.Builder
+	sb.WriteString(`あなたは小説の執筆アプリ「tenkai」のアシスタントです。作家の依頼を、用意された関数の呼び出しに置き換えてください。
+- 作家はGitの用語を知りません。「版」は保存履歴（コミット）、「草案」はブランチ、「提出する」は souan_teishutsu、「校正に出す」は kousei_irai です
+- 校正に出す前に、草案をGitHubに送るため souan_teishutsu を呼んでください
+- 日時で版を指定された場合は、まず history で該当するコミットを探してから restore を呼んでください
+- 章やファイルを指定された場合は、下のファイル一覧から該当する path を選んでください
+- history 以外の操作はすぐには実行されず、作家の確認後にまとめて実行されます
+- 依頼があいまいな場合は関数を呼ばずに、日本語で確認の質問を返してください
+`)
+	sb.WriteString("\n現在時刻: " + time.Now().Format("2006/01/02 15:04 (Mon)") + "\n")
+	if head, err := repo.Head(); err == nil {
+		sb.WriteString("現在の草案: " + head.Name().Short() + "\n")
+	}
+	if branches, err := repo.Branches(); err == nil {
+		var names []string
+		branches.ForEach(func(ref *plumbing.Reference) error {
+			names = append(names, ref.Name().Short())
+			return nil
+		})
+		sb.WriteString("草案一覧: " + strings.Join(names, ", ") + "\n")
+	}
+	if files, err := readWorkspaceManuscript(); err == nil {
+		sb.WriteString("原稿ファイル:\n")
+		for _, f := range files {
+			sb.WriteString("- " + f.Path + "\n")
+		}
+	}
+	if repository == "" {
+		sb.WriteString("GitHubリポジトリが指定されていないため、souan_teishutsu と kousei_irai は使えません\n")
+	}
+	return sb.String()
+}
+
+// ヘルパー関数：モデルからの関数呼び出しを検証し、計画に加える（history だけはその場で実行する）
+func planAssistantCall(plan *assistantPlan, call LLMToolCall) map[string]interface{} {
+	str := func(key string) string {
+		v, _ := call.Args[key].(string)
+		return strings.TrimSpace(v)
+	}
+	fail := func(format string, args ...interface{}) map[string]interface{} {
+		return map[string]interface{}{"error": fmt.Sprintf(format, args...)}
+	}
+
+	action := assistantAction{Tool: call.Name, Args: call.Args}
+	switch call.Name {
+	case "history":
+		limit := 20
+		if n, ok := call.Args["limit"].(float64); ok && n > 0 {
+			limit = int(n)
+		}
+		commits, err := recentCommits(limit, str("path"))
+		if err != nil {
+			return fail("履歴の取得に失敗しました: %v", err)
+		}
+		return map[string]interface{}{"commits": commits}
+
+	case "restore":
+		commit, err := resolveCommit(str("commit"))
+		if err != nil {
+			return fail("版「%s」が見つかりません", str("commit"))
+		}
+		target := "全体"
+		if p := str("path"); p != "" {
+			if _, err := workspacePath(p); err != nil {
+				return fail("%v", err)
+			}
+			target = p
+		}
+		subject, _, _ := strings.Cut(commit.Message, "\n")
+		action.Args = map[string]interface{}{"commit": commit.Hash.String(), "path": str("path")}
+		action.Summary = fmt.Sprintf("%sを「%s」（%s %s）の版に戻して保存", target, commit.Hash.String()[:7], commit.Author.When.Format("2006/01/02 15:04"), subject)
+
+	case "draft_create", "draft_switch":
+		name := str("name")
+		if name == "" {
+			return fail("草案名が必要です")
+		}
+		_, err := repo.Reference(plumbing.NewBranchReferenceName(name), false)
+		if call.Name == "draft_create" {
+			if err == nil {
+				return fail("草案「%s」はすでにあります", name)
+			}
+			action.Summary = fmt.Sprintf("草案「%s」を作成して切り替え", name)
+		} else {
+			if err != nil {
+				return fail("草案「%s」が見つかりません", name)
+			}
+			action.Summary = fmt.Sprintf("草案「%s」に切り替え", name)
+		}
+
+	case "souan_teishutsu":
+		if plan.Repository == "" {
+			return fail("GitHubリポジトリが指定されていません")
+		}
+		head, err := repo.Head()
+		if err != nil {
+			return fail("現在の草案がありません")
+		}
+		message := str("message")
+		if message == "" {
+			message = fmt.Sprintf("%s - 自動保存", time.Now().Format("2006/01/02 15:04:05"))
+		}
+		base := str("base_branch")
+		if base == "" {
+			base = "main"
+		}
+		action.Args = map[string]interface{}{"message": message, "base_branch": base}
+		action.Summary = fmt.Sprintf("原稿の変更を「%s」として保存し、草案「%s」をGitHubに提出", message, head.Name().Short())
+
+	case "kousei_irai":
+		if plan.Repository == "" {
+			return fail("GitHubリポジトリが指定されていません")
+		}
+		branch := str("branch")
+		if branch == "" {
+			if head, err := repo.Head(); err == nil {
+				branch = head.Name().Short()
+			}
+		}
+		base := str("base_branch")
+		if base == "" {
+			base = "main"
+		}
+		action.Args["branch"] = branch
+		action.Args["base_branch"] = base
+		action.Summary = fmt.Sprintf("草案「%s」を「%s」への校正依頼として提出", branch, base)
+		if reviewers := stringList(call.Args["reviewers"]); len(reviewers) > 0 {
+			action.Summary += "（校正者: " + strings.Join(reviewers, ", ") + "）"
+		}
+
+	default:
+		return fail("未対応の操作です: %s", call.Name)
+	}
+
+	plan.Actions = append(plan.Actions, action)
+	return map[string]interface{}{"status": "planned", "summary": action.Summary}
+}
+
+// ヘルパー関数：計画した操作を1件実行する
+func executeAssistantAction(c *gin.Context, plan *assistantPlan, action assistantAction, accessToken string) (interface{}, error) {
+	str := func(key string) string {
+		v, _ := action.Args[key].(string)
+		return v
+	}
+
+	switch action.Tool {
+	case "restore":
+		return restoreFromCommit(str("commit"), str("path"))
+
+	case "draft_create", "draft_switch":
+		if err := checkoutDraft(str("name"), action.Tool == "draft_create"); err != nil {
+			return nil, err
+		}
+		return map[string]string{"draft": str("name")}, nil
+
+	case "souan_teishutsu":
+		if accessToken == "" {
+			return nil, fmt.Errorf("草案提出にはGitHubへのログインが必要です")
+		}
+		return submitDraft(accessToken, plan.Repository, str("message"), str("base_branch"))
+
+	case "kousei_irai":
+		if accessToken == "" {
+			return nil, fmt.Errorf("校正依頼にはGitHubへのログインが必要です")
+		}
+		title, description := str("title"), ""
+		if title == "" {
+			var err error
+			title, description, err = draftIraiDescription(c, accessToken, plan.Repository, str("base_branch"), str("branch"), "kousei", "", "")
+			if err != nil {
+				return nil, err
+			}
+		}
+		reviewers := stringList(action.Args["reviewers"])
+		pr, err := createPullRequest(accessToken, plan.Repository, str("branch"), str("base_branch"), title, description+"\n\n📝 校正をお願いします", reviewers)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"pullRequestNumber": pr["number"],
+			"pullRequestURL":    pr["html_url"],
+			"reviewers":         reviewers,
+		}, nil
+	}
+	return nil, fmt.Errorf("未対応の操作です: %s", action.Tool)
+}
+
+// ヘルパー関数：草案提出（原稿ファイルの変更だけを手元に保存し、現在の草案の原稿をGitHubの同名のブランチに送る）
+// GitHubにブランチがなければ base から作成する。手元で削除した原稿ファイルはGitHubからは消さない
+func submitDraft(accessToken, repository, message, base string) (map[string]interface{}, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	branch := head.Name().Short()
+
+	w, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	status, err := w.Status()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for file, st := range status {
+		if (st.Staging != git.Unmodified || st.Worktree != git.Unmodified) && checkManuscriptPath(file) == nil {
+			paths = append(paths, file)
+		}
+	}
+	sort.Strings(paths)
+
+	commitID := ""
+	if len(paths) > 0 {
+		hash, err := commitWorkspace(message, paths...)
+		if err != nil {
+			return nil, err
+		}
+		commitID = hash.String()[:7]
+	}
+
+	// 保存済みの原稿をすべて送る（GitHubと同じ内容のファイルは putGitHubFiles が飛ばす）
+	tree := headCommitTree()
+	if tree == nil {
+		return nil, fmt.Errorf("保存された原稿がありません")
+	}
+	var files []SouanFile
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if checkManuscriptPath(f.Name) != nil {
+			return nil
+		}
+		content, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		files = append(files, SouanFile{Path: f.Name, Content: content, Mode: "100644"})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := ensureGitHubBranch(accessToken, repository, branch, base)
+	if err != nil {
+		return nil, fmt.Errorf("GitHubの草案の作成に失敗しました: %v", err)
+	}
+	committed, err := putGitHubFiles(accessToken, repository, branch, message, files)
+	if err != nil {
+		return nil, fmt.Errorf("ファイルのコミットに失敗しました: %v", err)
+	}
+
+	return map[string]interface{}{
+		"commit":         commitID,
+		"message":        message,
+		"branch":         branch,
+		"createdBranch":  created,
+		"committedFiles": committed,
+	}, nil
+}
+
+// ヘルパー関数：確認待ちの計画を保存（期限切れのものは掃除する）
+func storeAssistantPlan(plan *assistantPlan) {
+	assistantPlansMu.Lock()
+	defer assistantPlansMu.Unlock()
+
+	now := time.Now()
+	for id, p := range assistantPlans {
+		if now.After(p.ExpiresAt) {
+			delete(assistantPlans, id)
+		}
+	}
+	assistantPlans[plan.ID] = plan
+}
+
+// ヘルパー関数：計画を取り出す（1回限り。別のユーザーの計画は返さない）
+func consumeAssistantPlan(id, user string) *assistantPlan {
+	assistantPlansMu.Lock()
+	defer assistantPlansMu.Unlock()
+
+	plan, ok := assistantPlans[id]
+	if !ok || plan.User != user {
+		return nil
+	}
+	delete(assistantPlans, id)
+	if time.Now().After(plan.ExpiresAt) {
+		return nil
+	}
+	return plan
+}
+
+// ヘルパー関数：コミットIDや草案名から版を解決する
+func resolveCommit(revision string) (*object.Commit, error) {
+	if revision == "" {
+		return nil, fmt.Errorf("版が指定されていません")
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return nil, err
+	}
+	return repo.CommitObject(*hash)
+}
+
+// ヘルパー関数：現在の草案の保存履歴（path を指定するとそのファイル・フォルダを変更したものだけ）
+func recentCommits(limit int, target string) ([]map[string]string, error) {
+	ref, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &git.LogOptions{From: ref.Hash()}
+	if target = strings.Trim(path.Clean("/"+target), "/"); target != "" {
+		opts.PathFilter = func(p string) bool {
+			return p == target || strings.HasPrefix(p, target+"/")
+		}
+	}
+	cIter, err := repo.Log(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := []map[string]string{}
+	err = cIter.ForEach(func(commit *object.Commit) error {
+		if len(commits) >= limit {
+			return storer.ErrStop
+		}
+		commits = append(commits, map[string]string{
+			"id":      commit.Hash.String()[:7],
+			"date":    commit.Author.When.Format("2006/01/02 15:04:05"),
+			"message": commit.Message,
+		})
+		return nil
+	})
+	return commits, err
+}
+
+// ヘルパー関数：指定した版のファイルを作業ディレクトリに書き戻して保存する
+func restoreFromCommit(revision, target string) (map[string]interface{}, error) {
+	commit, err := resolveCommit(revision)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	target = strings.Trim(path.Clean("/"+target), "/")
+	inTarget := func(name string) bool {
+		return target == "" || name == target || strings.HasPrefix(name, target+"/")
+	}
+	var restored []string
+	inTree := make(map[string]bool)
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if !inTarget(f.Name) {
+			return nil
+		}
+		inTree[f.Name] = true
+		abs, err := workspacePath(f.Name)
+		if err != nil {
+			return nil // .git などは戻さない
+		}
+		content, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(abs, []byte(content), 0644); err != nil {
+			return err
+		}
+		restored = append(restored, f.Name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(restored) == 0 {
+		return nil, fmt.Errorf("版「%s」に「%s」はありません", commit.Hash.String()[:7], target)
+	}
+
+	// その版のあとで追加された（版にない）管理下のファイルは削除する
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+	removed := []string{}
+	for _, e := range idx.Entries {
+		if !inTarget(e.Name) || inTree[e.Name] {
+			continue
+		}
+		abs, err := workspacePath(e.Name)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(abs); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		removed = append(removed, e.Name)
+	}
+
+	label := target
+	if label == "" {
+		label = "全体"
+	}
+	hash, err := commitWorkspace(fmt.Sprintf("%sを「%s」の版に戻しました", label, commit.Hash.String()[:7]), append(restored, removed...)...)
+	if errors.Is(err, git.ErrEmptyCommit) {
+		return nil, fmt.Errorf("%sはすでに「%s」の版と同じ内容です", label, commit.Hash.String()[:7])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"commit":  hash.String()[:7],
+		"files":   restored,
+		"removed": removed,
+	}, nil
+}
+
+// ヘルパー関数：JSONの配列（[]interface{}）を文字列の配列にする
+func stringList(v interface{}) []string {
+	items, _ := v.([]interface{})
+	var list []string
+	for _, item := range items {
+		if s, ok := item.(string); ok && s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// ===== 原稿用紙のページ割り =====
+
+// 原稿用紙の既定値（TenkaiSettings のデフォルトと同じ）
+const (
+	defaultCharsPerLine = 17
+	defaultLinesPerPage = 42
+)
+
+// 縦中横にする半角数字の最大桁数（これより長い数字は1字ずつ並べる）
+const tateChuYokoMaxDigits = 2
+
+// ぶら下げ（行末のマスの外に出す）を許す句読点・閉じ括弧の数
+const kinsokuHangLimit = 2
+
+// 行頭に置けない文字（行頭禁則）
+const kinsokuNotAtLineStart = "、。，．」』）］｝〕〉》】〙〗〟’”ゝゞヽヾ々ーぁぃぅぇぉっゃゅょゎァィゥェォッャュョヮヵヶ・：；？！‼⁇⁈⁉"
+
+// 行末に置けない文字（行末禁則）
+const kinsokuNotAtLineEnd = "「『（［｛〔〈《【〘〖〝‘“"
+
+// ぶら下げできる文字（句読点と閉じ括弧）
+const kinsokuHangable = "、。，．」』）］｝〕〉》】〙〗〟’”"
+
+// 原稿用紙の設定
+type PageLayout struct {
+	CharsPerLine int `json:"charsPerLine"`
+	LinesPerPage int `json:"linesPerPage"`
+}
+
+// ページ割りの最小単位（1マス以上を占め、途中で改行しない）
+type layoutUnit struct {
+	Text        string // 表示する文字列（ルビ記法などは取り除く）
+	Cells       int    // 占めるマス数
+	Start       int    // 元の文字列での位置（文字単位）
+	End         int
+	Ruby        string // ルビ（Text が親文字）
+	Emphasis    string // 傍点・傍線
+	TateChuYoko bool
+}
+
+// ルビ・傍点の位置（行内のマス番号）
+type layoutSpan struct {
+	Cell   int    `json:"cell"`
+	Length int    `json:"length"` // 対象のマス数
+	Text   string `json:"text"`   // ルビ、または傍点・傍線の種類
+}
+
+// 1行
+type layoutLine struct {
+	Text        string       `json:"text"`
+	Start       int          `json:"start"` // 元の文字列での位置（文字単位、End は含まない）
+	End         int          `json:"end"`
+	Cells       int          `json:"cells"`             // 字下げを含まないマス数
+	Indent      int          `json:"indent,omitempty"`  // 字下げしたマス数
+	Hanging     int          `json:"hanging,omitempty"` // ぶら下げたマス数
+	Ruby        []layoutSpan `json:"ruby,omitempty"`
+	Emphasis    []layoutSpan `json:"emphasis,omitempty"`
+	TateChuYoko []int        `json:"tateChuYoko,omitempty"` // 縦中横のマス番号
+}
+
+// 1ページ
+type layoutPage struct {
+	Number int          `json:"number"`
+	Start  int          `json:"start"`
+	End    int          `json:"end"`
+	Lines  []layoutLine `json:"lines,omitempty"`
+}
+
+// ページ割りの結果
+type Pagination struct {
+	Layout     PageLayout   `json:"layout"`
+	TotalPages int          `json:"totalPages"`
+	TotalLines int          `json:"totalLines"`
+	Pages      []layoutPage `json:"pages"`
+}
+
+// ページ割りリクエスト
+type PaginateRequest struct {
+	Source       string `json:"source"` // "text", "file", "draft", "workspace"
+	Text         string `json:"text"`
+	Path         string `json:"path"`
+	Draft        string `json:"draft"`
+	CharsPerLine int    `json:"charsPerLine"` // 省略時はユーザー設定（なければ17）
+	LinesPerPage int    `json:"linesPerPage"` // 省略時はユーザー設定（なければ42）
+	IncludeLines bool   `json:"includeLines"` // true の場合は各行の内容も返す
+}
+
+// 原稿用紙でのページ割り
+func handlePaginate(c *gin.Context) {
+	var req PaginateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	files, err := loadAnalysisSource(LongAnalyzeRequest{Source: req.Source, Text: req.Text, Path: req.Path, Draft: req.Draft})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "原稿の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	layout := resolvePageLayout(c, req.CharsPerLine, req.LinesPerPage)
+
+	// ファイル（章）ごとに新しいページから始める
+	type filePages struct {
+		Path      string       `json:"path"`
+		StartPage int          `json:"startPage"`
+		Pages     int          `json:"pages"`
+		Lines     int          `json:"lines"`
+		Detail    []layoutPage `json:"detail,omitempty"`
+	}
+	result := make([]filePages, 0, len(files))
+	totalPages, totalLines := 0, 0
+	for _, f := range files {
+		p := paginateManuscript(f.Content, layout)
+		fp := filePages{Path: f.Path, StartPage: totalPages + 1, Pages: p.TotalPages, Lines: p.TotalLines}
+		if req.IncludeLines {
+			fp.Detail = p.Pages
+		}
+		result = append(result, fp)
+		totalPages += p.TotalPages
+		totalLines += p.TotalLines
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("原稿用紙（%d字×%d行）で%d枚です", layout.CharsPerLine, layout.LinesPerPage, totalPages),
+		Data: map[string]interface{}{
+			"layout":     layout,
+			"totalPages": totalPages,
+			"totalLines": totalLines,
+			"files":      result,
+		},
+	})
+}
+
+// ヘルパー関数：原稿用紙の設定（リクエストの指定 → ユーザー設定 → 既定値）
+func resolvePageLayout(c *gin.Context, charsPerLine, linesPerPage int) PageLayout {
+	layout := PageLayout{CharsPerLine: charsPerLine, LinesPerPage: linesPerPage}
+	if layout.CharsPerLine <= 0 || layout.LinesPerPage <= 0 {
+		if settings := userTenkaiSettings(c); settings != nil {
+			if layout.CharsPerLine <= 0 {
+				layout.CharsPerLine = settings.CharsPerLine
+			}
+			if layout.LinesPerPage <= 0 {
+				layout.LinesPerPage = settings.LinesPerPage
+			}
+		}
+	}
+	if layout.CharsPerLine <= 0 {
+		layout.CharsPerLine = defaultCharsPerLine
+	}
+	if layout.LinesPerPage <= 0 {
+		layout.LinesPerPage = defaultLinesPerPage
+	}
+	return layout
+}
+
+// 原稿を原稿用紙の行とページに割り付ける（クライアントやエクスポートで同じページ番号になるよう、ここだけで計算する）
+// 空の原稿は0枚にする（章ごとにページを数えるとき、空の章でページを使わない）
+func paginateManuscript(text string, layout PageLayout) *Pagination {
+	return paginateDocument(parseAozora(text), layout)
+}
+
+// 解析済みの文書を原稿用紙の行とページに割り付ける
+func paginateDocument(doc *AozoraDocument, layout PageLayout) *Pagination {
+	if layout.CharsPerLine <= 0 {
+		layout.CharsPerLine = defaultCharsPerLine
+	}
+	if layout.LinesPerPage <= 0 {
+		layout.LinesPerPage = defaultLinesPerPage
+	}
+
+	result := &Pagination{Layout: layout, Pages: []layoutPage{}}
+	var lines []layoutLine
+	flushPage := func() {
+		if len(lines) == 0 {
+			return
+		}
+		result.Pages = append(result.Pages, layoutPage{
+			Number: len(result.Pages) + 1,
+			Start:  lines[0].Start,
+			End:    lines[len(lines)-1].End,
+			Lines:  lines,
+		})
+		lines = nil
+	}
+
+	for _, block := range doc.Blocks {
+		if block.Type == "pageBreak" {
+			flushPage()
+			continue
+		}
+
+		units := blockLayoutUnits(block)
+		if len(units) == 0 {
+			// 空行も1行として数える
+			units = []layoutUnit{{Start: block.Start, End: block.Start}}
+		}
+		for _, line := range breakParagraph(units, layout.CharsPerLine, block.Indent) {
+			if len(lines) == layout.LinesPerPage {
+				flushPage()
+			}
+			lines = append(lines, line)
+			result.TotalLines++
+		}
+	}
+	flushPage()
+
+	result.TotalPages = len(result.Pages)
+	return result
+}
+
+// ヘルパー関数：段落を行に分ける（禁則処理つき）
+func breakParagraph(units []layoutUnit, charsPerLine, indent int) []layoutLine {
+	// 字下げは各行の先頭を空ける（1行に1字は入るようにする）
+	if indent >= charsPerLine {
+		indent = charsPerLine - 1
+	}
+	var lines []layoutLine
+	for start := 0; start < len(units); {
+		end, hanging := lineBreak(units, start, charsPerLine-indent)
+		line := buildLayoutLine(units[start:end], hanging)
+		line.Indent = indent
+		lines = append(lines, line)
+		start = end
+	}
+	return lines
+}
+
+// ヘルパー関数：start から始まる行の終わり（含まない）とぶら下げたマス数を決める
+func lineBreak(units []layoutUnit, start, charsPerLine int) (int, int) {
+	// 入るところまで詰める（1単位が1行より大きい場合もその単位だけは置く）
+	end, cells := start, 0
+	for end < len(units) && (end == start || cells+units[end].Cells <= charsPerLine) {
+		cells += units[end].Cells
+		end++
+	}
+	if end == len(units) {
+		return end, 0
+	}
+
+	// ぶら下げ：句読点・閉じ括弧は行末のマスの外に出す
+	hanging := 0
+	for k := 0; k < kinsokuHangLimit && end < len(units) && isKinsoku(kinsokuHangable, units[end]); k++ {
+		hanging += units[end].Cells
+		end++
+	}
+	if end == len(units) {
+		return end, hanging
+	}
+
+	// 追い出し：次の行頭が禁則文字なら、前の文字ごと次の行へ送る
+	for end-1 > start && isKinsoku(kinsokuNotAtLineStart, units[end]) {
+		end--
+		if hanging > 0 {
+			hanging -= units[end].Cells
+		}
+	}
+
+	// 行末禁則：開き括弧で終わる場合は次の行へ送る
+	for end-1 > start && isKinsoku(kinsokuNotAtLineEnd, units[end-1]) {
+		end--
+		if hanging > 0 {
+			hanging -= units[end].Cells
+		}
+	}
+	if hanging < 0 {
+		hanging = 0
+	}
+	return end, hanging
+}
+
+// ヘルパー関数：単位の先頭（行頭禁則）または末尾（行末禁則）の文字が禁則文字か
+func isKinsoku(chars string, u layoutUnit) bool {
+	if u.Text == "" || u.TateChuYoko {
+		return false
+	}
+	runes := []rune(u.Text)
+	if chars == kinsokuNotAtLineEnd {
+		return strings.ContainsRune(chars, runes[len(runes)-1])
+	}
+	return strings.ContainsRune(chars, runes[0])
+}
+
+// ヘルパー関数：単位を並べて1行にする
+func buildLayoutLine(units []layoutUnit, hanging int) layoutLine {
+	line := layoutLine{Hanging: hanging}
+	if len(units) == 0 {
+		return line
+	}
+	line.Start = units[0].Start
+	line.End = units[len(units)-1].End
+
+	var sb strings.Builder
+	for _, u := range units {
+		if u.Ruby != "" {
+			line.Ruby = append(line.Ruby, layoutSpan{Cell: line.Cells, Length: u.Cells, Text: u.Ruby})
+		}
+		if u.Emphasis != "" {
+			if n := len(line.Emphasis); n > 0 && line.Emphasis[n-1].Text == u.Emphasis && line.Emphasis[n-1].Cell+line.Emphasis[n-1].Length == line.Cells {
+				line.Emphasis[n-1].Length += u.Cells
+			} else {
+				line.Emphasis = append(line.Emphasis, layoutSpan{Cell: line.Cells, Length: u.Cells, Text: u.Emphasis})
+			}
+		}
+		if u.TateChuYoko {
+			line.TateChuYoko = append(line.TateChuYoko, line.Cells)
+		}
+		sb.WriteString(u.Text)
+		line.Cells += u.Cells
+	}
+	line.Text = sb.String()
+	line.Cells -= hanging
+	return line
+}
+
+// ヘルパー関数：段落・見出しを割り付けの単位に分ける
+func blockLayoutUnits(block AozoraBlock) []layoutUnit {
+	var units []layoutUnit
+	for _, in := range block.Inlines {
+		switch in.Type {
+		case "ruby":
+			// 親文字とルビは途中で改行しない
+			units = append(units, layoutUnit{Text: in.Text, Cells: len([]rune(in.Text)), Start: in.Start, End: in.End, Ruby: in.Ruby, Emphasis: in.Emphasis})
+		case "gaiji":
+			units = append(units, layoutUnit{Text: "〓", Cells: 1, Start: in.Start, End: in.End, Emphasis: in.Emphasis})
+		case "text":
+			units = append(units, textLayoutUnits(in)...)
+		}
+		// 未対応の注記はマスを使わない
+	}
+	return units
+}
+
+// ヘルパー関数：本文を1マスずつの単位に分ける（縦中横と「……」「――」はまとめる）
+func textLayoutUnits(in AozoraInline) []layoutUnit {
+	runes := []rune(in.Text)
+	var units []layoutUnit
+	add := func(i, n, cells int, tateChuYoko bool) {
+		units = append(units, layoutUnit{
+			Text:        string(runes[i : i+n]),
+			Cells:       cells,
+			Start:       in.Start + i,
+			End:         in.Start + i + n,
+			Emphasis:    in.Emphasis,
+			TateChuYoko: tateChuYoko,
+		})
+	}
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r >= '0' && r <= '9':
+			// 半角数字は桁数が少なければ縦中横で1マスにまとめ、長ければ1字ずつ並べる
+			end := i
+			for end < len(runes) && runes[end] >= '0' && runes[end] <= '9' {
+				end++
+			}
+			if end-i <= tateChuYokoMaxDigits {
+				add(i, end-i, 1, true)
+				i = end
+				continue
+			}
+			for ; i < end; i++ {
+				add(i, 1, 1, false)
+			}
+			continue
+
+		case (r == '!' || r == '?') && i+1 < len(runes) && (runes[i+1] == '!' || runes[i+1] == '?'):
+			add(i, 2, 1, true)
+			i += 2
+			continue
+
+		case (r == '…' || r == '―' || r == '‥') && i+1 < len(runes) && runes[i+1] == r:
+			// 「……」「――」は2マスで1組として分けない
+			add(i, 2, 2, false)
+			i += 2
+			continue
+		}
+
+		add(i, 1, 1, false)
+		i++
+	}
+	return units
+}
+
+// ヘルパー関数：from 以降で最初に r が現れる位置（なければ -1）
+func indexRune(runes []rune, from int, r rune) int {
+	for i := from; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// ===== 青空文庫形式の注記 =====
+
+// 青空文庫形式の原稿を構造化した文書
+type AozoraDocument struct {
+	Blocks []AozoraBlock `json:"blocks"`
+}
+
+// 段落・見出し・改ページ（段落と見出しは原稿の1行に対応する）
+type AozoraBlock struct {
+	Type    string         `json:"type"`             // "paragraph", "heading", "pageBreak"
+	Level   int            `json:"level,omitempty"`  // 見出しの大きさ（1: 大見出し, 2: 中見出し, 3: 小見出し）
+	Indent  int            `json:"indent,omitempty"` // 字下げの字数
+	Inlines []AozoraInline `json:"inlines,omitempty"`
+	Start   int            `json:"start"` // 元の文字列での位置（文字単位、End は含まない）
+	End     int            `json:"end"`
+}
+
+// 段落の中身
+type AozoraInline struct {
+	Type     string `json:"type"` // "text", "ruby", "gaiji"（※［＃…］の外字）, "annotation"（未対応の注記）
+	Text     string `json:"text"` // ruby は親文字、gaiji と annotation は注記の内容
+	Ruby     string `json:"ruby,omitempty"`
+	Emphasis string `json:"emphasis,omitempty"` // 傍点・傍線の種類（"傍点", "白ゴマ傍点", "傍線" など）
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+}
+
+// 青空文庫形式の注記のパターン
+var (
+	aozoraIndentPattern      = regexp.MustCompile(`^([0-9０-９]+)字下げ$`)
+	aozoraIndentRangePattern = regexp.MustCompile(`^ここから([0-9０-９]+)字下げ$`)
+	aozoraForwardPattern     = regexp.MustCompile(`^「(.+)」(に|は)(.+)$`)
+	aozoraHeadingLevels      = map[string]int{"大見出し": 1, "中見出し": 2, "小見出し": 3}
+)
+
+// 構文解析の状態（字下げ・見出し・傍点の範囲指定は行をまたぐ）
+type aozoraParser struct {
+	runes        []rune
+	doc          *AozoraDocument
+	rangeIndent  int
+	headingLevel int
+	emphasis     string
+}
+
+// 青空文庫形式の原稿を解析する（改行は "\n" と "\r\n" のどちらでもよい）
+func parseAozora(text string) *AozoraDocument {
+	p := &aozoraParser{runes: []rune(text), doc: &AozoraDocument{Blocks: []AozoraBlock{}}}
+	for start := 0; start < len(p.runes); {
+		end := indexRune(p.runes, start, '\n')
+		if end < 0 {
+			end = len(p.runes)
+		}
+		contentEnd := end
+		if contentEnd > start && p.runes[contentEnd-1] == '\r' {
+			contentEnd--
+		}
+		p.parseLine(start, contentEnd)
+		start = end + 1
+	}
+	return p.doc
+}
+
+// ヘルパー関数：1行を解析して段落・見出し・改ページを追加する
+func (p *aozoraParser) parseLine(start, end int) {
+	block := AozoraBlock{Type: "paragraph", Indent: p.rangeIndent, Start: start, End: end}
+	if p.headingLevel > 0 {
+		block.Type, block.Level = "heading", p.headingLevel
+	}
+	var after []AozoraBlock // 行の途中の改ページ
+	controlOnly := start < end
+
+	for i := start; i < end; {
+		r := p.runes[i]
+		switch {
+		case r == '［' && i+1 < end && p.runes[i+1] == '＃':
+			close := indexRune(p.runes[:end], i, '］')
+			if close < 0 {
+				break
+			}
+			note := string(p.runes[i+2 : close])
+			if pageBreak := p.annotation(&block, note, i, close+1); pageBreak != nil {
+				if len(block.Inlines) == 0 {
+					p.doc.Blocks = append(p.doc.Blocks, *pageBreak)
+					block.Start = close + 1
+				} else {
+					after = append(after, *pageBreak)
+				}
+			}
+			if len(block.Inlines) > 0 {
+				controlOnly = false
+			}
+			i = close + 1
+			continue
+
+		case r == '※' && i+2 < end && p.runes[i+1] == '［' && p.runes[i+2] == '＃':
+			close := indexRune(p.runes[:end], i, '］')
+			if close < 0 {
+				break
+			}
+			block.Inlines = append(block.Inlines, AozoraInline{Type: "gaiji", Text: string(p.runes[i+3 : close]), Emphasis: p.emphasis, Start: i, End: close + 1})
+			controlOnly = false
+			i = close + 1
+			continue
+
+		case r == '｜' || r == '|':
+			open := indexRune(p.runes[:end], i+1, '《')
+			if open < 0 || open == i+1 {
+				break
+			}
+			close := indexRune(p.runes[:end], open, '》')
+			if close < 0 {
+				break
+			}
+			block.Inlines = append(block.Inlines, AozoraInline{Type: "ruby", Text: string(p.runes[i+1 : open]), Ruby: string(p.runes[open+1 : close]), Emphasis: p.emphasis, Start: i, End: close + 1})
+			controlOnly = false
+			i = close + 1
+			continue
+
+		case r == '《':
+			close := indexRune(p.runes[:end], i, '》')
+			if close < 0 || !p.splitRubyBase(&block, i) {
+				break
+			}
+			last := &block.Inlines[len(block.Inlines)-1]
+			last.Ruby = string(p.runes[i+1 : close])
+			last.End = close + 1
+			i = close + 1
+			continue
+		}
+
+		p.addText(&block, r, i)
+		controlOnly = false
+		i++
+	}
+
+	if !controlOnly {
+		p.doc.Blocks = append(p.doc.Blocks, block)
+	}
+	p.doc.Blocks = append(p.doc.Blocks, after...)
+}
+
+// ヘルパー関数：注記を解釈する（改ページの場合はそのブロックを返す）
+func (p *aozoraParser) annotation(block *AozoraBlock, note string, start, end int) *AozoraBlock {
+	switch note {
+	case "改ページ", "改丁", "改段", "改見開き":
+		return &AozoraBlock{Type: "pageBreak", Start: start, End: end}
+	case "ここで字下げ終わり":
+		p.rangeIndent = 0
+		return nil
+	}
+
+	if m := aozoraIndentRangePattern.FindStringSubmatch(note); m != nil {
+		p.rangeIndent = parseWideInt(m[1])
+		block.Indent = p.rangeIndent
+		return nil
+	}
+	if m := aozoraIndentPattern.FindStringSubmatch(note); m != nil {
+		block.Indent = parseWideInt(m[1])
+		return nil
+	}
+	if level, ok := aozoraHeadingLevels[note]; ok {
+		p.headingLevel = level
+		block.Type, block.Level = "heading", level
+		return nil
+	}
+	if _, ok := aozoraHeadingLevels[strings.TrimSuffix(note, "終わり")]; ok && strings.HasSuffix(note, "終わり") {
+		p.headingLevel = 0
+		return nil
+	}
+	if m := aozoraForwardPattern.FindStringSubmatch(note); m != nil {
+		// 前方参照：「対象」に傍点 / 「対象」は大見出し
+		if level, ok := aozoraHeadingLevels[m[3]]; ok && m[2] == "は" {
+			block.Type, block.Level = "heading", level
+			return nil
+		}
+		if m[2] == "に" && isAozoraEmphasis(m[3]) && p.markPrevious(block, m[1], m[3]) {
+			return nil
+		}
+		// 対象が直前にない前方参照は範囲の開始として扱わず、注記のまま残す
+		block.Inlines = append(block.Inlines, AozoraInline{Type: "annotation", Text: note, Start: start, End: end})
+		return nil
+	}
+	if isAozoraEmphasis(note) {
+		p.emphasis = note
+		return nil
+	}
+	if name := strings.TrimSuffix(note, "終わり"); name != note && isAozoraEmphasis(name) {
+		p.emphasis = ""
+		return nil
+	}
+
+	// 未対応の注記は内容を残して、書き出しや差分で失われないようにする
+	block.Inlines = append(block.Inlines, AozoraInline{Type: "annotation", Text: note, Start: start, End: end})
+	return nil
+}
+
+// ヘルパー関数：本文を1文字追加する（直前の本文と連続していればまとめる）
+func (p *aozoraParser) addText(block *AozoraBlock, r rune, pos int) {
+	if n := len(block.Inlines); n > 0 {
+		last := &block.Inlines[n-1]
+		if last.Type == "text" && last.End == pos && last.Emphasis == p.emphasis {
+			last.Text += string(r)
+			last.End = pos + 1
+			return
+		}
+	}
+	block.Inlines = append(block.Inlines, AozoraInline{Type: "text", Text: string(r), Emphasis: p.emphasis, Start: pos, End: pos + 1})
+}
+
+// ヘルパー関数：「漢字《ルビ》」の親文字（直前の漢字の並び）を本文から切り出してルビにする
+func (p *aozoraParser) splitRubyBase(block *AozoraBlock, pos int) bool {
+	n := len(block.Inlines)
+	if n == 0 || block.Inlines[n-1].Type != "text" || block.Inlines[n-1].End != pos {
+		return false
+	}
+	last := block.Inlines[n-1]
+	runes := []rune(last.Text)
+	k := len(runes)
+	for k > 0 && isRubyBaseRune(runes[k-1]) {
+		k--
+	}
+	if k == len(runes) {
+		return false
+	}
+
+	ruby := AozoraInline{Type: "ruby", Text: string(runes[k:]), Emphasis: last.Emphasis, Start: last.Start + k, End: pos}
+	if k == 0 {
+		block.Inlines[n-1] = ruby
+		return true
+	}
+	block.Inlines[n-1].Text = string(runes[:k])
+	block.Inlines[n-1].End = last.Start + k
+	block.Inlines = append(block.Inlines, ruby)
+	return true
+}
+
+// ヘルパー関数：前方参照の傍点（直前の本文の末尾が対象と一致すれば切り出す）
+func (p *aozoraParser) markPrevious(block *AozoraBlock, target, emphasis string) bool {
+	n := len(block.Inlines)
+	if n == 0 {
+		return false
+	}
+	last := block.Inlines[n-1]
+	if (last.Type != "text" && last.Type != "ruby") || last.Emphasis != "" {
+		return false
+	}
+	if last.Type == "ruby" {
+		if last.Text != target {
+			return false
+		}
+		block.Inlines[n-1].Emphasis = emphasis
+		return true
+	}
+	if !strings.HasSuffix(last.Text, target) {
+		return false
+	}
+
+	k := len([]rune(last.Text)) - len([]rune(target))
+	marked := AozoraInline{Type: "text", Text: target, Emphasis: emphasis, Start: last.Start + k, End: last.End}
+	if k == 0 {
+		block.Inlines[n-1] = marked
+		return true
+	}
+	block.Inlines[n-1].Text = string([]rune(last.Text)[:k])
+	block.Inlines[n-1].End = last.Start + k
+	block.Inlines = append(block.Inlines, marked)
+	return true
+}
+
+// ヘルパー関数：傍点・傍線の注記か
+func isAozoraEmphasis(name string) bool {
+	return strings.HasSuffix(name, "傍点") || strings.HasSuffix(name, "傍線")
+}
+
+// ヘルパー関数：全角・半角の数字を整数にする
+func parseWideInt(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= '０' && r <= '９' {
+			r = r - '０' + '0'
+		}
+		n = n*10 + int(r-'0')
+	}
+	return n
+}
+
+// ルビの親文字として自動で扱う文字（｜で始めない場合は直前の漢字の並びが親文字になる）
+func isRubyBaseRune(r rune) bool {
+	return unicode.Is(unicode.Han, r) || r == '々' || r == '〆' || r == 'ヶ'
+}
+
+// 注記を取り除いた本文と、本文の各文字の元の文字列での位置（末尾に元の文字列の長さを加える）
+func (doc *AozoraDocument) PlainText() (string, []int) {
+	var sb strings.Builder
+	var offsets []int
+	last := len(doc.Blocks) - 1
+	for last >= 0 && doc.Blocks[last].Type == "pageBreak" {
+		last--
+	}
+
+	for bi, block := range doc.Blocks {
+		if block.Type == "pageBreak" {
+			continue
+		}
+		for _, in := range block.Inlines {
+			switch in.Type {
+			case "text":
+				for k, r := range []rune(in.Text) {
+					sb.WriteRune(r)
+					offsets = append(offsets, in.Start+k)
+				}
+			case "ruby":
+				// 親文字は《ルビ》の直前にある
+				base := []rune(in.Text)
+				baseStart := in.End - len([]rune(in.Ruby)) - 2 - len(base)
+				for k, r := range base {
+					sb.WriteRune(r)
+					offsets = append(offsets, baseStart+k)
+				}
+			case "gaiji":
+				sb.WriteRune('〓')
+				offsets = append(offsets, in.Start)
+			}
+		}
+		if bi < last {
+			sb.WriteRune('\n')
+			offsets = append(offsets, block.End)
+		}
+	}
+
+	end := 0
+	if n := len(doc.Blocks); n > 0 {
+		end = doc.Blocks[n-1].End
+	}
+	return sb.String(), append(offsets, end)
+}
+
+// 文書を青空文庫形式のテキストに戻す（取り込んだ原稿を保存するときに使う）
+func (doc *AozoraDocument) AozoraText() string {
+	var sb strings.Builder
+	for _, block := range doc.Blocks {
+		if block.Type == "pageBreak" {
+			sb.WriteString("［＃改ページ］\n")
+			continue
+		}
+		if block.Indent > 0 {
+			sb.WriteString("［＃" + toWideDigits(strconv.Itoa(block.Indent)) + "字下げ］")
+		}
+		note := ""
+		if block.Type == "heading" {
+			note = aozoraHeadingNote(block.Level)
+			sb.WriteString("［＃" + note + "］")
+		}
+		for _, in := range block.Inlines {
+			switch in.Type {
+			case "text":
+				sb.WriteString(aozoraEmphasisNotation(in.Text, in.Emphasis))
+			case "ruby":
+				sb.WriteString(aozoraEmphasisNotation("｜"+in.Text+"《"+in.Ruby+"》", in.Emphasis))
+			case "gaiji":
+				sb.WriteString(aozoraEmphasisNotation("※［＃"+in.Text+"］", in.Emphasis))
+			case "annotation":
+				sb.WriteString("［＃" + in.Text + "］")
+			}
+		}
+		if note != "" {
+			sb.WriteString("［＃" + note + "終わり］")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// ヘルパー関数：見出しの段階（1〜3）に対応する注記（大見出し・中見出し・小見出し）
+func aozoraHeadingNote(level int) string {
+	for note, l := range aozoraHeadingLevels {
+		if l == level {
+			return note
+		}
+	}
+	return ""
+}
+
+// ヘルパー関数：傍点・傍線を付けた文字列を注記で書く（ルビや注記を含まなければ前方参照の形にする）
+func aozoraEmphasisNotation(text, emphasis string) string {
+	if emphasis == "" {
+		return text
+	}
+	if strings.ContainsAny(text, "｜《》［］") {
+		return "［＃" + emphasis + "］" + text + "［＃" + emphasis + "終わり］"
+	}
+	return text + "［＃「" + text + "」に" + emphasis + "］"
+}
+
+// 青空文庫形式の解析リクエスト
+type AozoraParseRequest struct {
+	Source string `json:"source"` // "text", "file", "draft", "workspace"
+	Text   string `json:"text"`
+	Path   string `json:"path"`
+	Draft  string `json:"draft"`
+}
+
+// 青空文庫形式の原稿を構造化して返す
+func handleAozoraParse(c *gin.Context) {
+	var req AozoraParseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	files, err := loadAnalysisSource(LongAnalyzeRequest{Source: req.Source, Text: req.Text, Path: req.Path, Draft: req.Draft})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "原稿の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	documents := make([]map[string]interface{}, len(files))
+	for i, f := range files {
+		doc := parseAozora(f.Content)
+		plain, _ := doc.PlainText()
+		documents[i] = map[string]interface{}{
+			"path":     f.Path,
+			"document": doc,
+			"text":     plain,
+		}
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    documents,
+	})
+}
+
+// ===== EPUB3 の書き出し =====
+
+// 書き出す本
+type exportBook struct {
+	Title       string
+	Author      string
+	Language    string
+	WritingMode string // "vertical" または "horizontal"
+	Modified    time.Time
+	Chapters    []exportChapter
+}
+
+// 書き出す章（原稿ファイル1つ）
+type exportChapter struct {
+	Path     string
+	Title    string
+	Source   string
+	Document *AozoraDocument
+}
+
+// EPUB3 の書き出し（?revision= でコミット・草案、?path= で1章だけを指定。省略時は作業ディレクトリ全体）
+func handleExportEPUB(c *gin.Context) {
+	book, err := loadExportBook(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "原稿の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	data, err := buildEPUB(book)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "EPUBの作成に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// 壊れたファイルを渡さないよう、書き出す前に構造を検証する
+	if problems := validateEPUB(data); len(problems) > 0 {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "作成したEPUBの検証に失敗しました",
+			Error:   strings.Join(problems, "; "),
+		})
+		return
+	}
+
+	sendDownload(c, book.Title+".epub", "application/epub+zip", data)
+}
+
+// ヘルパー関数：書き出す原稿と書誌情報を読み込む
+func loadExportBook(c *gin.Context) (*exportBook, error) {
+	if repo == nil {
+		return nil, fmt.Errorf("先に初期化してください")
+	}
+
+	revision := c.Query("revision")
+	var files []manuscriptFile
+	var manifest *BookManifest
+	var err error
+	modified := time.Now()
+	if revision == "" {
+		if files, err = readWorkspaceManuscript(); err == nil {
+			manifest, err = getRepoBook()
+		}
+	} else {
+		files, err = readManuscriptAtRevision(revision)
+		if commit, cerr := resolveCommit(revision); cerr == nil {
+			modified = commit.Committer.When
+			if err == nil {
+				manifest, err = bookManifestAtCommit(commit)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if only := c.Query("path"); only != "" {
+		// 1章だけを書き出す
+		var selected []manuscriptFile
+		for _, f := range files {
+			if f.Path == path.Clean(only) {
+				selected = append(selected, f)
+			}
+		}
+		if len(selected) == 0 {
+			return nil, fmt.Errorf("原稿 %s が見つかりません", only)
+		}
+		files = selected
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("書き出す原稿がありません")
+	}
+
+	book := &exportBook{
+		Title:       c.Query("title"),
+		Author:      c.Query("author"),
+		Language:    "ja",
+		WritingMode: c.Query("writingMode"),
+		Modified:    modified.UTC(),
+	}
+	if manifest != nil {
+		if book.Title == "" {
+			book.Title = manifest.Title
+		}
+		if book.Author == "" {
+			book.Author = manifest.Author
+		}
+	}
+	if book.Title == "" {
+		book.Title = filepath.Base(workDir)
+	}
+	if book.WritingMode == "" {
+		book.WritingMode = "vertical"
+		if settings := userTenkaiSettings(c); settings != nil && settings.WritingMode != "" {
+			book.WritingMode = settings.WritingMode
+		}
+	}
+
+	titles := bookFileTitles(manifest)
+	for _, f := range files {
+		ch := newExportChapter(f)
+		if title := titles[f.Path]; title != "" {
+			// 構成に題があればそれを章題にする
+			ch.Title = title
+		}
+		book.Chapters = append(book.Chapters, ch)
+	}
+	return book, nil
+}
+
+// ヘルパー関数：原稿ファイルを章にする（最初の見出しを章題にし、なければファイル名を使う）
+func newExportChapter(f manuscriptFile) exportChapter {
+	doc := parseAozora(f.Content)
+	title := strings.TrimSuffix(path.Base(f.Path), path.Ext(f.Path))
+	for _, block := range doc.Blocks {
+		if block.Type == "heading" {
+			title = aozoraBlockText(block)
+			break
+		}
+	}
+	return exportChapter{Path: f.Path, Title: title, Source: f.Content, Document: doc}
+}
+
+// ヘルパー関数：段落・見出しの本文（ルビ・注記を除く）
+func aozoraBlockText(block AozoraBlock) string {
+	var sb strings.Builder
+	for _, in := range block.Inlines {
+		switch in.Type {
+		case "text", "ruby":
+			sb.WriteString(in.Text)
+		case "gaiji":
+			sb.WriteString("〓")
+		}
+	}
+	return sb.String()
+}
+
+// ヘルパー関数：ファイルとしてダウンロードさせる
+func sendDownload(c *gin.Context, filename, contentType string, data []byte) {
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"; filename*=UTF-8''%s",
+		strings.Map(func(r rune) rune {
+			if r > 0x7e || r == '"' || r == '\\' {
+				return '_'
+			}
+			return r
+		}, filename),
+		url.PathEscape(filename)))
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// ヘルパー関数：ユーザー設定（ログインしていない・取得できない場合は nil）
+func userTenkaiSettings(c *gin.Context) *TenkaiSettings {
+	accessToken := resolveAccessToken(c, "")
+	if accessToken == "" {
+		return nil
+	}
+
+	key := accessTokenKey(accessToken)
+	userSettingsCacheMu.Lock()
+	entry, ok := userSettingsCache[key]
+	userSettingsCacheMu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.settings
+	}
+
+	// 取得できなかった場合も nil を覚えておき、GitHubに問い合わせ続けない
+	var settings *TenkaiSettings
+	if user, err := getGitHubUser(accessToken); err == nil {
+		settings, _ = getTenkaiSettings(accessToken, user.Login)
+	}
+	userSettingsCacheMu.Lock()
+	userSettingsCache[key] = userSettingsCacheEntry{settings: settings, expiresAt: time.Now().Add(userSettingsCacheTTL)}
+	userSettingsCacheMu.Unlock()
+	return settings
+}
+
+// ユーザー設定のキャッシュ（AI呼び出しや書き出しのたびにGitHubへ問い合わせないようにする）
+const userSettingsCacheTTL = 5 * time.Minute
+
+type userSettingsCacheEntry struct {
+	settings  *TenkaiSettings
+	expiresAt time.Time
+}
+
+var (
+	userSettingsCacheMu sync.Mutex
+	userSettingsCache   = make(map[string]userSettingsCacheEntry)
+)
+
+// ヘルパー関数：キャッシュのキーにするアクセストークンのハッシュ（トークンそのものは保持しない）
+func accessTokenKey(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return fmt.Sprintf("%x", sum)
+}
+
+// ヘルパー関数：ユーザー設定のキャッシュを捨てる（保存した直後に古い設定を使わないようにする）
+func forgetUserSettings(accessToken string) {
+	userSettingsCacheMu.Lock()
+	delete(userSettingsCache, accessTokenKey(accessToken))
+	userSettingsCacheMu.Unlock()
+}
+
+// EPUBのスタイル（縦書き・横書き共通部分）
+const epubStyle = `@charset "UTF-8";
+html {
+  -epub-writing-mode: %[1]s;
+  writing-mode: %[1]s;
+}
+body { margin: 0; line-height: 1.75; }
+h1, h2, h3 { font-weight: bold; }
+h1 { font-size: 1.5em; }
+h2 { font-size: 1.3em; }
+h3 { font-size: 1.1em; }
+p { margin: 0; }
+.pagebreak { page-break-before: always; break-before: page; }
+.title-page { text-align: center; }
+.title-page h1 { margin-block-start: 3em; }
+em { font-style: normal; }
+em.sesame { -epub-text-emphasis-style: filled sesame; text-emphasis-style: filled sesame; }
+em.sesame-open { -epub-text-emphasis-style: open sesame; text-emphasis-style: open sesame; }
+em.circle { -epub-text-emphasis-style: filled circle; text-emphasis-style: filled circle; }
+em.circle-open { -epub-text-emphasis-style: open circle; text-emphasis-style: open circle; }
+em.underline { text-decoration: underline; }
+.gaiji { font-style: normal; }
+`
+
+// ヘルパー関数：EPUB3 を作成する
+func buildEPUB(book *exportBook) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	// mimetype は先頭に無圧縮で置く
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write([]byte("application/epub+zip")); err != nil {
+		return nil, err
+	}
+
+	writingMode := "horizontal-tb"
+	direction := "ltr"
+	if book.WritingMode != "horizontal" {
+		writingMode = "vertical-rl"
+		direction = "rtl"
+	}
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"META-INF/container.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`},
+		{"OEBPS/style.css", fmt.Sprintf(epubStyle, writingMode)},
+		{"OEBPS/title.xhtml", epubXHTML(book.Title, `<div class="title-page">
+<h1>`+xmlEscape(book.Title)+`</h1>
+<p>`+xmlEscape(book.Author)+`</p>
+</div>`)},
+		{"OEBPS/nav.xhtml", epubNav(book)},
+		{"OEBPS/content.opf", epubPackage(book, direction)},
+	}
+	for i, ch := range book.Chapters {
+		files = append(files, struct {
+			name    string
+			content string
+		}{fmt.Sprintf("OEBPS/%s", epubChapterFile(i)), epubXHTML(ch.Title, aozoraToXHTML(ch.Document))})
+	}
+
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(f.content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ヘルパー関数：章のファイル名
+func epubChapterFile(i int) string {
+	return fmt.Sprintf("chapter-%03d.xhtml", i+1)
+}
+
+// ヘルパー関数：XHTMLの文書
+func epubXHTML(title, body string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="ja" lang="ja">
+<head>
+<meta charset="UTF-8"/>
+<title>` + xmlEscape(title) + `</title>
+<link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+` + body + `
+</body>
+</html>
+`
+}
+
+// ヘルパー関数：目次（nav.xhtml）
+func epubNav(book *exportBook) string {
+	var sb strings.Builder
+	sb.WriteString(`<nav epub:type="toc" id="toc">
+<h1>目次</h1>
+<ol>
+`)
+	for i, ch := range book.Chapters {
+		sb.WriteString(fmt.Sprintf("<li><a href=\"%s\">%s</a></li>\n", epubChapterFile(i), xmlEscape(ch.Title)))
+	}
+	sb.WriteString("</ol>\n</nav>")
+	return epubXHTML("目次", sb.String())
+}
+
+// ヘルパー関数：パッケージ文書（content.opf）
+func epubPackage(book *exportBook, direction string) string {
+	sum := sha256.Sum256([]byte(book.Title + "\x00" + book.Author))
+	identifier := fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+
+	var manifest, spine strings.Builder
+	for i := range book.Chapters {
+		manifest.WriteString(fmt.Sprintf("    <item id=\"chapter-%03d\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", i+1, epubChapterFile(i)))
+		spine.WriteString(fmt.Sprintf("    <itemref idref=\"chapter-%03d\"/>\n", i+1))
+	}
+
+	creator := ""
+	if book.Author != "" {
+		creator = "    <dc:creator>" + xmlEscape(book.Author) + "</dc:creator>\n"
+	}
+
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id" xml:lang="` + book.Language + `">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">` + identifier + `</dc:identifier>
+    <dc:title>` + xmlEscape(book.Title) + `</dc:title>
+` + creator + `    <dc:language>` + book.Language + `</dc:language>
+    <meta property="dcterms:modified">` + book.Modified.Format("2006-01-02T15:04:05Z") + `</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+    <item id="title" href="title.xhtml" media-type="application/xhtml+xml"/>
+` + manifest.String() + `  </manifest>
+  <spine page-progression-direction="` + direction + `">
+    <itemref idref="title"/>
+    <itemref idref="nav"/>
+` + spine.String() + `  </spine>
+</package>
+`
+}
+
+// ヘルパー関数：傍点・傍線の種類に対応する CSS クラス
+func aozoraEmphasisClass(emphasis string) string {
+	switch {
+	case strings.HasSuffix(emphasis, "傍線"):
+		return "underline"
+	case strings.HasPrefix(emphasis, "白丸") || strings.HasPrefix(emphasis, "蛇の目"):
+		return "circle-open"
+	case strings.Contains(emphasis, "丸"):
+		return "circle"
+	case strings.HasPrefix(emphasis, "白"):
+		return "sesame-open"
+	default:
+		return "sesame"
+	}
+}
+
+// ヘルパー関数：文書をXHTMLの本文にする
+func aozoraToXHTML(doc *AozoraDocument) string {
+	var sb strings.Builder
+	pendingBreak := false
+	for _, block := range doc.Blocks {
+		if block.Type == "pageBreak" {
+			pendingBreak = true
+			continue
+		}
+
+		var attrs []string
+		if pendingBreak {
+			attrs = append(attrs, `class="pagebreak"`)
+			pendingBreak = false
+		}
+		if block.Indent > 0 {
+			attrs = append(attrs, fmt.Sprintf(`style="padding-inline-start: %dem"`, block.Indent))
+		}
+		attr := ""
+		if len(attrs) > 0 {
+			attr = " " + strings.Join(attrs, " ")
+		}
+
+		tag := "p"
+		if block.Type == "heading" {
+			tag = fmt.Sprintf("h%d", block.Level)
+		}
+		content := aozoraInlinesToXHTML(block.Inlines)
+		if content == "" {
+			content = "<br/>"
+		}
+		sb.WriteString(fmt.Sprintf("<%s%s>%s</%s>\n", tag, attr, content, tag))
+	}
+	return sb.String()
+}
+
+// ヘルパー関数：段落の中身をXHTMLにする
+func aozoraInlinesToXHTML(inlines []AozoraInline) string {
+	var sb strings.Builder
+	for _, in := range inlines {
+		var s string
+		switch in.Type {
+		case "text":
+			s = xmlEscape(in.Text)
+		case "ruby":
+			s = "<ruby>" + xmlEscape(in.Text) + "<rt>" + xmlEscape(in.Ruby) + "</rt></ruby>"
+		case "gaiji":
+			s = `<span class="gaiji" title="` + xmlEscape(in.Text) + `">〓</span>`
+		default:
+			continue
+		}
+		if in.Emphasis != "" {
+			s = `<em class="` + aozoraEmphasisClass(in.Emphasis) + `">` + s + "</em>"
+		}
+		sb.WriteString(s)
+	}
+	return sb.String()
+}
+
+// ヘルパー関数：XMLのエスケープ
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// EPUBの構造の検証（問題がなければ空）。mimetype・container.xml・パッケージ文書・目次・各XHTMLの整形式を確かめる
+func validateEPUB(data []byte) []string {
+	var problems []string
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return []string{"zipとして読み込めません: " + err.Error()}
+	}
+
+	entries := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+	read := func(name string) ([]byte, error) {
+		f, ok := entries[name]
+		if !ok {
+			return nil, fmt.Errorf("%s がありません", name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+
+	// mimetype は先頭・無圧縮・内容固定
+	if len(zr.File) == 0 || zr.File[0].Name != "mimetype" {
+		problems = append(problems, "mimetype が先頭にありません")
+	} else if zr.File[0].Method != zip.Store {
+		problems = append(problems, "mimetype が圧縮されています")
+	} else if content, _ := read("mimetype"); string(content) != "application/epub+zip" {
+		problems = append(problems, "mimetype の内容が不正です")
+	}
+
+	// container.xml からパッケージ文書を探す
+	var container struct {
+		Rootfiles []struct {
+			FullPath  string `xml:"full-path,attr"`
+			MediaType string `xml:"media-type,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	content, err := read("META-INF/container.xml")
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	if err := xml.Unmarshal(content, &container); err != nil || len(container.Rootfiles) == 0 {
+		return append(problems, "container.xml にパッケージ文書の指定がありません")
+	}
+	opfPath := container.Rootfiles[0].FullPath
+
+	var pkg struct {
+		Version  string `xml:"version,attr"`
+		UniqueID string `xml:"unique-identifier,attr"`
+		Metadata struct {
+			Identifiers []struct {
+				ID    string `xml:"id,attr"`
+				Value string `xml:",chardata"`
+			} `xml:"identifier"`
+			Titles    []string `xml:"title"`
+			Languages []string `xml:"language"`
+			Metas     []struct {
+				Property string `xml:"property,attr"`
+				Value    string `xml:",chardata"`
+			} `xml:"meta"`
+		} `xml:"metadata"`
+		Items []struct {
+			ID         string `xml:"id,attr"`
+			Href       string `xml:"href,attr"`
+			MediaType  string `xml:"media-type,attr"`
+			Properties string `xml:"properties,attr"`
+		} `xml:"manifest>item"`
+		Itemrefs []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"spine>itemref"`
+	}
+	content, err = read(opfPath)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	if err := xml.Unmarshal(content, &pkg); err != nil {
+		return append(problems, "パッケージ文書を解釈できません: "+err.Error())
+	}
+
+	if pkg.Version != "3.0" {
+		problems = append(problems, "パッケージ文書の version が 3.0 ではありません")
+	}
+	hasID := false
+	for _, id := range pkg.Metadata.Identifiers {
+		if id.ID == pkg.UniqueID && strings.TrimSpace(id.Value) != "" {
+			hasID = true
+		}
+	}
+	if !hasID {
+		problems = append(problems, "unique-identifier に対応する dc:identifier がありません")
+	}
+	if len(pkg.Metadata.Titles) == 0 || strings.TrimSpace(pkg.Metadata.Titles[0]) == "" {
+		problems = append(problems, "dc:title がありません")
+	}
+	if len(pkg.Metadata.Languages) == 0 {
+		problems = append(problems, "dc:language がありません")
+	}
+	hasModified := false
+	for _, m := range pkg.Metadata.Metas {
+		if m.Property == "dcterms:modified" {
+			if _, err := time.Parse("2006-01-02T15:04:05Z", m.Value); err != nil {
+				problems = append(problems, "dcterms:modified の形式が不正です")
+			}
+			hasModified = true
+		}
+	}
+	if !hasModified {
+		problems = append(problems, "dcterms:modified がありません")
+	}
+
+	// マニフェストの各ファイルが存在し、XHTML は整形式であること
+	base := path.Dir(opfPath)
+	ids := make(map[string]bool)
+	hasNav := false
+	for _, item := range pkg.Items {
+		ids[item.ID] = true
+		name := path.Join(base, item.Href)
+		content, err := read(name)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("マニフェストの %s", err.Error()))
+			continue
+		}
+		if strings.Contains(item.Properties, "nav") {
+			hasNav = true
+		}
+		if item.MediaType == "application/xhtml+xml" {
+			dec := xml.NewDecoder(bytes.NewReader(content))
+			dec.Strict = true
+			dec.Entity = xml.HTMLEntity
+			for {
+				if _, err := dec.Token(); err != nil {
+					if err != io.EOF {
+						problems = append(problems, fmt.Sprintf("%s が整形式ではありません: %v", name, err))
+					}
+					break
+				}
+			}
+		}
+	}
+	if !hasNav {
+		problems = append(problems, "目次（properties=\"nav\"）がありません")
+	}
+
+	// スパインはマニフェストの項目だけを参照する
+	if len(pkg.Itemrefs) == 0 {
+		problems = append(problems, "spine が空です")
+	}
+	for _, ref := range pkg.Itemrefs {
+		if !ids[ref.IDRef] {
+			problems = append(problems, fmt.Sprintf("spine の %s がマニフェストにありません", ref.IDRef))
+		}
+	}
+	return problems
+}
+
+// ===== DOCX の書き出し・取り込み =====
+
+// DOCX の用紙（A4、単位は twip = 1/20 pt）。縦書きは横置きにする
+const (
+	docxPageShort  = 11906
+	docxPageLong   = 16838
+	docxPageMargin = 1440
+	docxMaxUpload  = 20 << 20 // 取り込む .docx の上限（バイト）
+)
+
+// 章の境目を示すブックマーク名の接頭辞（"_" で始まるブックマークは Word で非表示になる）
+const docxChapterBookmark = "_tenkai_"
+
+// DOCX の書き出し（?revision= でコミット・草案、?path= で1章だけを指定）
+func handleExportDOCX(c *gin.Context) {
+	book, err := loadExportBook(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "原稿の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	charsPerLine, _ := strconv.Atoi(c.Query("charsPerLine"))
+	linesPerPage, _ := strconv.Atoi(c.Query("linesPerPage"))
+	layout := resolvePageLayout(c, charsPerLine, linesPerPage)
+
+	data, err := buildDOCX(book, layout)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "DOCXの作成に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	sendDownload(c, book.Title+".docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", data)
+}
+
+// DOCX の取り込み（multipart: file, path, message）。Word で直した原稿を青空文庫形式のテキストに戻して保存する
+func handleImportDOCX(c *gin.Context) {
+	if repo == nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "先に初期化してください",
+		})
+		return
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: ".docx ファイルを file で指定してください",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if header.Size > docxMaxUpload {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: fmt.Sprintf("ファイルが大きすぎます（上限 %dMB）", docxMaxUpload>>20),
+		})
+		return
+	}
+	f, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "ファイルを開けません",
+			Error:   err.Error(),
+		})
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(f, docxMaxUpload))
+	f.Close()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "ファイルを読み込めません",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	chapters, err := parseDOCX(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: ".docx として読み込めません",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// tenkai が書き出したファイルは章ごとに元のファイルへ戻す。それ以外は path に1ファイルで保存する
+	target := c.PostForm("path")
+	if target != "" || len(chapters) == 1 && chapters[0].Path == "" {
+		if target == "" {
+			target = strings.TrimSuffix(filepath.Base(header.Filename), filepath.Ext(header.Filename)) + ".txt"
+		}
+		var sb strings.Builder
+		for i, ch := range chapters {
+			if i > 0 {
+				sb.WriteString("［＃改ページ］\n")
+			}
+			sb.WriteString(ch.Content)
+		}
+		chapters = []manuscriptFile{{Path: target, Content: sb.String()}}
+	}
+
+	// 書き込む前にすべての保存先を確かめる（ファイルに埋め込まれたパスは、管理下の原稿ファイルに限る）
+	var tracked map[string]bool
+	if target == "" {
+		if tracked, err = trackedFiles(); err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Message: "原稿ファイルの一覧を取得できません",
+				Error:   err.Error(),
+			})
+			return
+		}
+	}
+	seen := make(map[string]bool)
+	for _, ch := range chapters {
+		if ch.Path == "" {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Message: "保存先の path を指定してください",
+			})
+			return
+		}
+		err := checkManuscriptPath(ch.Path)
+		if err == nil && seen[ch.Path] {
+			err = fmt.Errorf("%s が重複しています", ch.Path)
+		}
+		if err == nil && tracked != nil && !tracked[ch.Path] {
+			err = fmt.Errorf("%s は原稿リポジトリにありません", ch.Path)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Message: "保存先が不正です",
+				Error:   err.Error(),
+			})
+			return
+		}
+		seen[ch.Path] = true
+	}
+
+	var paths []string
+	for _, ch := range chapters {
+		full, _ := workspacePath(ch.Path)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Message: "フォルダの作成に失敗しました",
+				Error:   err.Error(),
+			})
+			return
+		}
+		if err := os.WriteFile(full, []byte(ch.Content), 0644); err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Message: "ファイルの書き込みに失敗しました",
+				Error:   err.Error(),
+			})
+			return
+		}
+		paths = append(paths, ch.Path)
+	}
+
+	message := c.PostForm("message")
+	if message == "" {
+		message = fmt.Sprintf("Wordファイル（%s）を取り込み", header.Filename)
+	}
+	commit, err := commitWorkspace(message, paths...)
+	if err != nil && !errors.Is(err, git.ErrEmptyCommit) {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "保存に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	result := map[string]interface{}{
+		"files":   paths,
+		"changed": err == nil,
+	}
+	if err == nil {
+		result["commit"] = commit.String()[:7]
+		result["message"] = message
+	}
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "Wordファイルを取り込んで保存しました",
+		Data:    result,
+	})
+}
+
+// ヘルパー関数：DOCX を作成する
+func buildDOCX(book *exportBook, layout PageLayout) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	var paths []string
+	for _, ch := range book.Chapters {
+		paths = append(paths, ch.Path)
+	}
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+  <Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+  <Default Extension="xml" ContentType="application/xml"/>
+  <Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>
+  <Override PartName="/word/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.styles+xml"/>
+  <Override PartName="/docProps/core.xml" ContentType="application/vnd.openxmlformats-package.core-properties+xml"/>
+  <Override PartName="/docProps/custom.xml" ContentType="application/vnd.openxmlformats-officedocument.custom-properties+xml"/>
+</Types>
+`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+  <Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>
+  <Relationship Id="rId2" Type="http://schemas.openxmlformats.org/package/2006/relationships/metadata/core-properties" Target="docProps/core.xml"/>
+  <Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/custom-properties" Target="docProps/custom.xml"/>
+</Relationships>
+`},
+		{"word/_rels/document.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+  <Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+</Relationships>
+`},
+		{"docProps/core.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <dc:title>` + xmlEscape(book.Title) + `</dc:title>
+  <dc:creator>` + xmlEscape(book.Author) + `</dc:creator>
+  <dc:language>` + book.Language + `</dc:language>
+  <dcterms:modified xsi:type="dcterms:W3CDTF">` + book.Modified.Format("2006-01-02T15:04:05Z") + `</dcterms:modified>
+</cp:coreProperties>
+`},
+		// 取り込み時に章を元のファイルへ戻すため、ファイルの並びを残しておく
+		{"docProps/custom.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/custom-properties" xmlns:vt="http://schemas.openxmlformats.org/officeDocument/2006/docPropsVTypes">
+  <property fmtid="{D5CDD505-2E9C-101B-9397-08002B2CF9AE}" pid="2" name="tenkaiFiles"><vt:lpwstr>` + xmlEscape(strings.Join(paths, "\n")) + `</vt:lpwstr></property>
+</Properties>
+`},
+		{"word/styles.xml", docxStyles(layout)},
+		{"word/document.xml", docxDocument(book, layout)},
+	}
+
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(f.content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ヘルパー関数：原稿用紙の設定から文字の大きさと字送り・行送りを決める（単位は pt）
+func docxGrid(layout PageLayout) (fontSize, charPitch, linePitch float64) {
+	lineExtent := float64(docxPageShort-2*docxPageMargin) / 20
+	acrossExtent := float64(docxPageLong-2*docxPageMargin) / 20
+	charPitch = lineExtent / float64(layout.CharsPerLine)
+	linePitch = acrossExtent / float64(layout.LinesPerPage)
+
+	// 行間が詰まりすぎないよう、文字は行送りの7割までにする
+	fontSize = math.Min(charPitch, linePitch*0.7)
+	fontSize = math.Floor(fontSize*2) / 2
+	return fontSize, charPitch, linePitch
+}
+
+// ヘルパー関数：styles.xml（既定の書式と見出し・表紙のスタイル）
+func docxStyles(layout PageLayout) string {
+	fontSize, _, _ := docxGrid(layout)
+	sz := int(fontSize * 2)
+	heading := func(id, name string, scale float64) string {
+		return fmt.Sprintf(`  <w:style w:type="paragraph" w:styleId="%s">
+    <w:name w:val="%s"/>
+    <w:basedOn w:val="Normal"/>
+    <w:next w:val="Normal"/>
+    <w:qFormat/>
+    <w:pPr><w:keepNext/></w:pPr>
+    <w:rPr><w:b/><w:sz w:val="%d"/><w:szCs w:val="%d"/></w:rPr>
+  </w:style>
+`, id, name, int(float64(sz)*scale), int(float64(sz)*scale))
+	}
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+  <w:docDefaults>
+    <w:rPrDefault>
+      <w:rPr>
+        <w:rFonts w:ascii="ＭＳ 明朝" w:hAnsi="ＭＳ 明朝" w:eastAsia="ＭＳ 明朝"/>
+        <w:sz w:val="` + strconv.Itoa(sz) + `"/>
+        <w:szCs w:val="` + strconv.Itoa(sz) + `"/>
+        <w:lang w:val="ja-JP" w:eastAsia="ja-JP"/>
+      </w:rPr>
+    </w:rPrDefault>
+    <w:pPrDefault>
+      <w:pPr><w:spacing w:before="0" w:after="0"/></w:pPr>
+    </w:pPrDefault>
+  </w:docDefaults>
+  <w:style w:type="paragraph" w:default="1" w:styleId="Normal">
+    <w:name w:val="Normal"/>
+    <w:qFormat/>
+  </w:style>
+` + heading("Heading1", "heading 1", 1.5) + heading("Heading2", "heading 2", 1.3) + heading("Heading3", "heading 3", 1.1) +
+		heading("Title", "Title", 2) + heading("Subtitle", "Subtitle", 1.2) + `</w:styles>
+`
+}
+
+// ヘルパー関数：document.xml（表紙と本文）
+func docxDocument(book *exportBook, layout PageLayout) string {
+	fontSize, charPitch, linePitch := docxGrid(layout)
+	var body strings.Builder
+
+	// 表紙（取り込み時は Title / Subtitle のスタイルで見分けて読み飛ばす）
+	body.WriteString(`<w:p><w:pPr><w:pStyle w:val="Title"/><w:jc w:val="center"/></w:pPr>` + docxRun(book.Title, "") + "</w:p>\n")
+	if book.Author != "" {
+		body.WriteString(`<w:p><w:pPr><w:pStyle w:val="Subtitle"/><w:jc w:val="center"/></w:pPr>` + docxRun(book.Author, "") + "</w:p>\n")
+	}
+
+	for i, ch := range book.Chapters {
+		// 各章は改ページして始め、章の境目にブックマークを置く
+		pageBreak := true
+		first := true
+		for _, block := range ch.Document.Blocks {
+			if block.Type == "pageBreak" {
+				pageBreak = true
+				continue
+			}
+			var ppr strings.Builder
+			if block.Type == "heading" {
+				ppr.WriteString(fmt.Sprintf(`<w:pStyle w:val="Heading%d"/>`, block.Level))
+			}
+			if pageBreak {
+				ppr.WriteString("<w:pageBreakBefore/>")
+				pageBreak = false
+			}
+			if block.Indent > 0 {
+				ppr.WriteString(fmt.Sprintf(`<w:ind w:leftChars="%d" w:left="%d"/>`, block.Indent*100, int(float64(block.Indent)*fontSize*20)))
+			}
+			body.WriteString("<w:p>")
+			if ppr.Len() > 0 {
+				body.WriteString("<w:pPr>" + ppr.String() + "</w:pPr>")
+			}
+			if first {
+				body.WriteString(fmt.Sprintf(`<w:bookmarkStart w:id="%d" w:name="%s%03d"/><w:bookmarkEnd w:id="%d"/>`, i, docxChapterBookmark, i+1, i))
+				first = false
+			}
+			body.WriteString(docxInlines(block.Inlines))
+			body.WriteString("</w:p>\n")
+		}
+		if first {
+			// 空の章もファイルとして戻せるよう段落を1つ置く
+			body.WriteString(fmt.Sprintf(`<w:p><w:pPr><w:pageBreakBefore/></w:pPr><w:bookmarkStart w:id="%d" w:name="%s%03d"/><w:bookmarkEnd w:id="%d"/></w:p>`+"\n", i, docxChapterBookmark, i+1, i))
+		}
+	}
+
+	// 縦書きは A4 横置きで、行は右から左へ進む
+	pgSz := fmt.Sprintf(`<w:pgSz w:w="%d" w:h="%d"/>`, docxPageShort, docxPageLong)
+	direction := ""
+	if book.WritingMode != "horizontal" {
+		pgSz = fmt.Sprintf(`<w:pgSz w:w="%d" w:h="%d" w:orient="landscape"/>`, docxPageLong, docxPageShort)
+		direction = `<w:textDirection w:val="tbRl"/>`
+	}
+	sectPr := fmt.Sprintf(`<w:sectPr>%s<w:pgMar w:top="%d" w:right="%d" w:bottom="%d" w:left="%d" w:header="720" w:footer="720" w:gutter="0"/>%s<w:docGrid w:type="linesAndChars" w:linePitch="%d" w:charSpace="%d"/></w:sectPr>`,
+		pgSz,
+		docxPageMargin, docxPageMargin, docxPageMargin, docxPageMargin,
+		direction, int(math.Round(linePitch*20)), int(math.Round((charPitch-fontSize)*4096)))
+
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+<w:body>
+` + body.String() + sectPr + `
+</w:body>
+</w:document>
+`
+}
+
+// ヘルパー関数：段落の中身を run にする（外字・未対応の注記は取り込みで戻せるよう注記のまま残す）
+func docxInlines(inlines []AozoraInline) string {
+	var sb strings.Builder
+	for _, in := range inlines {
+		switch in.Type {
+		case "text":
+			sb.WriteString(docxRun(in.Text, in.Emphasis))
+		case "ruby":
+			sb.WriteString(`<w:r><w:ruby><w:rubyPr><w:rubyAlign w:val="distributeSpace"/><w:hps w:val="10"/><w:hpsRaise w:val="18"/><w:hpsBaseText w:val="21"/><w:lid w:val="ja-JP"/></w:rubyPr>`)
+			sb.WriteString("<w:rt>" + docxRun(in.Ruby, "") + "</w:rt>")
+			sb.WriteString("<w:rubyBase>" + docxRun(in.Text, in.Emphasis) + "</w:rubyBase>")
+			sb.WriteString("</w:ruby></w:r>")
+		case "gaiji":
+			sb.WriteString(docxRun("※［＃"+in.Text+"］", in.Emphasis))
+		case "annotation":
+			sb.WriteString(docxRun("［＃"+in.Text+"］", ""))
+		}
+	}
+	return sb.String()
+}
+
+// ヘルパー関数：文字列を run にする（傍点は圏点、傍線は下線）
+func docxRun(text, emphasis string) string {
+	rpr := ""
+	if emphasis != "" {
+		if strings.HasSuffix(emphasis, "傍線") {
+			rpr = `<w:rPr><w:u w:val="single"/></w:rPr>`
+		} else if aozoraEmphasisClass(emphasis) == "circle" || aozoraEmphasisClass(emphasis) == "circle-open" {
+			rpr = `<w:rPr><w:em w:val="circle"/></w:rPr>`
+		} else {
+			rpr = `<w:rPr><w:em w:val="comma"/></w:rPr>`
+		}
+	}
+	return `<w:r>` + rpr + `<w:t xml:space="preserve">` + xmlEscape(text) + `</w:t></w:r>`
+}
+
+// 取り込み中の段落
+type docxParagraph struct {
+	style     string
+	pageBreak bool
+	indent    int
+	chapter   int // 章の境目のブックマーク番号（なければ 0）
+	lines     [][]docxSegment
+}
+
+// ヘルパー関数：Git の管理下にあるファイルの一覧
+func trackedFiles() (map[string]bool, error) {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]bool, len(idx.Entries))
+	for _, e := range idx.Entries {
+		files[e.Name] = true
+	}
+	return files, nil
+}
+
+// 取り込み中の文字列（傍点・傍線の種類つき）
+type docxSegment struct {
+	text     string
+	emphasis string
+}
+
+// ヘルパー関数：DOCX を青空文庫形式のテキストに戻す（tenkai が書き出したものは章ごとに Path を付ける）
+func parseDOCX(data []byte) ([]manuscriptFile, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	read := func(name string) ([]byte, error) {
+		for _, f := range zr.File {
+			if f.Name == name {
+				rc, err := f.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer rc.Close()
+				return io.ReadAll(io.LimitReader(rc, docxMaxUpload*5))
+			}
+		}
+		return nil, fmt.Errorf("%s がありません", name)
+	}
+
+	document, err := read("word/document.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	// スタイルIDは Word の言語で変わる（日本語版では "1" など）ので、名前から見出しと表紙を判別する
+	styleNames := make(map[string]string)
+	if styles, err := read("word/styles.xml"); err == nil {
+		var parsed struct {
+			Styles []struct {
+				ID   string `xml:"styleId,attr"`
+				Name struct {
+					Val string `xml:"val,attr"`
+				} `xml:"name"`
+			} `xml:"style"`
+		}
+		if xml.Unmarshal(styles, &parsed) == nil {
+			for _, s := range parsed.Styles {
+				styleNames[s.ID] = strings.ToLower(s.Name.Val)
+			}
+		}
+	}
+
+	var files []string
+	if custom, err := read("docProps/custom.xml"); err == nil {
+		var parsed struct {
+			Properties []struct {
+				Name  string `xml:"name,attr"`
+				Value string `xml:"lpwstr"`
+			} `xml:"property"`
+		}
+		if xml.Unmarshal(custom, &parsed) == nil {
+			for _, p := range parsed.Properties {
+				if p.Name == "tenkaiFiles" && p.Value != "" {
+					files = strings.Split(p.Value, "\n")
+				}
+			}
+			// 書き出したときのパスは原稿ファイルに限る（書き換えられたファイルで別の場所に書き込ませない）
+			for _, f := range files {
+				if f != path.Clean(f) || path.IsAbs(f) || strings.HasPrefix(f, "../") || isHiddenPath(f) || !manuscriptExtensions[strings.ToLower(path.Ext(f))] {
+					return nil, fmt.Errorf("tenkaiFiles に原稿ファイルではないパスがあります: %q", f)
+				}
+			}
+		}
+	}
+
+	paragraphs, err := readDOCXParagraphs(document)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []manuscriptFile
+	current := &manuscriptFile{}
+	var sb strings.Builder
+	flush := func() {
+		current.Content = sb.String()
+		if current.Path != "" || current.Content != "" {
+			result = append(result, *current)
+		}
+		sb.Reset()
+	}
+	for _, p := range paragraphs {
+		name := styleNames[p.style]
+		if name == "" {
+			name = strings.ToLower(p.style)
+		}
+		if name == "title" || name == "subtitle" {
+			continue
+		}
+		if p.chapter > 0 && p.chapter <= len(files) {
+			flush()
+			current = &manuscriptFile{Path: files[p.chapter-1]}
+			p.pageBreak = false
+		}
+		if p.pageBreak {
+			sb.WriteString("［＃改ページ］\n")
+		}
+		sb.WriteString(docxParagraphText(p, name))
+	}
+	flush()
+	if len(result) == 0 {
+		result = append(result, manuscriptFile{})
+	}
+	return result, nil
+}
+
+// ヘルパー関数：document.xml の段落を読み取る
+func readDOCXParagraphs(document []byte) ([]*docxParagraph, error) {
+	dec := xml.NewDecoder(bytes.NewReader(document))
+	var paragraphs []*docxParagraph
+	var p *docxParagraph
+	var emphasis string
+	var inPPr, inRPr, inText, inRuby, inRt bool
+	var rubyBase, rubyText strings.Builder
+
+	attr := func(e xml.StartElement, name string) string {
+		for _, a := range e.Attr {
+			if a.Name.Local == name {
+				return a.Value
+			}
+		}
+		return ""
+	}
+	appendText := func(text string) {
+		if p == nil {
+			return
+		}
+		if len(p.lines) == 0 {
+			p.lines = append(p.lines, nil)
+		}
+		last := &p.lines[len(p.lines)-1]
+		if n := len(*last); n > 0 && (*last)[n-1].emphasis == emphasis {
+			(*last)[n-1].text += text
+			return
+		}
+		*last = append(*last, docxSegment{text: text, emphasis: emphasis})
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "p":
+				p = &docxParagraph{}
+				paragraphs = append(paragraphs, p)
+			case "pPr":
+				inPPr = true
+			case "pStyle":
+				if inPPr && p != nil {
+					p.style = attr(t, "val")
+				}
+			case "pageBreakBefore":
+				if inPPr && p != nil && attr(t, "val") != "0" && attr(t, "val") != "false" {
+					p.pageBreak = true
+				}
+			case "ind":
+				if inPPr && p != nil {
+					if chars, err := strconv.Atoi(attr(t, "leftChars")); err == nil && chars > 0 {
+						p.indent = chars / 100
+					} else if chars, err := strconv.Atoi(attr(t, "startChars")); err == nil && chars > 0 {
+						p.indent = chars / 100
+					}
+				}
+			case "bookmarkStart":
+				name := attr(t, "name")
+				if p != nil && strings.HasPrefix(name, docxChapterBookmark) {
+					if n, err := strconv.Atoi(strings.TrimPrefix(name, docxChapterBookmark)); err == nil {
+						p.chapter = n
+					}
+				}
+			case "r":
+				if !inRuby {
+					emphasis = ""
+				}
+			case "rPr":
+				inRPr = !inPPr
+			case "em":
+				if inRPr && !inRt && attr(t, "val") != "none" {
+					emphasis = "傍点"
+				}
+			case "u":
+				if inRPr && !inRt && attr(t, "val") != "none" && emphasis == "" {
+					emphasis = "傍線"
+				}
+			case "t":
+				inText = true
+			case "tab":
+				if !inPPr {
+					appendText("\t")
+				}
+			case "br", "cr":
+				if p == nil || inRuby {
+					continue
+				}
+				if attr(t, "type") == "page" {
+					// 段落の途中の改ページは、段落を分けて改ページの注記を挟む
+					next := &docxParagraph{style: p.style, pageBreak: true, indent: p.indent}
+					paragraphs = append(paragraphs, next)
+					p = next
+				} else if attr(t, "type") == "" || attr(t, "type") == "textWrapping" {
+					p.lines = append(p.lines, nil)
+				}
+			case "ruby":
+				inRuby = true
+				rubyBase.Reset()
+				rubyText.Reset()
+			case "rt":
+				inRt = true
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "pPr":
+				inPPr = false
+			case "rPr":
+				inRPr = false
+			case "t":
+				inText = false
+			case "rt":
+				inRt = false
+			case "ruby":
+				inRuby = false
+				appendText("｜" + rubyBase.String() + "《" + rubyText.String() + "》")
+			case "p":
+				p = nil
+			}
+		case xml.CharData:
+			if !inText {
+				continue
+			}
+			switch {
+			case inRt:
+				rubyText.Write(t)
+			case inRuby:
+				rubyBase.Write(t)
+			default:
+				appendText(string(t))
+			}
+		}
+	}
+	return paragraphs, nil
+}
+
+// ヘルパー関数：取り込んだ段落を青空文庫形式の行にする
+func docxParagraphText(p *docxParagraph, styleName string) string {
+	level := 0
+	if strings.HasPrefix(styleName, "heading ") {
+		level, _ = strconv.Atoi(strings.TrimPrefix(styleName, "heading "))
+	}
+	headingNote := aozoraHeadingNote(level)
+
+	if len(p.lines) == 0 {
+		p.lines = append(p.lines, nil)
+	}
+	var sb strings.Builder
+	for _, line := range p.lines {
+		if p.indent > 0 {
+			sb.WriteString("［＃" + toWideDigits(strconv.Itoa(p.indent)) + "字下げ］")
+		}
+		if headingNote != "" {
+			sb.WriteString("［＃" + headingNote + "］")
+		}
+		for _, seg := range line {
+			sb.WriteString(aozoraEmphasisNotation(seg.text, seg.emphasis))
+		}
+		if headingNote != "" {
+			sb.WriteString("［＃" + headingNote + "終わり］")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// ヘルパー関数：半角数字を全角にする
+func toWideDigits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r - '0' + '０'
+		}
+		return r
+	}, s)
+}
+
+// ===== 応募用テキストの書き出し =====
+
+// 書き出しプロファイル（新人賞の応募規定などに合わせた文字コード・改行・字数×行数・注記の扱い）
+type ExportProfile struct {
+	Description  string `json:"description"`
+	Encoding     string `json:"encoding"`     // "utf-8" または "shift_jis"
+	LineEnding   string `json:"lineEnding"`   // "lf" または "crlf"
+	CharsPerLine int    `json:"charsPerLine"` // 0 は折り返さない
+	LinesPerPage int    `json:"linesPerPage"` // charsPerLine と組で指定する
+	Notation     string `json:"notation"`     // "keep"（青空文庫形式のまま）, "strip"（注記を除く）, "paren"（ルビを括弧書きにして注記を除く）
+	CoverSheet   bool   `json:"coverSheet"`   // 表紙（タイトル・筆名・字数・枚数）を付ける
+	Name         string `json:"name,omitempty"`
+	Source       string `json:"source,omitempty"` // "builtin", "repository"
+}
+
+// プロファイルファイルの形式（原稿リポジトリの .tenkai/export-profiles.json）
+type ExportProfileFile struct {
+	Version  string                    `json:"version"`
+	Profiles map[string]*ExportProfile `json:"profiles"`
+}
+
+// 書き出せない文字
+type exportTextIssue struct {
+	Path      string `json:"path"`
+	Line      int    `json:"line"`   // 1始まり
+	Column    int    `json:"column"` // 1始まり（文字数）
+	Char      string `json:"char"`
+	CodePoint string `json:"codePoint"`
+}
+
+// プロファイルの保存先
+const repoExportProfilesFile = ".tenkai/export-profiles.json"
+
+// 400字詰め原稿用紙（枚数換算用）
+var genkouyoushi400 = PageLayout{CharsPerLine: 20, LinesPerPage: 20}
+
+// 組み込みのプロファイル
+var builtinExportProfiles = map[string]*ExportProfile{
+	"plain": {
+		Description: "UTF-8・LF、青空文庫形式のまま",
+		Encoding:    "utf-8",
+		LineEnding:  "lf",
+		Notation:    "keep",
+	},
+	"sjis": {
+		Description: "Shift_JIS・CRLF、注記を除いたテキスト",
+		Encoding:    "shift_jis",
+		LineEnding:  "crlf",
+		Notation:    "strip",
+	},
+	"contest-40x30": {
+		Description:  "新人賞応募用：40字×30行、Shift_JIS・CRLF、ルビは括弧書き、表紙つき",
+		Encoding:     "shift_jis",
+		LineEnding:   "crlf",
+		CharsPerLine: 40,
+		LinesPerPage: 30,
+		Notation:     "paren",
+		CoverSheet:   true,
+	},
+	"contest-42x34": {
+		Description:  "新人賞応募用：42字×34行、Shift_JIS・CRLF、ルビは括弧書き、表紙つき",
+		Encoding:     "shift_jis",
+		LineEnding:   "crlf",
+		CharsPerLine: 42,
+		LinesPerPage: 34,
+		Notation:     "paren",
+		CoverSheet:   true,
+	},
+}
+
+// プロファイル一覧
+func handleListExportProfiles(c *gin.Context) {
+	profiles, err := loadExportProfiles()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "書き出しプロファイルの読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]*ExportProfile, 0, len(names))
+	for _, name := range names {
+		list = append(list, profiles[name])
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "書き出しプロファイル一覧を取得しました",
+		Data:    list,
+	})
+}
+
+// プロファイル保存（原稿リポジトリの .tenkai/export-profiles.json に保存してコミット）
+func handleSaveExportProfile(c *gin.Context) {
+	name := c.Param("name")
+	if !promptNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "プロファイル名は英数字・ハイフン・アンダースコア（64文字以内）で指定してください",
+		})
+		return
+	}
+
+	var profile ExportProfile
+	if err := c.ShouldBindJSON(&profile); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validateExportProfile(&profile); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "プロファイルの設定が不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if err := updateRepoExportProfiles(fmt.Sprintf("書き出しプロファイル「%s」を保存", name), func(file *ExportProfileFile) error {
+		profile.Name, profile.Source = "", ""
+		file.Profiles[name] = &profile
+		return nil
+	}); err != nil {
+		respondExportProfileError(c, err)
+		return
+	}
+
+	profile.Name, profile.Source = name, "repository"
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "書き出しプロファイルを保存しました",
+		Data:    profile,
+	})
+}
+
+// プロファイル削除
+func handleDeleteExportProfile(c *gin.Context) {
+	name := c.Param("name")
+	if err := updateRepoExportProfiles(fmt.Sprintf("書き出しプロファイル「%s」を削除", name), func(file *ExportProfileFile) error {
+		if _, ok := file.Profiles[name]; !ok {
+			return os.ErrNotExist
+		}
+		delete(file.Profiles, name)
+		return nil
+	}); err != nil {
+		respondExportProfileError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "書き出しプロファイルを削除しました",
+	})
+}
+
+// ヘルパー関数：プロファイル保存・削除のエラー応答
+func respondExportProfileError(c *gin.Context, err error) {
+	switch {
+	case repo == nil:
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "先に初期化してください",
+		})
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Message: "原稿リポジトリのプロファイルが見つかりません（組み込みのプロファイルは削除できません）",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "書き出しプロファイルの保存に失敗しました",
+			Error:   err.Error(),
+		})
+	}
+}
+
+// 応募用テキストの書き出し（?profile= でプロファイル、?revision= / ?path= で原稿を指定）
+func handleExportText(c *gin.Context) {
+	profile, book, ok := loadTextExport(c)
+	if !ok {
+		return
+	}
+
+	text, issues := renderExportText(book, profile)
+	if len(issues) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, Response{
+			Success: false,
+			Message: fmt.Sprintf("%s で表せない文字が%d箇所あります", profile.Encoding, len(issues)),
+			Error:   "unrepresentable_characters",
+			Data:    map[string]interface{}{"issues": issues},
+		})
+		return
+	}
+
+	data, err := encodeExportText(text, profile.Encoding)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "文字コードの変換に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	charset := "utf-8"
+	if profile.Encoding == "shift_jis" {
+		charset = "Shift_JIS"
+	}
+	sendDownload(c, book.Title+".txt", "text/plain; charset="+charset, data)
+}
+
+// 応募用テキストの事前確認（書き出せない文字・字数・枚数）
+func handleCheckExportText(c *gin.Context) {
+	profile, book, ok := loadTextExport(c)
+	if !ok {
+		return
+	}
+
+	text, issues := renderExportText(book, profile)
+	stats := exportTextStats(book, profile)
+	message := "書き出せます"
+	// バイト数は書き出すファイルの文字コードで数える（表せない文字があって変換できない場合は null）
+	var size interface{}
+	if len(issues) > 0 {
+		message = fmt.Sprintf("%s で表せない文字が%d箇所あります", profile.Encoding, len(issues))
+	} else if data, err := encodeExportText(text, profile.Encoding); err == nil {
+		size = len(data)
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: message,
+		Data: map[string]interface{}{
+			"profile":       profile,
+			"issues":        issues,
+			"characters":    stats.Characters,
+			"pages":         stats.Pages,
+			"manuscript400": stats.Manuscript400,
+			"bytes":         size,
+		},
+	})
+}
+
+// ヘルパー関数：プロファイルと原稿を読み込む（失敗時は応答を返して false）
+func loadTextExport(c *gin.Context) (*ExportProfile, *exportBook, bool) {
+	name := c.DefaultQuery("profile", "plain")
+	profiles, err := loadExportProfiles()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "書き出しプロファイルの読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return nil, nil, false
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Message: fmt.Sprintf("書き出しプロファイル「%s」が見つかりません", name),
+		})
+		return nil, nil, false
+	}
+
+	book, err := loadExportBook(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "原稿の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return nil, nil, false
+	}
+	return profile, book, true
+}
+
+// ヘルパー関数：組み込みと原稿リポジトリのプロファイルを合わせる（同名はリポジトリ優先）
+func loadExportProfiles() (map[string]*ExportProfile, error) {
+	profiles := make(map[string]*ExportProfile)
+	for name, p := range builtinExportProfiles {
+		copied := *p
+		copied.Name, copied.Source = name, "builtin"
+		profiles[name] = &copied
+	}
+
+	file, err := getRepoExportProfiles()
+	if err != nil {
+		return nil, err
+	}
+	for name, p := range file.Profiles {
+		if err := validateExportProfile(p); err != nil {
+			return nil, fmt.Errorf("%s のプロファイル「%s」: %v", repoExportProfilesFile, name, err)
+		}
+		copied := *p
+		copied.Name, copied.Source = name, "repository"
+		profiles[name] = &copied
+	}
+	return profiles, nil
+}
+
+// ヘルパー関数：原稿リポジトリのプロファイルを取得（存在しない場合は空）
+func getRepoExportProfiles() (*ExportProfileFile, error) {
+	file := &ExportProfileFile{Version: "1.0", Profiles: make(map[string]*ExportProfile)}
+	if repo == nil {
+		return file, nil
+	}
+
+	content, err := os.ReadFile(filepath.Join(workDir, filepath.FromSlash(repoExportProfilesFile)))
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, file); err != nil {
+		return nil, fmt.Errorf("%s の形式が不正です: %v", repoExportProfilesFile, err)
+	}
+	if file.Profiles == nil {
+		file.Profiles = make(map[string]*ExportProfile)
+	}
+	return file, nil
+}
+
+// ヘルパー関数：原稿リポジトリのプロファイルを書き換えてコミットする
+func updateRepoExportProfiles(message string, update func(*ExportProfileFile) error) error {
+	if repo == nil {
+		return fmt.Errorf("先に初期化してください")
+	}
+	file, err := getRepoExportProfiles()
+	if err != nil {
+		return err
+	}
+	if err := update(file); err != nil {
+		return err
+	}
+	return writeRepoJSON(repoExportProfilesFile, file, message)
+}
+
+// ヘルパー関数：プロファイルの検証（省略された項目は既定値にする）
+func validateExportProfile(p *ExportProfile) error {
+	p.Encoding = strings.ToLower(strings.ReplaceAll(p.Encoding, "-", "_"))
+	switch p.Encoding {
+	case "", "utf_8", "utf8":
+		p.Encoding = "utf-8"
+	case "shift_jis", "sjis", "cp932", "windows_31j":
+		p.Encoding = "shift_jis"
+	default:
+		return fmt.Errorf("encoding は utf-8 または shift_jis を指定してください: %q", p.Encoding)
+	}
+
+	switch strings.ToLower(p.LineEnding) {
+	case "", "lf":
+		p.LineEnding = "lf"
+	case "crlf":
+		p.LineEnding = "crlf"
+	default:
+		return fmt.Errorf("lineEnding は lf または crlf を指定してください: %q", p.LineEnding)
+	}
+
+	if p.Notation == "" {
+		p.Notation = "keep"
+	}
+	if p.Notation != "keep" && p.Notation != "strip" && p.Notation != "paren" {
+		return fmt.Errorf("notation は keep, strip, paren のいずれかを指定してください: %q", p.Notation)
+	}
+
+	if p.CharsPerLine < 0 || p.LinesPerPage < 0 || (p.CharsPerLine > 0) != (p.LinesPerPage > 0) {
+		return fmt.Errorf("charsPerLine と linesPerPage は組で正の数を指定してください")
+	}
+	if p.CharsPerLine > 0 && p.Notation == "keep" {
+		// 注記を残したまま字数で折り返すと、注記の途中で行が分かれてしまう
+		return fmt.Errorf("字数×行数を指定する場合は notation に strip または paren を指定してください")
+	}
+	return nil
+}
+
+// ヘルパー関数：注記の扱いに合わせて文書を変換する（ルビの括弧書き・傍点や未対応の注記の除去）
+func convertDocumentNotation(doc *AozoraDocument, notation string) *AozoraDocument {
+	converted := &AozoraDocument{Blocks: make([]AozoraBlock, 0, len(doc.Blocks))}
+	for _, block := range doc.Blocks {
+		b := block
+		b.Inlines = nil
+		for _, in := range block.Inlines {
+			switch in.Type {
+			case "text":
+				in.Emphasis = ""
+				b.Inlines = append(b.Inlines, in)
+			case "ruby":
+				text := in.Text
+				if notation == "paren" {
+					text += "（" + in.Ruby + "）"
+				}
+				b.Inlines = append(b.Inlines, AozoraInline{Type: "text", Text: text, Start: in.Start, End: in.End})
+			case "gaiji":
+				b.Inlines = append(b.Inlines, AozoraInline{Type: "text", Text: "〓", Start: in.Start, End: in.End})
+			}
+		}
+		converted.Blocks = append(converted.Blocks, b)
+	}
+	return converted
+}
+
+// ヘルパー関数：章の本文を行の並びにする（字数×行数の指定があればページの行数まで空行で埋める）
+func exportChapterLines(ch exportChapter, profile *ExportProfile) []string {
+	if profile.Notation == "keep" {
+		// 注記を残す場合は元の原稿をそのまま使う
+		return strings.Split(strings.TrimRight(strings.ReplaceAll(ch.Source, "\r\n", "\n"), "\n"), "\n")
+	}
+	doc := convertDocumentNotation(ch.Document, profile.Notation)
+
+	if profile.CharsPerLine > 0 {
+		var lines []string
+		pagination := paginateDocument(doc, PageLayout{CharsPerLine: profile.CharsPerLine, LinesPerPage: profile.LinesPerPage})
+		for _, page := range pagination.Pages {
+			for _, line := range page.Lines {
+				lines = append(lines, strings.Repeat("　", line.Indent)+line.Text)
+			}
+			for i := len(page.Lines); i < profile.LinesPerPage; i++ {
+				lines = append(lines, "")
+			}
+		}
+		return lines
+	}
+
+	var lines []string
+	for _, block := range doc.Blocks {
+		if block.Type == "pageBreak" {
+			continue
+		}
+		var sb strings.Builder
+		sb.WriteString(strings.Repeat("　", block.Indent))
+		for _, in := range block.Inlines {
+			sb.WriteString(in.Text)
+		}
+		lines = append(lines, sb.String())
+	}
+	return lines
+}
+
+// 字数・枚数
+type exportStats struct {
+	Characters    int `json:"characters"`    // 本文の文字数（空白・改行を除く）
+	Pages         int `json:"pages"`         // プロファイルの字数×行数での枚数（指定がなければ 0）
+	Manuscript400 int `json:"manuscript400"` // 400字詰め原稿用紙換算の枚数
+}
+
+// ヘルパー関数：本文の字数と枚数を数える
+func exportTextStats(book *exportBook, profile *ExportProfile) exportStats {
+	var stats exportStats
+	for _, ch := range book.Chapters {
+		doc := convertDocumentNotation(ch.Document, profile.Notation)
+		for _, block := range doc.Blocks {
+			for _, in := range block.Inlines {
+				for _, r := range in.Text {
+					if !unicode.IsSpace(r) {
+						stats.Characters++
+					}
+				}
+			}
+		}
+		if profile.CharsPerLine > 0 {
+			stats.Pages += paginateDocument(doc, PageLayout{CharsPerLine: profile.CharsPerLine, LinesPerPage: profile.LinesPerPage}).TotalPages
+		}
+		stats.Manuscript400 += paginateDocument(doc, genkouyoushi400).TotalPages
+	}
+	return stats
+}
+
+// ヘルパー関数：プロファイルに従って書き出すテキストを作り、文字コードで表せない文字を調べる
+func renderExportText(book *exportBook, profile *ExportProfile) (string, []exportTextIssue) {
+	var lines []string
+	issues := []exportTextIssue{}
+
+	if profile.CoverSheet {
+		stats := exportTextStats(book, profile)
+		cover := []string{
+			"タイトル：" + book.Title,
+			"筆名：" + book.Author,
+			fmt.Sprintf("字数：%d字（空白・改行を除く）", stats.Characters),
+		}
+		if profile.CharsPerLine > 0 {
+			cover = append(cover, fmt.Sprintf("枚数：%d字×%d行で%d枚", profile.CharsPerLine, profile.LinesPerPage, stats.Pages))
+		}
+		cover = append(cover, fmt.Sprintf("400字詰め原稿用紙換算：%d枚", stats.Manuscript400))
+		for i, line := range cover {
+			for col, r := range []rune(line) {
+				if !encodableRune(r, profile.Encoding) {
+					issues = append(issues, newExportTextIssue("（表紙）", i+1, col+1, r))
+				}
+			}
+		}
+		lines = append(lines, cover...)
+		if profile.LinesPerPage > 0 {
+			for i := len(cover); i < profile.LinesPerPage; i++ {
+				lines = append(lines, "")
+			}
+		} else {
+			lines = append(lines, "")
+		}
+	}
+
+	for i, ch := range book.Chapters {
+		issues = append(issues, unencodableInChapter(ch, profile)...)
+		if i > 0 && profile.CharsPerLine == 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, exportChapterLines(ch, profile)...)
+	}
+
+	newline := "\n"
+	if profile.LineEnding == "crlf" {
+		newline = "\r\n"
+	}
+	return strings.Join(lines, newline) + newline, issues
+}
+
+// ヘルパー関数：章の中で文字コードで表せない文字を探す（位置は元の原稿の行・桁）
+func unencodableInChapter(ch exportChapter, profile *ExportProfile) []exportTextIssue {
+	var issues []exportTextIssue
+	source := []rune(ch.Source)
+	lineStarts := []int{0}
+	for i, r := range source {
+		if r == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+	check := func(r rune, offset int) {
+		if encodableRune(r, profile.Encoding) {
+			return
+		}
+		line := sort.Search(len(lineStarts), func(i int) bool { return lineStarts[i] > offset })
+		issues = append(issues, newExportTextIssue(ch.Path, line, offset-lineStarts[line-1]+1, r))
+	}
+
+	if profile.Notation == "keep" {
+		for i, r := range source {
+			if r != '\r' && r != '\n' {
+				check(r, i)
+			}
+		}
+		return issues
+	}
+	for _, block := range ch.Document.Blocks {
+		for _, in := range block.Inlines {
+			switch in.Type {
+			case "text":
+				for i, r := range []rune(in.Text) {
+					check(r, in.Start+i)
+				}
+			case "ruby":
+				// 親文字の位置は注記の先頭（｜があればその次）から数える
+				base := in.Start
+				if source[base] == '｜' || source[base] == '|' {
+					base++
+				}
+				for i, r := range []rune(in.Text) {
+					check(r, base+i)
+				}
+				if profile.Notation == "paren" {
+					for _, r := range in.Ruby {
+						check(r, in.Start)
+					}
+				}
+			}
+		}
+	}
+	return issues
+}
+
+// ヘルパー関数：書き出せない文字の指摘
+func newExportTextIssue(path string, line, col int, r rune) exportTextIssue {
+	return exportTextIssue{Path: path, Line: line, Column: col, Char: string(r), CodePoint: fmt.Sprintf("U+%04X", r)}
+}
+
+// ヘルパー関数：文字コードで表せる文字か
+func encodableRune(r rune, encoding string) bool {
+	if encoding != "shift_jis" {
+		return r != utf8.RuneError
+	}
+	if r < utf8.RuneSelf {
+		return true
+	}
+	_, err := japanese.ShiftJIS.NewEncoder().String(string(r))
+	return err == nil
+}
+
+// ヘルパー関数：テキストを文字コードに変換する
+func encodeExportText(text, encoding string) ([]byte, error) {
+	if encoding != "shift_jis" {
+		return []byte(text), nil
+	}
+	out, err := japanese.ShiftJIS.NewEncoder().String(text)
+	return []byte(out), err
+}
+
+// ===== Web小説サイト形式（小説家になろう・カクヨム） =====
+
+// 対応するサイト
+var webSerialPlatforms = map[string]string{
+	"narou":    "小説家になろう",
+	"kakuyomu": "カクヨム",
+}
+
+// Web小説サイト形式の取り込みリクエスト
+type WebSerialImportRequest struct {
+	Platform string `json:"platform" binding:"required"` // "narou" または "kakuyomu"
+	Text     string `json:"text" binding:"required"`
+	Title    string `json:"title"`   // 話のタイトル（大見出しとして先頭に入れる）
+	Path     string `json:"path"`    // 指定した場合は作業ディレクトリに保存してコミットする
+	Message  string `json:"message"` // コミットメッセージ
+}
+
+// 1話分の書き出し
+type webSerialEpisode struct {
+	Path  string `json:"path"`
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// 1話（1ファイル）をサイト形式で書き出す（?platform=, ?path= 必須、?revision= で草案・コミットを指定）
+// サイトの記法で表せないものは変換で失われ、取り込み直しても元に戻らない（renderWebSerial を参照）
+func handleExportWebSerial(c *gin.Context) {
+	platform, ok := requireWebSerialPlatform(c, c.Query("platform"))
+	if !ok {
+		return
+	}
+	if c.Query("path") == "" {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "書き出す話（path）を指定してください",
+		})
+		return
+	}
+
+	book, err := loadExportBook(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "原稿の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	ch := book.Chapters[0]
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("%s形式に変換しました", webSerialPlatforms[platform]),
+		Data: webSerialEpisode{
+			Path:  ch.Path,
+			Title: ch.Title,
+			Body:  renderWebSerial(ch.Document, platform),
+		},
+	})
+}
+
+// 草案全体を話ごとのファイルにして zip で書き出す（?platform=, ?revision= で草案・コミットを指定）
+func handleExportWebSerialZip(c *gin.Context) {
+	platform, ok := requireWebSerialPlatform(c, c.Query("platform"))
+	if !ok {
+		return
+	}
+
+	book, err := loadExportBook(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "原稿の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i, ch := range book.Chapters {
+		// 投稿順が分かるよう、ファイル名は通し番号とタイトルにする
+		w, err := zw.Create(fmt.Sprintf("%03d_%s.txt", i+1, safeFileName(ch.Title)))
+		if err == nil {
+			_, err = w.Write([]byte(renderWebSerial(ch.Document, platform)))
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Message: "zipの作成に失敗しました",
+				Error:   err.Error(),
+			})
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "zipの作成に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	sendDownload(c, fmt.Sprintf("%s_%s.zip", book.Title, platform), "application/zip", buf.Bytes())
+}
+
+// サイト形式の本文を青空文庫形式に変換する（path を指定した場合は保存してコミット）
+// 書き出した本文を取り込み直すと、字下げは全角空白の本文に、改ページは空行になり、
+// 傍点は ［＃「…」に傍点］ の形で、ルビは ｜親文字《ルビ》 の形で戻る。見出しと傍線は戻らない
+func handleImportWebSerial(c *gin.Context) {
+	var req WebSerialImportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+	platform, ok := requireWebSerialPlatform(c, req.Platform)
+	if !ok {
+		return
+	}
+
+	doc := parseWebSerial(req.Text, platform)
+	if req.Title != "" {
+		heading := AozoraBlock{Type: "heading", Level: 1, Inlines: []AozoraInline{{Type: "text", Text: req.Title}}}
+		doc.Blocks = append([]AozoraBlock{heading}, doc.Blocks...)
+	}
+	text := doc.AozoraText()
+
+	result := map[string]interface{}{
+		"text": text,
+	}
+	if req.Path != "" {
+		if repo == nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Message: "先に初期化してください",
+			})
+			return
+		}
+		// .tenkai/ の構成・用語集・校正ルールなどを上書きしないよう、原稿ファイルのパスに限る
+		full, err := workspacePath(req.Path)
+		if err == nil {
+			err = checkManuscriptPath(req.Path)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Message: "保存先が不正です",
+				Error:   err.Error(),
+			})
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err == nil {
+			err = os.WriteFile(full, []byte(text), 0644)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Message: "ファイルの書き込みに失敗しました",
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		message := req.Message
+		if message == "" {
+			message = fmt.Sprintf("%s形式の原稿を取り込み（%s）", webSerialPlatforms[platform], req.Path)
+		}
+		commit, err := commitWorkspace(message, req.Path)
+		if err != nil && !errors.Is(err, git.ErrEmptyCommit) {
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Message: "保存に失敗しました",
+				Error:   err.Error(),
+			})
+			return
+		}
+		result["path"] = req.Path
+		result["changed"] = err == nil
+		if err == nil {
+			result["commit"] = commit.String()[:7]
+		}
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("%s形式から変換しました", webSerialPlatforms[platform]),
+		Data:    result,
+	})
+}
+
+// ヘルパー関数：サイト名を確かめる（不正なら応答を返して false）
+func requireWebSerialPlatform(c *gin.Context, platform string) (string, bool) {
+	if _, ok := webSerialPlatforms[platform]; !ok {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "platform には narou（小説家になろう）または kakuyomu（カクヨム）を指定してください",
+		})
+		return "", false
+	}
+	return platform, true
+}
+
+// ヘルパー関数：ファイル名に使えない文字を置き換える
+func safeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" {
+		name = "untitled"
+	}
+	return name
+}
+
+// ヘルパー関数：文書をサイト形式の本文にする
+// 見出しは話のタイトル欄に入れるので本文からは除き、字下げは全角空白、改ページは空行にする
+// サイトには字下げ・改ページの記法がないため、取り込み直すと ［＃３字下げ］ などの注記は戻らない
+func renderWebSerial(doc *AozoraDocument, platform string) string {
+	var lines []string
+	for _, block := range doc.Blocks {
+		switch block.Type {
+		case "heading":
+			continue
+		case "pageBreak":
+			lines = append(lines, "")
+			continue
+		}
+
+		var sb strings.Builder
+		sb.WriteString(strings.Repeat("　", block.Indent))
+		for _, in := range block.Inlines {
+			switch in.Type {
+			case "text":
+				sb.WriteString(webSerialEmphasis(in.Text, in.Emphasis, platform))
+			case "ruby":
+				// ルビと傍点が重なる場合はルビを優先する
+				bar := "｜"
+				if platform == "narou" {
+					bar = "|"
+				}
+				sb.WriteString(bar + in.Text + "《" + in.Ruby + "》")
+			case "gaiji":
+				sb.WriteString("〓")
+			}
+		}
+		lines = append(lines, sb.String())
+	}
+
+	// 先頭の見出しの後の空行は詰める
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// ヘルパー関数：傍点をサイトの記法にする（なろうは「・」のルビ、カクヨムは《《》》。傍線は表せないので外す）
+func webSerialEmphasis(text, emphasis, platform string) string {
+	if emphasis == "" || strings.HasSuffix(emphasis, "傍線") || text == "" {
+		return text
+	}
+	if platform == "kakuyomu" {
+		return "《《" + text + "》》"
+	}
+	return "|" + text + "《" + strings.Repeat("・", utf8.RuneCountInString(text)) + "》"
+}
+
+// ヘルパー関数：サイト形式の本文を文書にする
+// なろう：|親文字《ルビ》・|親文字(ルビ)・漢字《ルビ》・漢字（かな）、|文字《・・》は傍点
+// カクヨム：｜親文字《ルビ》・漢字《ルビ》・《《傍点》》
+func parseWebSerial(text, platform string) *AozoraDocument {
+	doc := &AozoraDocument{}
+	offset := 0
+	for _, line := range strings.Split(strings.TrimRight(strings.ReplaceAll(text, "\r\n", "\n"), "\n"), "\n") {
+		runes := []rune(line)
+		block := AozoraBlock{Type: "paragraph", Start: offset, End: offset + len(runes)}
+		addText := func(s string, pos int) {
+			if n := len(block.Inlines); n > 0 && block.Inlines[n-1].Type == "text" && block.Inlines[n-1].Emphasis == "" {
+				block.Inlines[n-1].Text += s
+				block.Inlines[n-1].End = pos + utf8.RuneCountInString(s)
+				return
+			}
+			block.Inlines = append(block.Inlines, AozoraInline{Type: "text", Text: s, Start: pos, End: pos + utf8.RuneCountInString(s)})
+		}
+		addRuby := func(base, ruby string, start, end int) {
+			if ruby != "" && strings.Trim(ruby, "・﹅") == "" && utf8.RuneCountInString(ruby) == utf8.RuneCountInString(base) {
+				block.Inlines = append(block.Inlines, AozoraInline{Type: "text", Text: base, Emphasis: "傍点", Start: start, End: end})
+				return
+			}
+			block.Inlines = append(block.Inlines, AozoraInline{Type: "ruby", Text: base, Ruby: ruby, Start: start, End: end})
+		}
+		// 直前の本文の末尾の漢字の並びを親文字として切り出す
+		takeKanji := func() (string, int, bool) {
+			n := len(block.Inlines)
+			if n == 0 || block.Inlines[n-1].Type != "text" || block.Inlines[n-1].Emphasis != "" {
+				return "", 0, false
+			}
+			last := []rune(block.Inlines[n-1].Text)
+			k := len(last)
+			for k > 0 && isRubyBaseRune(last[k-1]) {
+				k--
+			}
+			if k == len(last) {
+				return "", 0, false
+			}
+			start := block.Inlines[n-1].Start + k
+			if k == 0 {
+				block.Inlines = block.Inlines[:n-1]
+			} else {
+				block.Inlines[n-1].Text = string(last[:k])
+				block.Inlines[n-1].End = start
+			}
+			return string(last[k:]), start, true
+		}
+
+		for i := 0; i < len(runes); {
+			r := runes[i]
+			pos := offset + i
+
+			// カクヨムの傍点《《…》》
+			if platform == "kakuyomu" && r == '《' && i+1 < len(runes) && runes[i+1] == '《' {
+				if end := indexRunes(runes, i+2, "》》"); end > i+2 {
+					block.Inlines = append(block.Inlines, AozoraInline{Type: "text", Text: string(runes[i+2 : end]), Emphasis: "傍点", Start: pos, End: offset + end + 2})
+					i = end + 2
+					continue
+				}
+			}
+
+			// |親文字《ルビ》（なろうは（）も使える）
+			if r == '|' || r == '｜' {
+				if open, close, ok := findWebSerialRuby(runes, i+1, platform, false); ok && open > i+1 {
+					addRuby(string(runes[i+1:open]), string(runes[open+1:close]), pos, offset+close+1)
+					i = close + 1
+					continue
+				}
+			}
+
+			// 漢字《ルビ》・なろうの漢字（かな）
+			if r == '《' || (platform == "narou" && (r == '(' || r == '（')) {
+				if _, close, ok := findWebSerialRuby(runes, i, platform, r != '《'); ok {
+					if base, start, ok := takeKanji(); ok {
+						addRuby(base, string(runes[i+1:close]), start, offset+close+1)
+						i = close + 1
+						continue
+					}
+				}
+			}
+
+			addText(string(r), pos)
+			i++
+		}
+
+		doc.Blocks = append(doc.Blocks, block)
+		offset += len(runes) + 1
+	}
+	return doc
+}
+
+// ルビとして扱う長さの上限（それより長いものは本文のまま）
+const (
+	webSerialRubyBaseMaxLength = 20 // |から《までの親文字
+	narouParenRubyMaxLength    = 10 // なろうの（）書きのルビ
+)
+
+// ヘルパー関数：from 以降のルビの括弧の位置を探す（kanaOnly は（）書きのルビで、中身がかなだけの場合に限る）
+func findWebSerialRuby(runes []rune, from int, platform string, kanaOnly bool) (int, int, bool) {
+	open := from
+	for open < len(runes) && runes[open] != '《' && !(platform == "narou" && (runes[open] == '(' || runes[open] == '（')) {
+		if runes[open] == '|' || runes[open] == '｜' {
+			return 0, 0, false
+		}
+		open++
+	}
+	if open >= len(runes) || open-from > webSerialRubyBaseMaxLength {
+		return 0, 0, false
+	}
+
+	closer := map[rune]rune{'《': '》', '(': ')', '（': '）'}[runes[open]]
+	for close := open + 1; close < len(runes); close++ {
+		switch runes[close] {
+		case closer:
+			ruby := runes[open+1 : close]
+			if len(ruby) == 0 {
+				return 0, 0, false
+			}
+			if kanaOnly || runes[open] != '《' {
+				if len(ruby) > narouParenRubyMaxLength {
+					return 0, 0, false
+				}
+				for _, r := range ruby {
+					if !unicode.Is(unicode.Hiragana, r) && !unicode.Is(unicode.Katakana, r) && r != 'ー' && r != '・' {
+						return 0, 0, false
+					}
+				}
+			}
+			return open, close, true
+		case '《', '(', '（':
+			return 0, 0, false
+		}
+	}
+	return 0, 0, false
+}
+
+// ヘルパー関数：from 以降で sub が現れる位置（なければ -1）
+func indexRunes(runes []rune, from int, sub string) int {
+	if from > len(runes) {
+		return -1
+	}
+	i := strings.Index(string(runes[from:]), sub)
+	if i < 0 {
+		return -1
+	}
+	return from + utf8.RuneCountInString(string(runes[from:])[:i])
+}
+
+// ===== ルールによる校正 =====
+
+// ルール校正リクエスト（text か path のどちらかを指定）
+type ProofreadLintRequest struct {
+	Text string `json:"text"`
+	Path string `json:"path"` // 作業ディレクトリからの相対パス
+}
+
+// ルールの設定（原稿リポジトリの .tenkai/proofread.json）
+type ProofreadRuleConfig struct {
+	Enabled  *bool      `json:"enabled,omitempty"`
+	Max      int        `json:"max,omitempty"`      // sentence-length：1文の最大文字数
+	Interval int        `json:"interval,omitempty"` // doubled-joshi：同じ助詞を続けて使ったとみなす間隔（文字数）
+	Terms    [][]string `json:"terms,omitempty"`    // hyoki-yure：表記の組（先頭が推奨表記）
+}
+
+// ルール設定ファイルの形式
+type ProofreadRuleFile struct {
+	Version string                          `json:"version"`
+	Rules   map[string]*ProofreadRuleConfig `json:"rules"`
+}
+
+// 校正ルール（Check は注記を除いた本文を受け取り、本文での位置で指摘を返す。Suggestion が空の指摘は直し方を示さない）
+type proofreadRule struct {
+	ID          string
+	Type        string
+	Description string
+	Check       func(text string, cfg *ProofreadRuleConfig) []ProofreadIssue
+}
+
+// ルール設定の保存先
+const repoProofreadRulesFile = ".tenkai/proofread.json"
+
+// ルールの既定値
+const (
+	defaultSentenceMaxLength = 100
+	defaultJoshiInterval     = 8
+)
+
+// 校正ルール一覧
+var proofreadRules = []proofreadRule{
+	{"ra-nuki", "grammar", "ら抜き言葉（見れる → 見られる）", checkRaNuki},
+	{"double-negation", "style", "二重否定（ないことはない など）", checkDoubleNegation},
+	{"doubled-joshi", "grammar", "同じ助詞の連続（私は今日は など）", checkDoubledJoshi},
+	{"mixed-style", "consistency", "地の文の です・ます調 と だ・である調 の混在", checkMixedStyle},
+	{"width-mixing", "notation", "全角と半角の混在（半角の句読点・括弧、半角カナ）", checkWidthMixing},
+	{"leader-dash", "notation", "三点リーダー・ダッシュを2つ組で使う", checkLeaderDash},
+	{"sentence-length", "style", "長すぎる文", checkSentenceLength},
+	{"hyoki-yure", "consistency", "表記ゆれ（出来る／できる など）", checkHyokiYure},
+}
+
+// ルールによる校正（AI校正と同じ形の指摘を返す）
+func handleProofreadLint(c *gin.Context) {
+	var req ProofreadLintRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	text := req.Text
+	if req.Path != "" {
+		files, err := loadAnalysisSource(LongAnalyzeRequest{Source: "file", Path: req.Path})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Message: "原稿の読み込みに失敗しました",
+				Error:   err.Error(),
+			})
+			return
+		}
+		text = files[0].Content
+	}
+
+	config, err := getRepoProofreadRules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "校正ルールの設定の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// 用語集の表記の組も表記ゆれのルールで調べる
+	if glossary, err := getRepoGlossary(); err == nil {
+		if groups := glossaryTermGroups(glossary.Entries); len(groups) > 0 {
+			cfg := ProofreadRuleConfig{}
+			if existing := config.Rules["hyoki-yure"]; existing != nil {
+				cfg = *existing
+			}
+			cfg.Terms = append(append([][]string{}, cfg.Terms...), groups...)
+			config.Rules["hyoki-yure"] = &cfg
+		}
+	}
+
+	issues, enabled := lintManuscript(text, config)
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("%d件の指摘があります", len(issues)),
+		Data: map[string]interface{}{
+			"issues": issues,
+			"rules":  enabled,
+		},
+	})
+}
+
+// 校正ルール一覧（説明と原稿リポジトリでの設定）
+func handleListProofreadRules(c *gin.Context) {
+	config, err := getRepoProofreadRules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "校正ルールの設定の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	type ruleInfo struct {
+		ID          string               `json:"id"`
+		Type        string               `json:"type"`
+		Description string               `json:"description"`
+		Enabled     bool                 `json:"enabled"`
+		Config      *ProofreadRuleConfig `json:"config,omitempty"`
+	}
+	rules := make([]ruleInfo, 0, len(proofreadRules))
+	for _, rule := range proofreadRules {
+		cfg := config.Rules[rule.ID]
+		rules = append(rules, ruleInfo{
+			ID:          rule.ID,
+			Type:        rule.Type,
+			Description: rule.Description,
+			Enabled:     cfg == nil || cfg.Enabled == nil || *cfg.Enabled,
+			Config:      cfg,
+		})
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "校正ルール一覧を取得しました",
+		Data:    rules,
+	})
+}
+
+// 校正ルールの設定を保存（原稿リポジトリの .tenkai/proofread.json に保存してコミット）
+func handleSaveProofreadRule(c *gin.Context) {
+	id := c.Param("id")
+	if findProofreadRule(id) == nil {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Message: fmt.Sprintf("校正ルール「%s」はありません", id),
+		})
+		return
+	}
+
+	var cfg ProofreadRuleConfig
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if cfg.Max < 0 || cfg.Interval < 0 {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "max と interval は0以上を指定してください",
+		})
+		return
+	}
+	for _, group := range cfg.Terms {
+		if len(group) < 2 {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Message: "terms は推奨表記とゆれの表記を2つ以上の組で指定してください",
+			})
+			return
+		}
+	}
+
+	if repo == nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "先に初期化してください",
+		})
+		return
+	}
+	file, err := getRepoProofreadRules()
+	if err == nil {
+		file.Rules[id] = &cfg
+		err = writeRepoJSON(repoProofreadRulesFile, file, fmt.Sprintf("校正ルール「%s」の設定を保存", id))
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "校正ルールの設定の保存に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "校正ルールの設定を保存しました",
+		Data:    cfg,
+	})
+}
+
+// ヘルパー関数：ルールを探す
+func findProofreadRule(id string) *proofreadRule {
+	for i := range proofreadRules {
+		if proofreadRules[i].ID == id {
+			return &proofreadRules[i]
+		}
+	}
+	return nil
+}
+
+// ヘルパー関数：原稿リポジトリのルール設定を取得（存在しない場合は空）
+func getRepoProofreadRules() (*ProofreadRuleFile, error) {
+	file := &ProofreadRuleFile{Version: "1.0", Rules: make(map[string]*ProofreadRuleConfig)}
+	if repo == nil {
+		return file, nil
+	}
+
+	content, err := os.ReadFile(filepath.Join(workDir, filepath.FromSlash(repoProofreadRulesFile)))
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, file); err != nil {
+		return nil, fmt.Errorf("%s の形式が不正です: %v", repoProofreadRulesFile, err)
+	}
+	if file.Rules == nil {
+		file.Rules = make(map[string]*ProofreadRuleConfig)
+	}
+	return file, nil
+}
+
+// ヘルパー関数：作業ディレクトリのJSONファイルを書き換えてコミットする
+func writeRepoJSON(rel string, value interface{}, message string) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	full := filepath.Join(workDir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(full, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	_, err = commitWorkspace(message, rel)
+	return err
+}
+
+// ヘルパー関数：有効なルールで原稿を校正し、元の文字列での位置の指摘と使ったルールを返す
+func lintManuscript(source string, config *ProofreadRuleFile) ([]ProofreadIssue, []string) {
+	plain, offsets := parseAozora(source).PlainText()
+
+	issues := []ProofreadIssue{}
+	enabled := []string{}
+	for _, rule := range proofreadRules {
+		cfg := config.Rules[rule.ID]
+		if cfg == nil {
+			cfg = &ProofreadRuleConfig{}
+		}
+		if cfg.Enabled != nil && !*cfg.Enabled {
+			continue
+		}
+		enabled = append(enabled, rule.ID)
+
+		found := rule.Check(plain, cfg)
+		for i := range found {
+			found[i].Type = rule.Type
+			found[i].RuleID = rule.ID
+			found[i].Source = "rule"
+		}
+		for _, issue := range mapProofreadIssues(source, found, offsets) {
+			// 直し方のない指摘は、反映しても本文が変わらないよう元の文字列を入れておく
+			if issue.Suggestion == "" {
+				issue.Suggestion = issue.Original
+			}
+			issue.ID = fmt.Sprintf("rule-%s-%d-%d", issue.RuleID, issue.Start, issue.End)
+			issues = append(issues, issue)
+		}
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].Start < issues[j].Start })
+	return issues, enabled
+}
+
+// ヘルパー関数：正規表現の一致をすべて指摘にする（位置は文字単位に直す）
+func regexpIssues(text string, pattern *regexp.Regexp, build func(match []string) (suggestion, reason string)) []ProofreadIssue {
+	var issues []ProofreadIssue
+	counted, runes := 0, 0 // text[:counted] の文字数（一致は前から順に並ぶので、続きから数える）
+	for _, loc := range pattern.FindAllStringSubmatchIndex(text, -1) {
+		match := make([]string, len(loc)/2)
+		for i := range match {
+			if loc[2*i] >= 0 {
+				match[i] = text[loc[2*i]:loc[2*i+1]]
+			}
+		}
+		suggestion, reason := build(match)
+		if reason == "" {
+			continue
+		}
+		runes += utf8.RuneCountInString(text[counted:loc[0]])
+		counted = loc[0]
+		start := runes
+		issues = append(issues, ProofreadIssue{
+			Start:      start,
+			End:        start + utf8.RuneCountInString(match[0]),
+			Original:   match[0],
+			Suggestion: suggestion,
+			Reason:     reason,
+		})
+	}
+	return issues
+}
+
+// ら抜き言葉になりやすい一段動詞・カ変動詞の語幹
+var raNukiPattern = regexp.MustCompile(`(見|来|着|寝|居|出|似|煮|食べ|起き|考え|決め|投げ|覚え|調べ|借り|信じ|感じ|降り|落ち|逃げ|助け|受け|生き|続け|忘れ|比べ|答え|教え|変え|止め|辞め|伸び|浴び)れ(る|ない|なかった|ます|ません|た|て|ず|れば)`)
+
+// ルール：ら抜き言葉
+func checkRaNuki(text string, cfg *ProofreadRuleConfig) []ProofreadIssue {
+	return regexpIssues(text, raNukiPattern, func(m []string) (string, string) {
+		return m[1] + "られ" + m[2], "ら抜き言葉です"
+	})
+}
+
+var doubleNegationPattern = regexp.MustCompile(`な(いことはない|いことも(ない|なくはない)|いわけではない|いわけでもない|いでもない|くはない|くもない|いとも限らない)`)
+
+// ルール：二重否定
+func checkDoubleNegation(text string, cfg *ProofreadRuleConfig) []ProofreadIssue {
+	return regexpIssues(text, doubleNegationPattern, func(m []string) (string, string) {
+		return "", "二重否定は意味が取りにくくなります。肯定の形にできないか確認してください"
+	})
+}
+
+// 続けて使ったかを調べる助詞と、同じ助詞が重なった誤字
+var (
+	doubledJoshiTargets  = []rune{'は', 'が', 'を'}
+	repeatedJoshiPattern = regexp.MustCompile(`をを|がが|にに`)
+)
+
+// ルール：同じ助詞の連続
+func checkDoubledJoshi(text string, cfg *ProofreadRuleConfig) []ProofreadIssue {
+	issues := regexpIssues(text, repeatedJoshiPattern, func(m []string) (string, string) {
+		return string([]rune(m[0])[:1]), "助詞が重なっています"
+	})
+
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultJoshiInterval
+	}
+	all := []rune(text)
+	for _, s := range splitSentences(text) {
+		runes := all[s[0]:s[1]]
+		last := make(map[rune]int)
+		for i := 1; i < len(runes); i++ {
+			r := runes[i]
+			if !containsRune(doubledJoshiTargets, r) {
+				continue
+			}
+			// 漢字・カタカナ・閉じ括弧の直後だけを助詞とみなす（ひらがなの語の一部を拾わないため）
+			prev := runes[i-1]
+			if !unicode.Is(unicode.Han, prev) && !unicode.Is(unicode.Katakana, prev) && prev != 'ー' && prev != '」' && prev != '』' {
+				continue
+			}
+			if i+1 < len(runes) && runes[i+1] == r {
+				continue
+			}
+			if j, ok := last[r]; ok && i-j <= interval {
+				issues = append(issues, ProofreadIssue{
+					Start:    s[0] + i,
+					End:      s[0] + i + 1,
+					Original: string(r),
+					Reason:   fmt.Sprintf("助詞「%c」が続いています", r),
+				})
+			}
+			last[r] = i
+		}
+	}
+	return issues
+}
+
+// 文末の形（長いものから調べる）
+var (
+	desuMasuEndings = []string{"ませんでした", "でしょう", "ましょう", "でした", "ました", "ません", "です", "ます"}
+	dearuEndings    = []string{"であろう", "であった", "ではない", "である", "だった", "だろう", "だ"}
+)
+
+// ルール：地の文の文体の混在（会話文「」『』の中は調べない。少ない方の文末を指摘する）
+func checkMixedStyle(text string, cfg *ProofreadRuleConfig) []ProofreadIssue {
+	type ending struct {
+		start, end int
+		desu       bool
+	}
+	var endings []ending
+	runes := []rune(text)
+	depth := 0
+	for i := 0; i <= len(runes); i++ {
+		if i < len(runes) {
+			switch runes[i] {
+			case '「', '『':
+				depth++
+				continue
+			case '」', '』':
+				if depth > 0 {
+					depth--
+				}
+				continue
+			case '。', '\n':
+			default:
+				continue
+			}
+		}
+		if depth > 0 {
+			continue
+		}
+		for _, list := range [][]string{desuMasuEndings, dearuEndings} {
+			for _, e := range list {
+				if runesHaveSuffix(runes[:i], e) {
+					n := utf8.RuneCountInString(e)
+					endings = append(endings, ending{i - n, i, list[0] == desuMasuEndings[0]})
+					break
+				}
+			}
+		}
+	}
+
+	desu := 0
+	for _, e := range endings {
+		if e.desu {
+			desu++
+		}
+	}
+	dearu := len(endings) - desu
+	if desu == 0 || dearu == 0 || desu == dearu {
+		return nil
+	}
+
+	var issues []ProofreadIssue
+	for _, e := range endings {
+		if e.desu == (desu < dearu) {
+			reason := "地の文は だ・である調 が多いので、統一してください"
+			if desu > dearu {
+				reason = "地の文は です・ます調 が多いので、統一してください"
+			}
+			issues = append(issues, ProofreadIssue{Start: e.start, End: e.end, Original: string(runes[e.start:e.end]), Reason: reason})
+		}
+	}
+	return issues
+}
+
+// ヘルパー関数：文字列の末尾が suffix か（末尾の数文字だけを比べる）
+func runesHaveSuffix(runes []rune, suffix string) bool {
+	i := len(runes)
+	for suffix != "" {
+		r, size := utf8.DecodeLastRuneInString(suffix)
+		if i == 0 || runes[i-1] != r {
+			return false
+		}
+		i--
+		suffix = suffix[:len(suffix)-size]
+	}
+	return true
+}
+
+// 半角カナと、和文に隣り合う半角の句読点・括弧（縦中横にする !? !! などの組は除く）
+var (
+	halfwidthKanaPattern  = regexp.MustCompile(`[ｦ-ﾟ]+`)
+	halfwidthPunctPattern = regexp.MustCompile(`[!?]{2}|[,.:;()!?]`)
+)
+
+// ルール：全角と半角の混在
+func checkWidthMixing(text string, cfg *ProofreadRuleConfig) []ProofreadIssue {
+	issues := regexpIssues(text, halfwidthKanaPattern, func(m []string) (string, string) {
+		return width.Widen.String(m[0]), "半角カナは全角にしてください"
+	})
+
+	runes := []rune(text)
+	for _, issue := range regexpIssues(text, halfwidthPunctPattern, func(m []string) (string, string) {
+		if len(m[0]) == 2 {
+			return "", ""
+		}
+		return width.Widen.String(m[0]), "和文の中の記号は全角にしてください"
+	}) {
+		// 英数字の中の記号（3.14 や Mr. など）はそのままにする
+		if issue.Start > 0 && isJapaneseRune(runes[issue.Start-1]) || issue.End < len(runes) && isJapaneseRune(runes[issue.End]) {
+			if issue.Original == "." && (issue.End < len(runes) && runes[issue.End] == '.' || issue.Start > 0 && runes[issue.Start-1] == '.') {
+				continue // ... は leader-dash で指摘する
+			}
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+// ヘルパー関数：和文の文字か（かな・漢字・全角の記号）
+func isJapaneseRune(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana) || (r >= 0x3000 && r <= 0x303f) || (r >= 0xff01 && r <= 0xff60)
+}
+
+// 三点リーダー・ダッシュの代わりに使われがちな記号
+var (
+	leaderRunPattern  = regexp.MustCompile(`…+|―+`)
+	fakeLeaderPattern = regexp.MustCompile(`・{3,}|\.{3,}|[—─━]{2,}`)
+)
+
+// ルール：三点リーダー・ダッシュは2つ組（……　――）で使う
+func checkLeaderDash(text string, cfg *ProofreadRuleConfig) []ProofreadIssue {
+	issues := regexpIssues(text, leaderRunPattern, func(m []string) (string, string) {
+		n := utf8.RuneCountInString(m[0])
+		if n%2 == 0 {
+			return "", ""
+		}
+		r, _ := utf8.DecodeRuneInString(m[0])
+		return strings.Repeat(string(r), n+1), fmt.Sprintf("「%c」は2つ組で使ってください", r)
+	})
+	issues = append(issues, regexpIssues(text, fakeLeaderPattern, func(m []string) (string, string) {
+		r, _ := utf8.DecodeRuneInString(m[0])
+		if r == '・' || r == '.' {
+			return "……", "三点リーダー（……）を使ってください"
+		}
+		n := utf8.RuneCountInString(m[0])
+		return strings.Repeat("―", n+n%2), "ダッシュ（――）を使ってください"
+	})...)
+	return issues
+}
+
+// ルール：長すぎる文
+func checkSentenceLength(text string, cfg *ProofreadRuleConfig) []ProofreadIssue {
+	max := cfg.Max
+	if max <= 0 {
+		max = defaultSentenceMaxLength
+	}
+
+	var issues []ProofreadIssue
+	runes := []rune(text)
+	for _, s := range splitSentences(text) {
+		start := s[0]
+		for start < s[1] && unicode.IsSpace(runes[start]) {
+			start++
+		}
+		if s[1]-start > max {
+			issues = append(issues, ProofreadIssue{
+				Start:    start,
+				End:      s[1],
+				Original: string(runes[start:s[1]]),
+				Reason:   fmt.Sprintf("1文が%d字あります（%d字以内を目安に分けてください）", s[1]-start, max),
+			})
+		}
+	}
+	return issues
+}
+
+// ヘルパー関数：文の範囲（文字単位、句点・感嘆符・改行で区切る。閉じ括弧は前の文に含める）
+func splitSentences(text string) [][2]int {
+	var sentences [][2]int
+	runes := []rune(text)
+	start := 0
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '\n':
+			if i > start {
+				sentences = append(sentences, [2]int{start, i})
+			}
+			start = i + 1
+		case '。', '！', '？', '!', '?':
+			end := i + 1
+			for end < len(runes) && strings.ContainsRune("！？!?」』）)", runes[end]) {
+				end++
+			}
+			sentences = append(sentences, [2]int{start, end})
+			start = end
+			i = end - 1
+		}
+	}
+	if start < len(runes) {
+		sentences = append(sentences, [2]int{start, len(runes)})
+	}
+	return sentences
+}
+
+// ヘルパー関数：r が list に含まれるか
+func containsRune(list []rune, r rune) bool {
+	for _, x := range list {
+		if x == r {
+			return true
+		}
+	}
+	return false
+}
+
+// 組み込みの表記の組（どちらも使われている場合だけ、少ない方を指摘する）
+var builtinHyokiYure = [][]string{
+	{"ください", "下さい"},
+	{"すべて", "全て"},
+	{"さまざま", "様々"},
+	{"いろいろ", "色々"},
+	{"ほとんど", "殆ど"},
+	{"すでに", "既に"},
+	{"わずか", "僅か"},
+	{"いっしょ", "一緒"},
+	{"できる", "出来る"},
+	{"できない", "出来ない"},
+	{"できた", "出来た"},
+	{"コンピューター", "コンピュータ"},
+	{"サーバー", "サーバ"},
+	{"ユーザー", "ユーザ"},
+}
+
+// ルール：表記ゆれ（設定の terms は推奨表記以外をすべて指摘する）
+func checkHyokiYure(text string, cfg *ProofreadRuleConfig) []ProofreadIssue {
+	var issues []ProofreadIssue
+	for _, group := range cfg.Terms {
+		issues = append(issues, hyokiYureIssues(text, group, true)...)
+	}
+	for _, group := range builtinHyokiYure {
+		issues = append(issues, hyokiYureIssues(text, group, false)...)
+	}
+	return issues
+}
+
+// ヘルパー関数：表記の組の使われ方を調べる
+// strict は先頭を推奨表記としてそれ以外をすべて指摘し、そうでなければ多い方に合わせる
+func hyokiYureIssues(text string, group []string, strict bool) []ProofreadIssue {
+	// 長い表記から照合して、「コンピューター」の中の「コンピュータ」などを拾わないようにする
+	variants := make([]string, 0, len(group))
+	for _, v := range group {
+		if v != "" {
+			variants = append(variants, regexp.QuoteMeta(v))
+		}
+	}
+	if len(variants) < 2 {
+		return nil
+	}
+	sort.SliceStable(variants, func(i, j int) bool { return len(variants[i]) > len(variants[j]) })
+	pattern := regexp.MustCompile(strings.Join(variants, "|"))
+
+	matches := regexpIssues(text, pattern, func(m []string) (string, string) { return "", m[0] })
+	counts := make(map[string]int)
+	for _, m := range matches {
+		counts[m.Original] = counts[m.Original] + 1
+	}
+
+	preferred := group[0]
+	if !strict {
+		if len(counts) < 2 {
+			return nil
+		}
+		for _, v := range group {
+			if counts[v] > counts[preferred] {
+				preferred = v
+			}
+		}
+	}
+
+	var issues []ProofreadIssue
+	for _, m := range matches {
+		if m.Original == preferred {
+			continue
+		}
+		m.Suggestion = preferred
+		m.Reason = fmt.Sprintf("表記ゆれです（「%s」に統一）", preferred)
+		issues = append(issues, m)
+	}
+	return issues
+}
+
+// ===== 用語集・表記ゆれ辞書 =====
+
+// 用語集の項目
+type GlossaryEntry struct {
+	Term     string   `json:"term" binding:"required"` // 推奨表記
+	Reading  string   `json:"reading,omitempty"`       // 読み（この語のルビが違えば指摘する）
+	Variants []string `json:"variants,omitempty"`      // ゆれの表記（見つけたら推奨表記に直す）
+	Category string   `json:"category,omitempty"`      // "character", "place", "term" など
+	Note     string   `json:"note,omitempty"`
+}
+
+// 用語集ファイルの形式（原稿リポジトリの .tenkai/glossary.json）
+type GlossaryFile struct {
+	Version string           `json:"version"`
+	Entries []*GlossaryEntry `json:"entries"`
+}
+
+// 表記ゆれの確認リクエスト（対象の指定は長編分析と同じ。省略時は作業ディレクトリ全体）
+type GlossaryCheckRequest struct {
+	Source string `json:"source"` // "text", "file", "draft", "workspace"
+	Text   string `json:"text"`
+	Path   string `json:"path"`
+	Draft  string `json:"draft"`
+}
+
+// 表記の統一リクエスト
+type GlossaryNormalizeRequest struct {
+	Paths   []string `json:"paths"` // 省略時は作業ディレクトリの原稿すべて
+	Message string   `json:"message"`
+}
+
+// 用語集の保存先
+const repoGlossaryFile = ".tenkai/glossary.json"
+
+// 用語集の取得
+func handleListGlossary(c *gin.Context) {
+	file, err := getRepoGlossary()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "用語集の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("用語集を取得しました（%d語）", len(file.Entries)),
+		Data:    file.Entries,
+	})
+}
+
+// 用語の追加
+func handleCreateGlossaryEntry(c *gin.Context) {
+	var entry GlossaryEntry
+	if err := c.ShouldBindJSON(&entry); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	updateGlossary(c, http.StatusCreated, fmt.Sprintf("用語「%s」を追加", entry.Term), func(file *GlossaryFile) (int, error) {
+		if findGlossaryEntry(file, entry.Term) >= 0 {
+			return http.StatusConflict, fmt.Errorf("用語「%s」はすでにあります", entry.Term)
+		}
+		file.Entries = append(file.Entries, &entry)
+		return 0, nil
+	}, &entry)
+}
+
+// 用語の更新（term を変えると表記の変更になる）
+func handleUpdateGlossaryEntry(c *gin.Context) {
+	term := c.Param("term")
+	var entry GlossaryEntry
+	if err := c.ShouldBindJSON(&entry); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	updateGlossary(c, http.StatusOK, fmt.Sprintf("用語「%s」を更新", entry.Term), func(file *GlossaryFile) (int, error) {
+		i := findGlossaryEntry(file, term)
+		if i < 0 {
+			return http.StatusNotFound, fmt.Errorf("用語「%s」が見つかりません", term)
+		}
+		if entry.Term != term && findGlossaryEntry(file, entry.Term) >= 0 {
+			return http.StatusConflict, fmt.Errorf("用語「%s」はすでにあります", entry.Term)
+		}
+		file.Entries[i] = &entry
+		return 0, nil
+	}, &entry)
+}
+
+// 用語の削除
+func handleDeleteGlossaryEntry(c *gin.Context) {
+	term := c.Param("term")
+	updateGlossary(c, http.StatusOK, fmt.Sprintf("用語「%s」を削除", term), func(file *GlossaryFile) (int, error) {
+		i := findGlossaryEntry(file, term)
+		if i < 0 {
+			return http.StatusNotFound, fmt.Errorf("用語「%s」が見つかりません", term)
+		}
+		file.Entries = append(file.Entries[:i], file.Entries[i+1:]...)
+		return 0, nil
+	}, nil)
+}
+
+// 表記ゆれ・読みの違いの確認
+func handleCheckGlossary(c *gin.Context) {
+	var req GlossaryCheckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if req.Source == "" {
+		req.Source = "workspace"
+	}
+
+	file, err := getRepoGlossary()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "用語集の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+	files, err := loadAnalysisSource(LongAnalyzeRequest{Source: req.Source, Text: req.Text, Path: req.Path, Draft: req.Draft})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "原稿の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	type fileIssues struct {
+		Path   string           `json:"path"`
+		Issues []ProofreadIssue `json:"issues"`
+	}
+	result := []fileIssues{}
+	total := 0
+	for _, f := range files {
+		issues := checkGlossary(f.Content, file.Entries)
+		if len(issues) > 0 {
+			result = append(result, fileIssues{Path: f.Path, Issues: issues})
+			total += len(issues)
+		}
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("%d件の表記ゆれがあります", total),
+		Data: map[string]interface{}{
+			"total": total,
+			"files": result,
+		},
+	})
+}
+
+// 表記の統一（ゆれの表記を推奨表記に置き換えて1回の保存にする）
+func handleNormalizeGlossary(c *gin.Context) {
+	var req GlossaryNormalizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if repo == nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "先に初期化してください",
+		})
+		return
+	}
+
+	file, err := getRepoGlossary()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "用語集の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+	files, err := readWorkspaceManuscript()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "原稿の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	targets := make(map[string]bool)
+	for _, p := range req.Paths {
+		targets[path.Clean(filepath.ToSlash(p))] = true
+	}
+
+	// すべての原稿を書き換えられると確かめてから、まとめて書き込む
+	var changed []string
+	writes := make(map[string]string)
+	replaced := 0
+	for _, f := range files {
+		if len(targets) > 0 && !targets[f.Path] {
+			continue
+		}
+		issues := checkGlossary(f.Content, file.Entries)
+		if len(issues) == 0 {
+			continue
+		}
+		updated, err := applyProofreadIssues(f.Content, issues)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Success: false,
+				Message: fmt.Sprintf("%s の書き換えに失敗しました", f.Path),
+				Error:   err.Error(),
+			})
+			return
+		}
+		writes[f.Path] = updated
+		changed = append(changed, f.Path)
+		replaced += len(issues)
+	}
+
+	if len(changed) == 0 {
+		c.JSON(http.StatusOK, Response{
+			Success: true,
+			Message: "表記ゆれはありませんでした",
+			Data: map[string]interface{}{
+				"replaced": 0,
+				"files":    []string{},
+			},
+		})
+		return
+	}
+
+	message := req.Message
+	if message == "" {
+		message = fmt.Sprintf("用語集に合わせて表記を統一（%d件）", replaced)
+	}
+	var commit plumbing.Hash
+	rollback, err := applyWorkspaceChanges(writes, nil)
+	if err == nil {
+		if commit, err = commitWorkspace(message, changed...); err != nil {
+			rollback()
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "保存に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("%d件の表記を統一して保存しました", replaced),
+		Data: map[string]interface{}{
+			"commit":   commit.String()[:7],
+			"message":  message,
+			"replaced": replaced,
+			"files":    changed,
+		},
+	})
+}
+
+// ヘルパー関数：用語集を書き換えてコミットし、応答を返す（update は失敗時に応答のステータスとエラーを返す）
+func updateGlossary(c *gin.Context, status int, message string, update func(*GlossaryFile) (int, error), entry *GlossaryEntry) {
+	if repo == nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "先に初期化してください",
+		})
+		return
+	}
+	if entry != nil {
+		normalizeGlossaryEntry(entry)
+	}
+
+	file, err := getRepoGlossary()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "用語集の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if code, err := update(file); err != nil {
+		c.JSON(code, Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+	if err := validateGlossary(file); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "用語集の内容が不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	sort.SliceStable(file.Entries, func(i, j int) bool { return file.Entries[i].Term < file.Entries[j].Term })
+	if err := writeRepoJSON(repoGlossaryFile, file, message); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "用語集の保存に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(status, Response{
+		Success: true,
+		Message: "用語集を保存しました",
+		Data:    entry,
+	})
+}
+
+// ヘルパー関数：原稿リポジトリの用語集を取得（存在しない場合は空）
+func getRepoGlossary() (*GlossaryFile, error) {
+	file := &GlossaryFile{Version: "1.0", Entries: []*GlossaryEntry{}}
+	if repo == nil {
+		return file, nil
+	}
+
+	content, err := os.ReadFile(filepath.Join(workDir, filepath.FromSlash(repoGlossaryFile)))
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, file); err != nil {
+		return nil, fmt.Errorf("%s の形式が不正です: %v", repoGlossaryFile, err)
+	}
+	if file.Entries == nil {
+		file.Entries = []*GlossaryEntry{}
+	}
+	return file, nil
+}
+
+// ヘルパー関数：用語を探す（なければ -1）
+func findGlossaryEntry(file *GlossaryFile, term string) int {
+	for i, e := range file.Entries {
+		if e.Term == term {
+			return i
+		}
+	}
+	return -1
+}
+
+// ヘルパー関数：前後の空白・空の表記・重複を取り除く
+func normalizeGlossaryEntry(entry *GlossaryEntry) {
+	entry.Term = strings.TrimSpace(entry.Term)
+	entry.Reading = strings.TrimSpace(entry.Reading)
+	seen := map[string]bool{entry.Term: true}
+	variants := []string{}
+	for _, v := range entry.Variants {
+		v = strings.TrimSpace(v)
+		if v != "" && !seen[v] {
+			seen[v] = true
+			variants = append(variants, v)
+		}
+	}
+	entry.Variants = variants
+}
+
+// ヘルパー関数：用語集の検証（同じ表記が複数の用語に出てくると、どちらに直すか決められない）
+func validateGlossary(file *GlossaryFile) error {
+	owner := make(map[string]string)
+	for _, e := range file.Entries {
+		if e.Term == "" {
+			return fmt.Errorf("用語（term）が空です")
+		}
+		for _, s := range append([]string{e.Term}, e.Variants...) {
+			if other, ok := owner[s]; ok && other != e.Term {
+				return fmt.Errorf("「%s」が用語「%s」と「%s」の両方にあります", s, other, e.Term)
+			}
+			owner[s] = e.Term
+		}
+	}
+	return nil
+}
+
+// ヘルパー関数：表記の組（先頭が推奨表記）にする（表記ゆれの校正ルールでも使う）
+func glossaryTermGroups(entries []*GlossaryEntry) [][]string {
+	var groups [][]string
+	for _, e := range entries {
+		if len(e.Variants) > 0 {
+			groups = append(groups, append([]string{e.Term}, e.Variants...))
+		}
+	}
+	return groups
+}
+
+// ヘルパー関数：原稿の表記ゆれと読みの違いを探す（位置は元の原稿での文字単位）
+func checkGlossary(source string, entries []*GlossaryEntry) []ProofreadIssue {
+	doc := parseAozora(source)
+	plain, offsets := doc.PlainText()
+
+	var found []ProofreadIssue
+	for _, group := range glossaryTermGroups(entries) {
+		found = append(found, hyokiYureIssues(plain, group, true)...)
+	}
+	for i := range found {
+		found[i].Type = "consistency"
+		found[i].Source = "rule"
+		found[i].RuleID = "glossary"
+	}
+	issues := mapProofreadIssues(source, found, offsets)
+
+	// ルビが用語集の読みと違うものは、ルビの部分を指摘する
+	readings := make(map[string]string)
+	for _, e := range entries {
+		if e.Reading == "" {
+			continue
+		}
+		readings[e.Term] = e.Reading
+		for _, v := range e.Variants {
+			readings[v] = e.Reading
+		}
+	}
+	runes := []rune(source)
+	for _, block := range doc.Blocks {
+		for _, in := range block.Inlines {
+			reading, ok := readings[in.Text]
+			if in.Type != "ruby" || !ok || in.Ruby == reading {
+				continue
+			}
+			end := in.End - 1 // 《ルビ》の 》 の位置
+			start := end - utf8.RuneCountInString(in.Ruby)
+			if start < 0 || string(runes[start:end]) != in.Ruby {
+				continue
+			}
+			issues = append(issues, ProofreadIssue{
+				Type:       "consistency",
+				Start:      start,
+				End:        end,
+				Original:   in.Ruby,
+				Suggestion: reading,
+				Reason:     fmt.Sprintf("「%s」の読みは用語集では「%s」です", in.Text, reading),
+				Source:     "rule",
+				RuleID:     "glossary",
+			})
+		}
+	}
+
+	for i := range issues {
+		issues[i].ID = fmt.Sprintf("rule-glossary-%d-%d", issues[i].Start, issues[i].End)
+	}
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].Start < issues[j].Start })
+	return issues
+}
+
+// ===== 登場人物・設定資料 =====
+
+// 設定資料の項目（人物・場所・物・組織）
+type WorldEntity struct {
+	ID            string              `json:"id" yaml:"id"`
+	Kind          string              `json:"kind" yaml:"kind"` // "character", "place", "item", "faction"
+	Name          string              `json:"name" yaml:"name"`
+	Reading       string              `json:"reading,omitempty" yaml:"reading,omitempty"`
+	Aliases       []string            `json:"aliases,omitempty" yaml:"aliases,omitempty"` // 別名・呼び名（登場箇所の検索にも使う）
+	Description   string              `json:"description,omitempty" yaml:"description,omitempty"`
+	Attributes    map[string]string   `json:"attributes,omitempty" yaml:"attributes,omitempty"` // 年齢・所属・外見など自由な項目
+	Relationships []WorldRelationship `json:"relationships,omitempty" yaml:"relationships,omitempty"`
+}
+
+// 項目どうしの関係
+type WorldRelationship struct {
+	Target string `json:"target" yaml:"target"` // 相手のID
+	Type   string `json:"type" yaml:"type"`     // "家族", "師弟", "所属", "所持" など
+	Note   string `json:"note,omitempty" yaml:"note,omitempty"`
+}
+
+// 原稿での登場箇所
+type worldAppearance struct {
+	Path    string `json:"path"`
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+	Line    int    `json:"line"` // 1始まり
+	Text    string `json:"text"` // 見つかった名前・別名
+	Snippet string `json:"snippet"`
+}
+
+// 設定資料の保存先（1項目1ファイル。YAML で書き出し、手で書いた JSON も読む）
+const repoWorldDir = ".tenkai/world"
+
+// 項目の種類
+var worldEntityKinds = map[string]string{
+	"character": "人物",
+	"place":     "場所",
+	"item":      "物",
+	"faction":   "組織",
+}
+
+// 登場箇所の前後に付ける文字数と、返す箇所の上限の既定値
+const (
+	worldSnippetRadius          = 20
+	defaultWorldAppearanceLimit = 100
+)
+
+// 設定資料の一覧（?kind= で種類を絞り込む）
+func handleListWorld(c *gin.Context) {
+	entities, _, err := loadWorld()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "設定資料の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	kind := c.Query("kind")
+	list := make([]*WorldEntity, 0, len(entities))
+	for _, e := range sortedWorldEntities(entities) {
+		if kind == "" || e.Kind == kind {
+			list = append(list, e)
+		}
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("設定資料を取得しました（%d件）", len(list)),
+		Data:    list,
+	})
+}
+
+// 設定資料の取得
+func handleGetWorldEntity(c *gin.Context) {
+	entities, _, err := loadWorld()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "設定資料の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+	entity, ok := entities[c.Param("id")]
+	if !ok {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Message: fmt.Sprintf("設定資料「%s」が見つかりません", c.Param("id")),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "設定資料を取得しました",
+		Data:    entity,
+	})
+}
+
+// 設定資料の追加
+func handleCreateWorldEntity(c *gin.Context) {
+	var entity WorldEntity
+	if err := c.ShouldBindJSON(&entity); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	saveWorldEntity(c, http.StatusCreated, "", &entity)
+}
+
+// 設定資料の更新（ID は変えられない）
+func handleUpdateWorldEntity(c *gin.Context) {
+	var entity WorldEntity
+	if err := c.ShouldBindJSON(&entity); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if entity.ID != "" && entity.ID != c.Param("id") {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "ID は変更できません",
+		})
+		return
+	}
+	entity.ID = c.Param("id")
+
+	saveWorldEntity(c, http.StatusOK, entity.ID, &entity)
+}
+
+// 設定資料の削除（他の項目からの関係も同じ保存で取り除く）
+func handleDeleteWorldEntity(c *gin.Context) {
+	if repo == nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "先に初期化してください",
+		})
+		return
+	}
+
+	id := c.Param("id")
+	entities, paths, err := loadWorld()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "設定資料の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+	entity, ok := entities[id]
+	if !ok {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Message: fmt.Sprintf("設定資料「%s」が見つかりません", id),
+		})
+		return
+	}
+
+	// 項目の削除と、ほかの項目からの関係の削除を1回のコミットにする
+	changed := []string{paths[id]}
+	writes := make(map[string]string)
+	for _, other := range sortedWorldEntities(entities) {
+		if other.ID == id || err != nil {
+			continue
+		}
+		kept := other.Relationships[:0]
+		for _, rel := range other.Relationships {
+			if rel.Target != id {
+				kept = append(kept, rel)
+			}
+		}
+		if len(kept) == len(other.Relationships) {
+			continue
+		}
+		other.Relationships = kept
+		var content []byte
+		if content, err = marshalWorldEntity(paths[other.ID], other); err == nil {
+			writes[paths[other.ID]] = string(content)
+			changed = append(changed, paths[other.ID])
+		}
+	}
+	if err == nil {
+		var rollback func()
+		if rollback, err = applyWorkspaceChanges(writes, []string{paths[id]}); err == nil {
+			if _, err = commitWorkspace(fmt.Sprintf("設定資料「%s」を削除", entity.Name), changed...); err != nil {
+				rollback()
+			}
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "設定資料の削除に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "設定資料を削除しました",
+		Data: map[string]interface{}{
+			"files": changed,
+		},
+	})
+}
+
+// 関係図（?kind= で種類を絞り込む）
+func handleWorldGraph(c *gin.Context) {
+	entities, _, err := loadWorld()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "設定資料の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	type node struct {
+		ID   string `json:"id"`
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	}
+	type edge struct {
+		Source string `json:"source"`
+		Target string `json:"target"`
+		Type   string `json:"type"`
+		Note   string `json:"note,omitempty"`
+	}
+	kind := c.Query("kind")
+	nodes := []node{}
+	edges := []edge{}
+	included := make(map[string]bool)
+	for _, e := range sortedWorldEntities(entities) {
+		if kind == "" || e.Kind == kind {
+			nodes = append(nodes, node{ID: e.ID, Kind: e.Kind, Name: e.Name})
+			included[e.ID] = true
+		}
+	}
+	for _, e := range sortedWorldEntities(entities) {
+		for _, rel := range e.Relationships {
+			if included[e.ID] && included[rel.Target] {
+				edges = append(edges, edge{Source: e.ID, Target: rel.Target, Type: rel.Type, Note: rel.Note})
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("関係図を作成しました（%d項目・%d関係）", len(nodes), len(edges)),
+		Data: map[string]interface{}{
+			"nodes": nodes,
+			"edges": edges,
+		},
+	})
+}
+
+// 全項目の初登場と登場回数（?revision= でコミット・草案を指定）
+func handleWorldAppearanceSummary(c *gin.Context) {
+	entities, files, ok := loadWorldWithManuscript(c)
+	if !ok {
+		return
+	}
+
+	type summary struct {
+		ID    string           `json:"id"`
+		Kind  string           `json:"kind"`
+		Name  string           `json:"name"`
+		Count int              `json:"count"`
+		First *worldAppearance `json:"first"`
+	}
+	result := []summary{}
+	for _, e := range sortedWorldEntities(entities) {
+		appearances := findWorldAppearances(e, files)
+		s := summary{ID: e.ID, Kind: e.Kind, Name: e.Name, Count: len(appearances)}
+		if len(appearances) > 0 {
+			s.First = &appearances[0]
+		}
+		result = append(result, s)
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: "登場状況を集計しました",
+		Data:    result,
+	})
+}
+
+// 1項目の登場箇所（?revision= でコミット・草案、?limit= で返す箇所の上限を指定）
+func handleWorldAppearances(c *gin.Context) {
+	entities, files, ok := loadWorldWithManuscript(c)
+	if !ok {
+		return
+	}
+	entity, found := entities[c.Param("id")]
+	if !found {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Message: fmt.Sprintf("設定資料「%s」が見つかりません", c.Param("id")),
+		})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultWorldAppearanceLimit)))
+	if err != nil || limit <= 0 {
+		limit = defaultWorldAppearanceLimit
+	}
+
+	appearances := findWorldAppearances(entity, files)
+	perFile := []map[string]interface{}{}
+	for _, a := range appearances {
+		if n := len(perFile); n > 0 && perFile[n-1]["path"] == a.Path {
+			perFile[n-1]["count"] = perFile[n-1]["count"].(int) + 1
+			continue
+		}
+		perFile = append(perFile, map[string]interface{}{"path": a.Path, "count": 1})
+	}
+	var first *worldAppearance
+	if len(appearances) > 0 {
+		first = &appearances[0]
+	}
+	total := len(appearances)
+	if len(appearances) > limit {
+		appearances = appearances[:limit]
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("「%s」は%d箇所に登場します", entity.Name, total),
+		Data: map[string]interface{}{
+			"entity":      entity,
+			"total":       total,
+			"first":       first,
+			"files":       perFile,
+			"appearances": appearances,
+		},
+	})
+}
+
+// ヘルパー関数：設定資料と原稿を読み込む（?revision= の場合はどちらもその版から。失敗時は応答を返して false）
+func loadWorldWithManuscript(c *gin.Context) (map[string]*WorldEntity, []worldSearchFile, bool) {
+	revision := c.Query("revision")
+	var entities map[string]*WorldEntity
+	var err error
+	if revision != "" && repo != nil {
+		entities, _, err = loadWorldAtRevision(revision)
+	} else {
+		entities, _, err = loadWorld()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "設定資料の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return nil, nil, false
+	}
+
+	var files []manuscriptFile
+	if repo == nil {
+		err = fmt.Errorf("先に初期化してください")
+	} else if revision != "" {
+		files, err = readManuscriptAtRevision(revision)
+	} else {
+		files, err = readWorkspaceManuscript()
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "原稿の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return nil, nil, false
+	}
+	return entities, newWorldSearchFiles(files), true
+}
+
+// ヘルパー関数：項目を検証して保存し、応答を返す（id が空なら追加）
+func saveWorldEntity(c *gin.Context, status int, id string, entity *WorldEntity) {
+	if repo == nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "先に初期化してください",
+		})
+		return
+	}
+
+	entities, paths, err := loadWorld()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "設定資料の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	rel := paths[id]
+	if id == "" {
+		if entity.ID == "" {
+			entity.ID = newWorldEntityID(entity.Kind, entities)
+		}
+		if _, exists := entities[entity.ID]; exists {
+			c.JSON(http.StatusConflict, Response{
+				Success: false,
+				Message: fmt.Sprintf("ID「%s」はすでに使われています", entity.ID),
+			})
+			return
+		}
+		rel = repoWorldDir + "/" + entity.ID + ".yaml"
+	} else if _, exists := entities[id]; !exists {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Message: fmt.Sprintf("設定資料「%s」が見つかりません", id),
+		})
+		return
+	}
+
+	entities[entity.ID] = entity
+	if err := validateWorldEntity(entity, entities); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "設定資料の内容が不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	verb := "更新"
+	if id == "" {
+		verb = "追加"
+	}
+	err = writeWorldEntityFile(rel, entity)
+	if err == nil {
+		_, err = commitWorkspace(fmt.Sprintf("設定資料「%s」を%s", entity.Name, verb), rel)
+	}
+	if err != nil && !errors.Is(err, git.ErrEmptyCommit) {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "設定資料の保存に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(status, Response{
+		Success: true,
+		Message: fmt.Sprintf("設定資料を%sしました", verb),
+		Data:    entity,
+	})
+}
+
+// ヘルパー関数：原稿リポジトリの設定資料を読み込む（ID → 項目、ID → ファイルの相対パス）
+func loadWorld() (map[string]*WorldEntity, map[string]string, error) {
+	entities := make(map[string]*WorldEntity)
+	paths := make(map[string]string)
+	if repo == nil {
+		return entities, paths, nil
+	}
+
+	entries, err := os.ReadDir(filepath.Join(workDir, filepath.FromSlash(repoWorldDir)))
+	if os.IsNotExist(err) {
+		return entities, paths, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var files []manuscriptFile
+	for _, entry := range entries {
+		if entry.IsDir() || !isWorldEntityFile(entry.Name()) {
+			continue
+		}
+		rel := repoWorldDir + "/" + entry.Name()
+		content, err := os.ReadFile(filepath.Join(workDir, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, manuscriptFile{Path: rel, Content: string(content)})
+	}
+	return parseWorldFiles(files)
+}
+
+// ヘルパー関数：コミット・草案の時点の設定資料を読み込む
+func loadWorldAtRevision(revision string) (map[string]*WorldEntity, map[string]string, error) {
+	commit, err := resolveCommit(revision)
+	if err != nil {
+		return nil, nil, fmt.Errorf("リビジョン %s が見つかりません: %v", revision, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, err := tree.Tree(repoWorldDir)
+	if errors.Is(err, object.ErrDirectoryNotFound) {
+		return parseWorldFiles(nil)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []manuscriptFile
+	for _, entry := range dir.Entries {
+		if !entry.Mode.IsFile() || !isWorldEntityFile(entry.Name) {
+			continue
+		}
+		f, err := dir.File(entry.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		content, err := f.Contents()
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, manuscriptFile{Path: repoWorldDir + "/" + entry.Name, Content: content})
+	}
+	return parseWorldFiles(files)
+}
+
+// ヘルパー関数：設定資料のファイルか（YAML / JSON）
+func isWorldEntityFile(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".yaml" || ext == ".yml" || ext == ".json"
+}
+
+// ヘルパー関数：設定資料のファイルを解析する（IDの省略時はファイル名）
+func parseWorldFiles(files []manuscriptFile) (map[string]*WorldEntity, map[string]string, error) {
+	entities := make(map[string]*WorldEntity)
+	paths := make(map[string]string)
+	for _, f := range files {
+		var entity WorldEntity
+		var err error
+		if strings.ToLower(path.Ext(f.Path)) == ".json" {
+			err = json.Unmarshal([]byte(f.Content), &entity)
+		} else {
+			err = yaml.Unmarshal([]byte(f.Content), &entity)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s の形式が不正です: %v", f.Path, err)
+		}
+		if entity.ID == "" {
+			entity.ID = strings.TrimSuffix(path.Base(f.Path), path.Ext(f.Path))
+		}
+		if other, ok := paths[entity.ID]; ok {
+			return nil, nil, fmt.Errorf("ID「%s」が %s と %s で重複しています", entity.ID, other, f.Path)
+		}
+		entities[entity.ID] = &entity
+		paths[entity.ID] = f.Path
+	}
+	return entities, paths, nil
+}
+
+// ヘルパー関数：項目をファイルに書き出す（拡張子に合わせて YAML か JSON）
+func writeWorldEntityFile(rel string, entity *WorldEntity) error {
+	content, err := marshalWorldEntity(rel, entity)
+	if err != nil {
+		return err
+	}
+
+	full := filepath.Join(workDir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(full, content, 0644)
+}
+
+// ヘルパー関数：項目をファイルの形式（拡張子が .json なら JSON、それ以外は YAML）にする
+func marshalWorldEntity(rel string, entity *WorldEntity) ([]byte, error) {
+	if strings.HasSuffix(rel, ".json") {
+		content, err := json.MarshalIndent(entity, "", "  ")
+		return append(content, '\n'), err
+	}
+	return yaml.Marshal(entity)
+}
+
+// ヘルパー関数：項目の検証（関係の相手は存在する項目に限る）
+func validateWorldEntity(entity *WorldEntity, entities map[string]*WorldEntity) error {
+	if !promptNamePattern.MatchString(entity.ID) {
+		return fmt.Errorf("ID は英数字・ハイフン・アンダースコア（64文字以内）で指定してください: %q", entity.ID)
+	}
+	if _, ok := worldEntityKinds[entity.Kind]; !ok {
+		return fmt.Errorf("kind は character, place, item, faction のいずれかを指定してください: %q", entity.Kind)
+	}
+	entity.Name = strings.TrimSpace(entity.Name)
+	if entity.Name == "" {
+		return fmt.Errorf("name を指定してください")
+	}
+	for _, rel := range entity.Relationships {
+		if rel.Target == entity.ID {
+			return fmt.Errorf("自分自身との関係は指定できません")
+		}
+		if _, ok := entities[rel.Target]; !ok {
+			return fmt.Errorf("関係の相手「%s」が見つかりません", rel.Target)
+		}
+		if strings.TrimSpace(rel.Type) == "" {
+			return fmt.Errorf("「%s」との関係の種類（type）を指定してください", rel.Target)
+		}
+	}
+	return nil
+}
+
+// ヘルパー関数：種類ごとの連番のIDを作る（character-1, character-2, ...）
+func newWorldEntityID(kind string, entities map[string]*WorldEntity) string {
+	for n := 1; ; n++ {
+		id := fmt.Sprintf("%s-%d", kind, n)
+		if _, exists := entities[id]; !exists {
+			return id
+		}
+	}
+}
+
+// ヘルパー関数：項目をIDの順に並べる
+func sortedWorldEntities(entities map[string]*WorldEntity) []*WorldEntity {
+	list := make([]*WorldEntity, 0, len(entities))
+	for _, e := range entities {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// 登場箇所を探すために解析しておいた原稿ファイル（項目ごとに解析し直さない）
+type worldSearchFile struct {
+	Path       string
+	Plain      string
+	PlainRunes []rune
+	Offsets    []int // 本文の文字 → 元の原稿での文字位置
+	LineStarts []int // 各行の先頭の文字位置（元の原稿）
+}
+
+// ヘルパー関数：原稿ファイルを解析して、登場箇所を探せるようにする
+func newWorldSearchFiles(files []manuscriptFile) []worldSearchFile {
+	result := make([]worldSearchFile, 0, len(files))
+	for _, f := range files {
+		plain, offsets := parseAozora(f.Content).PlainText()
+		lineStarts := []int{0}
+		i := 0
+		for _, r := range f.Content {
+			i++
+			if r == '\n' {
+				lineStarts = append(lineStarts, i)
+			}
+		}
+		result = append(result, worldSearchFile{Path: f.Path, Plain: plain, PlainRunes: []rune(plain), Offsets: offsets, LineStarts: lineStarts})
+	}
+	return result
+}
+
+// ヘルパー関数：原稿の中で名前・別名が出てくる箇所を原稿の順に探す（位置は元の原稿での文字単位）
+func findWorldAppearances(entity *WorldEntity, files []worldSearchFile) []worldAppearance {
+	names := []string{}
+	for _, n := range append([]string{entity.Name}, entity.Aliases...) {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, regexp.QuoteMeta(n))
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	// 長い名前から照合して、フルネームの中の名字だけを別に数えないようにする
+	sort.SliceStable(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	pattern := regexp.MustCompile(strings.Join(names, "|"))
+
+	var appearances []worldAppearance
+	for _, f := range files {
+		for _, m := range regexpIssues(f.Plain, pattern, func(m []string) (string, string) { return "", m[0] }) {
+			start := f.Offsets[m.Start]
+			end := f.Offsets[m.End-1] + 1
+			// start より後ろで始まる最初の行の番号が、start のある行の次の行
+			line := sort.SearchInts(f.LineStarts, start+1)
+			from, to := m.Start-worldSnippetRadius, m.End+worldSnippetRadius
+			if from < 0 {
+				from = 0
+			}
+			if to > len(f.PlainRunes) {
+				to = len(f.PlainRunes)
+			}
+			appearances = append(appearances, worldAppearance{
+				Path:    f.Path,
+				Start:   start,
+				End:     end,
+				Line:    line,
+				Text:    m.Original,
+				Snippet: strings.ReplaceAll(string(f.PlainRunes[from:to]), "\n", " "),
+			})
+		}
+	}
+	return appearances
+}
+
+// ===== 原稿の構成 =====
+
+// 原稿の構成（部・章・場面とファイルの対応、順序）
+type BookManifest struct {
+	Title  string      `json:"title,omitempty" yaml:"title,omitempty"`
+	Author string      `json:"author,omitempty" yaml:"author,omitempty"`
+	Parts  []*BookPart `json:"parts" yaml:"parts"`
+}
+
+// 部（title が空なら部に分けない）
+type BookPart struct {
+	Title    string         `json:"title,omitempty" yaml:"title,omitempty"`
+	Chapters []*BookChapter `json:"chapters" yaml:"chapters"`
+}
+
+// 章（1ファイルの章は file、場面ごとにファイルを分けた章は scenes。構想中はどちらもなくてよい）
+type BookChapter struct {
+	ID     string       `json:"id" yaml:"id"`
+	Title  string       `json:"title,omitempty" yaml:"title,omitempty"`
+	Status string       `json:"status,omitempty" yaml:"status,omitempty"` // "構想", "執筆中", "推敲中", "完成"
+	Target int          `json:"target,omitempty" yaml:"target,omitempty"` // 目標の文字数
+	File   string       `json:"file,omitempty" yaml:"file,omitempty"`
+	Scenes []*BookScene `json:"scenes,omitempty" yaml:"scenes,omitempty"`
+}
+
+// 場面
+type BookScene struct {
+	Title  string `json:"title,omitempty" yaml:"title,omitempty"`
+	Status string `json:"status,omitempty" yaml:"status,omitempty"`
+	Target int    `json:"target,omitempty" yaml:"target,omitempty"`
+	File   string `json:"file" yaml:"file"`
+}
+
+// 章の更新リクエスト（指定した項目だけを変える）
+type BookChapterUpdateRequest struct {
+	Title   *string `json:"title"`
+	Status  *string `json:"status"`
+	Target  *int    `json:"target"`
+	Message string  `json:"message"`
+}
+
+// 章の並べ替えリクエスト（部ごとの章IDの並び。すべての章をちょうど1回ずつ指定する）
+type BookReorderRequest struct {
+	Parts   [][]string `json:"parts" binding:"required"`
+	Message string     `json:"message"`
+}
+
+// 章の分割リクエスト
+type BookSplitRequest struct {
+	Chapter string `json:"chapter" binding:"required"`
+	Scene   int    `json:"scene"`  // 場面のある章：この番号（0始まり）の場面から後ろを新しい章にする
+	Offset  int    `json:"offset"` // 1ファイルの章：この位置（文字単位）から後ろを新しいファイル・章にする
+	File    string `json:"file"`   // 新しいファイルのパス（省略時は元のファイル名に -2 などを付ける）
+	Title   string `json:"title"`  // 新しい章の題
+	Message string `json:"message"`
+}
+
+// 章の結合リクエスト（2番目以降の章を最初の章にまとめる）
+type BookMergeRequest struct {
+	Chapters  []string `json:"chapters" binding:"required"`
+	JoinFiles bool     `json:"joinFiles"` // true の場合は本文を最初の章の最後のファイルに書き足し、他のファイルを削除する
+	Message   string   `json:"message"`
+}
+
+// 章ごとの進み具合
+type bookChapterStats struct {
+	ID         string          `json:"id"`
+	Part       string          `json:"part,omitempty"`
+	Title      string          `json:"title"`
+	Status     string          `json:"status"`
+	Target     int             `json:"target"`
+	Characters int             `json:"characters"` // 本文の文字数（空白・改行を除く）
+	Progress   int             `json:"progress"`   // 目標に対する割合（%。目標がなければ 0）
+	Files      []bookFileStats `json:"files"`
+}
+
+// ファイルごとの文字数
+type bookFileStats struct {
+	Path       string `json:"path"`
+	Characters int    `json:"characters"`
+	Exists     bool   `json:"exists"`
+}
+
+// 構成ファイル（原稿リポジトリ内）
+const repoBookFile = ".tenkai/book.yaml"
+
+// 章・場面の状態
+var bookStatuses = []string{"構想", "執筆中", "推敲中", "完成"}
+
+// 構成と章ごとの進み具合（?revision= でコミット・草案を指定。構成がなければ原稿ファイルから案を作る）
+func handleGetBook(c *gin.Context) {
+	if repo == nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "先に初期化してください",
+		})
+		return
+	}
+
+	var book *BookManifest
+	var files []manuscriptFile
+	var err error
+	if revision := c.Query("revision"); revision != "" {
+		var commit *object.Commit
+		if commit, err = resolveCommit(revision); err == nil {
+			if book, err = bookManifestAtCommit(commit); err == nil {
+				files, err = readManuscriptAtRevision(commit.Hash.String())
+			}
+		}
+	} else if book, err = getRepoBook(); err == nil {
+		files, err = readWorkspaceManuscript()
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "構成の読み込みに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	exists := book != nil
+	if !exists {
+		book = suggestBookManifest(files)
+	}
+
+	contents := make(map[string]string)
+	for _, f := range files {
+		contents[f.Path] = f.Content
+	}
+	chapters := []bookChapterStats{}
+	listed := make(map[string]bool)
+	missing := []string{}
+	total, target := 0, 0
+	for _, part := range book.Parts {
+		for _, ch := range part.Chapters {
+			stats := bookChapterStats{ID: ch.ID, Part: part.Title, Title: ch.Title, Status: ch.Status, Target: ch.Target, Files: []bookFileStats{}}
+			for _, p := range bookChapterFiles(ch) {
+				content, ok := contents[p]
+				fs := bookFileStats{Path: p, Characters: manuscriptCharacters(content), Exists: ok}
+				if !ok {
+					missing = append(missing, p)
+				}
+				listed[p] = true
+				stats.Characters += fs.Characters
+				stats.Files = append(stats.Files, fs)
+			}
+			if ch.Target > 0 {
+				stats.Progress = stats.Characters * 100 / ch.Target
+			}
+			total += stats.Characters
+			target += ch.Target
+			chapters = append(chapters, stats)
+		}
+	}
+	unlisted := []string{}
+	for _, f := range files {
+		if !listed[f.Path] {
+			unlisted = append(unlisted, f.Path)
+		}
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("構成を取得しました（%d章・%d字）", len(chapters), total),
+		Data: map[string]interface{}{
+			"exists":     exists,
+			"book":       book,
+			"chapters":   chapters,
+			"characters": total,
+			"target":     target,
+			"unlisted":   unlisted, // 構成にない原稿ファイル（構成の章の後ろに並ぶ）
+			"missing":    missing,  // 構成にあるが原稿にないファイル
+		},
+	})
+}
+
+// 構成の保存（全体を置き換える）
+func handleUpdateBook(c *gin.Context) {
+	var book BookManifest
+	if err := c.ShouldBindJSON(&book); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if repo == nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "先に初期化してください",
+		})
+		return
+	}
+
+	saveBook(c, &book, "構成を更新")
+}
+
+// 章の題・状態・目標の文字数の更新
+func handleUpdateBookChapter(c *gin.Context) {
+	var req BookChapterUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+	book, ok := loadBookForUpdate(c)
+	if !ok {
+		return
+	}
+	ch, ok := requireBookChapter(c, book, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	if req.Title != nil {
+		ch.Title = strings.TrimSpace(*req.Title)
+	}
+	if req.Status != nil {
+		ch.Status = *req.Status
+	}
+	if req.Target != nil {
+		ch.Target = *req.Target
+	}
+	message := req.Message
+	if message == "" {
+		message = fmt.Sprintf("章「%s」を更新", bookChapterLabel(ch))
+	}
+	saveBook(c, book, message)
+}
+
+// 章の並べ替え（部をまたいで移すこともできる）
+func handleReorderBook(c *gin.Context) {
+	var req BookReorderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+	book, ok := loadBookForUpdate(c)
+	if !ok {
+		return
+	}
+
+	err := func() error {
+		if len(req.Parts) != len(book.Parts) {
+			return fmt.Errorf("parts は部の数（%d）と同じ数だけ指定してください", len(book.Parts))
+		}
+		byID := make(map[string]*BookChapter)
+		for _, part := range book.Parts {
+			for _, ch := range part.Chapters {
+				byID[ch.ID] = ch
+			}
+		}
+		used := make(map[string]bool)
+		reordered := make([][]*BookChapter, len(req.Parts))
+		for i, ids := range req.Parts {
+			reordered[i] = []*BookChapter{}
+			for _, id := range ids {
+				ch, ok := byID[id]
+				if !ok {
+					return fmt.Errorf("章「%s」が見つかりません", id)
+				}
+				if used[id] {
+					return fmt.Errorf("章「%s」が2回指定されています", id)
+				}
+				used[id] = true
+				reordered[i] = append(reordered[i], ch)
+			}
+		}
+		if len(used) != len(byID) {
+			return fmt.Errorf("すべての章（%d章）を指定してください", len(byID))
+		}
+		for i, part := range book.Parts {
+			part.Chapters = reordered[i]
+		}
+		return nil
+	}()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "章の並べ替えに失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	message := req.Message
+	if message == "" {
+		message = "章を並べ替え"
+	}
+	saveBook(c, book, message)
+}
+
+// 章の分割（場面のある章は場面の区切りで、1ファイルの章は本文の位置で分ける）
+func handleSplitBookChapter(c *gin.Context) {
+	var req BookSplitRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+	book, ok := loadBookForUpdate(c)
+	if !ok {
+		return
+	}
+	ch, ok := requireBookChapter(c, book, req.Chapter)
+	if !ok {
+		return
+	}
+
+	added := &BookChapter{Title: strings.TrimSpace(req.Title), Status: ch.Status}
+	var changed []string
+	var writes map[string]string
+	err := func() error {
+		if len(ch.Scenes) > 0 {
+			if req.Scene <= 0 || req.Scene >= len(ch.Scenes) {
+				return fmt.Errorf("scene は 1〜%d で指定してください", len(ch.Scenes)-1)
+			}
+			added.Scenes = append([]*BookScene{}, ch.Scenes[req.Scene:]...)
+			ch.Scenes = ch.Scenes[:req.Scene]
+			return nil
+		}
+		if ch.File == "" {
+			return fmt.Errorf("章「%s」にはファイルがありません", bookChapterLabel(ch))
+		}
+
+		fullPath, err := workspacePath(ch.File)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(fullPath)
+		if err != nil {
+			return err
+		}
+		runes := []rune(string(content))
+		if req.Offset <= 0 || req.Offset >= len(runes) {
+			return fmt.Errorf("offset は 1〜%d で指定してください", len(runes)-1)
+		}
+		if splitsAozoraNotation(runes, req.Offset) {
+			return fmt.Errorf("offset %d はルビや注記の途中です", req.Offset)
+		}
+
+		added.File = path.Clean(filepath.ToSlash(req.File))
+		if req.File == "" {
+			added.File = nextBookFileName(ch.File)
+		}
+		if _, err := os.Stat(filepath.Join(workDir, filepath.FromSlash(added.File))); err == nil {
+			return fmt.Errorf("ファイル %s はすでにあります", added.File)
+		}
+		writes = map[string]string{
+			ch.File:    string(runes[:req.Offset]),
+			added.File: string(runes[req.Offset:]),
+		}
+		changed = []string{ch.File, added.File}
+		return nil
+	}()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "章の分割に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	part, index := findBookChapter(book, ch.ID)
+	chapters := append([]*BookChapter{}, part.Chapters[:index+1]...)
+	chapters = append(chapters, added)
+	part.Chapters = append(chapters, part.Chapters[index+1:]...)
+
+	message := req.Message
+	if message == "" {
+		message = fmt.Sprintf("章「%s」を分割", bookChapterLabel(ch))
+	}
+	saveBookFiles(c, book, message, writes, nil, changed)
+}
+
+// ヘルパー関数：その位置で分けるとルビや注記（｜…《…》、漢字《…》、［＃…］）が壊れるか（0 < offset < len(runes)）
+func splitsAozoraNotation(runes []rune, offset int) bool {
+	// 親文字と《の間、※と［＃の間
+	if runes[offset] == '《' || (runes[offset-1] == '※' && runes[offset] == '［') {
+		return true
+	}
+	// ｜のないルビの親文字（《の直前の漢字の並び）の途中
+	if isRubyBaseRune(runes[offset-1]) && isRubyBaseRune(runes[offset]) {
+		i := offset
+		for i < len(runes) && isRubyBaseRune(runes[i]) {
+			i++
+		}
+		if i < len(runes) && runes[i] == '《' {
+			return true
+		}
+	}
+	// 同じ行で直前に閉じていない｜、《、［＃がある
+	for i := offset - 1; i >= 0 && runes[i] != '\n'; i-- {
+		switch runes[i] {
+		case '》', '］':
+			return false
+		case '《':
+			return true
+		case '［':
+			return i+1 < len(runes) && runes[i+1] == '＃'
+		case '｜':
+			for j := offset; j < len(runes) && runes[j] != '\n' && runes[j] != '｜'; j++ {
+				if runes[j] == '《' {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return false
+}
+
+// 章の結合
+func handleMergeBookChapters(c *gin.Context) {
+	var req BookMergeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "リクエストが不正です",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if len(req.Chapters) < 2 {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "結合する章を2つ以上指定してください",
+		})
+		return
+	}
+	book, ok := loadBookForUpdate(c)
+	if !ok {
+		return
+	}
+
+	var merged []*BookChapter
+	seen := make(map[string]bool)
+	for _, id := range req.Chapters {
+		if seen[id] {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Message: fmt.Sprintf("章「%s」が2回指定されています", id),
+			})
+			return
+		}
+		seen[id] = true
+		ch, ok := requireBookChapter(c, book, id)
+		if !ok {
+			return
+		}
+		merged = append(merged, ch)
+	}
+
+	first := merged[0]
+	writes := make(map[string]string)
+	var removes, changed []string
+	err := func() error {
+		if !req.JoinFiles {
+			if first.File != "" {
+				first.Scenes = []*BookScene{{File: first.File, Status: first.Status}}
+				first.File = ""
+			}
+			for _, ch := range merged[1:] {
+				if ch.File != "" {
+					first.Scenes = append(first.Scenes, &BookScene{Title: ch.Title, Status: ch.Status, Target: ch.Target, File: ch.File})
+				}
+				first.Scenes = append(first.Scenes, ch.Scenes...)
+			}
+			return nil
+		}
+
+		files := bookChapterFiles(first)
+		if len(files) == 0 {
+			return fmt.Errorf("章「%s」にはファイルがありません", bookChapterLabel(first))
+		}
+		into := files[len(files)-1]
+		fullPath, err := workspacePath(into)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(fullPath)
+		if err != nil {
+			return err
+		}
+		text := string(content)
+		for _, ch := range merged[1:] {
+			for _, p := range bookChapterFiles(ch) {
+				fullPath, err := workspacePath(p)
+				if err != nil {
+					return err
+				}
+				content, err := os.ReadFile(fullPath)
+				if err != nil {
+					return err
+				}
+				if text != "" && !strings.HasSuffix(text, "\n") {
+					text += "\n"
+				}
+				text += "\n" + string(content)
+				removes = append(removes, p)
+			}
+		}
+		writes[into] = text
+		changed = append([]string{into}, removes...)
+		return nil
+	}()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Message: "章の結合に失敗しました",
 			Error:   err.Error(),
 		})
 		return
 	}
-	
-	c.JSON(http.StatusOK, Response{
-		Success: true,
-		Message: "修正依頼を作成しました",
-		Data: map[string]interface{}{
-			"repository": req.Repository,
-			"pullRequestNumber": prResult["number"],
-			"pullRequestURL": prResult["html_url"],
-		},
-	})
+
+	for _, ch := range merged[1:] {
+		first.Target += ch.Target
+		part, index := findBookChapter(book, ch.ID)
+		part.Chapters = append(part.Chapters[:index], part.Chapters[index+1:]...)
+	}
+
+	message := req.Message
+	if message == "" {
+		message = fmt.Sprintf("章「%s」に%d章を結合", bookChapterLabel(first), len(merged)-1)
+	}
+	saveBookFiles(c, book, message, writes, removes, changed)
 }
 
-// 校正依頼（レビュワー付きプルリクエスト作成）
-func handleKouseiIrai(c *gin.Context) {
-	var req KouseiIraiRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
+// ヘルパー関数：変更する構成を読み込む（まだなければ原稿ファイルから作る。失敗時は応答を返して false）
+func loadBookForUpdate(c *gin.Context) (*BookManifest, bool) {
+	if repo == nil {
 		c.JSON(http.StatusBadRequest, Response{
 			Success: false,
-			Message: "リクエストが不正です",
-			Error:   err.Error(),
+			Message: "先に初期化してください",
 		})
-		return
-	}
-
-	// ベースブランチの設定（デフォルト: main）
-	baseBranch := req.BaseBranch
-	if baseBranch == "" {
-		baseBranch = "main"
+		return nil, false
 	}
 
-	// プルリクエストを作成
-	prURL := fmt.Sprintf("https://api.github.com/repos/%s/pulls", req.Repository)
-	prData := map[string]interface{}{
-		"title": req.Title,
-		"body":  req.Description + "\n\n📝 校正をお願いします",
-		"head":  req.Branch,
-		"base":  baseBranch,
+	book, err := getRepoBook()
+	if err == nil && book == nil {
+		var files []manuscriptFile
+		if files, err = readWorkspaceManuscript(); err == nil {
+			book = suggestBookManifest(files)
+		}
 	}
-	
-	prJSON, _ := json.Marshal(prData)
-	
-	prReq, _ := http.NewRequest("POST", prURL, strings.NewReader(string(prJSON)))
-	prReq.Header.Set("Authorization", "Bearer "+req.AccessToken)
-	prReq.Header.Set("User-Agent", "tenkai-app")
-	prReq.Header.Set("Content-Type", "application/json")
-	
-	client := &http.Client{}
-	prResp, err := client.Do(prReq)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{
 			Success: false,
-			Message: "校正依頼の作成に失敗しました",
+			Message: "構成の読み込みに失敗しました",
 			Error:   err.Error(),
 		})
-		return
+		return nil, false
 	}
-	defer prResp.Body.Close()
-	
-	if prResp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(prResp.Body)
-		c.JSON(http.StatusInternalServerError, Response{
+	return book, true
+}
+
+// ヘルパー関数：章を探す（なければ 404 を返して false）
+func requireBookChapter(c *gin.Context, book *BookManifest, id string) (*BookChapter, bool) {
+	part, index := findBookChapter(book, id)
+	if part == nil {
+		c.JSON(http.StatusNotFound, Response{
 			Success: false,
-			Message: "校正依頼の作成に失敗しました",
-			Error:   string(body),
+			Message: fmt.Sprintf("章「%s」が見つかりません", id),
 		})
-		return
+		return nil, false
 	}
-	
-	var prResult map[string]interface{}
-	if err := json.NewDecoder(prResp.Body).Decode(&prResult); err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
+	return part.Chapters[index], true
+}
+
+// ヘルパー関数：章とその部での位置を探す（なければ nil）
+func findBookChapter(book *BookManifest, id string) (*BookPart, int) {
+	for _, part := range book.Parts {
+		for i, ch := range part.Chapters {
+			if ch.ID == id {
+				return part, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+// ヘルパー関数：構成を検証して保存し、応答を返す
+func saveBook(c *gin.Context, book *BookManifest, message string) {
+	saveBookFiles(c, book, message, nil, nil, nil)
+}
+
+// ヘルパー関数：構成と原稿ファイルの書き換え・削除を検証して1回のコミットにし、応答を返す
+func saveBookFiles(c *gin.Context, book *BookManifest, message string, writes map[string]string, removes, changed []string) {
+	if err := validateBook(book); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
 			Success: false,
-			Message: "レスポンスのパースに失敗しました",
+			Message: "構成の内容が不正です",
 			Error:   err.Error(),
 		})
 		return
 	}
-	
-	// レビュワーを追加
-	if len(req.Reviewers) > 0 {
-		reviewURL := fmt.Sprintf("https://api.github.com/repos/%s/pulls/%v/requested_reviewers", 
-			req.Repository, prResult["number"])
-		reviewData := map[string]interface{}{
-			"reviewers": req.Reviewers,
+
+	content, err := yaml.Marshal(book)
+	if err == nil {
+		if writes == nil {
+			writes = make(map[string]string)
 		}
-		
-		reviewJSON, _ := json.Marshal(reviewData)
-		
-		reviewReq, _ := http.NewRequest("POST", reviewURL, strings.NewReader(string(reviewJSON)))
-		reviewReq.Header.Set("Authorization", "Bearer "+req.AccessToken)
-		reviewReq.Header.Set("User-Agent", "tenkai-app")
-		reviewReq.Header.Set("Content-Type", "application/json")
-		
-		reviewResp, err := client.Do(reviewReq)
-		if err != nil {
-			// レビュワー追加に失敗してもPRは作成されているので、警告のみ
-			log.Printf("レビュワーの追加に失敗: %v", err)
-		} else {
-			reviewResp.Body.Close()
+		writes[repoBookFile] = string(content)
+		var rollback func()
+		if rollback, err = applyWorkspaceChanges(writes, removes); err == nil {
+			_, err = commitWorkspace(message, append([]string{repoBookFile}, changed...)...)
+			if err != nil && !errors.Is(err, git.ErrEmptyCommit) {
+				rollback()
+			}
 		}
 	}
-	
+	if err != nil && !errors.Is(err, git.ErrEmptyCommit) {
+		c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Message: "構成の保存に失敗しました",
+			Error:   err.Error(),
+		})
+		return
+	}
+
 	c.JSON(http.StatusOK, Response{
 		Success: true,
-		Message: "校正依頼を作成しました",
+		Message: "構成を保存しました",
 		Data: map[string]interface{}{
-			"repository": req.Repository,
-			"pullRequestNumber": prResult["number"],
-			"pullRequestURL": prResult["html_url"],
-			"reviewers": req.Reviewers,
+			"book":  book,
+			"files": append([]string{repoBookFile}, changed...),
 		},
 	})
 }
 
-// リポジトリ情報取得
-func handleRepositoryInfo(c *gin.Context) {
-	accessToken := c.GetHeader("Authorization")
-	repository := c.Query("repository")
-	
-	if accessToken == "" || repository == "" {
-		c.JSON(http.StatusBadRequest, Response{
-			Success: false,
-			Message: "認証トークンとリポジトリ名が必要です",
-		})
-		return
+// ヘルパー関数：書き込みと削除をまとめて行う。途中で失敗した場合は元に戻してエラーを返し、
+// 成功した場合はあとで元に戻すための関数を返す（コミットに失敗したときに使う）
+func applyWorkspaceChanges(writes map[string]string, removes []string) (func(), error) {
+	// 書き換える前に、すべてのパスを確かめて元の内容を控えておく
+	rels := make([]string, 0, len(writes)+len(removes))
+	for rel := range writes {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	rels = append(rels, removes...)
+
+	type original struct {
+		full    string
+		content []byte
+		existed bool
+	}
+	originals := make(map[string]*original, len(rels))
+	for _, rel := range rels {
+		if originals[rel] != nil {
+			continue
+		}
+		full, err := workspacePath(rel)
+		if err != nil {
+			return nil, err
+		}
+		content, err := os.ReadFile(full)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		originals[rel] = &original{full: full, content: content, existed: err == nil}
 	}
-	
-	// "Bearer " プレフィックスを削除
-	if strings.HasPrefix(accessToken, "Bearer ") {
-		accessToken = strings.TrimPrefix(accessToken, "Bearer ")
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, err
 	}
 
-	// リポジトリ情報を取得
-	repoURL := fmt.Sprintf("https://api.github.com/repos/%s", repository)
-	req, _ := http.NewRequest("GET", repoURL, nil)
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("User-Agent", "tenkai-app")
-	
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	rollback := func() {
+		for rel, o := range originals {
+			var err error
+			if o.existed {
+				if err = os.MkdirAll(filepath.Dir(o.full), 0755); err == nil {
+					err = os.WriteFile(o.full, o.content, 0644)
+				}
+			} else if err = os.Remove(o.full); os.IsNotExist(err) {
+				err = nil
+			}
+			if err != nil {
+				log.Printf("%s を元に戻せませんでした: %v", rel, err)
+			}
+		}
+		if err := repo.Storer.SetIndex(idx); err != nil {
+			log.Printf("インデックスを元に戻せませんでした: %v", err)
+		}
+	}
+
+	for i, rel := range rels {
+		o := originals[rel]
+		var err error
+		if i < len(writes) {
+			if err = os.MkdirAll(filepath.Dir(o.full), 0755); err == nil {
+				err = os.WriteFile(o.full, []byte(writes[rel]), 0644)
+			}
+		} else {
+			err = os.Remove(o.full)
+		}
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+	}
+	return rollback, nil
+}
+
+// ヘルパー関数：構成の検証（章IDがなければ振り、状態の既定は「構想」）
+func validateBook(book *BookManifest) error {
+	if len(book.Parts) == 0 {
+		book.Parts = []*BookPart{{Chapters: []*BookChapter{}}}
+	}
+	// JSON の null で渡された部・章・場面は受け付けない
+	if err := checkBookEntries(book); err != nil {
+		return err
+	}
+	ids := make(map[string]bool)
+	for _, part := range book.Parts {
+		for _, ch := range part.Chapters {
+			if ch.ID != "" {
+				ids[ch.ID] = true
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	files := make(map[string]bool)
+	checkFile := func(p string) error {
+		if _, err := workspacePath(p); err != nil {
+			return err
+		}
+		if p != path.Clean(p) || isHiddenPath(p) || !manuscriptExtensions[strings.ToLower(path.Ext(p))] {
+			return fmt.Errorf("原稿ファイル（.txt / .md）を相対パスで指定してください: %q", p)
+		}
+		if files[p] {
+			return fmt.Errorf("ファイル %s が2回指定されています", p)
+		}
+		files[p] = true
+		return nil
+	}
+	checkStatus := func(status *string, target int) error {
+		if *status == "" {
+			*status = bookStatuses[0]
+		}
+		valid := false
+		for _, s := range bookStatuses {
+			valid = valid || s == *status
+		}
+		if !valid {
+			return fmt.Errorf("状態は %s のいずれかを指定してください: %q", strings.Join(bookStatuses, "・"), *status)
+		}
+		if target < 0 {
+			return fmt.Errorf("目標の文字数は 0 以上で指定してください")
+		}
+		return nil
+	}
+
+	for _, part := range book.Parts {
+		if part.Chapters == nil {
+			part.Chapters = []*BookChapter{}
+		}
+		for _, ch := range part.Chapters {
+			if ch.ID == "" {
+				for n := 1; ; n++ {
+					if id := fmt.Sprintf("ch-%d", n); !ids[id] {
+						ch.ID = id
+						ids[id] = true
+						break
+					}
+				}
+			}
+			if !promptNamePattern.MatchString(ch.ID) {
+				return fmt.Errorf("章ID は英数字・ハイフン・アンダースコア（64文字以内）で指定してください: %q", ch.ID)
+			}
+			if seen[ch.ID] {
+				return fmt.Errorf("章ID「%s」が重複しています", ch.ID)
+			}
+			seen[ch.ID] = true
+			if err := checkStatus(&ch.Status, ch.Target); err != nil {
+				return fmt.Errorf("章「%s」: %v", ch.ID, err)
+			}
+			if ch.File != "" && len(ch.Scenes) > 0 {
+				return fmt.Errorf("章「%s」: file と scenes は同時に指定できません", ch.ID)
+			}
+			if ch.File != "" {
+				if err := checkFile(ch.File); err != nil {
+					return fmt.Errorf("章「%s」: %v", ch.ID, err)
+				}
+			}
+			for _, scene := range ch.Scenes {
+				if err := checkStatus(&scene.Status, scene.Target); err != nil {
+					return fmt.Errorf("章「%s」の場面: %v", ch.ID, err)
+				}
+				if err := checkFile(scene.File); err != nil {
+					return fmt.Errorf("章「%s」の場面: %v", ch.ID, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ヘルパー関数：作業ディレクトリの構成を読み込む（なければ nil）
+func getRepoBook() (*BookManifest, error) {
+	if repo == nil {
+		return nil, nil
+	}
+	content, err := os.ReadFile(filepath.Join(workDir, filepath.FromSlash(repoBookFile)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Success: false,
-			Message: "リポジトリ情報の取得に失敗しました",
-			Error:   err.Error(),
-		})
-		return
+		return nil, err
 	}
-	defer resp.Body.Close()
-	
-	if resp.StatusCode != http.StatusOK {
-		c.JSON(http.StatusInternalServerError, Response{
-			Success: false,
-			Message: "リポジトリ情報の取得に失敗しました",
-			Error:   fmt.Sprintf("GitHub API error: %d", resp.StatusCode),
-		})
-		return
+	return parseBookManifest(content)
+}
+
+// ヘルパー関数：コミット時点の構成を読み込む（なければ nil）
+func bookManifestAtCommit(commit *object.Commit) (*BookManifest, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
 	}
-	
-	var repoInfo map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&repoInfo); err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Success: false,
-			Message: "レスポンスのパースに失敗しました",
-			Error:   err.Error(),
+	return bookManifestInTree(tree)
+}
+
+// ヘルパー関数：ツリーの構成を読み込む（なければ nil）
+func bookManifestInTree(tree *object.Tree) (*BookManifest, error) {
+	f, err := tree.File(repoBookFile)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	content, err := f.Contents()
+	if err != nil {
+		return nil, err
+	}
+	return parseBookManifest([]byte(content))
+}
+
+// ヘルパー関数：構成ファイルを読む
+func parseBookManifest(content []byte) (*BookManifest, error) {
+	var book BookManifest
+	if err := yaml.Unmarshal(content, &book); err != nil {
+		return nil, fmt.Errorf("%s の形式が不正です: %v", repoBookFile, err)
+	}
+	if err := checkBookEntries(&book); err != nil {
+		return nil, fmt.Errorf("%s の形式が不正です: %v", repoBookFile, err)
+	}
+	return &book, nil
+}
+
+// ヘルパー関数：空（null）の部・章・場面がないか
+func checkBookEntries(book *BookManifest) error {
+	for _, part := range book.Parts {
+		if part == nil {
+			return fmt.Errorf("空の部があります")
+		}
+		for _, ch := range part.Chapters {
+			if ch == nil {
+				return fmt.Errorf("空の章があります")
+			}
+			for _, scene := range ch.Scenes {
+				if scene == nil {
+					return fmt.Errorf("章「%s」に空の場面があります", ch.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ヘルパー関数：原稿ファイルから構成の案を作る（1ファイル1章、章題は最初の見出しかファイル名）
+func suggestBookManifest(files []manuscriptFile) *BookManifest {
+	part := &BookPart{Chapters: []*BookChapter{}}
+	for i, f := range files {
+		part.Chapters = append(part.Chapters, &BookChapter{
+			ID:     fmt.Sprintf("ch-%d", i+1),
+			Title:  newExportChapter(f).Title,
+			Status: "執筆中",
+			File:   f.Path,
 		})
-		return
 	}
-	
-	c.JSON(http.StatusOK, Response{
-		Success: true,
-		Data:    repoInfo,
+	return &BookManifest{Title: filepath.Base(workDir), Parts: []*BookPart{part}}
+}
+
+// ヘルパー関数：章のファイルを順に返す
+func bookChapterFiles(ch *BookChapter) []string {
+	if ch.File != "" {
+		return []string{ch.File}
+	}
+	var files []string
+	for _, scene := range ch.Scenes {
+		files = append(files, scene.File)
+	}
+	return files
+}
+
+// ヘルパー関数：書き出しで使う、ファイルごとの題（場面の題、なければ章の題。章の2番目以降の場面は場面の題だけ）
+func bookFileTitles(book *BookManifest) map[string]string {
+	titles := make(map[string]string)
+	if book == nil {
+		return titles
+	}
+	for _, part := range book.Parts {
+		for _, ch := range part.Chapters {
+			if ch.File != "" {
+				titles[ch.File] = ch.Title
+			}
+			for i, scene := range ch.Scenes {
+				titles[scene.File] = scene.Title
+				if i == 0 && scene.Title == "" {
+					titles[scene.File] = ch.Title
+				}
+			}
+		}
+	}
+	return titles
+}
+
+// ヘルパー関数：原稿ファイルを構成の順に並べる（構成にないファイルはパス順で後ろに置く）
+func orderByBook(files []manuscriptFile, book *BookManifest) []manuscriptFile {
+	if book == nil {
+		return files
+	}
+	rank := make(map[string]int)
+	for _, part := range book.Parts {
+		for _, ch := range part.Chapters {
+			for _, p := range bookChapterFiles(ch) {
+				if _, ok := rank[p]; !ok {
+					rank[p] = len(rank)
+				}
+			}
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		ri, iok := rank[files[i].Path]
+		rj, jok := rank[files[j].Path]
+		if iok != jok {
+			return iok
+		}
+		return iok && ri < rj
 	})
+	return files
+}
+
+// ヘルパー関数：分割で作るファイル名（ch01.txt → ch01-2.txt, ch01-3.txt, ...）
+func nextBookFileName(p string) string {
+	ext := path.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, n, ext)
+		if _, err := os.Stat(filepath.Join(workDir, filepath.FromSlash(candidate))); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// ヘルパー関数：メッセージ用の章の呼び名（題がなければID）
+func bookChapterLabel(ch *BookChapter) string {
+	if ch.Title != "" {
+		return ch.Title
+	}
+	return ch.ID
 }
 
+// ヘルパー関数：本文の文字数（注記・ルビの読みを除き、空白・改行も数えない）
+func manuscriptCharacters(content string) int {
+	plain, _ := parseAozora(content).PlainText()
+	n := 0
+	for _, r := range plain {
+		if !unicode.IsSpace(r) {
+			n++
+		}
+	}
+	return n
+}
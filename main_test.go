@@ -0,0 +1,1740 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// テスト用に fake プロバイダーを有効にし、利用量とキャッシュを初期化する
+func setupFakeAI(t *testing.T, quota QuotaConfig) {
+	t.Helper()
+	config = defaultConfig()
+	config.AI.Provider = "fake"
+	config.AI.EnableFake = true
+	config.AI.Cache.MaxEntries = 0
+	var err error
+	if aiUsage, err = newAIUsageTracker(quota); err != nil {
+		t.Fatal(err)
+	}
+	aiCache = newAIResultCache(config.AI.Cache)
+}
+
+// テスト用の原稿リポジトリを作り、ファイルを書いてコミットする
+func setupWorkspace(t *testing.T, files map[string]string) {
+	t.Helper()
+	workDir = t.TempDir()
+	var err error
+	if repo, err = git.PlainInit(workDir, false); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for rel, content := range files {
+		full := filepath.Join(workDir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, rel)
+	}
+	if len(paths) > 0 {
+		if _, err := commitWorkspace("テスト用の原稿", paths...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// テスト用のJSONリクエスト
+func jsonRequest(method, target string, body interface{}) *http.Request {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, target, strings.NewReader(string(data)))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// テスト用の応答を読む
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder) Response {
+	t.Helper()
+	var resp Response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	return resp
+}
+
+// テスト用のリクエストを実行する
+func performRequest(handler gin.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+	handler(c)
+	return w
+}
+
+func TestOAuthCallbackRequiresStateCookie(t *testing.T) {
+	config = defaultConfig()
+	config.GitHub.ClientID = "client"
+
+	w := performRequest(handleGitHubLogin, httptest.NewRequest(http.MethodGet, "/api/auth/github/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login status = %d", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := location.Query().Get("state")
+	var cookie *http.Cookie
+	for _, ck := range w.Result().Cookies() {
+		if ck.Name == oauthStateCookieName {
+			cookie = ck
+		}
+	}
+	if cookie == nil || cookie.Value != state || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("state cookie = %+v, want HttpOnly SameSite=Lax with value %q", cookie, state)
+	}
+
+	// 別のブラウザ（Cookieなし・Cookie不一致）からのコールバックは拒否し、state も消費しない
+	for _, ck := range []*http.Cookie{nil, {Name: oauthStateCookieName, Value: "other"}} {
+		req := httptest.NewRequest(http.MethodGet, "/api/auth/github/callback?code=x&state="+url.QueryEscape(state), nil)
+		if ck != nil {
+			req.AddCookie(ck)
+		}
+		w = performRequest(handleGitHubCallback, req)
+		if got := w.Header().Get("Location"); got != config.FrontendURL+"/auth?error=invalid_state" {
+			t.Fatalf("callback redirect = %q, want invalid_state", got)
+		}
+	}
+	if _, ok := consumeOAuthState(state); !ok {
+		t.Fatal("state was consumed by a callback without the matching cookie")
+	}
+}
+
+func TestCrossSiteLoginExchangesOneTimeCode(t *testing.T) {
+	config = defaultConfig()
+	config.ServerURL = "https://tenkaiserver-production.up.railway.app"
+	config.FrontendURL = "https://tenkai-production.up.railway.app"
+	config.GitHub.ClientID = "client"
+	config.GitHub.ClientSecret = "secret"
+	var err error
+	if tokenVault, err = newTokenVault(VaultConfig{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+
+	orig := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		body := `{"id": 5, "login": "writer"}`
+		if req.URL.Host == "github.com" {
+			body = `{"access_token": "gho_token"}`
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})
+	defer func() { http.DefaultTransport = orig }()
+
+	w := performRequest(handleGitHubLogin, httptest.NewRequest(http.MethodGet, "/api/auth/github/login", nil))
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := location.Query().Get("state")
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/github/callback?code=x&state="+url.QueryEscape(state), nil)
+	req.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: state})
+	w = performRequest(handleGitHubCallback, req)
+	redirect, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := redirect.Query().Get("login_code")
+	if !strings.HasPrefix(redirect.String(), config.FrontendURL+"/app?") || code == "" {
+		t.Fatalf("callback redirect = %q, want the frontend with a login_code", redirect)
+	}
+
+	// フロントエンドのオリジンからコードを交換し、得たセッションIDをヘッダーで使う
+	r := gin.New()
+	r.Use(corsMiddleware(config.FrontendURL, config.CORS))
+	r.POST("/api/auth/session", handleExchangeLoginCode)
+	exchange := func() *httptest.ResponseRecorder {
+		req := jsonRequest(http.MethodPost, "/api/auth/session", LoginCodeRequest{Code: code})
+		req.Header.Set("Origin", config.FrontendURL)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w = exchange()
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != config.FrontendURL {
+		t.Fatalf("exchange status = %d, allow-origin = %q, body = %s", w.Code, w.Header().Get("Access-Control-Allow-Origin"), w.Body.String())
+	}
+	data, _ := decodeResponse(t, w).Data.(map[string]interface{})
+	sessionID, _ := data["sessionId"].(string)
+	if sessionID == "" || strings.Contains(redirect.String(), sessionID) {
+		t.Fatalf("session id = %q, redirect = %q", sessionID, redirect)
+	}
+
+	var token string
+	req = httptest.NewRequest(http.MethodGet, "/api/settings", nil)
+	req.Header.Set("X-Tenkai-Session", sessionID)
+	performRequest(func(c *gin.Context) { token = resolveAccessToken(c, "") }, req)
+	if token != "gho_token" {
+		t.Fatalf("token from X-Tenkai-Session = %q", token)
+	}
+
+	// コードは一度しか使えない
+	if w := exchange(); w.Code != http.StatusUnauthorized {
+		t.Fatalf("second exchange status = %d, want 401", w.Code)
+	}
+}
+
+func TestLogoutRevokesVaultSession(t *testing.T) {
+	config = defaultConfig()
+	config.GitHub.ClientID = "client"
+	config.GitHub.ClientSecret = "secret"
+	var err error
+	if tokenVault, err = newTokenVault(VaultConfig{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var revoked []string
+	orig := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		var body struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		revoked = append(revoked, req.Method+" "+req.URL.Path+" "+body.AccessToken)
+		return &http.Response{StatusCode: http.StatusNoContent, Body: io.NopCloser(strings.NewReader("")), Header: make(http.Header)}, nil
+	})
+	defer func() { http.DefaultTransport = orig }()
+
+	user := &GitHubUser{ID: 7, Login: "writer"}
+	first, err := createSession(user, "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := createSession(user, "t2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// この端末のセッションだけを破棄し、そのトークンを失効させる
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/logout", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: first.ID})
+	w := performRequest(handleLogout, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if getSession(first.ID) != nil {
+		t.Fatal("logged-out session is still in the vault")
+	}
+	if getSession(second.ID) == nil {
+		t.Fatal("logout removed another device's session")
+	}
+	if want := "DELETE /applications/client/token t1"; len(revoked) != 1 || revoked[0] != want {
+		t.Fatalf("revocations = %q, want [%q]", revoked, want)
+	}
+	cleared := false
+	for _, ck := range w.Result().Cookies() {
+		if ck.Name == sessionCookieName && ck.MaxAge < 0 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Fatal("session cookie was not cleared")
+	}
+
+	// everywhere は同じユーザーの全セッションを破棄し、認可そのものを取り消す
+	revoked = nil
+	req = httptest.NewRequest(http.MethodPost, "/api/auth/logout?everywhere=true", nil)
+	req.Header.Set("X-Tenkai-Session", second.ID)
+	if w := performRequest(handleLogout, req); w.Code != http.StatusOK {
+		t.Fatalf("everywhere status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if getSession(second.ID) != nil {
+		t.Fatal("everywhere logout left a session in the vault")
+	}
+	if want := "DELETE /applications/client/grant t2"; len(revoked) != 1 || revoked[0] != want {
+		t.Fatalf("revocations = %q, want [%q]", revoked, want)
+	}
+
+	// セッションもトークンもなければ 401
+	if w := performRequest(handleLogout, httptest.NewRequest(http.MethodPost, "/api/auth/logout", nil)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous logout status = %d, want 401", w.Code)
+	}
+}
+
+func TestLoadConfigDefaultsAndReleaseURLs(t *testing.T) {
+	t.Setenv("PORT", "4000")
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerURL != "http://localhost:4000" || cfg.FrontendURL != "http://localhost:3000" {
+		t.Fatalf("defaults = %q, %q", cfg.ServerURL, cfg.FrontendURL)
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	defer gin.SetMode(gin.TestMode)
+	if _, err := loadConfig(""); err == nil {
+		t.Fatal("release mode accepted localhost URLs")
+	}
+	t.Setenv("SERVER_URL", "https://api.example.com")
+	t.Setenv("FRONTEND_URL", "https://app.example.com")
+	if _, err := loadConfig(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCORSAllowsOnlyConfiguredOrigins(t *testing.T) {
+	r := gin.New()
+	r.Use(corsMiddleware("https://app.example.com", CORSConfig{AllowedOrigins: []string{"https://Preview.example.com/"}, MaxAge: 600}))
+	r.GET("/api/status", func(c *gin.Context) { c.JSON(http.StatusOK, Response{Success: true}) })
+
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"https://app.example.com", true},
+		{"https://preview.example.com", true},
+		{"https://evil.example.com", false},
+		{"https://app.example.com.evil.test", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodOptions, "/api/status", nil)
+		req.Header.Set("Origin", tt.origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		allowOrigin := w.Header().Get("Access-Control-Allow-Origin")
+		if tt.ok {
+			if w.Code != http.StatusNoContent || allowOrigin != tt.origin || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+				t.Errorf("%s: preflight status = %d, allow-origin = %q", tt.origin, w.Code, allowOrigin)
+			}
+			continue
+		}
+		if w.Code != http.StatusForbidden || allowOrigin != "" {
+			t.Errorf("%s: preflight status = %d, allow-origin = %q, want 403 without CORS headers", tt.origin, w.Code, allowOrigin)
+		}
+
+		// 許可していないオリジンには通常のリクエストでもCORSヘッダーを返さない
+		req = httptest.NewRequest(http.MethodGet, "/api/status", nil)
+		req.Header.Set("Origin", tt.origin)
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("%s: GET allow-origin = %q, want none", tt.origin, got)
+		}
+	}
+}
+
+func TestFileTokenStorePurgesExpiredSessions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	vault, err := newTokenVault(VaultConfig{Store: "file", Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	expired := &authSession{ID: "old", UserID: 1, AccessToken: "t1", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)}
+	if err := vault.Put(expired); err != nil {
+		t.Fatal(err)
+	}
+	if err := vault.Put(&authSession{ID: "new", UserID: 1, AccessToken: "t2", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), `"old"`) {
+		t.Fatal("expired session was not purged on write")
+	}
+
+	// 読み込みはメモリ上の内容を使い、ファイルを読み直さない
+	if err := os.WriteFile(path, []byte("{broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	session, err := vault.Get("new")
+	if err != nil || session == nil || session.AccessToken != "t2" {
+		t.Fatalf("Get = %+v, %v", session, err)
+	}
+}
+
+func TestAIAnalyzeWithFakeProvider(t *testing.T) {
+	setupFakeAI(t, QuotaConfig{})
+
+	w := performRequest(handleAIAnalyze, jsonRequest(http.MethodPost, "/api/ai/analyze", AnalyzeRequest{Text: "吾輩は猫である。", Type: "summary"}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "[fake:fake]") {
+		t.Fatalf("response does not come from the fake provider: %s", w.Body.String())
+	}
+}
+
+func TestResolveLLMAllowlist(t *testing.T) {
+	setupFakeAI(t, QuotaConfig{})
+	config.AI.Provider = "openai"
+	config.AI.OpenAI.BaseURL = "http://localhost:11434/v1"
+	config.AI.OpenAI.Model = "llama3"
+	config.AI.AllowedModels = []string{"openai:qwen2"}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+	for _, tc := range []struct {
+		provider, model string
+		ok              bool
+	}{
+		{"", "", true},
+		{"openai", "qwen2", true},
+		{"openai", "gpt-4o", false},
+		{"fake", "", true},
+	} {
+		_, err := resolveLLMForRequest(c, tc.provider, tc.model)
+		if (err == nil) != tc.ok {
+			t.Errorf("resolveLLMForRequest(%q, %q) err = %v, want ok = %v", tc.provider, tc.model, err, tc.ok)
+		}
+	}
+
+	config.AI.EnableFake = false
+	if _, err := resolveLLMForRequest(c, "fake", ""); err == nil {
+		t.Error("fake provider is available without AI_ENABLE_FAKE")
+	}
+}
+
+// テスト用のSSEイベント
+type sseEvent struct {
+	Name string
+	Data map[string]interface{}
+}
+
+// テスト用にSSEの応答本文をイベントに分ける（各イベントは空行で終わる）
+func parseSSE(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	if !strings.HasSuffix(body, "\n\n") {
+		t.Fatalf("stream does not end with a blank line: %q", body)
+	}
+	var events []sseEvent
+	for _, frame := range strings.Split(strings.TrimSuffix(body, "\n\n"), "\n\n") {
+		var ev sseEvent
+		for _, line := range strings.Split(frame, "\n") {
+			switch {
+			case strings.HasPrefix(line, "event:"):
+				ev.Name = strings.TrimPrefix(line, "event:")
+			case strings.HasPrefix(line, "data:"):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &ev.Data); err != nil {
+					t.Fatalf("invalid data line %q: %v", line, err)
+				}
+			default:
+				t.Fatalf("unexpected line %q in frame %q", line, frame)
+			}
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestAnalyzeStreamFramesEvents(t *testing.T) {
+	setupFakeAI(t, QuotaConfig{})
+	config.AI.Cache.MaxEntries = 10
+	aiCache = newAIResultCache(config.AI.Cache)
+
+	body := AnalyzeRequest{Text: strings.Repeat("吾輩は猫である。", 4), Type: "summary"}
+	want := decodeResponse(t, performRequest(handleAIAnalyze, jsonRequest(http.MethodPost, "/api/ai/analyze", AnalyzeRequest{Text: body.Text, Type: body.Type, NoCache: true}))).Data.(map[string]interface{})["result"].(string)
+	aiCache = newAIResultCache(config.AI.Cache)
+
+	stream := func() []sseEvent {
+		w := performRequest(handleAIAnalyzeStream, jsonRequest(http.MethodPost, "/api/ai/analyze/stream", body))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("status = %d, content-type = %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		return parseSSE(t, w.Body.String())
+	}
+
+	for _, cached := range []bool{false, true} {
+		events := stream()
+		if len(events) < 3 || events[0].Name != "meta" || events[len(events)-1].Name != "done" {
+			t.Fatalf("cached=%v: events = %+v, want meta, delta..., done", cached, events)
+		}
+		if events[0].Data["cached"] != cached || events[len(events)-1].Data["cached"] != cached {
+			t.Fatalf("cached=%v: meta = %v, done = %v", cached, events[0].Data, events[len(events)-1].Data)
+		}
+		var text strings.Builder
+		for _, ev := range events[1 : len(events)-1] {
+			if ev.Name != "delta" {
+				t.Fatalf("cached=%v: unexpected event %q between meta and done", cached, ev.Name)
+			}
+			text.WriteString(ev.Data["text"].(string))
+		}
+		if text.String() != want {
+			t.Fatalf("cached=%v: streamed %q, want %q", cached, text.String(), want)
+		}
+		// 初回は8文字ずつ、キャッシュ済みは一度に送る
+		if deltas := len(events) - 2; cached != (deltas == 1) {
+			t.Fatalf("cached=%v: %d delta events", cached, deltas)
+		}
+	}
+}
+
+func TestDiffSummaryTruncation(t *testing.T) {
+	var old, edited []string
+	for i := 0; i < 40; i++ {
+		old = append(old, fmt.Sprintf("第%d段落の文章。", i))
+		if i%2 == 0 {
+			edited = append(edited, fmt.Sprintf("第%d段落の改稿。", i))
+		} else {
+			edited = append(edited, old[i])
+		}
+	}
+	long := strings.Repeat("長", diffSummaryHunkLimit+50)
+	setupWorkspace(t, map[string]string{
+		"chapters/01.txt": strings.Join(old, "\n"),
+		"chapters/02.txt": "冒頭。",
+	})
+	write := func(rel, content string) {
+		if err := os.WriteFile(filepath.Join(workDir, filepath.FromSlash(rel)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("chapters/01.txt", strings.Join(edited, "\n"))
+	write("chapters/02.txt", "冒頭。\n"+long)
+
+	// 箇所が多いファイルは均等に抜き出し、残りの数を書く
+	summary := summarizeFileDiff(headCommitTree(), "chapters/01.txt")
+	lines := strings.Split(summary, "\n")
+	hunks := len(lines) - 2
+	if budget := diffSummaryFileLimit / diffSummaryHunkLimit; hunks != budget {
+		t.Fatalf("summary lists %d hunks, want %d:\n%s", hunks, budget, summary)
+	}
+	if !strings.HasPrefix(lines[0], "## chapters/01.txt（40箇所の変更）") || lines[len(lines)-1] != fmt.Sprintf("（ほか%d箇所は省略）", 40-hunks) {
+		t.Fatalf("unexpected header or footer:\n%s", summary)
+	}
+
+	// 長い箇所は1箇所の上限で切る
+	summary = summarizeFileDiff(headCommitTree(), "chapters/02.txt")
+	if n := strings.Count(summary, "長"); n == 0 || n >= diffSummaryHunkLimit || !strings.HasSuffix(summary, "長…") {
+		t.Fatalf("long hunk was not truncated to %d characters:\n%s", diffSummaryHunkLimit, summary)
+	}
+
+	// 全体の上限を超えるファイルは省略し、その数を書く
+	for i := 0; i < 10; i++ {
+		write(fmt.Sprintf("chapters/new%02d.txt", i), strings.Repeat("新", diffSummaryFileLimit*2))
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := wt.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary = summarizeChanges(status)
+	i := strings.LastIndex(summary, "\n")
+	body, footer := summary[:i], summary[i+1:]
+	if n := len([]rune(body)); n > diffSummaryTotalLimit {
+		t.Fatalf("summary is %d characters, limit %d", n, diffSummaryTotalLimit)
+	}
+	included := strings.Count(body, "## ")
+	if want := fmt.Sprintf("（ほか%dファイルの変更は省略）", 12-included); footer != want {
+		t.Fatalf("footer = %q, want %q", footer, want)
+	}
+}
+
+func TestChunkManuscriptOffsets(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		maxTokens int
+		chunks    int
+	}{
+		{"paragraphs fill a chunk exactly", "一二三四。\n五六七八。\n九十一二。\n", 12, 2},
+		{"long paragraph splits at sentences", strings.Repeat("吾輩は猫である。", 6) + "\n名前はまだ無い。\n", 20, 4},
+		{"no delimiter is split by tokens", strings.Repeat("あ", 25), 10, 3},
+		{"blank lines between chunks", "一二三。\n\n\n四五六。\n", 5, 2},
+		{"ascii counts four characters per token", strings.Repeat("abcd", 10) + "\n" + strings.Repeat("漢", 8), 10, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runes := []rune(tt.text)
+			chunks := chunkManuscript(tt.text, tt.maxTokens)
+			if len(chunks) != tt.chunks {
+				t.Fatalf("got %d chunks, want %d: %+v", len(chunks), tt.chunks, chunks)
+			}
+			prevEnd := 0
+			var covered strings.Builder
+			for i, ch := range chunks {
+				if ch.Start < prevEnd || ch.End > len(runes) || ch.Start >= ch.End {
+					t.Fatalf("chunk %d range [%d, %d) after %d in %d runes", i, ch.Start, ch.End, prevEnd, len(runes))
+				}
+				if got := string(runes[ch.Start:ch.End]); got != ch.Text {
+					t.Fatalf("chunk %d text %q does not match range [%d, %d) = %q", i, ch.Text, ch.Start, ch.End, got)
+				}
+				if ch.Tokens > tt.maxTokens {
+					t.Fatalf("chunk %d has %d tokens, limit %d", i, ch.Tokens, tt.maxTokens)
+				}
+				if gap := string(runes[prevEnd:ch.Start]); strings.TrimSpace(gap) != "" {
+					t.Fatalf("text %q before chunk %d is outside every chunk", gap, i)
+				}
+				covered.WriteString(string(runes[prevEnd:ch.Start]))
+				covered.WriteString(ch.Text)
+				prevEnd = ch.End
+			}
+			// 飛ばしてよいのは空白だけ
+			if rest := string(runes[prevEnd:]); strings.TrimSpace(rest) != "" || covered.String()+rest != tt.text {
+				t.Fatalf("chunks do not cover the text: %+v", chunks)
+			}
+		})
+	}
+}
+
+func TestWorkspacePathRejectsSymlinkEscape(t *testing.T) {
+	workDir = t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(workDir, "link")); err != nil {
+		t.Skip(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "missing.txt"), filepath.Join(workDir, "dangling.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(workDir, "chapters"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rel := range []string{"link/ch1.txt", "link/new/ch1.txt", "dangling.txt"} {
+		if _, err := workspacePath(rel); err == nil {
+			t.Errorf("workspacePath(%q) escaped the workspace", rel)
+		}
+	}
+	for _, rel := range []string{"ch1.txt", "chapters/ch1.txt", "new/dir/ch1.txt"} {
+		if _, err := workspacePath(rel); err != nil {
+			t.Errorf("workspacePath(%q) = %v", rel, err)
+		}
+	}
+}
+
+func TestAnalyzeFallsBackWhenTemplatesCannotBeLoaded(t *testing.T) {
+	setupFakeAI(t, QuotaConfig{})
+	setupWorkspace(t, map[string]string{repoPromptsFile: "{broken"})
+
+	w := performRequest(handleAIAnalyze, jsonRequest(http.MethodPost, "/api/ai/analyze", AnalyzeRequest{Text: "本文", Type: "summary"}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestUserPromptTemplatesAreCached(t *testing.T) {
+	token := "cached-token"
+	promptTemplateCacheMu.Lock()
+	promptTemplateCache[accessTokenKey(token)] = promptTemplateCacheEntry{
+		templates: map[string]*PromptTemplate{"mine": {Name: "mine", Source: "user", Template: "{{.Text}}"}},
+		expiresAt: time.Now().Add(time.Minute),
+	}
+	promptTemplateCacheMu.Unlock()
+	repo = nil
+
+	templates, err := loadPromptTemplates(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if templates["mine"] == nil || templates["summary"] == nil {
+		t.Fatalf("templates = %v, want cached user template and built-ins", templates)
+	}
+
+	forgetUserPromptTemplates(token)
+	promptTemplateCacheMu.Lock()
+	_, ok := promptTemplateCache[accessTokenKey(token)]
+	promptTemplateCacheMu.Unlock()
+	if ok {
+		t.Fatal("cache entry survived forgetUserPromptTemplates")
+	}
+}
+
+// 呼び出しが必ず失敗するプロバイダー
+type failingProvider struct{ *fakeProvider }
+
+func (*failingProvider) Generate(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	return nil, errors.New("upstream error")
+}
+
+func TestAIUsageReservesSlotsAtomically(t *testing.T) {
+	tracker, err := newAIUsageTracker(QuotaConfig{RequestsPerMinute: 3, DailyRequests: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同時に来た呼び出しは上限の数だけ通る
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var reserved []*aiUsageReservation
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r, err := tracker.Check("u"); err == nil {
+				mu.Lock()
+				reserved = append(reserved, r)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(reserved) != 3 {
+		t.Fatalf("reserved %d slots, want 3", len(reserved))
+	}
+
+	// 失敗した呼び出しの枠は返る
+	tracker.Release(reserved[0])
+	tracker.Release(reserved[0])
+	if _, err := tracker.Check("u"); err != nil {
+		t.Fatalf("released slot was not returned: %v", err)
+	}
+
+	metered := &meteredProvider{LLMProvider: &failingProvider{&fakeProvider{}}, user: "v", tracker: tracker}
+	for i := 0; i < 5; i++ {
+		var qe *quotaError
+		if _, err := metered.Generate(context.Background(), LLMRequest{Prompt: "x"}); err == nil || errors.As(err, &qe) {
+			t.Fatalf("Generate err = %v, want upstream error", err)
+		}
+	}
+	if day, _, _ := tracker.Snapshot("v"); day.Requests != 0 {
+		t.Fatalf("failed calls were counted: %+v", day)
+	}
+}
+
+func TestAIUsageFlushDropsPastMonths(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	tracker, err := newAIUsageTracker(QuotaConfig{UsagePath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := tracker.Check("u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.Record(r, aiUsageRecord{Time: time.Now(), Model: "m", InputTokens: 1})
+	tracker.mu.Lock()
+	tracker.accounts["u"].Monthly["2000-01"] = &aiUsageCounter{Requests: 1}
+	tracker.accounts["old"] = &aiUsageAccount{
+		Daily:   map[string]*aiUsageCounter{"2000-01-01": {Requests: 1}},
+		Monthly: map[string]*aiUsageCounter{"2000-01": {Requests: 1}},
+	}
+	tracker.mu.Unlock()
+
+	// 記録しただけではファイルに書かない
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("usage file was written before flush: %v", err)
+	}
+	if err := tracker.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "2000-01") || strings.Contains(string(data), `"old"`) {
+		t.Fatalf("past months were kept: %s", data)
+	}
+	if !strings.Contains(string(data), time.Now().Format("2006-01")) {
+		t.Fatalf("current month is missing: %s", data)
+	}
+}
+
+func TestClientIPIgnoresForwardedForWithoutTrustedProxies(t *testing.T) {
+	for _, tc := range []struct {
+		proxies []string
+		want    string
+	}{
+		{nil, "10.0.0.1"},
+		{[]string{"10.0.0.0/8"}, "203.0.113.7"},
+	} {
+		r := gin.New()
+		if err := r.SetTrustedProxies(tc.proxies); err != nil {
+			t.Fatal(err)
+		}
+		r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, aiUserID(c)) })
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if got := w.Body.String(); got != "ip:"+tc.want {
+			t.Errorf("proxies %v: aiUserID = %q, want ip:%s", tc.proxies, got, tc.want)
+		}
+	}
+}
+
+func TestAIUserIDCachesTokenLookups(t *testing.T) {
+	config = defaultConfig()
+	var err error
+	if tokenVault, err = newTokenVault(VaultConfig{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+
+	lookups := 0
+	orig := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		lookups++
+		status, body := http.StatusOK, `{"id": 9, "login": "writer"}`
+		if req.Header.Get("Authorization") != "Bearer valid-token" {
+			status, body = http.StatusUnauthorized, `{}`
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})
+	defer func() { http.DefaultTransport = orig }()
+
+	userID := func(token string) string {
+		var id string
+		req := httptest.NewRequest(http.MethodPost, "/api/ai/analyze", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Bearer "+token)
+		performRequest(func(c *gin.Context) { id = aiUserID(c) }, req)
+		return id
+	}
+	for i := 0; i < 3; i++ {
+		if got := userID("valid-token"); got != "github:writer" {
+			t.Fatalf("aiUserID = %q, want github:writer", got)
+		}
+		// 無効なトークンはIPアドレスで数え、失敗も覚えておく
+		if got := userID("invalid-token"); got != "ip:192.0.2.1" {
+			t.Fatalf("aiUserID = %q, want ip:192.0.2.1", got)
+		}
+	}
+	if lookups != 2 {
+		t.Fatalf("GitHub /user was called %d times, want once per token", lookups)
+	}
+}
+
+func TestCachedAIResultsIgnoreExhaustedQuota(t *testing.T) {
+	setupFakeAI(t, QuotaConfig{DailyRequests: 1})
+	config.AI.Cache.MaxEntries = 10
+	aiCache = newAIResultCache(config.AI.Cache)
+
+	analyze := func(text string) (int, Response) {
+		w := performRequest(handleAIAnalyze, jsonRequest(http.MethodPost, "/api/ai/analyze", AnalyzeRequest{Text: text, Type: "summary"}))
+		if w.Code != http.StatusOK {
+			return w.Code, Response{}
+		}
+		return w.Code, decodeResponse(t, w)
+	}
+	if code, _ := analyze("一度目"); code != http.StatusOK {
+		t.Fatalf("first call status = %d", code)
+	}
+	// 上限に達していても、キャッシュ済みの結果は返す
+	code, resp := analyze("一度目")
+	if code != http.StatusOK || !resp.Data.(map[string]interface{})["cached"].(bool) {
+		t.Fatalf("cached call status = %d, data = %v", code, resp.Data)
+	}
+	if code, _ := analyze("二度目"); code != http.StatusTooManyRequests {
+		t.Fatalf("uncached call status = %d, want 429", code)
+	}
+}
+
+// GitHub API への送信を横取りする
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestBranchComparisonEscapesRefsAndCapsCommits(t *testing.T) {
+	var requested string
+	orig := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requested = req.URL.EscapedPath()
+		var files []string
+		for i := 0; i < 50; i++ {
+			files = append(files, fmt.Sprintf(`{"filename": "notes/%02d.json", "status": "modified", "additions": 1, "deletions": 1, "patch": "@@ -1 +1 @@\n+%s"}`, i, strings.Repeat("差", 1000)))
+		}
+		body := `{"total_commits": 100, "commits": [` + strings.TrimSuffix(strings.Repeat(`{"commit": {"message": "修正\n本文"}},`, 100), ",") + `], "files": [` + strings.Join(files, ",") + `]}`
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})
+	defer func() { http.DefaultTransport = orig }()
+
+	comparison, err := fetchBranchComparison("token", "owner/repo", "main", "soan/第1章?x#y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/repos/owner/repo/compare/main...soan%2F%E7%AC%AC1%E7%AB%A0%3Fx%23y"; requested != want {
+		t.Fatalf("requested %q, want %q", requested, want)
+	}
+
+	summary := summarizeComparison(comparison)
+	if n := strings.Count(summary, "- 修正"); n != comparisonCommitLimit {
+		t.Fatalf("summary lists %d commits, want %d", n, comparisonCommitLimit)
+	}
+	if !strings.Contains(summary, "ほか70件は省略") {
+		t.Fatalf("summary does not mention omitted commits: %s", summary)
+	}
+
+	// ファイルの差分は全体の上限までに収め、残りの数を書く
+	i := strings.LastIndex(strings.TrimSuffix(summary, "\n"), "\n")
+	body, footer := summary[:i+1], summary[i+1:]
+	if n := len([]rune(body)); n > diffSummaryTotalLimit {
+		t.Fatalf("summary is %d characters, limit %d", n, diffSummaryTotalLimit)
+	}
+	if want := fmt.Sprintf("（ほか%dファイルは省略）\n", 50-strings.Count(body, "=== ")); footer != want {
+		t.Fatalf("footer = %q, want %q", footer, want)
+	}
+}
+
+func TestAssistantSouanTeishutsuPushesManuscripts(t *testing.T) {
+	setupWorkspace(t, map[string]string{"chapters/01.txt": "一章", "chapters/02.txt": "二章", "notes.json": "{}"})
+	write := func(rel, content string) {
+		if err := os.WriteFile(filepath.Join(workDir, filepath.FromSlash(rel)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("chapters/01.txt", "一章（改稿）")
+	write("chapters/03.txt", "三章")
+	write("notes.json", `{"draft": true}`)
+	write("scratch.log", "作業メモ")
+
+	unchanged := plumbing.ComputeHash(plumbing.BlobObject, []byte("二章")).String()
+	var requests []string
+	orig := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		status, body := http.StatusNotFound, `{}`
+		switch {
+		case req.Method == http.MethodGet && req.URL.Path == "/repos/owner/repo/git/refs/heads/main":
+			status, body = http.StatusOK, `{"object": {"sha": "base"}}`
+		case req.Method == http.MethodPost && req.URL.Path == "/repos/owner/repo/git/refs":
+			status = http.StatusCreated
+		case req.Method == http.MethodGet && req.URL.Path == "/repos/owner/repo/contents/chapters/02.txt":
+			status, body = http.StatusOK, `{"sha": "`+unchanged+`"}`
+		case req.Method == http.MethodPut:
+			status = http.StatusCreated
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})
+	defer func() { http.DefaultTransport = orig }()
+
+	plan := &assistantPlan{Repository: "owner/repo"}
+	result := planAssistantCall(plan, LLMToolCall{Name: "souan_teishutsu", Args: map[string]interface{}{"message": "第一章を改稿"}})
+	if result["status"] != "planned" {
+		t.Fatalf("plan result = %v", result)
+	}
+	if _, err := executeAssistantAction(nil, plan, plan.Actions[0], "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 手元には原稿ファイルだけを保存する
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := wt.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"chapters/01.txt", "chapters/03.txt"} {
+		if s, ok := status[p]; ok {
+			t.Errorf("%s was not committed: %+v", p, s)
+		}
+	}
+	if status.File("notes.json").Worktree != git.Modified || status.File("scratch.log").Worktree != git.Untracked {
+		t.Errorf("non-manuscript files were committed: %v", status)
+	}
+
+	// GitHubに草案を作り、内容が変わった原稿だけを送る
+	want := []string{
+		"GET /repos/owner/repo/git/ref/heads/master",
+		"GET /repos/owner/repo/git/refs/heads/main",
+		"POST /repos/owner/repo/git/refs",
+		"GET /repos/owner/repo/contents/chapters/01.txt",
+		"PUT /repos/owner/repo/contents/chapters/01.txt",
+		"GET /repos/owner/repo/contents/chapters/02.txt",
+		"GET /repos/owner/repo/contents/chapters/03.txt",
+		"PUT /repos/owner/repo/contents/chapters/03.txt",
+	}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("requests:\n%s\nwant:\n%s", strings.Join(requests, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestAssistantExecuteKeepsPlanWithoutRepo(t *testing.T) {
+	config = defaultConfig()
+	var err error
+	if tokenVault, err = newTokenVault(VaultConfig{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	repo = nil
+	req := httptest.NewRequest(http.MethodPost, "/api/assistant/execute", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	var user string
+	performRequest(func(c *gin.Context) { user = aiUserID(c) }, req)
+	storeAssistantPlan(&assistantPlan{ID: "plan-1", User: user, ExpiresAt: time.Now().Add(time.Minute)})
+
+	req = jsonRequest(http.MethodPost, "/api/assistant/execute", AssistantExecuteRequest{PlanID: "plan-1"})
+	req.RemoteAddr = "192.0.2.1:1234"
+	if w := performRequest(handleAssistantExecute, req); w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", w.Code)
+	}
+	if consumeAssistantPlan("plan-1", user) == nil {
+		t.Fatal("plan was consumed although it could not run")
+	}
+}
+
+func TestShuseiIraiCreatesPullRequest(t *testing.T) {
+	config = defaultConfig()
+	var requests []string
+	orig := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(req.Body)
+		requests = append(requests, req.Method+" "+req.URL.Path+" "+string(body))
+		return &http.Response{StatusCode: http.StatusCreated, Body: io.NopCloser(strings.NewReader(`{"number": 3, "html_url": "https://github.com/owner/repo/pull/3"}`)), Header: make(http.Header)}, nil
+	})
+	defer func() { http.DefaultTransport = orig }()
+
+	req := jsonRequest(http.MethodPost, "/api/git/shusei-irai", ShuseiIraiRequest{AccessToken: "token", Repository: "owner/repo", Branch: "soan/1", Title: "第一章の改稿"})
+	w := performRequest(handleShuseiIrai, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if data := decodeResponse(t, w).Data.(map[string]interface{}); data["pullRequestNumber"] != float64(3) {
+		t.Fatalf("data = %v", data)
+	}
+	want := `POST /repos/owner/repo/pulls {"base":"main","body":"","head":"soan/1","title":"第一章の改稿"}`
+	if len(requests) != 1 || requests[0] != want {
+		t.Fatalf("requests = %q, want [%q]", requests, want)
+	}
+}
+
+func TestRestoreFromCommitRemovesFilesAddedLater(t *testing.T) {
+	setupWorkspace(t, map[string]string{"chapters/01.txt": "一章", "notes.txt": "メモ"})
+	first, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rel, content := range map[string]string{"chapters/01.txt": "一章（改稿）", "chapters/02.txt": "二章", "notes2.txt": "別のメモ"} {
+		if err := os.WriteFile(filepath.Join(workDir, filepath.FromSlash(rel)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := commitWorkspace("改稿", "chapters/01.txt", "chapters/02.txt", "notes2.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := restoreFromCommit(first.Hash().String(), "chapters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed := result["removed"].([]string); len(removed) != 1 || removed[0] != "chapters/02.txt" {
+		t.Fatalf("removed = %v", removed)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "chapters", "02.txt")); !os.IsNotExist(err) {
+		t.Fatalf("chapters/02.txt still exists: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "notes2.txt")); err != nil {
+		t.Fatalf("file outside the target was removed: %v", err)
+	}
+
+	// 削除もコミットされ、作業ツリーに変更は残らない
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := w.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.IsClean() {
+		t.Fatalf("worktree is not clean after restore: %v", status)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commit.File("chapters/02.txt"); err == nil {
+		t.Fatal("chapters/02.txt is still in the restored commit")
+	}
+}
+
+func TestPaginateManuscriptLineBreaks(t *testing.T) {
+	// 各行を「本文 マス数 ぶら下げ 縦中横 ルビ」で表す
+	describe := func(line layoutLine) string {
+		var ruby []string
+		for _, r := range line.Ruby {
+			ruby = append(ruby, fmt.Sprintf("%d+%d:%s", r.Cell, r.Length, r.Text))
+		}
+		return fmt.Sprintf("%s cells=%d hang=%d tcy=%v ruby=%v", line.Text, line.Cells, line.Hanging, line.TateChuYoko, ruby)
+	}
+	tests := []struct {
+		name  string
+		text  string
+		lines []string
+	}{
+		{
+			"opening bracket is not left at the line end",
+			"あいうえ「お",
+			[]string{"あいうえ cells=4 hang=0 tcy=[] ruby=[]", "「お cells=2 hang=0 tcy=[] ruby=[]"},
+		},
+		{
+			"period and closing bracket hang off the line end",
+			"あいうえお。」かき",
+			[]string{"あいうえお。」 cells=5 hang=2 tcy=[] ruby=[]", "かき cells=2 hang=0 tcy=[] ruby=[]"},
+		},
+		{
+			"more closing marks than can hang push the last character down",
+			"あいうえお。」」か",
+			[]string{"あいうえ cells=4 hang=0 tcy=[] ruby=[]", "お。」」か cells=5 hang=0 tcy=[] ruby=[]"},
+		},
+		{
+			"two-digit numbers take one cell",
+			"12月31日に",
+			[]string{"12月31日に cells=5 hang=0 tcy=[0 2] ruby=[]"},
+		},
+		{
+			"three-digit numbers take one cell per digit",
+			"第123話",
+			[]string{"第123話 cells=5 hang=0 tcy=[] ruby=[]"},
+		},
+		{
+			"ruby base is not split and moves to the next line whole",
+			"あいうえ｜吾輩《わがはい》は",
+			[]string{"あいうえ cells=4 hang=0 tcy=[] ruby=[]", "吾輩は cells=3 hang=0 tcy=[] ruby=[0+2:わがはい]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := paginateManuscript(tt.text, PageLayout{CharsPerLine: 5, LinesPerPage: 10})
+			var got []string
+			for _, page := range p.Pages {
+				for _, line := range page.Lines {
+					got = append(got, describe(line))
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.lines, "\n") {
+				t.Fatalf("lines:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.lines, "\n"))
+			}
+		})
+	}
+
+	// 行数がページに収まらなければ次のページへ送る
+	p := paginateManuscript("一\n二\n三\n四\n五", PageLayout{CharsPerLine: 5, LinesPerPage: 2})
+	if p.TotalPages != 3 || p.TotalLines != 5 || p.Pages[2].Number != 3 || p.Pages[2].Lines[0].Text != "五" {
+		t.Fatalf("pagination = %+v", p)
+	}
+
+	// 空の原稿は0枚（章ごとにページを数えるとき、空のファイルでページを使わない）
+	if p := paginateManuscript("", PageLayout{CharsPerLine: 5, LinesPerPage: 2}); p.TotalPages != 0 || p.TotalLines != 0 || len(p.Pages) != 0 {
+		t.Fatalf("empty manuscript = %+v", p)
+	}
+}
+
+func TestDiffSummariesIgnoreAozoraNotation(t *testing.T) {
+	setupWorkspace(t, map[string]string{"01.txt": "吾輩は猫である。\n名前はまだ無い。\n"})
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(content string) {
+		if err := os.WriteFile(filepath.Join(workDir, "01.txt"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("｜吾輩《わがはい》は猫である。\n名前はまだ無い。\n")
+	if got := summarizeFileDiff(tree, "01.txt"); got != "## 01.txt（ルビ・注記のみの変更）" {
+		t.Fatalf("ruby only: %q", got)
+	}
+	write("｜吾輩《わがはい》は犬である。\n名前はまだ無い。\n")
+	if got := summarizeFileDiff(tree, "01.txt"); strings.Contains(got, "《") || !strings.Contains(got, "犬") {
+		t.Fatalf("text change: %q", got)
+	}
+
+	patch := "@@ -1,2 +1,2 @@\n-吾輩は猫である。\n+｜吾輩《わがはい》は猫である。\n-名前はまだ無い。\n+名前はもうある。"
+	if got := plainPatch(patch); got != "@@ -1,2 +1,2 @@\n-名前はまだ無い。\n+名前はもうある。" {
+		t.Fatalf("plainPatch = %q", got)
+	}
+}
+
+// EPUB の中のファイルを読む
+func readEPUBEntries(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[f.Name] = string(content)
+	}
+	return entries
+}
+
+func TestExportEPUB(t *testing.T) {
+	setupWorkspace(t, map[string]string{
+		"01.txt": "第一章　始まり［＃「第一章　始まり」は大見出し］\n｜吾輩《わがはい》は猫である。\n［＃改ページ］\n名前はまだ無い。\n",
+		"02.txt": "第二章［＃「第二章」は大見出し］\n二章の本文。\n",
+	})
+
+	export := func(query string, header http.Header) map[string]string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/export/epub?"+query, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := performRequest(handleExportEPUB, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		if problems := validateEPUB(w.Body.Bytes()); len(problems) > 0 {
+			t.Fatalf("validateEPUB: %v", problems)
+		}
+		return readEPUBEntries(t, w.Body.Bytes())
+	}
+
+	entries := export("title=猫", nil)
+	if !strings.Contains(entries["OEBPS/style.css"], "writing-mode: vertical-rl") {
+		t.Fatalf("style.css is not vertical: %s", entries["OEBPS/style.css"])
+	}
+	if !strings.Contains(entries["OEBPS/content.opf"], `page-progression-direction="rtl"`) {
+		t.Fatal("spine is not right-to-left")
+	}
+
+	// 章の順序・目次・本文
+	opf := entries["OEBPS/content.opf"]
+	if i, j := strings.Index(opf, `idref="chapter-001"`), strings.Index(opf, `idref="chapter-002"`); i < 0 || j < i {
+		t.Fatalf("spine order is wrong: %s", opf)
+	}
+	nav := entries["OEBPS/nav.xhtml"]
+	if i, j := strings.Index(nav, `<a href="chapter-001.xhtml">第一章　始まり</a>`), strings.Index(nav, `<a href="chapter-002.xhtml">第二章</a>`); i < 0 || j < i {
+		t.Fatalf("nav is wrong: %s", nav)
+	}
+	chapter := entries["OEBPS/chapter-001.xhtml"]
+	for _, want := range []string{
+		"<h1>第一章　始まり</h1>",
+		"<ruby>吾輩<rt>わがはい</rt></ruby>は猫である。",
+		`<p class="pagebreak">名前はまだ無い。</p>`,
+	} {
+		if !strings.Contains(chapter, want) {
+			t.Errorf("chapter-001.xhtml does not contain %q:\n%s", want, chapter)
+		}
+	}
+	if strings.Contains(chapter, "［＃") {
+		t.Errorf("annotation leaked into chapter-001.xhtml:\n%s", chapter)
+	}
+
+	// 横書き（クエリ）
+	entries = export("writingMode=horizontal", nil)
+	if !strings.Contains(entries["OEBPS/style.css"], "writing-mode: horizontal-tb") || !strings.Contains(entries["OEBPS/content.opf"], `page-progression-direction="ltr"`) {
+		t.Fatal("writingMode=horizontal was ignored")
+	}
+
+	// 横書き（ユーザー設定）
+	token := "epub-token"
+	userSettingsCacheMu.Lock()
+	userSettingsCache[accessTokenKey(token)] = userSettingsCacheEntry{settings: &TenkaiSettings{WritingMode: "horizontal"}, expiresAt: time.Now().Add(time.Minute)}
+	userSettingsCacheMu.Unlock()
+	defer func() {
+		userSettingsCacheMu.Lock()
+		delete(userSettingsCache, accessTokenKey(token))
+		userSettingsCacheMu.Unlock()
+	}()
+	entries = export("", http.Header{"Authorization": {"Bearer " + token}})
+	if !strings.Contains(entries["OEBPS/style.css"], "writing-mode: horizontal-tb") {
+		t.Fatal("the user's horizontal writing mode setting was ignored")
+	}
+}
+
+// 章ごとのパスを埋め込んだ .docx を作る
+func buildTestDOCX(t *testing.T, chapters map[string]string, order ...string) []byte {
+	t.Helper()
+	book := &exportBook{Title: "テスト", Language: "ja", WritingMode: "vertical", Modified: time.Now()}
+	for _, p := range order {
+		book.Chapters = append(book.Chapters, newExportChapter(manuscriptFile{Path: p, Content: chapters[p]}))
+	}
+	data, err := buildDOCX(book, PageLayout{CharsPerLine: 20, LinesPerPage: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// .docx を multipart で送る
+func importDOCXRequest(t *testing.T, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", "原稿.docx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/import/docx", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestImportDOCXRejectsUnsafeEmbeddedPaths(t *testing.T) {
+	setupWorkspace(t, map[string]string{"01.txt": "一章\n", "02.txt": "二章\n"})
+
+	for _, bad := range []string{".git/config", "../outside.txt", "/etc/passwd.txt", "notes.json"} {
+		data := buildTestDOCX(t, map[string]string{"01.txt": "一章\n", bad: "書き換え\n"}, "01.txt", bad)
+		if _, err := parseDOCX(data); err == nil {
+			t.Errorf("parseDOCX accepted %q", bad)
+		}
+	}
+
+	// 管理下にないファイルが1つでもあれば、どのファイルも書き換えない
+	data := buildTestDOCX(t, map[string]string{"01.txt": "一章（改稿）\n", "new.txt": "新しい章\n"}, "01.txt", "new.txt")
+	w := performRequest(handleImportDOCX, importDOCXRequest(t, data))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if content, _ := os.ReadFile(filepath.Join(workDir, "01.txt")); string(content) != "一章\n" {
+		t.Fatalf("01.txt was written before validation: %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "new.txt")); !os.IsNotExist(err) {
+		t.Fatalf("new.txt was created: %v", err)
+	}
+
+	data = buildTestDOCX(t, map[string]string{"01.txt": "一章（改稿）\n", "02.txt": "二章\n"}, "01.txt", "02.txt")
+	w = performRequest(handleImportDOCX, importDOCXRequest(t, data))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if content, _ := os.ReadFile(filepath.Join(workDir, "01.txt")); !strings.Contains(string(content), "改稿") {
+		t.Fatalf("01.txt was not imported: %q", content)
+	}
+}
+
+func TestCheckExportTextCountsEncodedBytes(t *testing.T) {
+	setupWorkspace(t, map[string]string{"01.txt": "吾輩は猫である。\n名前はまだ無い。\n"})
+
+	for _, profile := range []string{"plain", "sjis"} {
+		w := performRequest(handleExportText, httptest.NewRequest(http.MethodGet, "/api/export/text?profile="+profile, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: export status = %d, body = %s", profile, w.Code, w.Body.String())
+		}
+		exported := w.Body.Len()
+
+		w = performRequest(handleCheckExportText, httptest.NewRequest(http.MethodGet, "/api/export/text/check?profile="+profile, nil))
+		resp := decodeResponse(t, w)
+		if got := resp.Data.(map[string]interface{})["bytes"]; got != float64(exported) {
+			t.Errorf("%s: bytes = %v, want %d", profile, got, exported)
+		}
+	}
+}
+
+func TestWebSerialRoundTrip(t *testing.T) {
+	source := "［＃大見出し］第一話［＃大見出し終わり］\n" +
+		"　吾輩は｜猫《ねこ》である。\n" +
+		"［＃３字下げ］名前はまだ無い。\n" +
+		"［＃傍点］どこ［＃傍点終わり］で生れたか［＃「生れた」に傍線］。\n" +
+		"漢字《かんじ》と12時。\n" +
+		"［＃改ページ］\n" +
+		"次のページ"
+	// 見出し・字下げ・改ページ・傍線はサイトの記法にないため、取り込み直しても元に戻らない
+	back := "　吾輩は｜猫《ねこ》である。\n" +
+		"　　　名前はまだ無い。\n" +
+		"どこ［＃「どこ」に傍点］で生れたか。\n" +
+		"｜漢字《かんじ》と12時。\n" +
+		"\n" +
+		"次のページ\n"
+	tests := []struct {
+		platform string
+		site     string
+	}{
+		{"narou", "　吾輩は|猫《ねこ》である。\n　　　名前はまだ無い。\n|どこ《・・》で生れたか。\n|漢字《かんじ》と12時。\n\n次のページ\n"},
+		{"kakuyomu", "　吾輩は｜猫《ねこ》である。\n　　　名前はまだ無い。\n《《どこ》》で生れたか。\n｜漢字《かんじ》と12時。\n\n次のページ\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.platform, func(t *testing.T) {
+			site := renderWebSerial(parseAozora(source), tt.platform)
+			if site != tt.site {
+				t.Fatalf("rendered:\n%s\nwant:\n%s", site, tt.site)
+			}
+			if got := parseWebSerial(site, tt.platform).AozoraText(); got != back {
+				t.Fatalf("imported:\n%s\nwant:\n%s", got, back)
+			}
+			// サイト形式 → 青空文庫形式 → サイト形式では変わらない
+			if again := renderWebSerial(parseAozora(back), tt.platform); again != tt.site {
+				t.Fatalf("second round trip:\n%s\nwant:\n%s", again, tt.site)
+			}
+		})
+	}
+}
+
+func TestImportWebSerialRejectsConfigPaths(t *testing.T) {
+	setupWorkspace(t, map[string]string{".tenkai/book.yaml": "parts: []\n", "chapters/01.txt": "一章"})
+	for _, p := range []string{".tenkai/book.yaml", ".tenkai/glossary.json", "glossary.json", "../outside.txt", "chapters/../notes.txt"} {
+		w := performRequest(handleImportWebSerial, jsonRequest(http.MethodPost, "/api/import/web", WebSerialImportRequest{Platform: "narou", Text: "本文", Path: p}))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", p, w.Code)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(workDir, ".tenkai", "book.yaml")); err != nil || string(data) != "parts: []\n" {
+		t.Fatalf("book.yaml = %q, %v", data, err)
+	}
+
+	w := performRequest(handleImportWebSerial, jsonRequest(http.MethodPost, "/api/import/web", WebSerialImportRequest{Platform: "narou", Text: "|猫《ねこ》", Path: "chapters/02.txt"}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if data, err := os.ReadFile(filepath.Join(workDir, "chapters", "02.txt")); err != nil || string(data) != "｜猫《ねこ》\n" {
+		t.Fatalf("imported file = %q, %v", data, err)
+	}
+}
+
+func TestLintRulesOnLongManuscript(t *testing.T) {
+	// です・ます調の中に、だ・である調の文が1つだけある
+	var sb strings.Builder
+	for i := 0; i < 20000; i++ {
+		sb.WriteString("猫が庭を歩きます。")
+	}
+	sb.WriteString("犬は眠っている。犬が窓を見る。これは事件である。\n")
+	text := sb.String()
+
+	done := make(chan []ProofreadIssue)
+	go func() {
+		done <- append(checkMixedStyle(text, &ProofreadRuleConfig{}), checkDoubledJoshi(text, &ProofreadRuleConfig{})...)
+	}()
+	var issues []ProofreadIssue
+	select {
+	case issues = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("lint rules did not finish on a long manuscript")
+	}
+
+	var mixed, joshi int
+	for _, issue := range issues {
+		switch issue.Original {
+		case "である":
+			mixed++
+		case "が":
+			joshi++
+		}
+	}
+	if mixed != 1 {
+		t.Errorf("mixed style issues = %d, want 1", mixed)
+	}
+	if joshi != 0 {
+		t.Errorf("doubled joshi issues = %d, want 0 (each sentence has one が)", joshi)
+	}
+	if got := checkDoubledJoshi("私が猫が好きだ。", &ProofreadRuleConfig{}); len(got) != 1 || got[0].Start != 3 {
+		t.Errorf("checkDoubledJoshi = %+v", got)
+	}
+}
+
+func TestGlossaryNormalizeIsAtomic(t *testing.T) {
+	entries := []*GlossaryEntry{
+		{Term: "トウキョウ", Variants: []string{"東京"}},
+		{Term: "キョウト", Variants: []string{"京都"}},
+		{Term: "吾輩", Reading: "わがはい"},
+	}
+	// ルビの読みが用語集と違えば、読みの部分を指摘する
+	issues := checkGlossary("｜吾輩《わたし》は東京へ行く。", entries)
+	var got []string
+	for _, issue := range issues {
+		got = append(got, fmt.Sprintf("%d-%d:%s→%s", issue.Start, issue.End, issue.Original, issue.Suggestion))
+	}
+	if want := "[4-7:わたし→わがはい 9-11:東京→トウキョウ]"; fmt.Sprint(got) != want {
+		t.Fatalf("checkGlossary = %v, want %s", got, want)
+	}
+
+	glossary, _ := json.Marshal(GlossaryFile{Version: "1.0", Entries: entries})
+	setupWorkspace(t, map[string]string{
+		".tenkai/glossary.json": string(glossary),
+		"a.txt":                 "東京へ行く。\n",
+		"b.txt":                 "東京都へ行く。\n", // 「東京」と「京都」の指摘が重なって書き換えられない
+	})
+	w := performRequest(handleNormalizeGlossary, jsonRequest(http.MethodPost, "/api/glossary/normalize", GlossaryNormalizeRequest{}))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500 (body = %s)", w.Code, w.Body.String())
+	}
+	if content, _ := os.ReadFile(filepath.Join(workDir, "a.txt")); string(content) != "東京へ行く。\n" {
+		t.Fatalf("a.txt = %q, want it untouched", content)
+	}
+
+	w = performRequest(handleNormalizeGlossary, jsonRequest(http.MethodPost, "/api/glossary/normalize", GlossaryNormalizeRequest{Paths: []string{"a.txt"}}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if content, _ := os.ReadFile(filepath.Join(workDir, "a.txt")); string(content) != "トウキョウへ行く。\n" {
+		t.Fatalf("a.txt = %q", content)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := wt.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.IsClean() {
+		t.Fatalf("normalized files were not committed: %v", status)
+	}
+}
+
+func TestWorldAppearancesAtRevision(t *testing.T) {
+	setupWorkspace(t, map[string]string{
+		".tenkai/world/neko.yaml": "id: neko\nkind: character\nname: 吾輩\naliases: [猫]\n",
+		"01.txt":                  "｜吾輩《わがはい》は猫である。\n名前はまだ無い。\n\n猫は眠る。\n",
+	})
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 作業ディレクトリでは項目を消してあっても、版を指定すればその版の設定資料を使う
+	if err := os.Remove(filepath.Join(workDir, ".tenkai", "world", "neko.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/world/neko/appearances?revision="+head.Hash().String(), nil)
+	c.Params = gin.Params{{Key: "id", Value: "neko"}}
+	handleWorldAppearances(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Data struct {
+			Appearances []worldAppearance `json:"appearances"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var lines []int
+	for _, a := range resp.Data.Appearances {
+		lines = append(lines, a.Line)
+	}
+	if fmt.Sprint(lines) != "[1 1 4]" {
+		t.Fatalf("appearance lines = %v, want [1 1 4]", lines)
+	}
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/world/neko/appearances", nil)
+	c.Params = gin.Params{{Key: "id", Value: "neko"}}
+	handleWorldAppearances(c)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("workspace status = %d, want 404", w.Code)
+	}
+}
+
+func TestDeleteWorldEntityRemovesReferences(t *testing.T) {
+	setupWorkspace(t, map[string]string{
+		".tenkai/world/neko.yaml": "id: neko\nkind: character\nname: 吾輩\nrelationships:\n  - target: neko\n    type: 自分\n",
+		".tenkai/world/inu.json":  `{"id":"inu","kind":"character","name":"犬","relationships":[{"target":"neko","type":"友人"}]}`,
+	})
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodDelete, "/api/world/neko", nil)
+	c.Params = gin.Params{{Key: "id", Value: "neko"}}
+	handleDeleteWorldEntity(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	// 自分への関係を持つ項目でも、書き戻して復活させない
+	if _, err := os.Stat(filepath.Join(workDir, ".tenkai", "world", "neko.yaml")); !os.IsNotExist(err) {
+		t.Fatalf("neko.yaml was not removed: %v", err)
+	}
+	entities, _, err := loadWorld()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inu := entities["inu"]; inu == nil || len(inu.Relationships) != 0 {
+		t.Fatalf("inu = %+v, want no relationships", inu)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := wt.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.IsClean() {
+		t.Fatalf("deletion was not committed: %v", status)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.Message != "設定資料「吾輩」を削除" {
+		t.Fatalf("commit message = %q", commit.Message)
+	}
+}
+
+func TestUpdateBookRejectsNullEntries(t *testing.T) {
+	setupWorkspace(t, map[string]string{"01.txt": "一章\n"})
+
+	for _, body := range []string{
+		`{"parts":[null]}`,
+		`{"parts":[{"chapters":[null]}]}`,
+		`{"parts":[{"chapters":[{"id":"ch-1","scenes":[null]}]}]}`,
+	} {
+		req := httptest.NewRequest(http.MethodPut, "/api/book", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if w := performRequest(handleUpdateBook, req); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, w.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/api/book", strings.NewReader(`{"parts":[{"chapters":[{"id":"ch-1","file":"01.txt"}]}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	if w := performRequest(handleUpdateBook, req); w.Code != http.StatusOK {
+		t.Fatalf("valid book: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if book, err := getRepoBook(); err != nil || book == nil || book.Parts[0].Chapters[0].File != "01.txt" {
+		t.Fatalf("saved book = %+v, %v", book, err)
+	}
+
+	if _, err := parseBookManifest([]byte("parts:\n  - chapters:\n      - id: ch-1\n        scenes:\n          -\n")); err == nil {
+		t.Error("parseBookManifest accepted a null scene")
+	}
+}
+
+func TestApplyWorkspaceChangesRollsBack(t *testing.T) {
+	setupWorkspace(t, map[string]string{"a.txt": "元の内容\n", "b.txt": "消さない\n"})
+
+	// a.txt を書き換えたあと、a.txt の下にファイルを作ろうとして失敗する
+	_, err := applyWorkspaceChanges(map[string]string{"a.txt": "新しい内容\n", "a.txt/c.txt": "x", "new.txt": "y"}, []string{"b.txt"})
+	if err == nil {
+		t.Fatal("applyWorkspaceChanges succeeded")
+	}
+	if content, _ := os.ReadFile(filepath.Join(workDir, "a.txt")); string(content) != "元の内容\n" {
+		t.Fatalf("a.txt = %q, want the original", content)
+	}
+	if content, _ := os.ReadFile(filepath.Join(workDir, "b.txt")); string(content) != "消さない\n" {
+		t.Fatalf("b.txt = %q, want the original", content)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "new.txt")); !os.IsNotExist(err) {
+		t.Fatalf("new.txt was left behind: %v", err)
+	}
+
+	// 成功したあとでも、返された関数で元に戻せる（コミットに失敗した場合）
+	rollback, err := applyWorkspaceChanges(map[string]string{"a.txt": "新しい内容\n", "new.txt": "y"}, []string{"b.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a.txt", "b.txt", "new.txt"} {
+		if _, err := w.Add(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rollback()
+	status, err := w.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.IsClean() {
+		t.Fatalf("worktree or index was not restored: %v", status)
+	}
+}
+
+func TestCORSPreflightAllowsPatch(t *testing.T) {
+	r := gin.New()
+	r.Use(corsMiddleware("https://app.example.com", CORSConfig{}))
+	r.PATCH("/api/book/chapters/:id", func(c *gin.Context) { c.JSON(http.StatusOK, Response{Success: true}) })
+
+	req := httptest.NewRequest(http.MethodOptions, "/api/book/chapters/ch-1", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent || !strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), http.MethodPatch) {
+		t.Fatalf("preflight status = %d, allow-methods = %q", w.Code, w.Header().Get("Access-Control-Allow-Methods"))
+	}
+}
+
+func TestSplitBookChapterRejectsOffsetsInsideNotation(t *testing.T) {
+	text := "｜吾輩《わがはい》は猫である。\n※［＃「木＋戸」、第3水準1-85-54］と漢字《かんじ》。\n続き\n"
+	for _, tt := range []struct {
+		offset int
+		inside bool
+	}{
+		{1, true},   // ｜と親文字の間
+		{2, true},   // 親文字の途中
+		{3, true},   // 親文字と《の間
+		{6, true},   // ルビの途中
+		{9, false},  // 》の後ろ
+		{16, false}, // 行頭
+		{17, true},  // ※と［の間
+		{20, true},  // ［＃…］の途中
+		{39, true},  // 漢字《…》の親文字の途中
+		{38, false}, // 親文字の前
+	} {
+		if got := splitsAozoraNotation([]rune(text), tt.offset); got != tt.inside {
+			t.Errorf("offset %d (%q): got %v, want %v", tt.offset, string([]rune(text)[tt.offset:]), got, tt.inside)
+		}
+	}
+
+	setupWorkspace(t, map[string]string{
+		".tenkai/book.yaml": "parts:\n  - chapters:\n      - id: ch-1\n        file: 01.txt\n",
+		"01.txt":            text,
+	})
+	w := performRequest(handleSplitBookChapter, jsonRequest(http.MethodPost, "/api/book/split", BookSplitRequest{Chapter: "ch-1", Offset: 6}))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("split inside ruby: status = %d, want 400", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "01-2.txt")); !os.IsNotExist(err) {
+		t.Fatalf("new chapter file was created: %v", err)
+	}
+
+	w = performRequest(handleSplitBookChapter, jsonRequest(http.MethodPost, "/api/book/split", BookSplitRequest{Chapter: "ch-1", Offset: 16}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if content, _ := os.ReadFile(filepath.Join(workDir, "01.txt")); string(content) != "｜吾輩《わがはい》は猫である。\n" {
+		t.Fatalf("01.txt = %q", content)
+	}
+}